@@ -0,0 +1,239 @@
+// Package main provides the administrative endpoints of the server.
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/gin-gonic/gin"
+)
+
+// startRebalance starts moving keys between shards in the background.
+// The rebalance runs until every key is moved or the server shuts down.
+func startRebalance(ctx context.Context, rebalancer *database.Rebalancer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var opts database.RebalanceOptions
+		if err := c.ShouldBindJSON(&opts); err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Invalid JSON body: " + err.Error(),
+			})
+			return
+		}
+
+		err := rebalancer.Start(ctx, opts)
+		switch {
+		case err == nil:
+			log.Printf("Rebalance of shard %d to shard %d started", opts.From, opts.To)
+			c.JSON(http.StatusAccepted, Response{Success: true, Data: rebalancer.Progress()})
+		case errors.Is(err, database.ErrInvalidRebalance):
+			c.JSON(http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		case errors.Is(err, database.ErrRebalanceRunning), errors.Is(err, database.ErrRebalancePending):
+			c.JSON(http.StatusConflict, Response{Success: false, Error: err.Error()})
+		default:
+			log.Printf("Error starting rebalance: %v", err)
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to start rebalance",
+			})
+		}
+	}
+}
+
+// rebalanceStatus reports the progress of the current or last rebalance
+func rebalanceStatus(rebalancer *database.Rebalancer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, Response{Success: true, Data: rebalancer.Progress()})
+	}
+}
+
+// ShardRequest names a shard to activate
+type ShardRequest struct {
+	Shard *int64 `json:"shard"`
+}
+
+// ShardsResponse lists the active shards
+type ShardsResponse struct {
+	Shards []int64 `json:"shards"`
+}
+
+// listShards reports the shards new keys are placed on
+func listShards(registry *database.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, Response{Success: true, Data: ShardsResponse{Shards: registry.Active()}})
+	}
+}
+
+// addShard activates the shard of the request body so that new keys may be
+// placed on it
+func addShard(registry *database.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ShardRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "Invalid JSON body: " + err.Error(),
+			})
+			return
+		}
+		if req.Shard == nil || *req.Shard < 0 {
+			c.JSON(http.StatusBadRequest, Response{Success: false, Error: "shard must be a non-negative integer"})
+			return
+		}
+
+		err := registry.Add(*req.Shard)
+		switch {
+		case err == nil:
+			log.Printf("Shard %d activated", *req.Shard)
+			c.JSON(http.StatusCreated, Response{Success: true, Data: ShardsResponse{Shards: registry.Active()}})
+		case errors.Is(err, database.ErrShardExists):
+			c.JSON(http.StatusConflict, Response{Success: false, Error: err.Error()})
+		default:
+			log.Printf("Error adding shard %d: %v", *req.Shard, err)
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to update the shard registry",
+			})
+		}
+	}
+}
+
+// removeShard retires the shard of the path so that no new key is placed on
+// it. Its keys stay there until they are rebalanced.
+func removeShard(registry *database.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		shard, err := strconv.ParseInt(c.Param("shard"), 10, 64)
+		if err != nil || shard < 0 {
+			c.JSON(http.StatusBadRequest, Response{Success: false, Error: "shard must be a non-negative integer"})
+			return
+		}
+
+		err = registry.Remove(shard)
+		switch {
+		case err == nil:
+			log.Printf("Shard %d retired", shard)
+			c.JSON(http.StatusOK, Response{Success: true, Data: ShardsResponse{Shards: registry.Active()}})
+		case errors.Is(err, database.ErrShardInactive):
+			c.JSON(http.StatusNotFound, Response{Success: false, Error: err.Error()})
+		case errors.Is(err, database.ErrNoShards):
+			c.JSON(http.StatusConflict, Response{Success: false, Error: err.Error()})
+		default:
+			log.Printf("Error removing shard %d: %v", shard, err)
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to update the shard registry",
+			})
+		}
+	}
+}
+
+// DefaultKeyLimit is the number of keys listed when no limit is requested
+const DefaultKeyLimit = 1000
+
+// KeysResponse lists keys of the fragmentation schema
+type KeysResponse struct {
+	Keys []database.Entry `json:"keys"`
+	// Truncated is true when more keys matched than the limit
+	Truncated bool `json:"truncated"`
+}
+
+// fragmentationStats reports the number of keys per shard and their skew
+func fragmentationStats(schema *database.Schema) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stats, err := schema.Stats()
+		if err != nil {
+			log.Printf("Error computing fragmentation stats: %v", err)
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to read the fragmentation schema",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, Response{Success: true, Data: stats})
+	}
+}
+
+// fragmentationKeys lists the keys starting with the prefix query parameter,
+// optionally only those on the shard query parameter, up to limit keys
+func fragmentationKeys(schema *database.Schema) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		shard := int64(-1)
+		if value := c.Query("shard"); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, Response{Success: false, Error: "shard must be a non-negative integer"})
+				return
+			}
+			shard = n
+		}
+		limit := DefaultKeyLimit
+		if value := c.Query("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				c.JSON(http.StatusBadRequest, Response{Success: false, Error: "limit must be a positive integer"})
+				return
+			}
+			limit = n
+		}
+
+		response := KeysResponse{Keys: []database.Entry{}}
+		err := schema.Scan(c.Query("prefix"), func(e database.Entry) error {
+			if shard >= 0 && e.Shard != shard {
+				return nil
+			}
+			if len(response.Keys) == limit {
+				response.Truncated = true
+				return database.ErrStopScan
+			}
+			response.Keys = append(response.Keys, e)
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error listing fragmentation keys: %v", err)
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to read the fragmentation schema",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, Response{Success: true, Data: response})
+	}
+}
+
+// exportFragmentation streams the fragmentation schema as JSON Lines
+func exportFragmentation(schema *database.Schema) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Content-Disposition", `attachment; filename="fragmentation.jsonl"`)
+		c.Status(http.StatusOK)
+		// The status is sent with the first entry, so a later error can only
+		// be logged
+		if n, err := schema.Export(c.Writer); err != nil {
+			log.Printf("Error exporting fragmentation schema after %d entries: %v", n, err)
+		}
+	}
+}
+
+// importFragmentation adds the JSON Lines entries of the request body to the
+// fragmentation schema. Nothing is written if any line is invalid.
+func importFragmentation(schema *database.Schema) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n, err := schema.Import(c.Request.Body)
+		switch {
+		case err == nil:
+			c.JSON(http.StatusOK, Response{Success: true, Data: gin.H{"imported": n}})
+		case errors.Is(err, database.ErrInvalidEntry):
+			c.JSON(http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		default:
+			log.Printf("Error importing fragmentation schema: %v", err)
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to import the fragmentation schema",
+			})
+		}
+	}
+}
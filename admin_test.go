@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/TeamPentagon/DM-Backend/internal/middleware"
+)
+
+// adminSecret signs the tokens of adminRequest
+const adminSecret = "admin-test-secret-of-32-bytes-at-least"
+
+// adminConfig returns the default configuration accepting the tokens of
+// adminRequest
+func adminConfig() Config {
+	config := DefaultConfig()
+	config.Middleware.Auth.Secret = adminSecret
+	return config
+}
+
+// adminRequest sends an administrative request with a bearer token of the
+// admin role signed by adminSecret
+func adminRequest(srv *server, method, path, body string) *httptest.ResponseRecorder {
+	token, err := middleware.Sign(&middleware.Claims{
+		Subject:   "admin",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Extra:     map[string]interface{}{middleware.RoleClaim: middleware.RoleAdmin},
+	}, middleware.Key{Algorithm: middleware.HS256, Key: []byte(adminSecret)})
+	if err != nil {
+		panic(err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, req)
+	return w
+}
+
+// TestAdminRebalance tests starting a rebalance and following its progress
+func TestAdminRebalance(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	srv, err := newServer(adminConfig())
+	if err != nil {
+		t.Fatalf("newServer() returned an error: %v", err)
+	}
+	defer srv.stopBackground()
+
+	shard0, err := database.DefaultStore().ShardNumber(0)
+	if err != nil {
+		t.Fatalf("ShardNumber() returned an error: %v", err)
+	}
+	for _, key := range []string{"user_a", "user_b", "user_c"} {
+		shard0.Put([]byte(key), []byte("value"), nil)
+		if err := database.FragmentationAdd(0, key); err != nil {
+			t.Fatalf("FragmentationAdd() returned an error: %v", err)
+		}
+	}
+
+	// Administrative routes require authorization
+	req := httptest.NewRequest("GET", "/api/v1/admin/rebalance", nil)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without authorization, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if w := adminRequest(srv, "POST", "/api/v1/admin/rebalance", `{"from": 0, "to": 0}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid rebalance, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = adminRequest(srv, "POST", "/api/v1/admin/rebalance", `{"from": 0, "to": 5, "rate": 1000}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var progress database.RebalanceProgress
+	for {
+		w := adminRequest(srv, "GET", "/api/v1/admin/rebalance", "")
+		var response struct {
+			Data database.RebalanceProgress `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		progress = response.Data
+		if !progress.Running || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if progress.Running || progress.Moved != 3 || progress.Error != "" {
+		t.Errorf("Unexpected progress: %+v", progress)
+	}
+	if shard, err := database.FragmentationGet("user_b"); err != nil || shard != 5 {
+		t.Errorf("Expected user_b on shard 5, got %d, %v", shard, err)
+	}
+}
+
+// TestAdminFragmentation tests the fragmentation stats, listing, export and import endpoints
+func TestAdminFragmentation(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	srv, err := newServer(adminConfig())
+	if err != nil {
+		t.Fatalf("newServer() returned an error: %v", err)
+	}
+	defer srv.stopBackground()
+
+	if err := database.FragmentationAddMany(map[string]int64{"user_a": 0, "user_b": 1, "user_c": 1, "chat_a": 1}); err != nil {
+		t.Fatalf("FragmentationAddMany() returned an error: %v", err)
+	}
+
+	var stats struct {
+		Data database.SchemaStats `json:"data"`
+	}
+	w := adminRequest(srv, "GET", "/api/v1/admin/fragmentation/stats", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Expected stats, got %d: %s", w.Code, w.Body.String())
+	}
+	if stats.Data.Total != 4 || stats.Data.Shards[1].Keys != 3 {
+		t.Errorf("Unexpected stats: %+v", stats.Data)
+	}
+
+	tests := []struct {
+		name          string
+		query         string
+		wantStatus    int
+		wantKeys      []string
+		wantTruncated bool
+	}{
+		{"prefix", "?prefix=user_", http.StatusOK, []string{"user_a", "user_b", "user_c"}, false},
+		{"prefix and shard", "?prefix=user_&shard=1", http.StatusOK, []string{"user_b", "user_c"}, false},
+		{"limit", "?shard=1&limit=2", http.StatusOK, []string{"chat_a", "user_b"}, true},
+		{"invalid shard", "?shard=x", http.StatusBadRequest, nil, false},
+		{"invalid limit", "?limit=0", http.StatusBadRequest, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := adminRequest(srv, "GET", "/api/v1/admin/fragmentation/keys"+tt.query, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var response struct {
+				Data KeysResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			var keys []string
+			for _, e := range response.Data.Keys {
+				keys = append(keys, e.Key)
+			}
+			if strings.Join(keys, ",") != strings.Join(tt.wantKeys, ",") || response.Data.Truncated != tt.wantTruncated {
+				t.Errorf("Got keys %v (truncated %v), want %v (truncated %v)", keys, response.Data.Truncated, tt.wantKeys, tt.wantTruncated)
+			}
+		})
+	}
+
+	w = adminRequest(srv, "GET", "/api/v1/admin/fragmentation/export", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Expected a JSON Lines export, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 4 {
+		t.Errorf("Expected 4 exported entries, got %d", lines)
+	}
+
+	if w := adminRequest(srv, "POST", "/api/v1/admin/fragmentation/import", "{\"key\":\"user_d\"\n"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid import, got %d", http.StatusBadRequest, w.Code)
+	}
+	w = adminRequest(srv, "POST", "/api/v1/admin/fragmentation/import", "{\"key\":\"user_d\",\"shard\":2}\n{\"key\":\"user_a\",\"shard\":3}\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	for key, want := range map[string]int64{"user_d": 2, "user_a": 3} {
+		if shard, err := database.FragmentationGet(key); err != nil || shard != want {
+			t.Errorf("Expected %s on shard %d, got %d, %v", key, want, shard, err)
+		}
+	}
+}
+
+// TestAdminShards tests listing, adding and retiring active shards
+func TestAdminShards(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	config := adminConfig()
+	config.Database.Shards = 2
+	srv, err := newServer(config)
+	if err != nil {
+		t.Fatalf("newServer() returned an error: %v", err)
+	}
+	defer srv.stopBackground()
+
+	shards := func(w *httptest.ResponseRecorder) []int64 {
+		t.Helper()
+		var response struct {
+			Data ShardsResponse `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return response.Data.Shards
+	}
+
+	w := adminRequest(srv, "GET", "/api/v1/admin/shards", "")
+	if got := shards(w); w.Code != http.StatusOK || fmt.Sprint(got) != "[0 1]" {
+		t.Errorf("Expected shards [0 1], got %d %v", w.Code, got)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantShards string
+	}{
+		{"add", "POST", "/api/v1/admin/shards", `{"shard": 2}`, http.StatusCreated, "[0 1 2]"},
+		{"add active", "POST", "/api/v1/admin/shards", `{"shard": 2}`, http.StatusConflict, ""},
+		{"add without shard", "POST", "/api/v1/admin/shards", `{}`, http.StatusBadRequest, ""},
+		{"add negative", "POST", "/api/v1/admin/shards", `{"shard": -1}`, http.StatusBadRequest, ""},
+		{"remove", "DELETE", "/api/v1/admin/shards/0", "", http.StatusOK, "[1 2]"},
+		{"remove inactive", "DELETE", "/api/v1/admin/shards/0", "", http.StatusNotFound, ""},
+		{"remove invalid", "DELETE", "/api/v1/admin/shards/x", "", http.StatusBadRequest, ""},
+		{"remove second last", "DELETE", "/api/v1/admin/shards/1", "", http.StatusOK, "[2]"},
+		{"remove last", "DELETE", "/api/v1/admin/shards/2", "", http.StatusConflict, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := adminRequest(srv, tt.method, tt.path, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantShards != "" {
+				if got := shards(w); fmt.Sprint(got) != tt.wantShards {
+					t.Errorf("Expected shards %s, got %v", tt.wantShards, got)
+				}
+			}
+		})
+	}
+
+	// The active shards are kept across restarts
+	srv.stopBackground()
+	if srv, err = newServer(config); err != nil {
+		t.Fatalf("newServer() returned an error: %v", err)
+	}
+	defer srv.stopBackground()
+	w = adminRequest(srv, "GET", "/api/v1/admin/shards", "")
+	if got := shards(w); fmt.Sprint(got) != "[2]" {
+		t.Errorf("Expected shards [2] after a restart, got %v", got)
+	}
+}
+
+// TestAdminAuth tests that administrative endpoints require a valid bearer token
+func TestAdminAuth(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	srv, err := newServer(adminConfig())
+	if err != nil {
+		t.Fatalf("newServer() returned an error: %v", err)
+	}
+	defer srv.stopBackground()
+
+	expired, err := middleware.Sign(&middleware.Claims{Subject: "admin", ExpiresAt: time.Now().Add(-time.Hour).Unix()},
+		middleware.Key{Algorithm: middleware.HS256, Key: []byte(adminSecret)})
+	if err != nil {
+		t.Fatalf("Sign() returned an error: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"no header", ""},
+		{"not a token", "Bearer admin"},
+		{"expired token", "Bearer " + expired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/admin/fragmentation/stats", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			srv.router.ServeHTTP(w, req)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+			}
+		})
+	}
+
+	// Tokens issued to users carry no admin role
+	user, err := middleware.Sign(&middleware.Claims{Subject: "alice", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		middleware.Key{Algorithm: middleware.HS256, Key: []byte(adminSecret)})
+	if err != nil {
+		t.Fatalf("Sign() returned an error: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/api/v1/admin/fragmentation/stats", nil)
+	req.Header.Set("Authorization", "Bearer "+user)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d without the admin role, got %d", http.StatusForbidden, w.Code)
+	}
+
+	if w := adminRequest(srv, "GET", "/api/v1/admin/fragmentation/stats", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d with a valid token, got %d", http.StatusOK, w.Code)
+	}
+}
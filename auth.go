@@ -0,0 +1,386 @@
+// Package main provides the registration, login and token endpoints of the server.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/TeamPentagon/DM-Backend/internal/middleware"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+	"github.com/gin-gonic/gin"
+)
+
+// maxAuthBodyBytes limits the size of an authentication request body
+const maxAuthBodyBytes = 64 << 10
+
+// SessionClaim carries the session ID of the refresh token in access tokens
+const SessionClaim = "sid"
+
+// userNamePattern restricts user names to characters that are safe in
+// URLs, since the name is also the PersonId of the user
+var userNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,64}$`)
+
+// RegisterRequest is the JSON body accepted by POST /api/v1/auth/register
+type RegisterRequest struct {
+	UserName      string `json:"user_name" binding:"required,max=64"`
+	Password      string `json:"password" binding:"required,min=8,max=256"`
+	Email         string `json:"email" binding:"omitempty,email,max=254"`
+	PhoneNumber   string `json:"phone_number" binding:"omitempty,max=32"`
+	Profile       string `json:"profile" binding:"omitempty,max=4096"`
+	ProfilePicURL string `json:"profile_pic_url" binding:"omitempty,url,max=2048"`
+	Gender        string `json:"gender" binding:"omitempty,max=32"`
+	BirthDate     int64  `json:"birth_date"`
+}
+
+// LoginRequest is the JSON body accepted by POST /api/v1/auth/login. The
+// user is named by exactly one of UserName and Email.
+type LoginRequest struct {
+	UserName string `json:"user_name" binding:"max=64"`
+	Email    string `json:"email" binding:"omitempty,email,max=254"`
+	Password string `json:"password" binding:"required,max=256"`
+}
+
+// RefreshRequest is the JSON body accepted by POST /api/v1/auth/refresh and
+// POST /api/v1/auth/logout
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required,max=256"`
+}
+
+// UserProfile is a user as returned by the API, without its password
+type UserProfile struct {
+	PersonID      string `json:"person_id"`
+	UserName      string `json:"user_name"`
+	Email         string `json:"email,omitempty"`
+	PhoneNumber   string `json:"phone_number,omitempty"`
+	Profile       string `json:"profile,omitempty"`
+	ProfilePicURL string `json:"profile_pic_url,omitempty"`
+	Gender        string `json:"gender,omitempty"`
+	BirthDate     int64  `json:"birth_date,omitempty"`
+	AccountTime   int64  `json:"account_time"`
+	LastEdit      int64  `json:"last_edit"`
+}
+
+// TokenResponse holds the tokens issued at login and refresh
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// ExpiresIn is the lifetime of the access token in seconds
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// newUserProfile returns the public fields of u
+func newUserProfile(u *model.User) UserProfile {
+	return UserProfile{
+		PersonID:      u.PersonId,
+		UserName:      u.UserName,
+		Email:         u.Email,
+		PhoneNumber:   u.PhoneNumber,
+		Profile:       u.Profile,
+		ProfilePicURL: u.ProfilePicUrl,
+		Gender:        u.Gender,
+		BirthDate:     u.BirthDate,
+		AccountTime:   u.AccountTime,
+		LastEdit:      u.LastEdit,
+	}
+}
+
+// tokenIssuer signs the access tokens issued at login and refresh with the
+// HS256 secret, so the Auth middleware accepts them
+type tokenIssuer struct {
+	key    middleware.Key
+	config middleware.JWTConfig
+}
+
+// newTokenIssuer returns the issuer of config, or nil if no secret is set
+func newTokenIssuer(config middleware.JWTConfig) *tokenIssuer {
+	if config.Secret == "" {
+		return nil
+	}
+	return &tokenIssuer{
+		key:    middleware.Key{Algorithm: middleware.HS256, Key: []byte(config.Secret)},
+		config: config,
+	}
+}
+
+// issue returns an access token for the user of session together with its
+// refresh token
+func (i *tokenIssuer) issue(session *model.Session, refreshToken string) (TokenResponse, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return TokenResponse{}, err
+	}
+	now := time.Now()
+	claims := &middleware.Claims{
+		Subject:   session.UserID,
+		Issuer:    i.config.Issuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(i.config.AccessTTL).Unix(),
+		ID:        hex.EncodeToString(jti),
+		Extra:     map[string]interface{}{SessionClaim: session.ID},
+	}
+	if i.config.Audience != "" {
+		claims.Audience = middleware.Audience{i.config.Audience}
+	}
+	token, err := middleware.Sign(claims, i.key)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return TokenResponse{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(i.config.AccessTTL / time.Second),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// dummyPasswordHash is checked against the password of a login for an
+// unknown user, so the response time does not reveal which users exist
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := model.HashPassword("dummy password")
+	return hash
+})
+
+// bindAuthRequest reads and validates the JSON body of an authentication
+// request into req, writing the 400 response if it is invalid
+func bindAuthRequest(c *gin.Context, req interface{}) bool {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAuthBodyBytes)
+	if err := c.ShouldBindJSON(req); err != nil {
+		respondInvalidBody(c, err, "request")
+		return false
+	}
+	return true
+}
+
+// register creates a user with the name and password of the request. The
+// user name becomes the PersonId of the user.
+func register(c *gin.Context) {
+	var req RegisterRequest
+	if !bindAuthRequest(c, &req) {
+		return
+	}
+	if !userNamePattern.MatchString(req.UserName) {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "user_name must be 3 to 64 letters, digits, '_', '.' or '-'",
+		})
+		return
+	}
+
+	// Hash the password here, since a password shaped like a hash would
+	// otherwise be stored as it is
+	hash, err := model.HashPassword(req.Password)
+	if err != nil {
+		log.Printf("Error hashing the password of %s: %v", req.UserName, err)
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to register the user",
+		})
+		return
+	}
+
+	now := time.Now().Unix()
+	user := &model.User{
+		PersonId:      req.UserName,
+		UserName:      req.UserName,
+		Password:      hash,
+		Email:         req.Email,
+		PhoneNumber:   req.PhoneNumber,
+		Profile:       req.Profile,
+		ProfilePicUrl: req.ProfilePicURL,
+		Gender:        req.Gender,
+		BirthDate:     req.BirthDate,
+		AccountTime:   now,
+		LastEdit:      now,
+	}
+	err = user.CreateUserData()
+	switch {
+	case err == nil:
+		log.Printf("Registered user %s", user.PersonId)
+		c.JSON(http.StatusCreated, Response{Success: true, Data: newUserProfile(user)})
+	case errors.Is(err, model.ErrDuplicateUser):
+		c.JSON(http.StatusConflict, Response{Success: false, Error: "User name or email already in use"})
+	default:
+		log.Printf("Error registering user %s: %v", req.UserName, err)
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to register the user",
+		})
+	}
+}
+
+// login verifies the user name or email and the password of the request and
+// starts a session, returning an access token and the first refresh token
+func login(issuer *tokenIssuer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if issuer == nil {
+			respondNoIssuer(c)
+			return
+		}
+		var req LoginRequest
+		if !bindAuthRequest(c, &req) {
+			return
+		}
+		if (req.UserName == "") == (req.Email == "") {
+			c.JSON(http.StatusBadRequest, Response{Success: false, Error: "Exactly one of user_name and email is required"})
+			return
+		}
+
+		// Names and emails are looked up through their indexes, so a user
+		// is found by its current name even after renaming
+		user := &model.User{}
+		login := req.UserName
+		var err error
+		if req.Email != "" {
+			login = req.Email
+			err = user.FindUserDataByEmail(req.Email)
+		} else {
+			err = user.FindUserDataByName(req.UserName)
+		}
+		if errors.Is(err, model.ErrUserNotFound) {
+			model.CheckPassword(dummyPasswordHash(), req.Password)
+			err = model.ErrWrongPassword
+		} else if err == nil {
+			err = user.VerifyPassword(req.Password)
+		}
+		switch {
+		case errors.Is(err, model.ErrWrongPassword), errors.Is(err, model.ErrInvalidUsername):
+			c.JSON(http.StatusUnauthorized, Response{Success: false, Error: "Invalid user name, email or password"})
+			return
+		case err != nil:
+			log.Printf("Error verifying the password of user %s: %v", login, err)
+			c.JSON(http.StatusInternalServerError, Response{Success: false, Error: "Failed to log in"})
+			return
+		}
+
+		refreshToken, session, err := model.NewSession(user.PersonId, issuer.config.RefreshTTL)
+		if err != nil {
+			log.Printf("Error starting a session of user %s: %v", user.PersonId, err)
+			c.JSON(http.StatusInternalServerError, Response{Success: false, Error: "Failed to log in"})
+			return
+		}
+		respondTokens(c, issuer, session, refreshToken)
+	}
+}
+
+// refresh exchanges a refresh token for a new access token and refresh
+// token. Presenting a refresh token that was already exchanged revokes its
+// session.
+func refresh(issuer *tokenIssuer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if issuer == nil {
+			respondNoIssuer(c)
+			return
+		}
+		var req RefreshRequest
+		if !bindAuthRequest(c, &req) {
+			return
+		}
+
+		refreshToken, session, err := model.RefreshSession(req.RefreshToken, issuer.config.RefreshTTL)
+		if errors.Is(err, model.ErrInvalidRefreshToken) {
+			c.JSON(http.StatusUnauthorized, Response{Success: false, Error: "Invalid refresh token"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error refreshing a session: %v", err)
+			c.JSON(http.StatusInternalServerError, Response{Success: false, Error: "Failed to refresh the session"})
+			return
+		}
+
+		// Sessions of deleted users end at their next refresh
+		if exists, err := model.UserExists(session.UserID); err != nil || !exists {
+			if err != nil {
+				log.Printf("Error reading user %s: %v", session.UserID, err)
+			}
+			model.RevokeSession(refreshToken)
+			c.JSON(http.StatusUnauthorized, Response{Success: false, Error: "Invalid refresh token"})
+			return
+		}
+		respondTokens(c, issuer, session, refreshToken)
+	}
+}
+
+// logout revokes the session of a refresh token. Access tokens already
+// issued stay valid until they expire.
+func logout(c *gin.Context) {
+	var req RefreshRequest
+	if !bindAuthRequest(c, &req) {
+		return
+	}
+
+	err := model.RevokeSession(req.RefreshToken)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, Response{Success: true})
+	case errors.Is(err, model.ErrInvalidRefreshToken):
+		c.JSON(http.StatusUnauthorized, Response{Success: false, Error: "Invalid refresh token"})
+	default:
+		log.Printf("Error revoking a session: %v", err)
+		c.JSON(http.StatusInternalServerError, Response{Success: false, Error: "Failed to log out"})
+	}
+}
+
+// respondTokens writes the tokens of session
+func respondTokens(c *gin.Context, issuer *tokenIssuer, session *model.Session, refreshToken string) {
+	tokens, err := issuer.issue(session, refreshToken)
+	if err != nil {
+		log.Printf("Error signing an access token for user %s: %v", session.UserID, err)
+		c.JSON(http.StatusInternalServerError, Response{Success: false, Error: "Failed to issue tokens"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, Response{Success: true, Data: tokens})
+}
+
+// respondNoIssuer writes the 503 response of the token endpoints when no
+// signing secret is configured
+func respondNoIssuer(c *gin.Context) {
+	c.JSON(http.StatusServiceUnavailable, Response{
+		Success: false,
+		Error:   "Token issuance is not configured",
+	})
+}
+
+// requireSession is used after middleware.Auth and rejects an access token
+// whose session has ended, through a logout, an expiry or the deletion of its
+// user. An access token issued by login thereby cannot outlive its session,
+// nor act for a later user registered under the same name. Tokens without a
+// session claim were not issued by login and are left to their issuer.
+func requireSession(c *gin.Context) {
+	claims, ok := middleware.GetClaims(c)
+	if !ok {
+		c.Next()
+		return
+	}
+	sid, ok := claims.Extra[SessionClaim]
+	if !ok {
+		c.Next()
+		return
+	}
+
+	id, _ := sid.(string)
+	err := model.CheckSession(id, claims.Subject)
+	switch {
+	case err == nil:
+		c.Next()
+	case errors.Is(err, model.ErrSessionNotFound), errors.Is(err, model.ErrInvalidSessionID):
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Error:   "Invalid token: the session has ended",
+		})
+	default:
+		log.Printf("Error checking session %s of user %s: %v", id, claims.Subject, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to check the session",
+		})
+	}
+}
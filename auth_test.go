@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TeamPentagon/DM-Backend/internal/middleware"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+)
+
+// newAuthServer returns a server accepting the tokens it issues, with users
+// and sessions kept in memory
+func newAuthServer(t *testing.T, config Config) *server {
+	t.Helper()
+	cleanup := setupTestStorage(t)
+	t.Cleanup(cleanup)
+	model.SetRepositories(model.NewMemoryRepositories())
+	t.Cleanup(func() { model.SetRepositories(nil) })
+
+	srv, err := newServer(config)
+	if err != nil {
+		t.Fatalf("newServer() returned an error: %v", err)
+	}
+	t.Cleanup(srv.stopBackground)
+	return srv
+}
+
+// postJSON sends body to path and decodes the response into data, if set
+func postJSON(t *testing.T, srv *server, path, body string, data interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, req)
+	if data != nil && w.Code < 300 {
+		response := Response{Data: data}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode the response %s: %v", w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+// bearerRequest sends a request with the bearer token
+func bearerRequest(srv *server, token, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, req)
+	return w
+}
+
+// TestAuthFlow tests registration, login, refresh and logout
+func TestAuthFlow(t *testing.T) {
+	config := adminConfig()
+	config.Middleware.Auth.Issuer = "dm-backend"
+	srv := newAuthServer(t, config)
+
+	var profile UserProfile
+	w := postJSON(t, srv, "/api/v1/auth/register",
+		`{"user_name": "alice", "password": "correct horse", "email": "alice@example.com"}`, &profile)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if profile.PersonID != "alice" || profile.Email != "alice@example.com" || profile.AccountTime == 0 {
+		t.Errorf("Unexpected profile: %+v", profile)
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("password")) {
+		t.Errorf("Expected no password in the response: %s", w.Body.String())
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/register", `{"user_name": "alice", "password": "other password"}`, nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a taken name, got %d", http.StatusConflict, w.Code)
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/register", `{"user_name": "alice2", "password": "other password", "email": "alice@example.com"}`, nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a taken email, got %d", http.StatusConflict, w.Code)
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/login", `{"email": "alice@example.com", "password": "correct horse"}`, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d for a login by email, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var tokens TokenResponse
+	w = postJSON(t, srv, "/api/v1/auth/login", `{"user_name": "alice", "password": "correct horse"}`, &tokens)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if tokens.TokenType != "Bearer" || tokens.ExpiresIn != 15*60 || tokens.RefreshToken == "" {
+		t.Errorf("Unexpected tokens: %+v", tokens)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected the tokens not to be cached")
+	}
+
+	// The access token is accepted by the Auth middleware
+	verifier, err := middleware.NewVerifier(config.Middleware.Auth)
+	if err != nil {
+		t.Fatalf("NewVerifier() returned an error: %v", err)
+	}
+	claims, err := verifier.Verify(tokens.AccessToken)
+	if err != nil {
+		t.Fatalf("Verify() returned an error: %v", err)
+	}
+	if claims.Subject != "alice" || claims.Issuer != "dm-backend" || claims.Extra[SessionClaim] == nil || claims.Role() != "" {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	var refreshed TokenResponse
+	w = postJSON(t, srv, "/api/v1/auth/refresh", `{"refresh_token": "`+tokens.RefreshToken+`"}`, &refreshed)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if refreshed.RefreshToken == tokens.RefreshToken || refreshed.AccessToken == "" {
+		t.Errorf("Expected new tokens, got %+v", refreshed)
+	}
+
+	if w := bearerRequest(srv, refreshed.AccessToken, "GET", "/api/v1/users/alice"); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d with the access token, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/logout", `{"refresh_token": "`+refreshed.RefreshToken+`"}`, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d for logout, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := bearerRequest(srv, refreshed.AccessToken, "GET", "/api/v1/users/alice"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for the access token of an ended session, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/refresh", `{"refresh_token": "`+refreshed.RefreshToken+`"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d after logout, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/logout", `{"refresh_token": "`+refreshed.RefreshToken+`"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a second logout, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+// TestLoginByName tests that a login by user name goes through the name
+// index, not the PersonId
+func TestLoginByName(t *testing.T) {
+	config := adminConfig()
+	srv := newAuthServer(t, config)
+	user := &model.User{PersonId: "p_frank", UserName: "frank", Password: "frank's password"}
+	if err := user.CreateUserData(); err != nil {
+		t.Fatalf("CreateUserData() returned an error: %v", err)
+	}
+
+	var tokens TokenResponse
+	w := postJSON(t, srv, "/api/v1/auth/login", `{"user_name": "frank", "password": "frank's password"}`, &tokens)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	verifier, err := middleware.NewVerifier(config.Middleware.Auth)
+	if err != nil {
+		t.Fatalf("NewVerifier() returned an error: %v", err)
+	}
+	if claims, err := verifier.Verify(tokens.AccessToken); err != nil || claims.Subject != "p_frank" {
+		t.Errorf("Expected the PersonId as subject, got %+v, %v", claims, err)
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/login", `{"user_name": "p_frank", "password": "frank's password"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a login by PersonId, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+// TestRefreshTokenReuse tests that reusing a refresh token revokes its session
+func TestRefreshTokenReuse(t *testing.T) {
+	srv := newAuthServer(t, adminConfig())
+	if w := postJSON(t, srv, "/api/v1/auth/register", `{"user_name": "bob", "password": "bob's password"}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	var stolen, latest TokenResponse
+	postJSON(t, srv, "/api/v1/auth/login", `{"user_name": "bob", "password": "bob's password"}`, &stolen)
+	if w := postJSON(t, srv, "/api/v1/auth/refresh", `{"refresh_token": "`+stolen.RefreshToken+`"}`, &latest); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if w := postJSON(t, srv, "/api/v1/auth/refresh", `{"refresh_token": "`+stolen.RefreshToken+`"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a reused token, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/refresh", `{"refresh_token": "`+latest.RefreshToken+`"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for the latest token after reuse, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// Other sessions of the user are not affected
+	var other TokenResponse
+	postJSON(t, srv, "/api/v1/auth/login", `{"user_name": "bob", "password": "bob's password"}`, &other)
+	if w := postJSON(t, srv, "/api/v1/auth/refresh", `{"refresh_token": "`+other.RefreshToken+`"}`, &other); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d for another session, got %d", http.StatusOK, w.Code)
+	}
+
+	// Sessions of deleted users cannot be refreshed
+	if err := (&model.User{}).DeleteUserData("bob"); err != nil {
+		t.Fatalf("DeleteUserData() returned an error: %v", err)
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/refresh", `{"refresh_token": "`+other.RefreshToken+`"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a deleted user, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+// TestDeletedUserSessions tests that a user registered under the name of a
+// deleted user does not inherit its sessions
+func TestDeletedUserSessions(t *testing.T) {
+	srv := newAuthServer(t, adminConfig())
+	register := `{"user_name": "dave", "password": "dave's password"}`
+	if w := postJSON(t, srv, "/api/v1/auth/register", register, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var old TokenResponse
+	postJSON(t, srv, "/api/v1/auth/login", `{"user_name": "dave", "password": "dave's password"}`, &old)
+
+	if w := userRequest(srv, "dave", "DELETE", "/api/v1/users/dave", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/register", register, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d for the new user, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/refresh", `{"refresh_token": "`+old.RefreshToken+`"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a session of the deleted user, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// The access token of the deleted user does not act for the new one
+	if w := bearerRequest(srv, old.AccessToken, "GET", "/api/v1/users/dave"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for an access token of the deleted user, got %d", http.StatusUnauthorized, w.Code)
+	}
+	var current TokenResponse
+	postJSON(t, srv, "/api/v1/auth/login", `{"user_name": "dave", "password": "dave's password"}`, &current)
+	if w := bearerRequest(srv, current.AccessToken, "GET", "/api/v1/users/dave"); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d for an access token of the new user, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+// TestAuthRejections tests invalid registrations and failed logins
+func TestAuthRejections(t *testing.T) {
+	srv := newAuthServer(t, adminConfig())
+	if w := postJSON(t, srv, "/api/v1/auth/register", `{"user_name": "carol", "password": "carol's password"}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	// A password shaped like a hash is hashed too, so it cannot bypass the
+	// length check or choose the hash parameters
+	hash, err := model.HashPassword("short")
+	if err != nil {
+		t.Fatalf("HashPassword() returned an error: %v", err)
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/register", `{"user_name": "erin", "password": "`+hash+`"}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"login with the password of a hash", "/api/v1/auth/login", `{"user_name": "erin", "password": "short"}`, http.StatusUnauthorized},
+		{"login with a hash as password", "/api/v1/auth/login", `{"user_name": "erin", "password": "` + hash + `"}`, http.StatusOK},
+		{"register without password", "/api/v1/auth/register", `{"user_name": "dave"}`, http.StatusBadRequest},
+		{"register short password", "/api/v1/auth/register", `{"user_name": "dave", "password": "short"}`, http.StatusBadRequest},
+		{"register bad name", "/api/v1/auth/register", `{"user_name": "da/ve", "password": "long enough"}`, http.StatusBadRequest},
+		{"register bad email", "/api/v1/auth/register", `{"user_name": "dave", "password": "long enough", "email": "dave"}`, http.StatusBadRequest},
+		{"register not JSON", "/api/v1/auth/register", `user_name=dave`, http.StatusBadRequest},
+		{"login wrong password", "/api/v1/auth/login", `{"user_name": "carol", "password": "wrong password"}`, http.StatusUnauthorized},
+		{"login unknown user", "/api/v1/auth/login", `{"user_name": "nobody", "password": "carol's password"}`, http.StatusUnauthorized},
+		{"login without password", "/api/v1/auth/login", `{"user_name": "carol"}`, http.StatusBadRequest},
+		{"login unknown email", "/api/v1/auth/login", `{"email": "nobody@example.com", "password": "carol's password"}`, http.StatusUnauthorized},
+		{"login without user", "/api/v1/auth/login", `{"password": "carol's password"}`, http.StatusBadRequest},
+		{"login with name and email", "/api/v1/auth/login", `{"user_name": "carol", "email": "carol@example.com", "password": "carol's password"}`, http.StatusBadRequest},
+		{"refresh unknown token", "/api/v1/auth/refresh", `{"refresh_token": "sess_unknown.secret"}`, http.StatusUnauthorized},
+		{"refresh without token", "/api/v1/auth/refresh", `{}`, http.StatusBadRequest},
+		{"logout unknown token", "/api/v1/auth/logout", `{"refresh_token": "garbage"}`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := postJSON(t, srv, tt.path, tt.body, nil); w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestAuthWithoutSecret tests that tokens are not issued without a signing secret
+func TestAuthWithoutSecret(t *testing.T) {
+	srv := newAuthServer(t, DefaultConfig())
+	if w := postJSON(t, srv, "/api/v1/auth/register", `{"user_name": "erin", "password": "erin's password"}`, nil); w.Code != http.StatusCreated {
+		t.Errorf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/login", `{"user_name": "erin", "password": "erin's password"}`, nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
@@ -0,0 +1,260 @@
+// Package config provides the service configuration.
+// Settings start from built-in defaults and are overridden, in order, by an
+// optional YAML or TOML file, environment variables and command-line flags.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/TeamPentagon/DM-Backend/internal/middleware"
+	"github.com/TeamPentagon/DM-Backend/internal/prompt"
+	"github.com/TeamPentagon/DM-Backend/internal/provider"
+	"github.com/TeamPentagon/DM-Backend/internal/upstream"
+	"gopkg.in/yaml.v3"
+)
+
+// Common errors for configuration loading
+var (
+	ErrInvalidConfig     = errors.New("invalid configuration")
+	ErrUnsupportedFormat = errors.New("unsupported config file format")
+)
+
+// redacted replaces secrets in printed configurations
+const redacted = "REDACTED"
+
+// Config holds the application configuration
+type Config struct {
+	Server     ServerConfig     `yaml:"server" json:"server"`
+	Database   database.Layout  `yaml:"database" json:"database"`
+	Middleware MiddlewareConfig `yaml:"middleware" json:"middleware"`
+	AI         AIConfig         `yaml:"ai" json:"ai"`
+}
+
+// ServerConfig holds the HTTP server settings
+type ServerConfig struct {
+	// Port is the TCP port the server listens on
+	Port string `yaml:"port" json:"port"`
+	// RequestTimeout limits how long a chat request may wait for the AI service
+	RequestTimeout time.Duration `yaml:"request_timeout" json:"request_timeout"`
+	// ShutdownTimeout limits how long in-flight requests may run after a
+	// shutdown signal before their connections are closed
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+}
+
+// MiddlewareConfig holds the settings of the optional HTTP middleware
+type MiddlewareConfig struct {
+	CORS      CORSConfig      `yaml:"cors" json:"cors"`
+	RateLimit RateLimitConfig `yaml:"rate_limit" json:"rate_limit"`
+	// Auth configures the bearer tokens required by protected endpoints
+	Auth middleware.JWTConfig `yaml:"auth" json:"auth"`
+}
+
+// CORSConfig enables and configures the CORS middleware
+type CORSConfig struct {
+	Enabled               bool `yaml:"enabled" json:"enabled"`
+	middleware.CORSConfig `yaml:",inline"`
+}
+
+// RateLimitConfig enables and configures the per-client rate limiter
+type RateLimitConfig struct {
+	Enabled                      bool `yaml:"enabled" json:"enabled"`
+	middleware.RateLimiterConfig `yaml:",inline"`
+}
+
+// AIConfig holds the AI service settings
+type AIConfig struct {
+	// Provider selects the API flavour of the AI service
+	Provider string `yaml:"provider" json:"provider"`
+	// Endpoint is the generation API, used when Endpoints is empty
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+	// StreamEndpoint overrides the streaming API of Endpoint
+	StreamEndpoint string `yaml:"stream_endpoint,omitempty" json:"stream_endpoint,omitempty"`
+	// Endpoints lists weighted endpoints to balance across. When empty,
+	// Endpoint and StreamEndpoint form the only endpoint.
+	Endpoints []upstream.Endpoint `yaml:"endpoints,omitempty" json:"endpoints,omitempty"`
+	// Balance is the load balancing strategy
+	Balance string `yaml:"balance" json:"balance"`
+	// HealthInterval is the time between endpoint health probes, 0 disables them
+	HealthInterval time.Duration `yaml:"health_interval" json:"health_interval"`
+	// Model is the model name sent to providers that need one
+	Model string `yaml:"model,omitempty" json:"model,omitempty"`
+	// APIKey authenticates to the AI service
+	APIKey string `yaml:"api_key,omitempty" json:"api_key,omitempty"`
+	// Prompt controls how conversations are rendered into prompts
+	Prompt prompt.Template `yaml:"prompt" json:"prompt"`
+	// Upstream holds the retry, circuit breaker and connection pool settings
+	Upstream upstream.Config `yaml:"upstream" json:"upstream"`
+}
+
+// Default returns the configuration used when nothing is overridden
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Port:            "8085",
+			RequestTimeout:  30 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Database: database.DefaultLayout(),
+		Middleware: MiddlewareConfig{
+			CORS: CORSConfig{
+				Enabled:    true,
+				CORSConfig: middleware.DefaultCORSConfig(),
+			},
+			RateLimit: RateLimitConfig{
+				Enabled: false,
+				RateLimiterConfig: middleware.RateLimiterConfig{
+					RequestsPerSecond: 10,
+					BurstSize:         20,
+				},
+			},
+			Auth: middleware.DefaultJWTConfig(),
+		},
+		AI: AIConfig{
+			Provider:       provider.Kobold,
+			Endpoint:       "https://herbal-pmc-allowance-cognitive.trycloudflare.com/api/v1/generate",
+			Balance:        upstream.RoundRobin,
+			HealthInterval: 15 * time.Second,
+			Prompt:         prompt.DefaultTemplate(),
+			Upstream:       upstream.DefaultConfig(),
+		},
+	}
+}
+
+// ResolvedEndpoints returns the AI endpoints to balance across
+func (c AIConfig) ResolvedEndpoints() []upstream.Endpoint {
+	if len(c.Endpoints) > 0 {
+		return c.Endpoints
+	}
+	return []upstream.Endpoint{{URL: c.Endpoint, StreamURL: c.StreamEndpoint, Weight: 1}}
+}
+
+// Validate checks the configuration and reports every problem found
+func (c Config) Validate() error {
+	var problems []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Server.Port)
+	check(err == nil && port > 0 && port <= 65535, "server.port must be a number between 1 and 65535, got %q", c.Server.Port)
+	check(c.Server.RequestTimeout > 0, "server.request_timeout must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+
+	check(c.Database.BaseDir != "", "database.base_dir must be set")
+	check(c.Database.GlobalSchema != "", "database.global_schema must be set")
+	check(c.Database.ShardGroup != "", "database.shard_group must be set")
+	check(c.Database.DefaultShard != "", "database.default_shard must be set")
+	check(c.Database.HistoryDir != "", "database.history_dir must be set")
+	check(c.Database.SQLDir != "", "database.sql_dir must be set")
+	check(c.Database.Shards > 0, "database.shards must be positive")
+	check(c.Database.Placement == database.PlacementRing || c.Database.Placement == database.PlacementRange,
+		"database.placement must be %s or %s, got %q", database.PlacementRing, database.PlacementRange, c.Database.Placement)
+	check(c.Database.UserBackend == database.BackendLevelDB || c.Database.UserBackend == database.BackendSQLite,
+		"database.user_backend must be %s or %s, got %q", database.BackendLevelDB, database.BackendSQLite, c.Database.UserBackend)
+	check(c.Database.ChatBackend == database.BackendLevelDB || c.Database.ChatBackend == database.BackendSQLite,
+		"database.chat_backend must be %s or %s, got %q", database.BackendLevelDB, database.BackendSQLite, c.Database.ChatBackend)
+	check(c.Database.CacheSize >= 0, "database.cache_size must not be negative")
+	check(c.Database.CacheTTL >= 0, "database.cache_ttl must not be negative")
+
+	check(c.Middleware.CORS.MaxAge >= 0, "middleware.cors.max_age must not be negative")
+	if c.Middleware.RateLimit.Enabled {
+		check(c.Middleware.RateLimit.RequestsPerSecond > 0, "middleware.rate_limit.requests_per_second must be positive")
+		check(c.Middleware.RateLimit.BurstSize > 0, "middleware.rate_limit.burst_size must be positive")
+	}
+	auth := c.Middleware.Auth
+	check(auth.Secret == "" || len(auth.Secret) >= 32, "middleware.auth.secret must be at least 32 bytes")
+	check(auth.Leeway >= 0, "middleware.auth.leeway must not be negative")
+	check(auth.AccessTTL > 0, "middleware.auth.access_ttl must be positive")
+	check(auth.RefreshTTL > 0, "middleware.auth.refresh_ttl must be positive")
+	for _, alg := range auth.Algorithms {
+		check(middleware.SupportedAlgorithm(alg), "middleware.auth.algorithms must be %s, %s or %s, got %q",
+			middleware.HS256, middleware.RS256, middleware.EdDSA, alg)
+	}
+
+	switch strings.ToLower(c.AI.Provider) {
+	case provider.Kobold, provider.OpenAI, provider.Ollama:
+	default:
+		check(false, "ai.provider must be one of %s, %s or %s, got %q", provider.Kobold, provider.OpenAI, provider.Ollama, c.AI.Provider)
+	}
+	for i, endpoint := range c.AI.ResolvedEndpoints() {
+		check(validURL(endpoint.URL), "ai endpoint %d must be an http or https URL, got %q", i, endpoint.URL)
+		check(endpoint.StreamURL == "" || validURL(endpoint.StreamURL), "ai endpoint %d stream_url must be an http or https URL, got %q", i, endpoint.StreamURL)
+		check(endpoint.Weight >= 0, "ai endpoint %d weight must not be negative", i)
+	}
+	check(c.AI.Balance == upstream.RoundRobin || c.AI.Balance == upstream.LeastOutstanding,
+		"ai.balance must be %s or %s, got %q", upstream.RoundRobin, upstream.LeastOutstanding, c.AI.Balance)
+	check(c.AI.HealthInterval >= 0, "ai.health_interval must not be negative")
+
+	u := c.AI.Upstream
+	check(u.MaxRetries >= 0, "ai.upstream.max_retries must not be negative")
+	check(u.BaseDelay >= 0 && u.MaxDelay >= 0, "ai.upstream retry delays must not be negative")
+	check(u.FailureThreshold > 0, "ai.upstream.failure_threshold must be positive")
+	check(u.Cooldown > 0, "ai.upstream.cooldown must be positive")
+	check(u.MaxIdleConnsPerHost >= 0, "ai.upstream.max_idle_conns_per_host must not be negative")
+	check(u.IdleConnTimeout >= 0 && u.DialTimeout >= 0, "ai.upstream connection timeouts must not be negative")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, errors.Join(problems...))
+	}
+	return nil
+}
+
+// validURL reports whether raw is an absolute http or https URL
+func validURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Redacted returns a copy of the configuration that is safe to print.
+// The API key, the token secret and any passwords in endpoint URLs are
+// masked.
+func (c Config) Redacted() Config {
+	if c.AI.APIKey != "" {
+		c.AI.APIKey = redacted
+	}
+	if c.Middleware.Auth.Secret != "" {
+		c.Middleware.Auth.Secret = redacted
+	}
+	c.AI.Endpoint = redactURL(c.AI.Endpoint)
+	c.AI.StreamEndpoint = redactURL(c.AI.StreamEndpoint)
+
+	endpoints := make([]upstream.Endpoint, len(c.AI.Endpoints))
+	for i, endpoint := range c.AI.Endpoints {
+		endpoint.URL = redactURL(endpoint.URL)
+		endpoint.StreamURL = redactURL(endpoint.StreamURL)
+		endpoints[i] = endpoint
+	}
+	if len(endpoints) > 0 {
+		c.AI.Endpoints = endpoints
+	}
+	return c
+}
+
+// redactURL masks the credentials in raw, if any
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = url.User(redacted)
+	return u.String()
+}
+
+// WriteYAML writes the configuration to w as YAML
+func (c Config) WriteYAML(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,251 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TeamPentagon/DM-Backend/internal/upstream"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv names the environment variable holding the config file path
+const FileEnv = "CONFIG_FILE"
+
+// Options holds the command-line options that are not settings
+type Options struct {
+	// File is the config file that was loaded, if any
+	File string
+	// PrintConfig asks for the effective configuration to be printed
+	PrintConfig bool
+}
+
+// binding maps a setting to its environment variable and command-line flag
+type binding struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+	// keepEmpty applies an empty environment variable instead of ignoring it
+	keepEmpty bool
+}
+
+// bindings lists the settings that can be overridden outside the config file
+var bindings = []binding{
+	{"PORT", "port", "HTTP port to listen on", stringSetter(func(c *Config) *string { return &c.Server.Port }), false},
+	{"REQUEST_TIMEOUT", "request-timeout", "timeout of a chat request to the AI service", durationSetter(func(c *Config) *time.Duration { return &c.Server.RequestTimeout }), false},
+	{"SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long in-flight requests may finish after a shutdown signal", durationSetter(func(c *Config) *time.Duration { return &c.Server.ShutdownTimeout }), false},
+	{"DATABASE_DIR", "database-dir", "base directory of the database files", stringSetter(func(c *Config) *string { return &c.Database.BaseDir }), false},
+	{"DATABASE_SHARDS", "database-shards", "number of shards new records are spread over", int64Setter(func(c *Config) *int64 { return &c.Database.Shards }), false},
+	{"DATABASE_PLACEMENT", "database-placement", "shard placement strategy: ring or range", stringSetter(func(c *Config) *string { return &c.Database.Placement }), false},
+	{"DATABASE_USER_BACKEND", "database-user-backend", "storage engine of users: leveldb or sqlite", stringSetter(func(c *Config) *string { return &c.Database.UserBackend }), false},
+	{"DATABASE_CHAT_BACKEND", "database-chat-backend", "storage engine of messages and chat histories: leveldb or sqlite", stringSetter(func(c *Config) *string { return &c.Database.ChatBackend }), false},
+	{"DATABASE_CACHE_SIZE", "database-cache-size", "number of fragmentation lookups cached in memory, 0 disables the cache", intSetter(func(c *Config) *int { return &c.Database.CacheSize }), false},
+	{"DATABASE_CACHE_TTL", "database-cache-ttl", "time after which cached fragmentation lookups expire, 0 keeps them", durationSetter(func(c *Config) *time.Duration { return &c.Database.CacheTTL }), false},
+	{"CORS_ENABLED", "cors", "enable the CORS middleware", boolSetter(func(c *Config) *bool { return &c.Middleware.CORS.Enabled }), false},
+	{"CORS_ALLOW_ORIGINS", "cors-allow-origins", "comma-separated origins allowed by CORS", listSetter(func(c *Config) *[]string { return &c.Middleware.CORS.AllowOrigins }), false},
+	{"RATE_LIMIT_ENABLED", "rate-limit", "enable the per-client rate limiter", boolSetter(func(c *Config) *bool { return &c.Middleware.RateLimit.Enabled }), false},
+	{"RATE_LIMIT_RPS", "rate-limit-rps", "requests per second allowed per client", intSetter(func(c *Config) *int { return &c.Middleware.RateLimit.RequestsPerSecond }), false},
+	{"RATE_LIMIT_BURST", "rate-limit-burst", "burst size allowed per client", intSetter(func(c *Config) *int { return &c.Middleware.RateLimit.BurstSize }), false},
+	{"AUTH_JWT_SECRET", "", "", stringSetter(func(c *Config) *string { return &c.Middleware.Auth.Secret }), false},
+	{"AUTH_JWKS_FILE", "auth-jwks-file", "JSON Web Key Set file with the keys that verify bearer tokens", stringSetter(func(c *Config) *string { return &c.Middleware.Auth.JWKSFile }), false},
+	{"AUTH_ISSUER", "auth-issuer", "required iss claim of bearer tokens", stringSetter(func(c *Config) *string { return &c.Middleware.Auth.Issuer }), false},
+	{"AUTH_AUDIENCE", "auth-audience", "required aud claim of bearer tokens", stringSetter(func(c *Config) *string { return &c.Middleware.Auth.Audience }), false},
+	{"AUTH_LEEWAY", "auth-leeway", "clock skew tolerated when checking token expiry", durationSetter(func(c *Config) *time.Duration { return &c.Middleware.Auth.Leeway }), false},
+	{"AUTH_ACCESS_TTL", "auth-access-ttl", "lifetime of the access tokens issued at login", durationSetter(func(c *Config) *time.Duration { return &c.Middleware.Auth.AccessTTL }), false},
+	{"AUTH_REFRESH_TTL", "auth-refresh-ttl", "lifetime of refresh tokens", durationSetter(func(c *Config) *time.Duration { return &c.Middleware.Auth.RefreshTTL }), false},
+	{"AI_PROVIDER", "ai-provider", "AI service API: kobold, openai or ollama", stringSetter(func(c *Config) *string { return &c.AI.Provider }), false},
+	{"AI_ENDPOINT", "ai-endpoint", "generation API of the AI service", stringSetter(func(c *Config) *string { return &c.AI.Endpoint }), false},
+	{"AI_STREAM_ENDPOINT", "ai-stream-endpoint", "streaming API of the AI service", stringSetter(func(c *Config) *string { return &c.AI.StreamEndpoint }), false},
+	{"AI_ENDPOINTS", "ai-endpoints", "comma-separated endpoints to balance across, each optionally suffixed with |weight", endpointsSetter, false},
+	{"AI_BALANCE", "ai-balance", "load balancing strategy: round_robin or least_outstanding", stringSetter(func(c *Config) *string { return &c.AI.Balance }), false},
+	{"AI_HEALTH_INTERVAL", "ai-health-interval", "time between endpoint health probes, 0 disables them", durationSetter(func(c *Config) *time.Duration { return &c.AI.HealthInterval }), false},
+	{"AI_MODEL", "ai-model", "model name sent to the AI service", stringSetter(func(c *Config) *string { return &c.AI.Model }), false},
+	{"AI_API_KEY", "", "", stringSetter(func(c *Config) *string { return &c.AI.APIKey }), false},
+	{"AI_SYSTEM_PROMPT", "ai-system-prompt", "system prompt placed before each conversation", stringSetter(func(c *Config) *string { return &c.AI.Prompt.System }), true},
+}
+
+// Load builds the configuration from defaults, the config file, the
+// environment and args, in that order of precedence. The config file is
+// taken from the --config flag or the CONFIG_FILE environment variable.
+// Empty environment variables are ignored, except AI_SYSTEM_PROMPT which
+// clears the preamble.
+// lookupEnv is usually os.LookupEnv. Commands may define flags of their own
+// with extra; those are parsed together with the settings.
+// Returns flag.ErrHelp when args ask for usage.
+func Load(args []string, lookupEnv func(string) (string, bool), extra ...func(fs *flag.FlagSet)) (Config, Options, error) {
+	var opts Options
+
+	fs := flag.NewFlagSet("dm-backend", flag.ContinueOnError)
+	fs.StringVar(&opts.File, "config", "", "path to a YAML or TOML config file")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration with secrets redacted and exit")
+	for _, b := range bindings {
+		if b.flag != "" {
+			fs.String(b.flag, "", fmt.Sprintf("%s (env %s)", b.usage, b.env))
+		}
+	}
+	for _, define := range extra {
+		if define != nil {
+			define(fs)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, opts, err
+	}
+
+	if opts.File == "" {
+		opts.File, _ = lookupEnv(FileEnv)
+	}
+
+	cfg := Default()
+	if opts.File != "" {
+		if err := LoadFile(opts.File, &cfg); err != nil {
+			return Config{}, opts, err
+		}
+	}
+
+	for _, b := range bindings {
+		value, ok := lookupEnv(b.env)
+		if !ok || (value == "" && !b.keepEmpty) {
+			continue
+		}
+		if err := b.set(&cfg, value); err != nil {
+			return Config{}, opts, fmt.Errorf("%w: %s: %w", ErrInvalidConfig, b.env, err)
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, b := range bindings {
+			if b.flag == f.Name && flagErr == nil {
+				if err := b.set(&cfg, f.Value.String()); err != nil {
+					flagErr = fmt.Errorf("%w: --%s: %w", ErrInvalidConfig, b.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return Config{}, opts, flagErr
+	}
+
+	return cfg, opts, cfg.Validate()
+}
+
+// LoadFile reads a YAML (.yaml, .yml) or TOML (.toml) file into cfg.
+// Settings missing from the file keep their current value in cfg.
+func LoadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	case ".toml":
+		// Convert TOML to YAML so both formats share the same field names
+		// and duration parsing
+		var doc map[string]interface{}
+		if err := toml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if data, err = yaml.Marshal(doc); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedFormat, path)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// stringSetter sets a string setting
+func stringSetter(field func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+// durationSetter sets a duration setting such as "30s"
+func durationSetter(field func(c *Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+// intSetter sets an integer setting
+func intSetter(field func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// int64Setter sets a 64-bit integer setting
+func int64Setter(field func(c *Config) *int64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// boolSetter sets a boolean setting such as "true" or "0"
+func boolSetter(field func(c *Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+// listSetter sets a list setting from comma-separated values
+func listSetter(field func(c *Config) *[]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*field(c) = items
+		return nil
+	}
+}
+
+// endpointsSetter sets the balanced AI endpoints
+func endpointsSetter(c *Config, value string) error {
+	endpoints, err := upstream.ParseEndpoints(value)
+	if err != nil {
+		return err
+	}
+	c.AI.Endpoints = endpoints
+	return nil
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// DefaultCacheSize is the number of fragmentation lookups cached when the
+// layout does not set one
+const DefaultCacheSize = 10000
+
+// CacheStats reports the counters of a lookup cache
+type CacheStats struct {
+	// Hits counts lookups answered from the cache
+	Hits uint64 `json:"hits"`
+	// Misses counts lookups that read the schema database
+	Misses uint64 `json:"misses"`
+	// Evictions counts entries dropped to stay within the capacity
+	Evictions uint64 `json:"evictions"`
+	// Size is the number of cached entries
+	Size int `json:"size"`
+	// Capacity is the maximum number of cached entries
+	Capacity int `json:"capacity"`
+}
+
+// LookupCache is a bounded LRU cache of fragmentation lookups, including
+// keys without an entry. Writes to the schema update it after they reach
+// the database, so it never returns a superseded shard. Entries optionally
+// expire after a TTL. A nil *LookupCache caches nothing.
+// It is safe for concurrent use.
+type LookupCache struct {
+	capacity int
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+	// version changes on every write, so a lookup that read the database
+	// before a write does not cache what it read
+	version uint64
+	stats   CacheStats
+}
+
+// cacheEntry is a cached lookup; found is false for keys without an entry
+type cacheEntry struct {
+	key     string
+	shard   int64
+	found   bool
+	expires time.Time
+}
+
+// NewLookupCache creates a cache of at most capacity lookups that expire
+// after ttl, or never when ttl is 0. A capacity of 0 or less returns nil,
+// which disables caching.
+func NewLookupCache(capacity int, ttl time.Duration) *LookupCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &LookupCache{
+		capacity: capacity,
+		ttl:      ttl,
+		now:      time.Now,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+		stats:    CacheStats{Capacity: capacity},
+	}
+}
+
+// Stats returns the counters of the cache
+func (c *LookupCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.order.Len()
+	return stats
+}
+
+// Purge drops every cached lookup
+func (c *LookupCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version++
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// get returns the cached lookup of key and whether there was one. ver is
+// the version to pass to fill after a miss.
+func (c *LookupCache) get(key string) (shard int64, found, ok bool, ver uint64) {
+	if c == nil {
+		return -1, false, false, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, hit := c.items[key]; hit {
+		entry := elem.Value.(*cacheEntry)
+		if entry.expires.IsZero() || c.now().Before(entry.expires) {
+			c.order.MoveToFront(elem)
+			c.stats.Hits++
+			return entry.shard, entry.found, true, c.version
+		}
+		c.removeElement(elem)
+	}
+	c.stats.Misses++
+	return -1, false, false, c.version
+}
+
+// fill caches a lookup read from the database, unless the schema was
+// written since get returned ver
+func (c *LookupCache) fill(key string, shard int64, found bool, ver uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ver == c.version {
+		c.put(key, shard, found)
+	}
+}
+
+// apply updates the cache with the puts and deletes of a batch written to
+// the schema
+func (c *LookupCache) apply(batch *leveldb.Batch) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version++
+	batch.Replay(cacheReplay{c})
+}
+
+// cacheReplay applies the records of a batch to a locked cache
+type cacheReplay struct {
+	c *LookupCache
+}
+
+// Put caches the shard written for key
+func (r cacheReplay) Put(key, value []byte) {
+	shard, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		// Let the next lookup report the bad value
+		if elem, ok := r.c.items[string(key)]; ok {
+			r.c.removeElement(elem)
+		}
+		return
+	}
+	r.c.put(string(key), shard, true)
+}
+
+// Delete caches that key has no entry
+func (r cacheReplay) Delete(key []byte) {
+	r.c.put(string(key), -1, false)
+}
+
+// put stores a lookup as the most recently used, evicting the least
+// recently used one beyond the capacity. The caller holds mu.
+func (c *LookupCache) put(key string, shard int64, found bool) {
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = c.now().Add(c.ttl)
+	}
+	if elem, ok := c.items[key]; ok {
+		*elem.Value.(*cacheEntry) = cacheEntry{key: key, shard: shard, found: found, expires: expires}
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, shard: shard, found: found, expires: expires})
+	for c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+// removeElement drops a cached lookup. The caller holds mu.
+func (c *LookupCache) removeElement(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*cacheEntry).key)
+}
@@ -0,0 +1,198 @@
+// Package database provides tests and benchmarks for the fragmentation lookup cache.
+package database
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newCacheStore creates a test store whose lookup cache holds capacity
+// entries for ttl
+func newCacheStore(t testing.TB, capacity int, ttl time.Duration) *Store {
+	t.Helper()
+	layout := DefaultLayout()
+	layout.BaseDir = t.TempDir()
+	layout.CacheSize = capacity
+	layout.CacheTTL = ttl
+	store := NewStore(layout)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// TestLookupCacheLRU tests that the least recently used lookup is evicted
+func TestLookupCacheLRU(t *testing.T) {
+	c := NewLookupCache(2, 0)
+	for _, key := range []string{"a", "b"} {
+		_, _, _, ver := c.get(key)
+		c.fill(key, 1, true, ver)
+	}
+	c.get("a") // a is now more recently used than b
+	_, _, _, ver := c.get("c")
+	c.fill("c", 2, true, ver)
+
+	tests := []struct {
+		key    string
+		wantOK bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+	}
+	for _, tt := range tests {
+		if _, _, ok, _ := c.get(tt.key); ok != tt.wantOK {
+			t.Errorf("get(%q) cached = %v, want %v", tt.key, ok, tt.wantOK)
+		}
+	}
+
+	stats := c.Stats()
+	want := CacheStats{Hits: 3, Misses: 4, Evictions: 1, Size: 2, Capacity: 2}
+	if stats != want {
+		t.Errorf("Stats() = %+v, want %+v", stats, want)
+	}
+
+	c.Purge()
+	if stats := c.Stats(); stats.Size != 0 {
+		t.Errorf("Size after Purge() = %d, want 0", stats.Size)
+	}
+}
+
+// TestLookupCacheTTL tests that cached lookups expire
+func TestLookupCacheTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewLookupCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	_, _, _, ver := c.get("a")
+	c.fill("a", 1, true, ver)
+
+	now = now.Add(59 * time.Second)
+	if _, _, ok, _ := c.get("a"); !ok {
+		t.Error("Expected the lookup to be cached before the TTL")
+	}
+	now = now.Add(time.Second)
+	if _, _, ok, _ := c.get("a"); ok {
+		t.Error("Expected the lookup to expire after the TTL")
+	}
+	if stats := c.Stats(); stats.Size != 0 {
+		t.Errorf("Size after expiry = %d, want 0", stats.Size)
+	}
+}
+
+// TestLookupCacheStaleFill tests that a lookup read before a write is not cached
+func TestLookupCacheStaleFill(t *testing.T) {
+	store := newTestStore(t)
+	schema := NewSchema(store)
+	if err := schema.Add(1, "user_a"); err != nil {
+		t.Fatalf("Add() unexpected error: %v", err)
+	}
+	store.LookupCache().Purge()
+
+	// A reader misses and reads shard 1, then a writer moves the key
+	_, _, _, ver := store.LookupCache().get("user_a")
+	if err := schema.Update("user_a", 2); err != nil {
+		t.Fatalf("Update() unexpected error: %v", err)
+	}
+	store.LookupCache().fill("user_a", 1, true, ver)
+
+	if shard, err := schema.Get("user_a"); err != nil || shard != 2 {
+		t.Errorf("Get() = %d, %v, want 2", shard, err)
+	}
+}
+
+// TestSchemaCache tests that schema writes go through the cache
+func TestSchemaCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+	}{
+		{"cached", 100},
+		{"uncached", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newCacheStore(t, tt.capacity, 0)
+			schema := NewSchema(store)
+
+			// A miss of a key without an entry is cached until it is added
+			if ok, err := schema.Exists("user_a"); err != nil || ok {
+				t.Fatalf("Exists() = %v, %v, want false", ok, err)
+			}
+			steps := []struct {
+				write func() error
+				want  int64
+			}{
+				{func() error { return schema.Add(1, "user_a") }, 1},
+				{func() error { return schema.Update("user_a", 2) }, 2},
+				{func() error { _, err := schema.CompareAndSwap("user_a", 2, 3); return err }, 3},
+				{func() error { return schema.UpdateMany(map[string]int64{"user_a": 4}) }, 4},
+				{func() error { return schema.Remove("user_a") }, -1},
+				{func() error { return schema.AddMany(map[string]int64{"user_a": 5}) }, 5},
+				{func() error { return schema.RemoveMany("user_a") }, -1},
+			}
+			for i, step := range steps {
+				if err := step.write(); err != nil {
+					t.Fatalf("step %d: unexpected error: %v", i, err)
+				}
+				// Read twice so the second lookup is a hit when cached
+				for j := 0; j < 2; j++ {
+					shard, ok, err := schema.Lookup("user_a")
+					if err != nil || ok != (step.want >= 0) || (ok && shard != step.want) {
+						t.Fatalf("step %d: Lookup() = %d, %v, %v, want %d", i, shard, ok, err, step.want)
+					}
+				}
+			}
+
+			stats := store.LookupCache().Stats()
+			if tt.capacity == 0 {
+				if stats != (CacheStats{}) {
+					t.Errorf("Expected no stats without a cache, got %+v", stats)
+				}
+				return
+			}
+			// Only the first Exists misses; writes keep the cache current,
+			// and the existence checks of updates are hits as well
+			if stats.Misses != 1 || stats.Hits < 2*uint64(len(steps)) {
+				t.Errorf("Stats() = %+v, want 1 miss and at least %d hits", stats, 2*len(steps))
+			}
+		})
+	}
+}
+
+// BenchmarkLookup compares parallel fragmentation lookups with and without
+// the cache
+func BenchmarkLookup(b *testing.B) {
+	quietLogs(b)
+	const keys = 1000
+	entries := make(map[string]int64, keys)
+	for i := 0; i < keys; i++ {
+		entries[fmt.Sprintf("user_%d", i)] = int64(i % 4)
+	}
+
+	for _, bench := range []struct {
+		name     string
+		capacity int
+	}{
+		{"Uncached", 0},
+		{"Cached", DefaultCacheSize},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			schema := NewSchema(newCacheStore(b, bench.capacity, 0))
+			if err := schema.AddMany(entries); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if _, err := schema.Get(fmt.Sprintf("user_%d", i%keys)); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
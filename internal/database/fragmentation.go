@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 const (
@@ -25,168 +27,372 @@ var (
 	ErrEmptyKey           = errors.New("key cannot be empty")
 )
 
-// FragmentationAdd adds one or more fragment entries to the global schema.
-// Each key is mapped to the specified shard number.
+// Schema is the fragmentation schema kept in the GlobalSchema database of a
+// Store. It is safe for concurrent use.
+type Schema struct {
+	store *Store
+}
+
+// NewSchema returns the fragmentation schema of store
+func NewSchema(store *Store) *Schema {
+	return &Schema{store: store}
+}
+
+// defaultSchema returns the fragmentation schema of the default store
+func defaultSchema() *Schema {
+	return NewSchema(DefaultStore())
+}
+
+// FragmentationAdd adds one or more fragment entries to the default schema.
+// See Schema.Add.
+func FragmentationAdd(shard int64, keys ...string) error {
+	return defaultSchema().Add(shard, keys...)
+}
+
+// FragmentationAssign returns the shard of key in the default schema,
+// placing it with the default store's registry if it has none.
+// See Schema.Assign.
+func FragmentationAssign(key string) (int64, error) {
+	return defaultSchema().Assign(key, nil)
+}
+
+// FragmentationAddMany adds every entry of shards to the default schema, or
+// none of them. See Schema.AddMany.
+func FragmentationAddMany(shards map[string]int64) error {
+	return defaultSchema().AddMany(shards)
+}
+
+// FragmentationUpdateMany moves every key of shards to its new shard in the
+// default schema, or none of them. See Schema.UpdateMany.
+func FragmentationUpdateMany(shards map[string]int64) error {
+	return defaultSchema().UpdateMany(shards)
+}
+
+// FragmentationRemoveMany removes every key from the default schema, or none
+// of them. See Schema.RemoveMany.
+func FragmentationRemoveMany(keys ...string) error {
+	return defaultSchema().RemoveMany(keys...)
+}
+
+// FragmentationCompareAndSwap moves key to newShard in the default schema if
+// it is still on expected. See Schema.CompareAndSwap.
+func FragmentationCompareAndSwap(key string, expected, newShard int64) (bool, error) {
+	return defaultSchema().CompareAndSwap(key, expected, newShard)
+}
+
+// FragmentationRemove removes a fragment entry from the default schema.
+// See Schema.Remove.
+func FragmentationRemove(key string) error {
+	return defaultSchema().Remove(key)
+}
+
+// FragmentationGet retrieves the shard number for a row ID from the default
+// schema. See Schema.Get.
+func FragmentationGet(rowID string) (int64, error) {
+	return defaultSchema().Get(rowID)
+}
+
+// FragmentationExists checks if a key exists in the default schema.
+// See Schema.Exists.
+func FragmentationExists(key string) (bool, error) {
+	return defaultSchema().Exists(key)
+}
+
+// FragmentationUpdate updates the shard assignment for an existing key in the
+// default schema. See Schema.Update.
+func FragmentationUpdate(key string, newShard int64) error {
+	return defaultSchema().Update(key, newShard)
+}
+
+// Add adds one or more fragment entries to the global schema.
+// Each key is mapped to the specified shard number. The entries are written
+// in a single batch, so either every key is mapped or none is.
 //
 // Parameters:
 //   - shard: The shard number to associate with the keys
 //   - keys: One or more keys to add to the fragmentation schema
 //
 // Returns an error if any database operation fails.
-func FragmentationAdd(shard int64, keys ...string) error {
+func (s *Schema) Add(shard int64, keys ...string) error {
 	if len(keys) == 0 {
 		return ErrEmptyKey
 	}
 
-	ldb, err := CreateLevelDBDatabase(DefaultBaseDir, GlobalSchemaPath, "/")
-	if err != nil {
-		log.Printf("Error creating LevelDB database: %v", err)
-		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
-	}
-	defer ldb.Close()
-
-	shardBytes := []byte(fmt.Sprintf("%d", shard))
+	batch := new(leveldb.Batch)
+	shardBytes := []byte(strconv.FormatInt(shard, 10))
 	for _, key := range keys {
 		if key == "" {
 			log.Printf("Warning: skipping empty key")
 			continue
 		}
+		batch.Put([]byte(key), shardBytes)
+	}
+
+	s.store.schemaMu.Lock()
+	defer s.store.schemaMu.Unlock()
+
+	if err := s.write(batch); err != nil {
+		return err
+	}
+	log.Printf("Added fragmentation: %d keys -> shard=%d", batch.Len(), shard)
+	return nil
+}
+
+// AddMany maps every key of shards to its shard number in a single batch.
+// An empty key rejects the whole batch and nothing is written.
+func (s *Schema) AddMany(shards map[string]int64) error {
+	if len(shards) == 0 {
+		return ErrEmptyKey
+	}
 
-		err = ldb.Put([]byte(key), shardBytes, nil)
-		if err != nil {
-			log.Printf("Error adding fragmentation entry for key %s: %v", key, err)
-			return fmt.Errorf("%w for key %s: %v", ErrFragmentationWrite, key, err)
+	batch := new(leveldb.Batch)
+	for key, shard := range shards {
+		if key == "" {
+			return ErrEmptyKey
 		}
-		log.Printf("Added fragmentation: key=%s -> shard=%d", key, shard)
+		batch.Put([]byte(key), []byte(strconv.FormatInt(shard, 10)))
 	}
 
+	s.store.schemaMu.Lock()
+	defer s.store.schemaMu.Unlock()
+
+	if err := s.write(batch); err != nil {
+		return err
+	}
+	log.Printf("Added fragmentation: %d keys", batch.Len())
 	return nil
 }
 
-// FragmentationRemove removes a fragment entry from the global schema.
+// Remove removes a fragment entry from the global schema.
 //
 // Parameters:
 //   - key: The key to remove from the fragmentation schema
 //
-// Returns an error if the database operation fails.
-func FragmentationRemove(key string) error {
-	if key == "" {
-		return ErrEmptyKey
+// Returns an error if the key doesn't exist or the database operation fails.
+func (s *Schema) Remove(key string) error {
+	if err := s.RemoveMany(key); err != nil {
+		log.Printf("Error removing fragmentation entry for key %s: %v", key, err)
+		return err
 	}
+	log.Printf("Removed fragmentation entry for key: %s", key)
+	return nil
+}
 
-	ldb, err := CreateLevelDBDatabase(DefaultBaseDir, GlobalSchemaPath, "/")
-	if err != nil {
-		log.Printf("Error creating LevelDB database: %v", err)
-		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+// RemoveMany removes the entries of every key in a single batch. If any key
+// is empty or has no entry, nothing is removed.
+func (s *Schema) RemoveMany(keys ...string) error {
+	if len(keys) == 0 {
+		return ErrEmptyKey
 	}
-	defer ldb.Close()
 
-	// Check if key exists before attempting to delete
-	_, err = ldb.Get([]byte(key), nil)
-	if err != nil {
-		log.Printf("Key %s not found in fragmentation schema: %v", key, err)
-		return fmt.Errorf("%w: %v", ErrShardNotFound, err)
-	}
+	s.store.schemaMu.Lock()
+	defer s.store.schemaMu.Unlock()
 
-	err = ldb.Delete([]byte(key), nil)
-	if err != nil {
-		log.Printf("Error removing fragmentation entry for key %s: %v", key, err)
-		return fmt.Errorf("%w: %v", ErrFragmentationWrite, err)
+	batch := new(leveldb.Batch)
+	for _, key := range keys {
+		if err := s.mustExist(key); err != nil {
+			return err
+		}
+		batch.Delete([]byte(key))
 	}
-
-	log.Printf("Removed fragmentation entry for key: %s", key)
-	return nil
+	return s.write(batch)
 }
 
-// FragmentationGet retrieves the shard number for a given row ID.
+// Get retrieves the shard number for a given row ID.
 //
 // Parameters:
 //   - rowID: The row ID to look up in the fragmentation schema
 //
 // Returns the shard number and any error encountered.
-func FragmentationGet(rowID string) (int64, error) {
-	if rowID == "" {
-		return -1, ErrEmptyKey
+func (s *Schema) Get(rowID string) (int64, error) {
+	shard, ok, err := s.Lookup(rowID)
+	if err != nil {
+		log.Printf("Error getting shard for rowID %s: %v", rowID, err)
+		return -1, err
+	}
+	if !ok {
+		log.Printf("Error getting shard for rowID %s: not found", rowID)
+		return -1, fmt.Errorf("%w: key %s", ErrShardNotFound, rowID)
+	}
+	return shard, nil
+}
+
+// Lookup returns the shard number of key and whether key has an entry.
+// Unlike Get, a missing key is not an error. Lookups are answered from the
+// cache of the store when possible.
+func (s *Schema) Lookup(key string) (int64, bool, error) {
+	if key == "" {
+		return -1, false, ErrEmptyKey
 	}
 
-	ldb, err := CreateLevelDBDatabase(DefaultBaseDir, GlobalSchemaPath, "/")
+	cache := s.store.LookupCache()
+	shard, found, ok, ver := cache.get(key)
+	if ok {
+		return shard, found, nil
+	}
+	shard, found, err := s.lookup(key)
 	if err != nil {
-		log.Printf("Error creating LevelDB database: %v", err)
-		return -1, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+		return -1, false, err
 	}
-	defer ldb.Close()
+	cache.fill(key, shard, found, ver)
+	return shard, found, nil
+}
 
-	shard, err := ldb.Get([]byte(rowID), nil)
+// lookup reads the shard of key from the schema database
+func (s *Schema) lookup(key string) (int64, bool, error) {
+	ldb, err := s.store.GlobalSchema()
 	if err != nil {
-		log.Printf("Error getting shard for rowID %s: %v", rowID, err)
-		return -1, fmt.Errorf("%w: %v", ErrShardNotFound, err)
+		return -1, false, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	shard, err := ldb.Get([]byte(key), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return -1, false, nil
+	}
+	if err != nil {
+		return -1, false, fmt.Errorf("%w: %v", ErrFragmentationRead, err)
 	}
 
 	n, err := strconv.ParseInt(string(shard), 10, 64)
 	if err != nil {
-		log.Printf("Error converting shard to int64: %v", err)
-		return -1, fmt.Errorf("%w: %v", ErrShardConversion, err)
+		return -1, false, fmt.Errorf("%w: %v", ErrShardConversion, err)
+	}
+	return n, true, nil
+}
+
+// Assign returns the shard of key. A key without an entry is placed with p,
+// or with the registry of the store when p is nil, and the result is
+// recorded so later calls return the same shard.
+func (s *Schema) Assign(key string, p Placement) (int64, error) {
+	if p == nil {
+		p = s.store.Registry()
 	}
 
-	return n, nil
+	s.store.schemaMu.Lock()
+	defer s.store.schemaMu.Unlock()
+
+	shard, ok, err := s.Lookup(key)
+	if err != nil || ok {
+		return shard, err
+	}
+	if shard, err = p.Place(key); err != nil {
+		return -1, err
+	}
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(key), []byte(strconv.FormatInt(shard, 10)))
+	if err := s.write(batch); err != nil {
+		return -1, err
+	}
+	log.Printf("Added fragmentation: key=%s -> shard=%d", key, shard)
+	return shard, nil
 }
 
-// FragmentationExists checks if a key exists in the fragmentation schema.
+// Exists checks if a key exists in the fragmentation schema.
 //
 // Parameters:
 //   - key: The key to check
 //
 // Returns true if the key exists, false otherwise.
-func FragmentationExists(key string) (bool, error) {
-	if key == "" {
-		return false, ErrEmptyKey
-	}
-
-	ldb, err := CreateLevelDBDatabase(DefaultBaseDir, GlobalSchemaPath, "/")
-	if err != nil {
-		return false, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
-	}
-	defer ldb.Close()
-
-	_, err = ldb.Get([]byte(key), nil)
-	if err != nil {
-		return false, nil // Key doesn't exist
-	}
-
-	return true, nil
+func (s *Schema) Exists(key string) (bool, error) {
+	_, ok, err := s.Lookup(key)
+	return ok, err
 }
 
-// FragmentationUpdate updates the shard assignment for an existing key.
+// Update updates the shard assignment for an existing key.
 //
 // Parameters:
 //   - key: The key to update
 //   - newShard: The new shard number to assign
 //
 // Returns an error if the key doesn't exist or if the update fails.
-func FragmentationUpdate(key string, newShard int64) error {
-	if key == "" {
+func (s *Schema) Update(key string, newShard int64) error {
+	if err := s.UpdateMany(map[string]int64{key: newShard}); err != nil {
+		return err
+	}
+	log.Printf("Updated fragmentation: key=%s -> shard=%d", key, newShard)
+	return nil
+}
+
+// UpdateMany moves every key of shards to its new shard number in a single
+// batch. If any key is empty or has no entry, nothing is updated.
+func (s *Schema) UpdateMany(shards map[string]int64) error {
+	if len(shards) == 0 {
 		return ErrEmptyKey
 	}
 
-	exists, err := FragmentationExists(key)
+	s.store.schemaMu.Lock()
+	defer s.store.schemaMu.Unlock()
+
+	batch := new(leveldb.Batch)
+	for key, shard := range shards {
+		if err := s.mustExist(key); err != nil {
+			return err
+		}
+		batch.Put([]byte(key), []byte(strconv.FormatInt(shard, 10)))
+	}
+	return s.write(batch)
+}
+
+// CompareAndSwap moves key to newShard only if it is still on expected and
+// reports whether it was moved. The check and the write are atomic with
+// respect to the other operations of the schema. A key without an entry
+// returns ErrShardNotFound.
+func (s *Schema) CompareAndSwap(key string, expected, newShard int64) (bool, error) {
+	if key == "" {
+		return false, ErrEmptyKey
+	}
+
+	s.store.schemaMu.Lock()
+	defer s.store.schemaMu.Unlock()
+
+	shard, ok, err := s.Lookup(key)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, fmt.Errorf("%w: key %s", ErrShardNotFound, key)
+	}
+	if shard != expected {
+		return false, nil
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(key), []byte(strconv.FormatInt(newShard, 10)))
+	if err := s.write(batch); err != nil {
+		return false, err
+	}
+	log.Printf("Updated fragmentation: key=%s shard=%d -> shard=%d", key, expected, newShard)
+	return true, nil
+}
+
+// mustExist returns ErrShardNotFound unless key has an entry. The caller
+// holds schemaMu.
+func (s *Schema) mustExist(key string) error {
+	_, ok, err := s.Lookup(key)
 	if err != nil {
 		return err
 	}
-	if !exists {
+	if !ok {
 		return fmt.Errorf("%w: key %s", ErrShardNotFound, key)
 	}
+	return nil
+}
 
-	ldb, err := CreateLevelDBDatabase(DefaultBaseDir, GlobalSchemaPath, "/")
+// write applies batch to the global schema in one atomic write and then
+// to the lookup cache
+func (s *Schema) write(batch *leveldb.Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	ldb, err := s.store.GlobalSchema()
 	if err != nil {
+		log.Printf("Error creating LevelDB database: %v", err)
 		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
 	}
-	defer ldb.Close()
-
-	err = ldb.Put([]byte(key), []byte(fmt.Sprintf("%d", newShard)), nil)
-	if err != nil {
+	if err := ldb.Write(batch, nil); err != nil {
+		log.Printf("Error writing fragmentation entries: %v", err)
 		return fmt.Errorf("%w: %v", ErrFragmentationWrite, err)
 	}
-
-	log.Printf("Updated fragmentation: key=%s -> shard=%d", key, newShard)
+	s.store.LookupCache().apply(batch)
 	return nil
 }
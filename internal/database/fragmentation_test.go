@@ -2,8 +2,11 @@
 package database
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -14,6 +17,7 @@ func setupTestEnvironment(t *testing.T) (cleanup func()) {
 
 	// Override the default paths by managing our own test paths
 	return func() {
+		CloseAll()
 		os.RemoveAll(testDir)
 		os.RemoveAll("Database")
 	}
@@ -331,3 +335,202 @@ func TestFragmentationUpdate(t *testing.T) {
 		})
 	}
 }
+
+// TestSchemaLookup tests looking up keys with and without an entry
+func TestSchemaLookup(t *testing.T) {
+	schema := NewSchema(newTestStore(t))
+
+	if err := schema.Add(2, "user_lookup"); err != nil {
+		t.Fatalf("Add() unexpected error: %v", err)
+	}
+
+	shard, ok, err := schema.Lookup("user_lookup")
+	if err != nil || !ok || shard != 2 {
+		t.Errorf("Lookup() = %d, %v, %v, want 2, true, nil", shard, ok, err)
+	}
+	if _, ok, err := schema.Lookup("user_missing"); err != nil || ok {
+		t.Errorf("Lookup() of a missing key = %v, %v, want false, nil", ok, err)
+	}
+	if _, _, err := schema.Lookup(""); err != ErrEmptyKey {
+		t.Errorf("Lookup(\"\") error = %v, want %v", err, ErrEmptyKey)
+	}
+}
+
+// TestSchemaAssign tests that a key is placed once and keeps its shard
+func TestSchemaAssign(t *testing.T) {
+	schema := NewSchema(newTestStore(t))
+
+	first, err := schema.Assign("user_assign", nil)
+	if err != nil {
+		t.Fatalf("Assign() unexpected error: %v", err)
+	}
+	if !schema.store.Registry().IsActive(first) {
+		t.Errorf("Assign() = %d, want an active shard", first)
+	}
+
+	moved := PlacementFunc(func(string) (int64, error) { return first + 1, nil })
+	if again, err := schema.Assign("user_assign", moved); err != nil || again != first {
+		t.Errorf("Assign() again = %d, %v, want %d", again, err, first)
+	}
+	if shard, err := schema.Assign("user_other", moved); err != nil || shard != first+1 {
+		t.Errorf("Assign() with a placement = %d, %v, want %d", shard, err, first+1)
+	}
+	if recorded, err := schema.Get("user_other"); err != nil || recorded != first+1 {
+		t.Errorf("Get() = %d, %v, want the assigned shard", recorded, err)
+	}
+}
+
+// TestSchemaBatches tests that batch operations apply to every key or none
+func TestSchemaBatches(t *testing.T) {
+	schema := NewSchema(newTestStore(t))
+
+	if err := schema.AddMany(map[string]int64{"user_a": 1, "": 2}); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("AddMany() with an empty key error = %v, want %v", err, ErrEmptyKey)
+	}
+	if ok, _ := schema.Exists("user_a"); ok {
+		t.Error("Expected a rejected AddMany() to write no keys")
+	}
+
+	if err := schema.AddMany(map[string]int64{"user_a": 1, "user_b": 2, "user_c": 3}); err != nil {
+		t.Fatalf("AddMany() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		apply   func() error
+		wantErr error
+		want    map[string]int64
+	}{
+		{
+			name:    "update with a missing key",
+			apply:   func() error { return schema.UpdateMany(map[string]int64{"user_a": 5, "user_missing": 5}) },
+			wantErr: ErrShardNotFound,
+			want:    map[string]int64{"user_a": 1, "user_b": 2, "user_c": 3},
+		},
+		{
+			name:  "update",
+			apply: func() error { return schema.UpdateMany(map[string]int64{"user_a": 5, "user_b": 6}) },
+			want:  map[string]int64{"user_a": 5, "user_b": 6, "user_c": 3},
+		},
+		{
+			name:    "remove with a missing key",
+			apply:   func() error { return schema.RemoveMany("user_a", "user_missing") },
+			wantErr: ErrShardNotFound,
+			want:    map[string]int64{"user_a": 5, "user_b": 6, "user_c": 3},
+		},
+		{
+			name:  "remove",
+			apply: func() error { return schema.RemoveMany("user_a", "user_c") },
+			want:  map[string]int64{"user_b": 6},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.apply(); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			for _, key := range []string{"user_a", "user_b", "user_c"} {
+				shard, ok, err := schema.Lookup(key)
+				if err != nil {
+					t.Fatalf("Lookup(%q) unexpected error: %v", key, err)
+				}
+				want, wantOK := tt.want[key]
+				if ok != wantOK || (ok && shard != want) {
+					t.Errorf("Lookup(%q) = %d, %v, want %d, %v", key, shard, ok, want, wantOK)
+				}
+			}
+		})
+	}
+}
+
+// TestSchemaCompareAndSwap tests that a key only moves from the expected shard
+func TestSchemaCompareAndSwap(t *testing.T) {
+	schema := NewSchema(newTestStore(t))
+	if err := schema.Add(1, "user_cas"); err != nil {
+		t.Fatalf("Add() unexpected error: %v", err)
+	}
+
+	if swapped, err := schema.CompareAndSwap("user_cas", 2, 3); err != nil || swapped {
+		t.Errorf("CompareAndSwap() from the wrong shard = %v, %v, want false", swapped, err)
+	}
+	if swapped, err := schema.CompareAndSwap("user_cas", 1, 3); err != nil || !swapped {
+		t.Errorf("CompareAndSwap() = %v, %v, want true", swapped, err)
+	}
+	if shard, err := schema.Get("user_cas"); err != nil || shard != 3 {
+		t.Errorf("Get() = %d, %v, want 3", shard, err)
+	}
+	if _, err := schema.CompareAndSwap("user_missing", 0, 1); !errors.Is(err, ErrShardNotFound) {
+		t.Errorf("CompareAndSwap() of a missing key error = %v, want %v", err, ErrShardNotFound)
+	}
+	if _, err := schema.CompareAndSwap("", 0, 1); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("CompareAndSwap() of an empty key error = %v, want %v", err, ErrEmptyKey)
+	}
+}
+
+// TestSchemaConcurrentUpdates tests that racing compare-and-swaps lose no updates
+func TestSchemaConcurrentUpdates(t *testing.T) {
+	schema := NewSchema(newTestStore(t))
+	if err := schema.Add(0, "user_counter"); err != nil {
+		t.Fatalf("Add() unexpected error: %v", err)
+	}
+
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Use the shard number as a counter, retrying when another
+			// worker incremented it first
+			for done := 0; done < increments; {
+				current, err := schema.Get("user_counter")
+				if err != nil {
+					errs <- err
+					return
+				}
+				swapped, err := schema.CompareAndSwap("user_counter", current, current+1)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if swapped {
+					done++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Concurrent update failed: %v", err)
+	}
+
+	if shard, err := schema.Get("user_counter"); err != nil || shard != workers*increments {
+		t.Errorf("Get() = %d, %v, want %d", shard, err, workers*increments)
+	}
+
+	// Batches of distinct keys written concurrently all land
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			batch := make(map[string]int64)
+			for i := 0; i < increments; i++ {
+				batch[fmt.Sprintf("user_%d_%d", w, i)] = int64(w)
+			}
+			if err := schema.AddMany(batch); err != nil {
+				t.Errorf("AddMany() unexpected error: %v", err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for w := 0; w < workers; w++ {
+		for i := 0; i < increments; i++ {
+			if shard, err := schema.Get(fmt.Sprintf("user_%d_%d", w, i)); err != nil || shard != int64(w) {
+				t.Errorf("Get() = %d, %v, want %d", shard, err, w)
+			}
+		}
+	}
+}
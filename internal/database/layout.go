@@ -0,0 +1,109 @@
+// Package database provides the on-disk layout of the service databases.
+package database
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Layout names the directories that hold each database.
+// All paths except BaseDir are relative to BaseDir.
+type Layout struct {
+	// BaseDir is the root directory of all database files
+	BaseDir string `yaml:"base_dir" json:"base_dir"`
+	// GlobalSchema holds the fragmentation schema
+	GlobalSchema string `yaml:"global_schema" json:"global_schema"`
+	// ShardGroup is the directory holding the data shards
+	ShardGroup string `yaml:"shard_group" json:"shard_group"`
+	// DefaultShard is the database of shard 0, which also holds records
+	// written before they were assigned a shard
+	DefaultShard string `yaml:"default_shard" json:"default_shard"`
+	// Shards is the number of shards new records are spread over
+	Shards int64 `yaml:"shards" json:"shards"`
+	// Placement is the strategy assigning new records to shards:
+	// PlacementRing or PlacementRange
+	Placement string `yaml:"placement" json:"placement"`
+	// HistoryDir holds the conversation histories
+	HistoryDir string `yaml:"history_dir" json:"history_dir"`
+	// SQLDir holds the SQLite databases
+	SQLDir string `yaml:"sql_dir" json:"sql_dir"`
+	// UserBackend is the storage engine of users: BackendLevelDB or
+	// BackendSQLite
+	UserBackend string `yaml:"user_backend" json:"user_backend"`
+	// ChatBackend is the storage engine of messages and chat histories:
+	// BackendLevelDB or BackendSQLite
+	ChatBackend string `yaml:"chat_backend" json:"chat_backend"`
+	// CacheSize is the number of fragmentation lookups kept in memory,
+	// 0 disables the cache
+	CacheSize int `yaml:"cache_size" json:"cache_size"`
+	// CacheTTL expires cached lookups after this long, 0 keeps them until
+	// they are evicted
+	CacheTTL time.Duration `yaml:"cache_ttl" json:"cache_ttl"`
+}
+
+// Storage engines of Layout.UserBackend and Layout.ChatBackend
+const (
+	BackendLevelDB = "leveldb"
+	BackendSQLite  = "sqlite"
+)
+
+// DefaultLayout returns the layout used when none is configured
+func DefaultLayout() Layout {
+	return Layout{
+		BaseDir:      DefaultBaseDir,
+		GlobalSchema: GlobalSchemaPath,
+		ShardGroup:   "Common",
+		DefaultShard: "Shard_0.sqlite",
+		Shards:       4,
+		Placement:    PlacementRing,
+		HistoryDir:   "NOSQL",
+		SQLDir:       "SQL",
+		UserBackend:  BackendLevelDB,
+		ChatBackend:  BackendLevelDB,
+		CacheSize:    DefaultCacheSize,
+	}
+}
+
+// ShardName returns the database directory of shard n in the shard group
+func (l Layout) ShardName(n int64) string {
+	if n == 0 {
+		return l.DefaultShard
+	}
+	return fmt.Sprintf("Shard_%d.sqlite", n)
+}
+
+var (
+	defaultMu    sync.RWMutex
+	defaultStore = NewStore(DefaultLayout())
+)
+
+// DefaultStore returns the store used by the package-level functions
+func DefaultStore() *Store {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultStore
+}
+
+// SetLayout replaces the default store with one over l and closes the
+// previous one. It should be called once at startup, before any database is
+// opened.
+func SetLayout(l Layout) error {
+	defaultMu.Lock()
+	previous := defaultStore
+	defaultStore = NewStore(l)
+	defaultMu.Unlock()
+	return previous.Close()
+}
+
+// CurrentLayout returns the layout of the default store
+func CurrentLayout() Layout {
+	return DefaultStore().Layout()
+}
+
+// CloseAll closes the databases of the default store and releases their
+// locks. The default store is replaced by a fresh one over the same layout,
+// so later calls open the databases again.
+func CloseAll() error {
+	return SetLayout(CurrentLayout())
+}
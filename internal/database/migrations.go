@@ -0,0 +1,222 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Common errors for schema migrations
+var (
+	ErrMigrationFiles = errors.New("invalid migration files")
+	ErrMigration      = errors.New("migration failed")
+)
+
+// migrationFile matches the names of migration files, such as
+// 0001_create_users.up.sql and 0001_create_users.down.sql
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one versioned change of a SQL schema
+type Migration struct {
+	Version int
+	Name    string
+	// Up applies the change
+	Up string
+	// Down reverts it; empty if the migration cannot be reverted
+	Down string
+}
+
+// LoadMigrations reads the migrations in the root of fsys, ordered by
+// version. Every version needs an up file; the down file is optional.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMigrationFiles, err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := migrationFile.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMigrationFiles, err)
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		} else if migration.Name != m[2] {
+			return nil, fmt.Errorf("%w: version %d is named both %s and %s", ErrMigrationFiles, version, migration.Name, m[2])
+		}
+		if m[3] == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("%w: version %d has no up file", ErrMigrationFiles, migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Migrator applies and reverts versioned migrations of a SQL database. The
+// applied versions are recorded in the schema_migrations table, and each
+// migration runs in a transaction together with its record.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator creates a migrator of db with the migrations in fsys
+func NewMigrator(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Latest returns the version of the last migration, or 0 if there is none
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the version of the last applied migration, or 0 if none
+// is applied
+func (m *Migrator) Version() (int, error) {
+	if err := m.init(); err != nil {
+		return 0, err
+	}
+	var version int
+	err := m.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrMigration, err)
+	}
+	return version, nil
+}
+
+// Up applies every migration newer than the current version and returns
+// the number applied
+func (m *Migrator) Up() (int, error) {
+	return m.To(m.Latest())
+}
+
+// Down reverts the last steps applied migrations and returns the number
+// reverted
+func (m *Migrator) Down(steps int) (int, error) {
+	current, err := m.Version()
+	if err != nil {
+		return 0, err
+	}
+	target := 0
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		if m.migrations[i].Version > current {
+			continue
+		}
+		if steps == 0 {
+			target = m.migrations[i].Version
+			break
+		}
+		steps--
+	}
+	return m.To(target)
+}
+
+// To applies or reverts migrations until version is the current version,
+// and returns the number of migrations run
+func (m *Migrator) To(version int) (int, error) {
+	current, err := m.Version()
+	if err != nil {
+		return 0, err
+	}
+
+	run := 0
+	if version >= current {
+		for _, migration := range m.migrations {
+			if migration.Version <= current || migration.Version > version {
+				continue
+			}
+			if err := m.apply(migration, migration.Up,
+				`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+				migration.Version, migration.Name, time.Now().Unix()); err != nil {
+				return run, err
+			}
+			log.Printf("Applied migration %04d_%s", migration.Version, migration.Name)
+			run++
+		}
+		return run, nil
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version > current || migration.Version <= version {
+			continue
+		}
+		if migration.Down == "" {
+			return run, fmt.Errorf("%w: %04d_%s cannot be reverted", ErrMigration, migration.Version, migration.Name)
+		}
+		if err := m.apply(migration, migration.Down,
+			`DELETE FROM schema_migrations WHERE version = ?`, migration.Version); err != nil {
+			return run, err
+		}
+		log.Printf("Reverted migration %04d_%s", migration.Version, migration.Name)
+		run++
+	}
+	return run, nil
+}
+
+// init creates the schema_migrations table
+func (m *Migrator) init() error {
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMigration, err)
+	}
+	return nil
+}
+
+// apply runs script and the statement recording it in one transaction
+func (m *Migrator) apply(migration Migration, script, record string, args ...interface{}) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%w: %04d_%s: %v", ErrMigration, migration.Version, migration.Name, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return fmt.Errorf("%w: %04d_%s: %v", ErrMigration, migration.Version, migration.Name, err)
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return fmt.Errorf("%w: %04d_%s: %v", ErrMigration, migration.Version, migration.Name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%w: %04d_%s: %v", ErrMigration, migration.Version, migration.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Package database provides tests for versioned SQL migrations.
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"testing/fstest"
+)
+
+// testMigrations creates two tables in two versions
+var testMigrations = fstest.MapFS{
+	"0001_create_a.up.sql":   {Data: []byte("CREATE TABLE a (id INTEGER PRIMARY KEY);")},
+	"0001_create_a.down.sql": {Data: []byte("DROP TABLE a;")},
+	"0002_create_b.up.sql":   {Data: []byte("CREATE TABLE b (id INTEGER PRIMARY KEY); CREATE INDEX b_id ON b (id);")},
+	"0002_create_b.down.sql": {Data: []byte("DROP INDEX b_id; DROP TABLE b;")},
+	"README.md":              {Data: []byte("not a migration")},
+}
+
+// newTestSQL opens a SQLite database in a temporary store
+func newTestSQL(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := newTestStore(t).SQL("test.db")
+	if err != nil {
+		t.Fatalf("SQL() unexpected error: %v", err)
+	}
+	return db
+}
+
+// tableExists reports whether db has a table named name
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n); err != nil {
+		t.Fatalf("Query unexpected error: %v", err)
+	}
+	return n == 1
+}
+
+// TestMigrator tests applying and reverting migrations
+func TestMigrator(t *testing.T) {
+	db := newTestSQL(t)
+	m, err := NewMigrator(db, testMigrations)
+	if err != nil {
+		t.Fatalf("NewMigrator() unexpected error: %v", err)
+	}
+	if m.Latest() != 2 {
+		t.Errorf("Latest() = %d, want 2", m.Latest())
+	}
+
+	steps := []struct {
+		name        string
+		run         func() (int, error)
+		wantRun     int
+		wantVersion int
+		wantA       bool
+		wantB       bool
+	}{
+		{"up", m.Up, 2, 2, true, true},
+		{"up again", m.Up, 0, 2, true, true},
+		{"down one", func() (int, error) { return m.Down(1) }, 1, 1, true, false},
+		{"up to 2", func() (int, error) { return m.To(2) }, 1, 2, true, true},
+		{"down all", func() (int, error) { return m.Down(5) }, 2, 0, false, false},
+		{"up to 1", func() (int, error) { return m.To(1) }, 1, 1, true, false},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			run, err := step.run()
+			if err != nil || run != step.wantRun {
+				t.Fatalf("run = %d, %v, want %d", run, err, step.wantRun)
+			}
+			if version, err := m.Version(); err != nil || version != step.wantVersion {
+				t.Errorf("Version() = %d, %v, want %d", version, err, step.wantVersion)
+			}
+			if a, b := tableExists(t, db, "a"), tableExists(t, db, "b"); a != step.wantA || b != step.wantB {
+				t.Errorf("Tables a, b exist = %v, %v, want %v, %v", a, b, step.wantA, step.wantB)
+			}
+		})
+	}
+}
+
+// TestMigratorFailure tests that a failing migration leaves no trace
+func TestMigratorFailure(t *testing.T) {
+	db := newTestSQL(t)
+	files := fstest.MapFS{
+		"0001_create_a.up.sql": testMigrations["0001_create_a.up.sql"],
+		"0002_broken.up.sql":   {Data: []byte("CREATE TABLE c (id INTEGER); CREATE TABL oops;")},
+	}
+	m, err := NewMigrator(db, files)
+	if err != nil {
+		t.Fatalf("NewMigrator() unexpected error: %v", err)
+	}
+
+	if run, err := m.Up(); !errors.Is(err, ErrMigration) || run != 1 {
+		t.Fatalf("Up() = %d, %v, want 1 and %v", run, err, ErrMigration)
+	}
+	if version, _ := m.Version(); version != 1 {
+		t.Errorf("Version() = %d, want 1", version)
+	}
+	if tableExists(t, db, "c") {
+		t.Error("Expected the failed migration to be rolled back")
+	}
+	if _, err := m.Down(1); !errors.Is(err, ErrMigration) {
+		t.Errorf("Down() without a down file error = %v, want %v", err, ErrMigration)
+	}
+}
+
+// TestLoadMigrations tests rejecting inconsistent migration files
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{"down without up", fstest.MapFS{"0001_a.down.sql": {Data: []byte("DROP TABLE a;")}}},
+		{"two names", fstest.MapFS{
+			"0001_a.up.sql":   {Data: []byte("CREATE TABLE a (id INTEGER);")},
+			"0001_b.down.sql": {Data: []byte("DROP TABLE a;")},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadMigrations(tt.files); !errors.Is(err, ErrMigrationFiles) {
+				t.Errorf("LoadMigrations() error = %v, want %v", err, ErrMigrationFiles)
+			}
+		})
+	}
+}
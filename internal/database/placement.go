@@ -0,0 +1,86 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// Common errors for shard placement
+var (
+	ErrNoShards         = errors.New("no shards available for placement")
+	ErrShardExists      = errors.New("shard is already active")
+	ErrShardInactive    = errors.New("shard is not active")
+	ErrUnknownPlacement = errors.New("unknown placement strategy")
+)
+
+// Placement strategies selectable in a Layout
+const (
+	// PlacementRing places keys on a consistent-hash ring
+	PlacementRing = "ring"
+	// PlacementRange places keys by contiguous ranges of their hash
+	PlacementRange = "range"
+)
+
+// Placement chooses the shard of a key written for the first time.
+// Placements shared between goroutines must be safe for concurrent use.
+type Placement interface {
+	Place(key string) (int64, error)
+}
+
+// ShardedPlacement is a Placement over a set of shards that can grow and
+// shrink. Implementations need not be safe for concurrent use; a Registry
+// serializes access to them.
+type ShardedPlacement interface {
+	Placement
+	// AddShard starts placing keys on shard
+	AddShard(shard int64) error
+	// RemoveShard stops placing keys on shard
+	RemoveShard(shard int64) error
+	// Shards returns the active shards in ascending order
+	Shards() []int64
+}
+
+// NewPlacement returns the placement strategy named strategy over shards 0
+// to shards-1
+func NewPlacement(strategy string, shards int64) (ShardedPlacement, error) {
+	ids := make([]int64, 0, shards)
+	for i := int64(0); i < shards; i++ {
+		ids = append(ids, i)
+	}
+	return newPlacement(strategy, ids)
+}
+
+// newPlacement returns the placement strategy named strategy over ids
+func newPlacement(strategy string, ids []int64) (ShardedPlacement, error) {
+	switch strategy {
+	case PlacementRing:
+		return NewRing(DefaultReplicas, ids...), nil
+	case PlacementRange:
+		return NewRangePlacement(ids...), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPlacement, strategy)
+	}
+}
+
+// hashKey hashes key to a point of the 64-bit hash space. FNV-1a is mixed
+// with the SplitMix64 finalizer so that similar keys land far apart.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// PlacementFunc adapts a function to the Placement interface
+type PlacementFunc func(key string) (int64, error)
+
+// Place calls f(key)
+func (f PlacementFunc) Place(key string) (int64, error) {
+	return f(key)
+}
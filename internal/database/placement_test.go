@@ -0,0 +1,249 @@
+// Package database provides tests for shard placement.
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestShardName tests that shard 0 is the default shard
+func TestShardName(t *testing.T) {
+	l := DefaultLayout()
+	l.DefaultShard = "Primary"
+	if got := l.ShardName(0); got != "Primary" {
+		t.Errorf("ShardName(0) = %q, want Primary", got)
+	}
+	if got := l.ShardName(3); got != "Shard_3.sqlite" {
+		t.Errorf("ShardName(3) = %q, want Shard_3.sqlite", got)
+	}
+}
+
+// placeAll places n keys and returns the shard of each
+func placeAll(t *testing.T, p Placement, n int) map[string]int64 {
+	t.Helper()
+	placed := make(map[string]int64, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("user_%d", i)
+		shard, err := p.Place(key)
+		if err != nil {
+			t.Fatalf("Place(%q) unexpected error: %v", key, err)
+		}
+		placed[key] = shard
+	}
+	return placed
+}
+
+// counts returns the number of keys placed on each shard
+func counts(placed map[string]int64) map[int64]int {
+	c := make(map[int64]int)
+	for _, shard := range placed {
+		c[shard]++
+	}
+	return c
+}
+
+// TestRingDistribution tests that the ring spreads keys evenly over its shards
+func TestRingDistribution(t *testing.T) {
+	const keys = 20000
+	ring := NewRing(DefaultReplicas, 0, 1, 2, 3, 4)
+
+	mean := keys / 5
+	for shard, n := range counts(placeAll(t, ring, keys)) {
+		if n < mean*7/10 || n > mean*13/10 {
+			t.Errorf("Shard %d received %d keys, want within 30%% of %d", shard, n, mean)
+		}
+	}
+}
+
+// TestRingMovement tests that adding or removing a shard only moves the keys it gains or loses
+func TestRingMovement(t *testing.T) {
+	const keys = 20000
+	ring := NewRing(DefaultReplicas, 0, 1, 2, 3)
+	before := placeAll(t, ring, keys)
+
+	if err := ring.AddShard(4); err != nil {
+		t.Fatalf("AddShard() unexpected error: %v", err)
+	}
+	after := placeAll(t, ring, keys)
+
+	moved := 0
+	for key, shard := range after {
+		if shard == before[key] {
+			continue
+		}
+		moved++
+		if shard != 4 {
+			t.Fatalf("Key %s moved from shard %d to %d, want only moves to the new shard", key, before[key], shard)
+		}
+	}
+	// Ideally 1/5 of the keys move
+	if moved < keys/10 || moved > keys*3/10 {
+		t.Errorf("Adding a shard moved %d of %d keys, want about %d", moved, keys, keys/5)
+	}
+
+	if err := ring.RemoveShard(4); err != nil {
+		t.Fatalf("RemoveShard() unexpected error: %v", err)
+	}
+	for key, shard := range placeAll(t, ring, keys) {
+		if shard != before[key] {
+			t.Fatalf("Key %s is on shard %d after removing the new shard, want %d", key, shard, before[key])
+		}
+	}
+}
+
+// TestRangePlacement tests that adding a shard splits one range and removing it merges the range back
+func TestRangePlacement(t *testing.T) {
+	const keys = 20000
+	p := NewRangePlacement(0, 1, 2, 3)
+
+	before := placeAll(t, p, keys)
+	mean := keys / 4
+	for shard, n := range counts(before) {
+		if n < mean*8/10 || n > mean*12/10 {
+			t.Errorf("Shard %d received %d keys, want within 20%% of %d", shard, n, mean)
+		}
+	}
+
+	if err := p.AddShard(4); err != nil {
+		t.Fatalf("AddShard() unexpected error: %v", err)
+	}
+	after := placeAll(t, p, keys)
+
+	moved, donors := 0, make(map[int64]bool)
+	for key, shard := range after {
+		if shard == before[key] {
+			continue
+		}
+		moved++
+		donors[before[key]] = true
+		if shard != 4 {
+			t.Fatalf("Key %s moved from shard %d to %d, want only moves to the new shard", key, before[key], shard)
+		}
+	}
+	// Half of one range of a quarter of the hash space moves
+	if len(donors) != 1 || moved < keys/10 || moved > keys*3/20 {
+		t.Errorf("Adding a shard moved %d keys from shards %v, want about %d from one shard", moved, donors, keys/8)
+	}
+
+	if err := p.RemoveShard(4); err != nil {
+		t.Fatalf("RemoveShard() unexpected error: %v", err)
+	}
+	for key, shard := range placeAll(t, p, keys) {
+		if shard != before[key] {
+			t.Fatalf("Key %s is on shard %d after removing the new shard, want %d", key, shard, before[key])
+		}
+	}
+
+	// Removing the first shard hands its range to the next one
+	if err := p.RemoveShard(0); err != nil {
+		t.Fatalf("RemoveShard() unexpected error: %v", err)
+	}
+	if got := p.Shards(); fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("Shards() = %v, want [1 2 3]", got)
+	}
+	for key, shard := range placeAll(t, p, keys) {
+		if before[key] == 0 && shard != 1 {
+			t.Fatalf("Key %s moved to shard %d, want 1", key, shard)
+		}
+	}
+}
+
+// TestShardedPlacementErrors tests the errors shared by the sharded placements
+func TestShardedPlacementErrors(t *testing.T) {
+	placements := map[string]ShardedPlacement{
+		"ring":  NewRing(0, 0, 1),
+		"range": NewRangePlacement(0, 1),
+	}
+
+	for name, p := range placements {
+		t.Run(name, func(t *testing.T) {
+			if err := p.AddShard(1); !errors.Is(err, ErrShardExists) {
+				t.Errorf("AddShard() of an active shard error = %v, want %v", err, ErrShardExists)
+			}
+			if err := p.AddShard(-1); !errors.Is(err, ErrShardInactive) {
+				t.Errorf("AddShard(-1) error = %v, want %v", err, ErrShardInactive)
+			}
+			if err := p.RemoveShard(7); !errors.Is(err, ErrShardInactive) {
+				t.Errorf("RemoveShard() of an unknown shard error = %v, want %v", err, ErrShardInactive)
+			}
+
+			for _, shard := range []int64{0, 1} {
+				if err := p.RemoveShard(shard); err != nil {
+					t.Fatalf("RemoveShard(%d) unexpected error: %v", shard, err)
+				}
+			}
+			if _, err := p.Place("key"); !errors.Is(err, ErrNoShards) {
+				t.Errorf("Place() with no shards error = %v, want %v", err, ErrNoShards)
+			}
+
+			if err := p.AddShard(5); err != nil {
+				t.Fatalf("AddShard() unexpected error: %v", err)
+			}
+			if shard, err := p.Place("key"); err != nil || shard != 5 {
+				t.Errorf("Place() = %d, %v, want 5", shard, err)
+			}
+		})
+	}
+}
+
+// TestRegistry tests the active shard set and placement through a registry
+func TestRegistry(t *testing.T) {
+	layout := Layout{BaseDir: t.TempDir(), Shards: 3, Placement: PlacementRing}
+	r := NewStore(layout).Registry()
+	if got := r.Active(); fmt.Sprint(got) != "[0 1 2]" {
+		t.Errorf("Active() = %v, want [0 1 2]", got)
+	}
+
+	if err := r.Add(3); err != nil {
+		t.Fatalf("Add() unexpected error: %v", err)
+	}
+	if err := r.Remove(0); err != nil {
+		t.Fatalf("Remove() unexpected error: %v", err)
+	}
+	if !r.IsActive(3) || r.IsActive(0) {
+		t.Errorf("Active() = %v, want shard 3 active and shard 0 inactive", r.Active())
+	}
+	for key, shard := range placeAll(t, r, 1000) {
+		if shard == 0 {
+			t.Fatalf("Key %s placed on the removed shard", key)
+		}
+	}
+	if err := r.Add(3); !errors.Is(err, ErrShardExists) {
+		t.Errorf("Add() of an active shard error = %v, want %v", err, ErrShardExists)
+	}
+
+	if err := r.Remove(0); !errors.Is(err, ErrShardInactive) {
+		t.Errorf("Remove() of an inactive shard error = %v, want %v", err, ErrShardInactive)
+	}
+
+	// The active shards outlive the store
+	reopened := NewStore(layout).Registry()
+	if got := reopened.Active(); fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("Active() after reopening = %v, want [1 2 3]", got)
+	}
+	if err := reopened.Remove(1); err != nil {
+		t.Fatalf("Remove() unexpected error: %v", err)
+	}
+	if err := reopened.Remove(2); err != nil {
+		t.Fatalf("Remove() unexpected error: %v", err)
+	}
+	if err := reopened.Remove(3); !errors.Is(err, ErrNoShards) {
+		t.Errorf("Remove() of the last shard error = %v, want %v", err, ErrNoShards)
+	}
+
+	broken := NewStore(Layout{Shards: 3, Placement: "modulo"}).Registry()
+	if _, err := broken.Place("key"); !errors.Is(err, ErrUnknownPlacement) {
+		t.Errorf("Place() error = %v, want %v", err, ErrUnknownPlacement)
+	}
+
+	if err := os.WriteFile(filepath.Join(layout.BaseDir, RegistryFile), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	damaged := NewStore(layout).Registry()
+	if _, err := damaged.Place("key"); !errors.Is(err, ErrShardRegistry) {
+		t.Errorf("Place() with a damaged registry file error = %v, want %v", err, ErrShardRegistry)
+	}
+}
@@ -0,0 +1,135 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// RangePlacement splits the 64-bit hash space into contiguous ranges and
+// places a key on the shard owning the range of its hash. Adding a shard
+// splits the widest range in two, so only the keys of one half range move.
+// Unlike Ring, repeated additions leave ranges of unequal width.
+type RangePlacement struct {
+	// ranges are ordered by start; the first starts at 0 and each ends
+	// where the next starts
+	ranges []hashRange
+}
+
+// hashRange is the part of the hash space from start up to the next range
+type hashRange struct {
+	start uint64
+	shard int64
+}
+
+// NewRangePlacement creates a placement splitting the hash space evenly
+// between shards
+func NewRangePlacement(shards ...int64) *RangePlacement {
+	p := &RangePlacement{}
+	seen := make(map[int64]bool)
+	for _, shard := range shards {
+		if shard >= 0 && !seen[shard] {
+			seen[shard] = true
+		}
+	}
+	ids := sortedShards(seen)
+	if len(ids) == 0 {
+		return p
+	}
+
+	step := math.MaxUint64 / uint64(len(ids))
+	for i, shard := range ids {
+		p.ranges = append(p.ranges, hashRange{start: uint64(i) * step, shard: shard})
+	}
+	return p
+}
+
+// Place returns the shard of key
+func (p *RangePlacement) Place(key string) (int64, error) {
+	if len(p.ranges) == 0 {
+		return -1, ErrNoShards
+	}
+	h := hashKey(key)
+	i := sort.Search(len(p.ranges), func(i int) bool { return p.ranges[i].start > h })
+	return p.ranges[i-1].shard, nil
+}
+
+// AddShard gives shard the upper half of the widest range
+func (p *RangePlacement) AddShard(shard int64) error {
+	if shard < 0 {
+		return fmt.Errorf("%w: shard %d", ErrShardInactive, shard)
+	}
+	for _, r := range p.ranges {
+		if r.shard == shard {
+			return fmt.Errorf("%w: shard %d", ErrShardExists, shard)
+		}
+	}
+	if len(p.ranges) == 0 {
+		p.ranges = []hashRange{{start: 0, shard: shard}}
+		return nil
+	}
+
+	widest, span := 0, uint64(0)
+	for i := range p.ranges {
+		if s := p.span(i); s > span {
+			widest, span = i, s
+		}
+	}
+	split := hashRange{start: p.ranges[widest].start + span/2 + 1, shard: shard}
+	p.ranges = append(p.ranges[:widest+1], append([]hashRange{split}, p.ranges[widest+1:]...)...)
+	return nil
+}
+
+// RemoveShard hands the ranges of shard to the preceding range, or to the
+// following one for the first range
+func (p *RangePlacement) RemoveShard(shard int64) error {
+	found, fallback := false, int64(-1)
+	for _, r := range p.ranges {
+		if r.shard == shard {
+			found = true
+		} else if fallback < 0 {
+			fallback = r.shard
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: shard %d", ErrShardInactive, shard)
+	}
+	if fallback < 0 {
+		p.ranges = nil
+		return nil
+	}
+
+	// Reassign the ranges, merging neighbours that end up on the same shard
+	merged := p.ranges[:0]
+	previous := fallback
+	for _, r := range p.ranges {
+		if r.shard == shard {
+			r.shard = previous
+		}
+		if len(merged) > 0 && merged[len(merged)-1].shard == r.shard {
+			continue
+		}
+		merged = append(merged, r)
+		previous = r.shard
+	}
+	p.ranges = merged
+	return nil
+}
+
+// Shards returns the shards owning a range in ascending order
+func (p *RangePlacement) Shards() []int64 {
+	set := make(map[int64]bool)
+	for _, r := range p.ranges {
+		set[r.shard] = true
+	}
+	return sortedShards(set)
+}
+
+// span returns the width of range i minus one, so the full hash space fits
+func (p *RangePlacement) span(i int) uint64 {
+	end := uint64(math.MaxUint64)
+	if i+1 < len(p.ranges) {
+		end = p.ranges[i+1].start - 1
+	}
+	return end - p.ranges[i].start
+}
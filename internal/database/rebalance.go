@@ -0,0 +1,451 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// JournalFile is the name of the rebalance journal in the base directory
+const JournalFile = "rebalance.journal"
+
+// Common errors for rebalancing
+var (
+	ErrRebalanceRunning  = errors.New("a rebalance is already running")
+	ErrRebalancePending  = errors.New("an interrupted rebalance between other shards must be resumed first")
+	ErrInvalidRebalance  = errors.New("invalid rebalance")
+	ErrRebalanceJournal  = errors.New("failed to access the rebalance journal")
+	ErrRebalanceCanceled = errors.New("rebalance canceled")
+	ErrRecordMove        = errors.New("failed to move record")
+)
+
+// RebalanceOptions selects the keys to move and how fast
+type RebalanceOptions struct {
+	// From is the shard the keys are moved off
+	From int64 `json:"from"`
+	// To is the shard the keys are moved to
+	To int64 `json:"to"`
+	// Rate limits the moves to this many keys per second, 0 means no limit
+	Rate float64 `json:"rate"`
+	// Limit stops after this many keys, 0 moves every key of From
+	Limit int `json:"limit"`
+	// Retire removes From from the active shards of the store registry
+	// before moving its keys, so no new key is placed on it
+	Retire bool `json:"retire"`
+}
+
+// RebalanceProgress reports the state of the current or last rebalance
+type RebalanceProgress struct {
+	RebalanceOptions
+	// Running is true while keys are being moved
+	Running bool `json:"running"`
+	// Moved counts the keys moved so far
+	Moved int `json:"moved"`
+	// Remaining counts the keys of From not moved yet
+	Remaining int `json:"remaining"`
+	// Error is the reason the last rebalance stopped early
+	Error string `json:"error,omitempty"`
+}
+
+// journal is the on-disk record of an unfinished rebalance
+type journal struct {
+	From  int64 `json:"from"`
+	To    int64 `json:"to"`
+	Moved int   `json:"moved"`
+	// Key is the key being moved, empty between keys
+	Key string `json:"key,omitempty"`
+}
+
+// DependentKeys names records that are stored in the shard of an owner
+// record and always move together with it, such as secondary index entries.
+type DependentKeys struct {
+	// Prefixes match the dependent keys, which are never moved on their own
+	Prefixes []string
+	// Of returns the dependent keys of the owner record with key and value
+	Of func(key string, value []byte) []string
+}
+
+// dependent reports whether key matches one of the prefixes of d
+func (d DependentKeys) dependent(key string) bool {
+	for _, prefix := range d.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rebalancer moves keys, with their records, from one shard to another.
+// Each key is copied to the target shard, its fragmentation entry is then
+// flipped to the target and finally the source copy is deleted, so readers
+// always find the record. Dependent records set with SetDependents are
+// copied and deleted in the same batches as their owner. The key being
+// moved is recorded in a journal first, and an interrupted rebalance is
+// completed by running it again.
+// Moves are locked against writers going through Store.LockKey, so a
+// rebalance can run while the server handles requests.
+type Rebalancer struct {
+	store      *Store
+	schema     *Schema
+	dependents DependentKeys
+
+	mu       sync.Mutex
+	progress RebalanceProgress
+	done     chan struct{}
+}
+
+// NewRebalancer creates a rebalancer over the shards of store
+func NewRebalancer(store *Store) *Rebalancer {
+	done := make(chan struct{})
+	close(done)
+	return &Rebalancer{store: store, schema: NewSchema(store), done: done}
+}
+
+// SetDependents makes the rebalancer move the records named by d together
+// with their owner. Call it before the first rebalance.
+func (r *Rebalancer) SetDependents(d DependentKeys) {
+	r.dependents = d
+}
+
+// Progress returns the state of the current or last rebalance
+func (r *Rebalancer) Progress() RebalanceProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.progress
+}
+
+// Run moves the keys selected by opts and returns once they are moved, the
+// limit is reached or ctx is done
+func (r *Rebalancer) Run(ctx context.Context, opts RebalanceOptions) (RebalanceProgress, error) {
+	j, err := r.begin(opts)
+	if err != nil {
+		return r.Progress(), err
+	}
+	err = r.run(ctx, opts, j)
+	return r.Progress(), err
+}
+
+// Start moves the keys selected by opts in the background. Errors in the
+// options or the journal are returned at once; later errors are reported
+// by Progress.
+func (r *Rebalancer) Start(ctx context.Context, opts RebalanceOptions) error {
+	j, err := r.begin(opts)
+	if err != nil {
+		return err
+	}
+	go r.run(ctx, opts, j)
+	return nil
+}
+
+// Wait blocks until the running rebalance, if any, has stopped
+func (r *Rebalancer) Wait() {
+	r.mu.Lock()
+	done := r.done
+	r.mu.Unlock()
+	<-done
+}
+
+// begin checks opts against the journal and marks the rebalancer running
+func (r *Rebalancer) begin(opts RebalanceOptions) (*journal, error) {
+	if opts.From < 0 || opts.To < 0 || opts.From == opts.To {
+		return nil, fmt.Errorf("%w: cannot move keys from shard %d to shard %d", ErrInvalidRebalance, opts.From, opts.To)
+	}
+	if opts.Rate < 0 || opts.Limit < 0 {
+		return nil, fmt.Errorf("%w: rate and limit must not be negative", ErrInvalidRebalance)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.progress.Running {
+		return nil, ErrRebalanceRunning
+	}
+
+	j, err := r.readJournal()
+	if err != nil {
+		return nil, err
+	}
+	if j == nil {
+		j = &journal{From: opts.From, To: opts.To}
+	} else if j.From != opts.From || j.To != opts.To {
+		return nil, fmt.Errorf("%w: shard %d to shard %d", ErrRebalancePending, j.From, j.To)
+	}
+	if opts.Retire {
+		// A resumed rebalance may have retired the shard already
+		err := r.store.Registry().Remove(opts.From)
+		if errors.Is(err, ErrNoShards) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRebalance, err)
+		}
+		if err != nil && !errors.Is(err, ErrShardInactive) {
+			return nil, err
+		}
+	}
+
+	r.progress = RebalanceProgress{RebalanceOptions: opts, Running: true, Moved: j.Moved}
+	r.done = make(chan struct{})
+	return j, nil
+}
+
+// run moves the keys and records the outcome in the progress
+func (r *Rebalancer) run(ctx context.Context, opts RebalanceOptions, j *journal) (err error) {
+	defer func() {
+		r.mu.Lock()
+		r.progress.Running = false
+		if err != nil {
+			r.progress.Error = err.Error()
+		}
+		close(r.done)
+		r.mu.Unlock()
+	}()
+
+	// Finish the key an earlier run was moving when it stopped
+	if j.Key != "" {
+		log.Printf("Rebalance: resuming the move of %s", j.Key)
+		if err := r.move(j, j.Key); err != nil {
+			return err
+		}
+	}
+
+	keys, err := r.schema.KeysOnShard(opts.From)
+	if err != nil {
+		return err
+	}
+	// Dependent keys move with their owner
+	keys = slices.DeleteFunc(keys, r.dependents.dependent)
+	r.setProgress(j.Moved, len(keys))
+
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	moved := 0
+	for i, key := range keys {
+		if opts.Limit > 0 && moved >= opts.Limit {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ErrRebalanceCanceled, ctx.Err())
+		default:
+		}
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%w: %v", ErrRebalanceCanceled, ctx.Err())
+			case <-tick:
+			}
+		}
+
+		if err := r.move(j, key); err != nil {
+			return err
+		}
+		moved++
+		r.setProgress(j.Moved, len(keys)-i-1)
+	}
+
+	if opts.Limit > 0 && moved < len(keys) {
+		// Keep the count for the next run
+		return r.writeJournal(j)
+	}
+	log.Printf("Rebalance: moved %d keys from shard %d to shard %d", j.Moved, j.From, j.To)
+	return r.removeJournal()
+}
+
+// setProgress records the number of moved and remaining keys
+func (r *Rebalancer) setProgress(moved, remaining int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress.Moved = moved
+	r.progress.Remaining = remaining
+}
+
+// move moves key from the source to the target shard of j. It is safe to
+// repeat after a crash at any point.
+func (r *Rebalancer) move(j *journal, key string) error {
+	unlock := r.store.LockKey(key)
+	defer unlock()
+
+	j.Key = key
+	if err := r.writeJournal(j); err != nil {
+		return err
+	}
+
+	src, err := r.store.ShardNumber(j.From)
+	if err != nil {
+		return err
+	}
+	dst, err := r.store.ShardNumber(j.To)
+	if err != nil {
+		return err
+	}
+
+	shard, ok, err := r.schema.Lookup(key)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !ok:
+		// The record was deleted since the key was listed
+	case shard == j.From:
+		// Copy the record and its dependents, then flip the entry so
+		// readers switch to the copy
+		value, err := src.Get([]byte(key), nil)
+		if err == nil {
+			batch := new(leveldb.Batch)
+			batch.Put([]byte(key), value)
+			deps, err := r.dependentsOf(key, value, j.From)
+			if err != nil {
+				return err
+			}
+			for _, dep := range deps {
+				depValue, err := src.Get([]byte(dep), nil)
+				if errors.Is(err, leveldb.ErrNotFound) {
+					continue
+				} else if err != nil {
+					return fmt.Errorf("%w: %s: %v", ErrRecordMove, dep, err)
+				}
+				batch.Put([]byte(dep), depValue)
+			}
+			if err := dst.Write(batch, nil); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrRecordMove, key, err)
+			}
+		} else if !errors.Is(err, leveldb.ErrNotFound) {
+			return fmt.Errorf("%w: %s: %v", ErrRecordMove, key, err)
+		}
+		swapped, err := r.schema.CompareAndSwap(key, j.From, j.To)
+		if err != nil {
+			return err
+		}
+		if !swapped {
+			// Another writer moved the key; leave both copies to it
+			break
+		}
+		fallthrough
+	case shard == j.To:
+		// The entry already points to the target; flip the entries of the
+		// dependents and drop the stale source copies
+		batch := new(leveldb.Batch)
+		batch.Delete([]byte(key))
+		value, err := src.Get([]byte(key), nil)
+		if err == nil {
+			deps, err := r.dependentsOf(key, value, j.From, j.To)
+			if err != nil {
+				return err
+			}
+			for _, dep := range deps {
+				if _, err := r.schema.CompareAndSwap(dep, j.From, j.To); err != nil {
+					return err
+				}
+				batch.Delete([]byte(dep))
+			}
+		} else if !errors.Is(err, leveldb.ErrNotFound) {
+			return fmt.Errorf("%w: %s: %v", ErrRecordMove, key, err)
+		}
+		if err := src.Write(batch, nil); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrRecordMove, key, err)
+		}
+		j.Moved++
+	}
+
+	j.Key = ""
+	return nil
+}
+
+// dependentsOf returns the dependent keys of the record with key and value
+// whose entries are on one of shards
+func (r *Rebalancer) dependentsOf(key string, value []byte, shards ...int64) ([]string, error) {
+	if r.dependents.Of == nil {
+		return nil, nil
+	}
+	var deps []string
+	for _, dep := range r.dependents.Of(key, value) {
+		shard, ok, err := r.schema.Lookup(dep)
+		if err != nil {
+			return nil, err
+		}
+		if ok && slices.Contains(shards, shard) {
+			deps = append(deps, dep)
+		}
+	}
+	return deps, nil
+}
+
+// journalPath returns the path of the journal in the base directory
+func (r *Rebalancer) journalPath() string {
+	return filepath.Join(r.store.Layout().BaseDir, JournalFile)
+}
+
+// readJournal returns the journal of an unfinished rebalance, or nil
+func (r *Rebalancer) readJournal() (*journal, error) {
+	data, err := os.ReadFile(r.journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRebalanceJournal, err)
+	}
+	var j journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRebalanceJournal, err)
+	}
+	return &j, nil
+}
+
+// writeJournal replaces the journal with j
+func (r *Rebalancer) writeJournal(j *journal) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRebalanceJournal, err)
+	}
+
+	if err := writeFileAtomic(r.journalPath(), data); err != nil {
+		return fmt.Errorf("%w: %v", ErrRebalanceJournal, err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data. The data is written to
+// a temporary file and renamed so a crash never leaves the file half written.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// removeJournal deletes the journal of a finished rebalance
+func (r *Rebalancer) removeJournal() error {
+	if err := os.Remove(r.journalPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %v", ErrRebalanceJournal, err)
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+// Package database provides tests for moving keys between shards.
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// putOnShard writes key to shard and records the assignment
+func putOnShard(t *testing.T, store *Store, shard int64, key, value string) {
+	t.Helper()
+	db, err := store.ShardNumber(shard)
+	if err != nil {
+		t.Fatalf("ShardNumber() unexpected error: %v", err)
+	}
+	if err := db.Put([]byte(key), []byte(value), nil); err != nil {
+		t.Fatalf("Put() unexpected error: %v", err)
+	}
+	if err := NewSchema(store).Add(shard, key); err != nil {
+		t.Fatalf("Add() unexpected error: %v", err)
+	}
+}
+
+// readRouted reads key from the shard the schema assigns it to
+func readRouted(t *testing.T, store *Store, key string) (int64, string) {
+	t.Helper()
+	shard, err := NewSchema(store).Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q) unexpected error: %v", key, err)
+	}
+	db, err := store.ShardNumber(shard)
+	if err != nil {
+		t.Fatalf("ShardNumber() unexpected error: %v", err)
+	}
+	value, err := db.Get([]byte(key), nil)
+	if err != nil {
+		t.Fatalf("Expected %s on shard %d: %v", key, shard, err)
+	}
+	return shard, string(value)
+}
+
+// assertAbsent fails if key is still stored on shard
+func assertAbsent(t *testing.T, store *Store, shard int64, key string) {
+	t.Helper()
+	db, err := store.ShardNumber(shard)
+	if err != nil {
+		t.Fatalf("ShardNumber() unexpected error: %v", err)
+	}
+	if _, err := db.Get([]byte(key), nil); !errors.Is(err, leveldb.ErrNotFound) {
+		t.Errorf("Expected %s to be deleted from shard %d, got %v", key, shard, err)
+	}
+}
+
+// TestRebalance tests that records move with their fragmentation entries
+func TestRebalance(t *testing.T) {
+	store := newTestStore(t)
+	for i := 0; i < 5; i++ {
+		putOnShard(t, store, 0, fmt.Sprintf("user_%d", i), fmt.Sprintf("value_%d", i))
+	}
+	putOnShard(t, store, 2, "user_other", "other")
+
+	progress, err := NewRebalancer(store).Run(context.Background(), RebalanceOptions{From: 0, To: 3})
+	if err != nil {
+		t.Fatalf("Run() unexpected error: %v", err)
+	}
+	if progress.Moved != 5 || progress.Remaining != 0 || progress.Running {
+		t.Errorf("Unexpected progress: %+v", progress)
+	}
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("user_%d", i)
+		shard, value := readRouted(t, store, key)
+		if shard != 3 || value != fmt.Sprintf("value_%d", i) {
+			t.Errorf("Expected %s on shard 3, got %q on shard %d", key, value, shard)
+		}
+		assertAbsent(t, store, 0, key)
+	}
+	if shard, _ := readRouted(t, store, "user_other"); shard != 2 {
+		t.Errorf("Expected keys of other shards to stay, got shard %d", shard)
+	}
+	if _, err := os.Stat(filepath.Join(store.Layout().BaseDir, JournalFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected the journal to be removed after a complete rebalance, got %v", err)
+	}
+}
+
+// TestRebalanceResume tests completing moves interrupted at each step
+func TestRebalanceResume(t *testing.T) {
+	tests := []struct {
+		name string
+		// crash leaves the key in the state of an interrupted move
+		crash func(t *testing.T, store *Store)
+	}{
+		{"before copy", func(t *testing.T, store *Store) {}},
+		{"after copy", func(t *testing.T, store *Store) {
+			putOnShard(t, store, 1, "user_crash", "value")
+			NewSchema(store).Update("user_crash", 0)
+		}},
+		{"after flip", func(t *testing.T, store *Store) {
+			putOnShard(t, store, 1, "user_crash", "value")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			putOnShard(t, store, 0, "user_crash", "value")
+			putOnShard(t, store, 0, "user_next", "next")
+			tt.crash(t, store)
+
+			r := NewRebalancer(store)
+			if err := r.writeJournal(&journal{From: 0, To: 1, Key: "user_crash"}); err != nil {
+				t.Fatalf("writeJournal() unexpected error: %v", err)
+			}
+
+			progress, err := r.Run(context.Background(), RebalanceOptions{From: 0, To: 1})
+			if err != nil {
+				t.Fatalf("Run() unexpected error: %v", err)
+			}
+			if progress.Moved != 2 {
+				t.Errorf("Moved = %d, want 2", progress.Moved)
+			}
+			for _, key := range []string{"user_crash", "user_next"} {
+				if shard, _ := readRouted(t, store, key); shard != 1 {
+					t.Errorf("Expected %s on shard 1, got %d", key, shard)
+				}
+				assertAbsent(t, store, 0, key)
+			}
+		})
+	}
+}
+
+// TestRebalanceDependents tests that dependent records move with their owner
+func TestRebalanceDependents(t *testing.T) {
+	// The value of an owner lists its dependents
+	deps := DependentKeys{
+		Prefixes: []string{"idx_"},
+		Of: func(key string, value []byte) []string {
+			return []string{"idx_" + string(value)}
+		},
+	}
+
+	tests := []struct {
+		name string
+		// crash leaves the owner in the state of an interrupted move
+		crash func(t *testing.T, store *Store)
+	}{
+		{"complete", func(t *testing.T, store *Store) {}},
+		{"after flip", func(t *testing.T, store *Store) {
+			putOnShard(t, store, 1, "user_a", "a")
+			putOnShard(t, store, 1, "idx_a", "")
+			NewSchema(store).Update("idx_a", 0)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			putOnShard(t, store, 0, "user_a", "a")
+			putOnShard(t, store, 0, "idx_a", "")
+			// Dependents on another shard than their owner stay there
+			putOnShard(t, store, 2, "user_b", "b")
+			putOnShard(t, store, 0, "idx_b", "")
+			tt.crash(t, store)
+
+			r := NewRebalancer(store)
+			r.SetDependents(deps)
+			if err := r.writeJournal(&journal{From: 0, To: 1, Key: "user_a"}); err != nil {
+				t.Fatalf("writeJournal() unexpected error: %v", err)
+			}
+			progress, err := r.Run(context.Background(), RebalanceOptions{From: 0, To: 1})
+			if err != nil {
+				t.Fatalf("Run() unexpected error: %v", err)
+			}
+			if progress.Moved != 1 {
+				t.Errorf("Moved = %d, want only the owner", progress.Moved)
+			}
+
+			for _, key := range []string{"user_a", "idx_a"} {
+				if shard, _ := readRouted(t, store, key); shard != 1 {
+					t.Errorf("Expected %s on shard 1, got %d", key, shard)
+				}
+				assertAbsent(t, store, 0, key)
+			}
+			if shard, _ := readRouted(t, store, "idx_b"); shard != 0 {
+				t.Errorf("Expected idx_b to stay on shard 0, got %d", shard)
+			}
+		})
+	}
+}
+
+// TestRebalanceLimit tests that a limited rebalance is continued by the next run
+func TestRebalanceLimit(t *testing.T) {
+	store := newTestStore(t)
+	for i := 0; i < 5; i++ {
+		putOnShard(t, store, 0, fmt.Sprintf("user_%d", i), "value")
+	}
+	r := NewRebalancer(store)
+
+	progress, err := r.Run(context.Background(), RebalanceOptions{From: 0, To: 1, Limit: 2})
+	if err != nil {
+		t.Fatalf("Run() unexpected error: %v", err)
+	}
+	if progress.Moved != 2 || progress.Remaining != 3 {
+		t.Errorf("Unexpected progress after the limit: %+v", progress)
+	}
+
+	if _, err := r.Run(context.Background(), RebalanceOptions{From: 0, To: 2}); !errors.Is(err, ErrRebalancePending) {
+		t.Errorf("Run() of another rebalance error = %v, want %v", err, ErrRebalancePending)
+	}
+
+	progress, err = r.Run(context.Background(), RebalanceOptions{From: 0, To: 1})
+	if err != nil {
+		t.Fatalf("Run() unexpected error: %v", err)
+	}
+	if progress.Moved != 5 || progress.Remaining != 0 {
+		t.Errorf("Unexpected progress after resuming: %+v", progress)
+	}
+}
+
+// TestRebalanceRetire tests that a retiring rebalance stops placing keys on
+// its source shard, also when it is resumed
+func TestRebalanceRetire(t *testing.T) {
+	store := newTestStore(t)
+	for i := 0; i < 5; i++ {
+		putOnShard(t, store, 1, fmt.Sprintf("user_%d", i), "value")
+	}
+	r := NewRebalancer(store)
+
+	opts := RebalanceOptions{From: 1, To: 2, Limit: 2, Retire: true}
+	if _, err := r.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run() unexpected error: %v", err)
+	}
+	if store.Registry().IsActive(1) {
+		t.Errorf("Active() = %v, want shard 1 retired", store.Registry().Active())
+	}
+
+	opts.Limit = 0
+	progress, err := r.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run() of the resumed rebalance unexpected error: %v", err)
+	}
+	if progress.Moved != 5 || progress.Remaining != 0 {
+		t.Errorf("Unexpected progress after resuming: %+v", progress)
+	}
+	for i := 0; i < 5; i++ {
+		if shard, _ := readRouted(t, store, fmt.Sprintf("user_%d", i)); shard != 2 {
+			t.Errorf("user_%d routed to shard %d, want 2", i, shard)
+		}
+	}
+}
+
+// TestRebalanceThrottle tests that the rate limits the moves and cancelation stops them
+func TestRebalanceThrottle(t *testing.T) {
+	store := newTestStore(t)
+	for i := 0; i < 10; i++ {
+		putOnShard(t, store, 0, fmt.Sprintf("user_%d", i), "value")
+	}
+	r := NewRebalancer(store)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	progress, err := r.Run(ctx, RebalanceOptions{From: 0, To: 1, Rate: 20})
+	if !errors.Is(err, ErrRebalanceCanceled) {
+		t.Fatalf("Run() error = %v, want %v", err, ErrRebalanceCanceled)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Run() returned after %s, want the timeout", elapsed)
+	}
+	// 20 keys per second for 250ms moves about 5 keys
+	if progress.Moved < 3 || progress.Moved > 6 || progress.Error == "" {
+		t.Errorf("Unexpected progress of a throttled rebalance: %+v", progress)
+	}
+
+	progress, err = r.Run(context.Background(), RebalanceOptions{From: 0, To: 1})
+	if err != nil || progress.Moved != 10 {
+		t.Errorf("Run() after cancelation = %+v, %v, want every key moved", progress, err)
+	}
+}
+
+// TestRebalanceConcurrentWrites tests that writes racing a rebalance are not lost
+func TestRebalanceConcurrentWrites(t *testing.T) {
+	store := newTestStore(t)
+	schema := NewSchema(store)
+	const keys = 50
+	for i := 0; i < keys; i++ {
+		putOnShard(t, store, 0, fmt.Sprintf("user_%d", i), "0")
+	}
+
+	// write routes and writes key under its lock, like the model layer
+	write := func(key, value string) error {
+		unlock := store.LockKey(key)
+		defer unlock()
+		shard, err := schema.Get(key)
+		if err != nil {
+			return err
+		}
+		db, err := store.ShardNumber(shard)
+		if err != nil {
+			return err
+		}
+		return db.Put([]byte(key), []byte(value), nil)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, keys)
+	for i := 0; i < keys; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for v := 1; v <= 20; v++ {
+				if err := write(key, fmt.Sprint(v)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(fmt.Sprintf("user_%d", i))
+	}
+
+	if _, err := NewRebalancer(store).Run(context.Background(), RebalanceOptions{From: 0, To: 1}); err != nil {
+		t.Fatalf("Run() unexpected error: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Concurrent write failed: %v", err)
+	}
+
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user_%d", i)
+		if shard, value := readRouted(t, store, key); shard != 1 || value != "20" {
+			t.Errorf("Expected the last write of %s on shard 1, got %q on shard %d", key, value, shard)
+		}
+	}
+}
+
+// TestRebalanceInvalid tests rejecting bad options and a second concurrent run
+func TestRebalanceInvalid(t *testing.T) {
+	store := newTestStore(t)
+	r := NewRebalancer(store)
+
+	for _, opts := range []RebalanceOptions{
+		{From: 1, To: 1},
+		{From: -1, To: 1},
+		{From: 0, To: 1, Rate: -1},
+	} {
+		if _, err := r.Run(context.Background(), opts); !errors.Is(err, ErrInvalidRebalance) {
+			t.Errorf("Run(%+v) error = %v, want %v", opts, err, ErrInvalidRebalance)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		putOnShard(t, store, 0, fmt.Sprintf("user_%d", i), "value")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := r.Start(ctx, RebalanceOptions{From: 0, To: 1, Rate: 1}); err != nil {
+		t.Fatalf("Start() unexpected error: %v", err)
+	}
+	if err := r.Start(ctx, RebalanceOptions{From: 0, To: 1}); !errors.Is(err, ErrRebalanceRunning) {
+		t.Errorf("Start() while running error = %v, want %v", err, ErrRebalanceRunning)
+	}
+	cancel()
+	r.Wait()
+	if r.Progress().Running {
+		t.Error("Expected the rebalance to stop after cancelation")
+	}
+}
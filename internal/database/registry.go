@@ -0,0 +1,179 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// RegistryFile is the name of the file in the base directory that records
+// the active shards once they were changed through a Registry
+const RegistryFile = "shards.json"
+
+// ErrShardRegistry is returned when the active shards cannot be read or saved
+var ErrShardRegistry = errors.New("failed to access the shard registry")
+
+// registryFile is the on-disk record of the active shards
+type registryFile struct {
+	Shards []int64 `json:"shards"`
+}
+
+// Registry is the set of active shards and the placement strategy that
+// assigns new keys to them. It is safe for concurrent use.
+type Registry struct {
+	mu        sync.RWMutex
+	placement ShardedPlacement
+	// path is the file the active shards are saved to, empty to keep them
+	// in memory only
+	path string
+	// err is returned by Place when the registry could not be built
+	err error
+}
+
+// NewRegistry creates a registry over the shards of p. Changes to the
+// active shards are kept in memory only.
+func NewRegistry(p ShardedPlacement) *Registry {
+	return &Registry{placement: p}
+}
+
+// newLayoutRegistry creates the registry described by l, or one that fails
+// every placement when l names an unknown strategy or its registry file
+// cannot be read. The active shards are those saved in the registry file of
+// the base directory, or shards 0 to l.Shards-1 when there is none yet.
+func newLayoutRegistry(l Layout) *Registry {
+	path := filepath.Join(l.BaseDir, RegistryFile)
+	ids, err := readRegistryFile(path)
+	if err != nil {
+		return &Registry{err: err}
+	}
+
+	var p ShardedPlacement
+	if ids == nil {
+		p, err = NewPlacement(l.Placement, l.Shards)
+	} else {
+		p, err = newPlacement(l.Placement, ids)
+	}
+	if err != nil {
+		return &Registry{err: err}
+	}
+	return &Registry{placement: p, path: path}
+}
+
+// readRegistryFile returns the active shards saved at path, or nil when no
+// file was saved
+func readRegistryFile(path string) ([]int64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrShardRegistry, err)
+	}
+	var f registryFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrShardRegistry, path, err)
+	}
+	if f.Shards == nil {
+		f.Shards = []int64{}
+	}
+	return f.Shards, nil
+}
+
+// Place returns the shard a new key is assigned to
+func (r *Registry) Place(key string) (int64, error) {
+	if r.err != nil {
+		return -1, r.err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.placement.Place(key)
+}
+
+// Add activates shard so that new keys may be placed on it. When the
+// registry belongs to a store, the active shards are saved to its registry
+// file first, so the change outlives the process.
+func (r *Registry) Add(shard int64) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if shard < 0 {
+		return fmt.Errorf("failed to add shard %d: %w", shard, ErrShardInactive)
+	}
+	if slices.Contains(r.placement.Shards(), shard) {
+		return fmt.Errorf("failed to add shard %d: %w", shard, ErrShardExists)
+	}
+	if err := r.save(append(r.placement.Shards(), shard)); err != nil {
+		return err
+	}
+	if err := r.placement.AddShard(shard); err != nil {
+		return fmt.Errorf("failed to add shard %d: %w", shard, err)
+	}
+	return nil
+}
+
+// Remove deactivates shard so that no new key is placed on it. Keys already
+// assigned to it stay there until they are rebalanced. The last active shard
+// cannot be removed. The change is saved like those of Add.
+func (r *Registry) Remove(shard int64) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	active := r.placement.Shards()
+	if !slices.Contains(active, shard) {
+		return fmt.Errorf("failed to remove shard %d: %w", shard, ErrShardInactive)
+	}
+	if len(active) == 1 {
+		return fmt.Errorf("failed to remove shard %d: %w: it is the last active shard", shard, ErrNoShards)
+	}
+	if err := r.save(slices.DeleteFunc(active, func(id int64) bool { return id == shard })); err != nil {
+		return err
+	}
+	if err := r.placement.RemoveShard(shard); err != nil {
+		return fmt.Errorf("failed to remove shard %d: %w", shard, err)
+	}
+	return nil
+}
+
+// save writes the active shards ids to the registry file, if any
+func (r *Registry) save(ids []int64) error {
+	if r.path == "" {
+		return nil
+	}
+	slices.Sort(ids)
+	data, err := json.Marshal(registryFile{Shards: ids})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrShardRegistry, err)
+	}
+	if err := writeFileAtomic(r.path, data); err != nil {
+		return fmt.Errorf("%w: %v", ErrShardRegistry, err)
+	}
+	return nil
+}
+
+// Active returns the active shards in ascending order
+func (r *Registry) Active() []int64 {
+	if r.err != nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.placement.Shards()
+}
+
+// IsActive reports whether shard is active
+func (r *Registry) IsActive(shard int64) bool {
+	for _, active := range r.Active() {
+		if active == shard {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of virtual nodes each shard has on a Ring
+const DefaultReplicas = 128
+
+// Ring places keys on a consistent-hash ring. Each shard owns Replicas
+// virtual nodes spread around the ring, and a key belongs to the shard of
+// the first node at or after its hash. Adding a shard only moves the keys
+// that fall just before its new nodes, about 1/N of all keys for N shards.
+type Ring struct {
+	replicas int
+	nodes    []ringNode
+	shards   map[int64]bool
+}
+
+// ringNode is one virtual node of a shard
+type ringNode struct {
+	hash  uint64
+	shard int64
+}
+
+// NewRing creates a ring with the given shards and number of virtual nodes
+// per shard. A replicas value below 1 selects DefaultReplicas.
+func NewRing(replicas int, shards ...int64) *Ring {
+	if replicas < 1 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{replicas: replicas, shards: make(map[int64]bool)}
+	for _, shard := range shards {
+		r.AddShard(shard)
+	}
+	return r
+}
+
+// Place returns the shard of key
+func (r *Ring) Place(key string) (int64, error) {
+	if len(r.nodes) == 0 {
+		return -1, ErrNoShards
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.nodes), func(i int) bool { return r.nodes[i].hash >= h })
+	if i == len(r.nodes) {
+		// Wrap around to the first node
+		i = 0
+	}
+	return r.nodes[i].shard, nil
+}
+
+// AddShard adds the virtual nodes of shard to the ring
+func (r *Ring) AddShard(shard int64) error {
+	if shard < 0 {
+		return fmt.Errorf("%w: shard %d", ErrShardInactive, shard)
+	}
+	if r.shards[shard] {
+		return fmt.Errorf("%w: shard %d", ErrShardExists, shard)
+	}
+	r.shards[shard] = true
+
+	for i := 0; i < r.replicas; i++ {
+		r.nodes = append(r.nodes, ringNode{
+			hash:  hashKey(strconv.FormatInt(shard, 10) + "#" + strconv.Itoa(i)),
+			shard: shard,
+		})
+	}
+	sort.Slice(r.nodes, func(i, j int) bool {
+		if r.nodes[i].hash != r.nodes[j].hash {
+			return r.nodes[i].hash < r.nodes[j].hash
+		}
+		return r.nodes[i].shard < r.nodes[j].shard
+	})
+	return nil
+}
+
+// RemoveShard removes the virtual nodes of shard. Its keys move to the
+// shards owning the next nodes around the ring.
+func (r *Ring) RemoveShard(shard int64) error {
+	if !r.shards[shard] {
+		return fmt.Errorf("%w: shard %d", ErrShardInactive, shard)
+	}
+	delete(r.shards, shard)
+
+	nodes := r.nodes[:0]
+	for _, node := range r.nodes {
+		if node.shard != shard {
+			nodes = append(nodes, node)
+		}
+	}
+	r.nodes = nodes
+	return nil
+}
+
+// Shards returns the shards on the ring in ascending order
+func (r *Ring) Shards() []int64 {
+	return sortedShards(r.shards)
+}
+
+// sortedShards returns the keys of set in ascending order
+func sortedShards(set map[int64]bool) []int64 {
+	shards := make([]int64, 0, len(set))
+	for shard := range set {
+		shards = append(shards, shard)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i] < shards[j] })
+	return shards
+}
@@ -0,0 +1,230 @@
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Common errors for scanning and importing the fragmentation schema
+var (
+	ErrInvalidEntry = errors.New("invalid fragmentation entry")
+	ErrStopScan     = errors.New("stop scan")
+)
+
+// Entry is a key of the fragmentation schema and its shard. Export writes
+// one entry per line and Import reads them back.
+type Entry struct {
+	Key   string `json:"key"`
+	Shard int64  `json:"shard"`
+}
+
+// ShardCount is the number of keys mapped to a shard
+type ShardCount struct {
+	Shard int64 `json:"shard"`
+	Keys  int   `json:"keys"`
+}
+
+// SchemaStats summarizes how the keys of the schema are spread over shards
+type SchemaStats struct {
+	// Total is the number of keys in the schema
+	Total int `json:"total"`
+	// Shards counts the keys of every active shard and of every other shard
+	// with at least one key, ordered by shard number
+	Shards []ShardCount `json:"shards"`
+	// Mean is the average number of keys per shard
+	Mean float64 `json:"mean"`
+	// Skew is the key count of the fullest shard divided by Mean; 1 means
+	// the keys are spread evenly
+	Skew float64 `json:"skew"`
+	// Cache reports the counters of the lookup cache of the store
+	Cache CacheStats `json:"cache"`
+}
+
+// FragmentationScan calls fn for every entry of the default schema whose key
+// starts with prefix. See Schema.Scan.
+func FragmentationScan(prefix string, fn func(Entry) error) error {
+	return defaultSchema().Scan(prefix, fn)
+}
+
+// FragmentationKeys lists the keys of the default schema starting with prefix
+func FragmentationKeys(prefix string) ([]string, error) {
+	return defaultSchema().Keys(prefix)
+}
+
+// FragmentationKeysOnShard lists the keys the default schema maps to shard
+func FragmentationKeysOnShard(shard int64) ([]string, error) {
+	return defaultSchema().KeysOnShard(shard)
+}
+
+// FragmentationStats counts the keys per shard of the default schema
+func FragmentationStats() (SchemaStats, error) {
+	return defaultSchema().Stats()
+}
+
+// FragmentationExport writes the default schema to w as JSON Lines
+func FragmentationExport(w io.Writer) (int, error) {
+	return defaultSchema().Export(w)
+}
+
+// FragmentationImport reads JSON Lines entries from r into the default schema
+func FragmentationImport(r io.Reader) (int, error) {
+	return defaultSchema().Import(r)
+}
+
+// Scan calls fn for every entry whose key starts with prefix, in key order.
+// An empty prefix scans every entry. Returning ErrStopScan from fn ends the
+// scan without an error; any other error ends it and is returned.
+func (s *Schema) Scan(prefix string, fn func(Entry) error) error {
+	ldb, err := s.store.GlobalSchema()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	var r *util.Range
+	if prefix != "" {
+		r = util.BytesPrefix([]byte(prefix))
+	}
+	iter := ldb.NewIterator(r, nil)
+	defer iter.Release()
+	for iter.Next() {
+		shard, err := strconv.ParseInt(string(iter.Value()), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w for key %s: %v", ErrShardConversion, iter.Key(), err)
+		}
+		if err := fn(Entry{Key: string(iter.Key()), Shard: shard}); err != nil {
+			if errors.Is(err, ErrStopScan) {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("%w: %v", ErrFragmentationRead, err)
+	}
+	return nil
+}
+
+// Keys lists the keys starting with prefix, in key order
+func (s *Schema) Keys(prefix string) ([]string, error) {
+	var keys []string
+	err := s.Scan(prefix, func(e Entry) error {
+		keys = append(keys, e.Key)
+		return nil
+	})
+	return keys, err
+}
+
+// KeysOnShard lists the keys mapped to shard, in key order
+func (s *Schema) KeysOnShard(shard int64) ([]string, error) {
+	var keys []string
+	err := s.Scan("", func(e Entry) error {
+		if e.Shard == shard {
+			keys = append(keys, e.Key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Stats counts the keys of every shard and reports the lookup cache
+// counters. Active shards of the store registry are listed even when they
+// hold no keys, so an empty shard shows up in the skew.
+func (s *Schema) Stats() (SchemaStats, error) {
+	counts := make(map[int64]int)
+	for _, shard := range s.store.Registry().Active() {
+		counts[shard] = 0
+	}
+
+	var stats SchemaStats
+	err := s.Scan("", func(e Entry) error {
+		counts[e.Shard]++
+		stats.Total++
+		return nil
+	})
+	if err != nil {
+		return SchemaStats{}, err
+	}
+
+	stats.Shards = make([]ShardCount, 0, len(counts))
+	most := 0
+	for shard, keys := range counts {
+		stats.Shards = append(stats.Shards, ShardCount{Shard: shard, Keys: keys})
+		if keys > most {
+			most = keys
+		}
+	}
+	sort.Slice(stats.Shards, func(i, j int) bool {
+		return stats.Shards[i].Shard < stats.Shards[j].Shard
+	})
+	if len(stats.Shards) > 0 {
+		stats.Mean = float64(stats.Total) / float64(len(stats.Shards))
+	}
+	if stats.Mean > 0 {
+		stats.Skew = float64(most) / stats.Mean
+	}
+	stats.Cache = s.store.LookupCache().Stats()
+	return stats, nil
+}
+
+// Export writes every entry to w as JSON Lines, one Entry per line in key
+// order, and returns the number of entries written
+func (s *Schema) Export(w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	err := s.Scan("", func(e Entry) error {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// Import reads JSON Lines entries, as written by Export, from r and adds
+// them to the schema in a single batch. Existing keys are overwritten and
+// keys missing from r are kept. If any line is invalid nothing is written.
+// It returns the number of entries imported.
+func (s *Schema) Import(r io.Reader) (int, error) {
+	batch := new(leveldb.Batch)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return 0, fmt.Errorf("%w on line %d: %v", ErrInvalidEntry, line, err)
+		}
+		if e.Key == "" || e.Shard < 0 {
+			return 0, fmt.Errorf("%w on line %d: key must not be empty and shard must not be negative", ErrInvalidEntry, line)
+		}
+		batch.Put([]byte(e.Key), []byte(strconv.FormatInt(e.Shard, 10)))
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidEntry, err)
+	}
+
+	s.store.schemaMu.Lock()
+	defer s.store.schemaMu.Unlock()
+
+	if err := s.write(batch); err != nil {
+		return 0, err
+	}
+	log.Printf("Imported %d fragmentation entries", batch.Len())
+	return batch.Len(), nil
+}
@@ -0,0 +1,145 @@
+// Package database provides tests for scanning and exporting the fragmentation schema.
+package database
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newScanSchema returns a schema of a fresh store holding entries
+func newScanSchema(t *testing.T, entries map[string]int64) *Schema {
+	t.Helper()
+	schema := NewSchema(newTestStore(t))
+	if err := schema.AddMany(entries); err != nil {
+		t.Fatalf("AddMany() unexpected error: %v", err)
+	}
+	return schema
+}
+
+// TestSchemaScan tests listing keys by prefix and by shard
+func TestSchemaScan(t *testing.T) {
+	schema := newScanSchema(t, map[string]int64{
+		"user_a":    1,
+		"user_b":    2,
+		"user_c":    1,
+		"chat_a":    1,
+		"history_a": 3,
+	})
+
+	tests := []struct {
+		name string
+		list func() ([]string, error)
+		want []string
+	}{
+		{"prefix", func() ([]string, error) { return schema.Keys("user_") }, []string{"user_a", "user_b", "user_c"}},
+		{"every key", func() ([]string, error) { return schema.Keys("") }, []string{"chat_a", "history_a", "user_a", "user_b", "user_c"}},
+		{"unknown prefix", func() ([]string, error) { return schema.Keys("missing_") }, nil},
+		{"shard", func() ([]string, error) { return schema.KeysOnShard(1) }, []string{"chat_a", "user_a", "user_c"}},
+		{"empty shard", func() ([]string, error) { return schema.KeysOnShard(7) }, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.list()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// ErrStopScan ends the scan early without an error
+	seen := 0
+	err := schema.Scan("", func(Entry) error {
+		seen++
+		return ErrStopScan
+	})
+	if err != nil || seen != 1 {
+		t.Errorf("Scan() stopped after %d entries with %v, want 1 and no error", seen, err)
+	}
+}
+
+// TestSchemaStats tests per-shard counts and skew
+func TestSchemaStats(t *testing.T) {
+	store := newTestStore(t)
+	stats, err := NewSchema(store).Stats()
+	if err != nil {
+		t.Fatalf("Stats() unexpected error: %v", err)
+	}
+	if stats.Total != 0 || stats.Skew != 0 || len(stats.Shards) != len(store.Registry().Active()) {
+		t.Errorf("Unexpected stats of an empty schema: %+v", stats)
+	}
+
+	// Shards 0-3 are active by default; shard 9 only appears with keys
+	schema := NewSchema(store)
+	if err := schema.AddMany(map[string]int64{"a": 0, "b": 0, "c": 0, "d": 1, "e": 2, "f": 9}); err != nil {
+		t.Fatalf("AddMany() unexpected error: %v", err)
+	}
+	stats, err = schema.Stats()
+	if err != nil {
+		t.Fatalf("Stats() unexpected error: %v", err)
+	}
+
+	want := []ShardCount{{0, 3}, {1, 1}, {2, 1}, {3, 0}, {9, 1}}
+	if !reflect.DeepEqual(stats.Shards, want) {
+		t.Errorf("Shards = %v, want %v", stats.Shards, want)
+	}
+	if stats.Total != 6 || stats.Mean != 1.2 || stats.Skew != 2.5 {
+		t.Errorf("Total, Mean, Skew = %d, %v, %v, want 6, 1.2, 2.5", stats.Total, stats.Mean, stats.Skew)
+	}
+}
+
+// TestSchemaExportImport tests that an export restores the mapping of another store
+func TestSchemaExportImport(t *testing.T) {
+	entries := map[string]int64{"user_a": 1, "user_b": 2, "chat_a": 3}
+	source := newScanSchema(t, entries)
+
+	var buf bytes.Buffer
+	n, err := source.Export(&buf)
+	if err != nil || n != len(entries) {
+		t.Fatalf("Export() = %d, %v, want %d", n, err, len(entries))
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != len(entries) {
+		t.Errorf("Export() wrote %d lines, want %d", lines, len(entries))
+	}
+
+	target := newScanSchema(t, map[string]int64{"user_a": 5, "user_kept": 4})
+	n, err = target.Import(&buf)
+	if err != nil || n != len(entries) {
+		t.Fatalf("Import() = %d, %v, want %d", n, err, len(entries))
+	}
+	for key, want := range map[string]int64{"user_a": 1, "user_b": 2, "chat_a": 3, "user_kept": 4} {
+		if shard, err := target.Get(key); err != nil || shard != want {
+			t.Errorf("Get(%q) = %d, %v, want %d", key, shard, err, want)
+		}
+	}
+}
+
+// TestSchemaImportInvalid tests that an invalid line rejects the whole import
+func TestSchemaImportInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"malformed JSON", "{\"key\":\"user_new\",\"shard\":1}\n{not json}\n"},
+		{"empty key", "{\"key\":\"user_new\",\"shard\":1}\n{\"key\":\"\",\"shard\":1}\n"},
+		{"negative shard", "{\"key\":\"user_new\",\"shard\":1}\n{\"key\":\"user_bad\",\"shard\":-1}\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema := NewSchema(newTestStore(t))
+			if _, err := schema.Import(strings.NewReader(tt.input)); !errors.Is(err, ErrInvalidEntry) {
+				t.Fatalf("Import() error = %v, want %v", err, ErrInvalidEntry)
+			}
+			if ok, _ := schema.Exists("user_new"); ok {
+				t.Error("Expected a rejected import to write no entries")
+			}
+		})
+	}
+}
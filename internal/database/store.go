@@ -0,0 +1,213 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Common errors for stores
+var (
+	ErrStoreClosed = errors.New("database store is closed")
+)
+
+// Store opens each LevelDB database of a layout once and shares the handle
+// between all callers. LevelDB holds an exclusive lock on its directory, so
+// every user of a database in the process must go through one Store.
+// It is safe for concurrent use.
+type Store struct {
+	layout   Layout
+	registry *Registry
+	// keyLocks serializes the writers of a record with the rebalancer
+	// moving it, striped by key hash
+	keyLocks [64]sync.Mutex
+	// schemaMu serializes the read-modify-write operations of the
+	// fragmentation schema
+	schemaMu sync.Mutex
+	cache    *LookupCache
+
+	mu     sync.Mutex
+	dbs    map[string]*leveldb.DB
+	sqls   map[string]*sql.DB
+	closed bool
+}
+
+// NewStore creates a Store over layout. Databases are opened on first use.
+func NewStore(layout Layout) *Store {
+	return &Store{
+		layout:   layout,
+		registry: newLayoutRegistry(layout),
+		cache:    NewLookupCache(layout.CacheSize, layout.CacheTTL),
+		dbs:      make(map[string]*leveldb.DB),
+		sqls:     make(map[string]*sql.DB),
+	}
+}
+
+// Layout returns the layout of the store
+func (s *Store) Layout() Layout {
+	return s.layout
+}
+
+// Registry returns the registry of the active shards of the store, built
+// from the Shards and Placement of its layout
+func (s *Store) Registry() *Registry {
+	return s.registry
+}
+
+// LookupCache returns the cache of fragmentation lookups of the store, or
+// nil when the layout disables it
+func (s *Store) LookupCache() *LookupCache {
+	return s.cache
+}
+
+// LockKey locks the record stored under key against being moved to another
+// shard, and against other writers, until the returned function is called.
+// Writers must hold the lock from routing the key to writing it.
+//
+// The locks are striped and not reentrant, and unrelated keys may share a
+// stripe, so a caller holding a LockKey must never take another one: it
+// would deadlock on a shared stripe, or against a caller locking the same
+// keys in the other order. Callers that need several keys lock them at once
+// with LockKeys.
+func (s *Store) LockKey(key string) (unlock func()) {
+	mu := &s.keyLocks[s.keyStripe(key)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// LockKeys locks the records stored under keys like LockKey, until the
+// returned function is called. Each stripe is locked once, in ascending
+// order, so callers locking overlapping keys never deadlock each other.
+func (s *Store) LockKeys(keys ...string) (unlock func()) {
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		stripes = append(stripes, s.keyStripe(key))
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+
+	for _, i := range stripes {
+		s.keyLocks[i].Lock()
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			s.keyLocks[stripes[i]].Unlock()
+		}
+	}
+}
+
+// keyStripe returns the index of the key lock guarding key
+func (s *Store) keyStripe(key string) int {
+	return int(hashKey(key) % uint64(len(s.keyLocks)))
+}
+
+// Open returns the LevelDB database at the path built from BaseDir and
+// params, opening it on first use. The handle is shared and must not be
+// closed by the caller.
+func (s *Store) Open(params ...string) (*leveldb.DB, error) {
+	params = append([]string{s.layout.BaseDir}, params...)
+	dir, err := buildPath(params...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDirectoryCreate, err)
+	}
+	key, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	if db, ok := s.dbs[key]; ok {
+		return db, nil
+	}
+
+	db, err := CreateLevelDBDatabase(params...)
+	if err != nil {
+		return nil, err
+	}
+	s.dbs[key] = db
+	return db, nil
+}
+
+// Shard returns the database of the named shard in the shard group
+func (s *Store) Shard(name string) (*leveldb.DB, error) {
+	return s.Open(s.layout.ShardGroup, name)
+}
+
+// ShardNumber returns the database of shard n
+func (s *Store) ShardNumber(n int64) (*leveldb.DB, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("%w: shard %d", ErrShardNotFound, n)
+	}
+	return s.Shard(s.layout.ShardName(n))
+}
+
+// DefaultShard returns the database of the default shard
+func (s *Store) DefaultShard() (*leveldb.DB, error) {
+	return s.Shard(s.layout.DefaultShard)
+}
+
+// History returns the database of the conversation histories
+func (s *Store) History() (*leveldb.DB, error) {
+	return s.Open(s.layout.HistoryDir, "/")
+}
+
+// GlobalSchema returns the database of the fragmentation schema
+func (s *Store) GlobalSchema() (*leveldb.DB, error) {
+	return s.Open(s.layout.GlobalSchema, "/")
+}
+
+// SQL returns the SQLite database name in the SQL directory, opening it on
+// first use. The handle is shared and must not be closed by the caller. It
+// uses a single connection, since SQLite allows one writer at a time.
+func (s *Store) SQL(name string) (*sql.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	if db, ok := s.sqls[name]; ok {
+		return db, nil
+	}
+
+	db, err := CreateSQLiteDatabase(s.layout.BaseDir, s.layout.SQLDir, name)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	s.sqls[name] = db
+	return db, nil
+}
+
+// Close closes every open database and releases the directory locks.
+// Later calls to Open fail with ErrStoreClosed.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var errs []error
+	for key, db := range s.dbs {
+		if err := db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close %s: %w", key, err))
+		}
+		delete(s.dbs, key)
+	}
+	for name, db := range s.sqls {
+		if err := db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close %s: %w", name, err))
+		}
+		delete(s.sqls, name)
+	}
+	return errors.Join(errs...)
+}
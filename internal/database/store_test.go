@@ -0,0 +1,342 @@
+// Package database provides tests and benchmarks for the shared LevelDB store.
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// newTestStore creates a store rooted in a temporary directory
+func newTestStore(t testing.TB) *Store {
+	t.Helper()
+	layout := DefaultLayout()
+	layout.BaseDir = t.TempDir()
+	store := NewStore(layout)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// quietLogs discards log output for the rest of the benchmark
+func quietLogs(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// TestStoreOpen tests that each database directory is opened once
+func TestStoreOpen(t *testing.T) {
+	store := newTestStore(t)
+
+	first, err := store.DefaultShard()
+	if err != nil {
+		t.Fatalf("DefaultShard() unexpected error: %v", err)
+	}
+	second, err := store.Open(" "+store.Layout().ShardGroup+" ", store.Layout().DefaultShard)
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	if first != second {
+		t.Error("Expected the same handle for the same directory")
+	}
+
+	others := map[string]func() (*leveldb.DB, error){
+		"Shard":        func() (*leveldb.DB, error) { return store.Shard("Shard_1.sqlite") },
+		"History":      store.History,
+		"GlobalSchema": store.GlobalSchema,
+	}
+	for name, open := range others {
+		db, err := open()
+		if err != nil {
+			t.Fatalf("%s() unexpected error: %v", name, err)
+		}
+		if db == first {
+			t.Errorf("Expected %s() to open a separate database", name)
+		}
+	}
+
+	if _, err := store.Open(); err == nil {
+		t.Error("Open() expected error for an invalid path")
+	}
+}
+
+// TestStoreClose tests that closing the store releases the directory locks
+func TestStoreClose(t *testing.T) {
+	store := newTestStore(t)
+	l := store.Layout()
+	dir := filepath.Join(l.BaseDir, l.ShardGroup, l.DefaultShard)
+
+	db, err := store.DefaultShard()
+	if err != nil {
+		t.Fatalf("DefaultShard() unexpected error: %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("value"), nil); err != nil {
+		t.Fatalf("Put() unexpected error: %v", err)
+	}
+
+	if locked, err := leveldb.OpenFile(dir, nil); err == nil {
+		locked.Close()
+		t.Fatal("Expected the directory to be locked while the store is open")
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	direct, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatalf("Expected the directory to be unlocked after Close: %v", err)
+	}
+	defer direct.Close()
+	if value, err := direct.Get([]byte("key"), nil); err != nil || string(value) != "value" {
+		t.Errorf("Get() = %q, %v, want value", value, err)
+	}
+
+	if _, err := store.DefaultShard(); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("DefaultShard() after Close error = %v, want %v", err, ErrStoreClosed)
+	}
+}
+
+// TestStoreConcurrentUse tests that concurrent callers share one handle instead of failing on the lock
+func TestStoreConcurrentUse(t *testing.T) {
+	store := newTestStore(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			db, err := store.DefaultShard()
+			if err == nil {
+				err = db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value"), nil)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent write failed: %v", err)
+		}
+	}
+}
+
+// collidingKeys returns two distinct keys guarded by the same key lock
+func collidingKeys(t *testing.T, store *Store) (string, string) {
+	t.Helper()
+	seen := make(map[int]string)
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if other, ok := seen[store.keyStripe(key)]; ok {
+			return other, key
+		}
+		seen[store.keyStripe(key)] = key
+	}
+}
+
+// TestLockKeys tests that keys sharing a lock stripe can be locked together
+// and that callers locking the same keys in any order do not deadlock
+func TestLockKeys(t *testing.T) {
+	store := newTestStore(t)
+	a, b := collidingKeys(t, store)
+
+	var other string
+	for i := 0; other == ""; i++ {
+		if key := fmt.Sprintf("other_%d", i); store.keyStripe(key) != store.keyStripe(a) {
+			other = key
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				store.LockKeys(a, other, b)()
+			}()
+			go func() {
+				defer wg.Done()
+				store.LockKeys(other, b, a, other)()
+			}()
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("LockKeys() deadlocked")
+	}
+
+	// A key locked together with others is locked against LockKey
+	unlock := store.LockKeys(a, other)
+	locked := make(chan struct{})
+	go func() {
+		store.LockKey(b)()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Expected LockKey() to wait for LockKeys() on a shared stripe")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected LockKey() to proceed after unlock")
+	}
+}
+
+// TestCloseAll tests that the default store is replaced after it is closed
+func TestCloseAll(t *testing.T) {
+	layout := DefaultLayout()
+	layout.BaseDir = t.TempDir()
+	if err := SetLayout(layout); err != nil {
+		t.Fatalf("SetLayout() unexpected error: %v", err)
+	}
+	defer SetLayout(DefaultLayout())
+
+	before := DefaultStore()
+	if _, err := before.GlobalSchema(); err != nil {
+		t.Fatalf("GlobalSchema() unexpected error: %v", err)
+	}
+
+	if err := CloseAll(); err != nil {
+		t.Fatalf("CloseAll() unexpected error: %v", err)
+	}
+
+	after := DefaultStore()
+	if after == before || after.Layout() != layout {
+		t.Error("Expected a fresh default store over the same layout")
+	}
+	if _, err := before.GlobalSchema(); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("Expected the old store to be closed, got %v", err)
+	}
+	if _, err := after.GlobalSchema(); err != nil {
+		t.Errorf("GlobalSchema() on the new store unexpected error: %v", err)
+	}
+}
+
+// BenchmarkPut compares parallel writes through a shared Store with opening
+// the database for every write. Opening per call has to be serialized, since
+// a second open of the same directory fails on the LevelDB lock.
+func BenchmarkPut(b *testing.B) {
+	quietLogs(b)
+	value := []byte("value")
+
+	b.Run("OpenPerCall", func(b *testing.B) {
+		dir := b.TempDir()
+		var mu sync.Mutex
+		var n int64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				key := []byte(fmt.Sprintf("key_%d", atomic.AddInt64(&n, 1)))
+				mu.Lock()
+				db, err := CreateLevelDBDatabase(dir, "Common", "Shard_0.sqlite")
+				if err != nil {
+					mu.Unlock()
+					b.Error(err)
+					return
+				}
+				err = db.Put(key, value, nil)
+				db.Close()
+				mu.Unlock()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+
+	b.Run("Store", func(b *testing.B) {
+		store := newTestStore(b)
+		var n int64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				key := []byte(fmt.Sprintf("key_%d", atomic.AddInt64(&n, 1)))
+				db, err := store.DefaultShard()
+				if err == nil {
+					err = db.Put(key, value, nil)
+				}
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkGet compares parallel reads through a shared Store with opening
+// the database for every read
+func BenchmarkGet(b *testing.B) {
+	quietLogs(b)
+	key := []byte("key")
+
+	b.Run("OpenPerCall", func(b *testing.B) {
+		dir := b.TempDir()
+		db, err := CreateLevelDBDatabase(dir, "Common", "Shard_0.sqlite")
+		if err != nil {
+			b.Fatal(err)
+		}
+		db.Put(key, []byte("value"), nil)
+		db.Close()
+
+		var mu sync.Mutex
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				mu.Lock()
+				db, err := CreateLevelDBDatabase(dir, "Common", "Shard_0.sqlite")
+				if err != nil {
+					mu.Unlock()
+					b.Error(err)
+					return
+				}
+				_, err = db.Get(key, nil)
+				db.Close()
+				mu.Unlock()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+
+	b.Run("Store", func(b *testing.B) {
+		store := newTestStore(b)
+		db, err := store.DefaultShard()
+		if err != nil {
+			b.Fatal(err)
+		}
+		db.Put(key, []byte("value"), nil)
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				db, err := store.DefaultShard()
+				if err == nil {
+					_, err = db.Get(key, nil)
+				}
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// Common errors for JSON Web Key Sets
+var (
+	ErrInvalidJWKS = errors.New("invalid JSON Web Key Set")
+)
+
+// jwk is a JSON Web Key (RFC 7517) of type oct, RSA or OKP (Ed25519)
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv"`
+	K         string `json:"k"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	X         string `json:"x"`
+}
+
+// ParseJWKS reads the verification keys of a JSON Web Key Set. Symmetric
+// (oct) keys verify HS256, RSA keys RS256 and Ed25519 (OKP) keys EdDSA.
+// Keys meant for encryption are skipped.
+func ParseJWKS(data []byte) ([]Key, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidJWKS, err)
+	}
+
+	keys := make([]Key, 0, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.key()
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %d (%s): %v", ErrInvalidJWKS, i, k.KeyID, err)
+		}
+		if k.Algorithm != "" && k.Algorithm != key.Algorithm {
+			return nil, fmt.Errorf("%w: key %d (%s): alg %s does not match key type %s", ErrInvalidJWKS, i, k.KeyID, k.Algorithm, k.KeyType)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// key converts k to a verification key
+func (k jwk) key() (Key, error) {
+	switch k.KeyType {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return Key{}, errors.New("bad k")
+		}
+		return Key{ID: k.KeyID, Algorithm: HS256, Key: secret}, nil
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil || len(n) == 0 {
+			return Key{}, errors.New("bad n")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return Key{}, errors.New("bad e")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return Key{}, fmt.Errorf("RSA key of %d bits, at least 2048 needed", pub.N.BitLen())
+		}
+		return Key{ID: k.KeyID, Algorithm: RS256, Key: pub}, nil
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return Key{}, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return Key{}, errors.New("bad x")
+		}
+		return Key{ID: k.KeyID, Algorithm: EdDSA, Key: ed25519.PublicKey(x)}, nil
+	}
+	return Key{}, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
+
+// JWKSFile provides the keys of a JSON Web Key Set on disk, so tokens can be
+// verified offline. The file is read again when its size or modification
+// time changes; if it then fails to parse, the previous keys stay in use.
+// It is safe for concurrent use.
+type JWKSFile struct {
+	path string
+
+	mu      sync.Mutex
+	keys    []Key
+	modTime time.Time
+	size    int64
+}
+
+// NewJWKSFile reads the key set at path
+func NewJWKSFile(path string) (*JWKSFile, error) {
+	f := &JWKSFile{path: path}
+	if _, err := f.Keys(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Keys returns the keys of the file, reading it again if it changed
+func (f *JWKSFile) Keys() ([]Key, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		if f.keys != nil {
+			log.Printf("Keeping the previous keys of %s: %v", f.path, err)
+			return f.keys, nil
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidJWKS, err)
+	}
+	if f.keys != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.keys, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err == nil {
+		var keys []Key
+		if keys, err = ParseJWKS(data); err == nil {
+			f.keys, f.modTime, f.size = keys, info.ModTime(), info.Size()
+			log.Printf("Loaded %d keys from %s", len(keys), f.path)
+			return f.keys, nil
+		}
+	}
+	if f.keys != nil {
+		// Not read again until the file changes once more
+		f.modTime, f.size = info.ModTime(), info.Size()
+		log.Printf("Keeping the previous keys of %s: %v", f.path, err)
+		return f.keys, nil
+	}
+	if errors.Is(err, ErrInvalidJWKS) {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: %v", ErrInvalidJWKS, err)
+}
@@ -0,0 +1,444 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Signing algorithms of bearer tokens
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+// Keys of the verified token on the gin.Context
+const (
+	SubjectKey = "Subject"
+	ClaimsKey  = "Claims"
+)
+
+// RoleClaim names the role of the token subject, checked by RequireRole.
+// Administrators have the role RoleAdmin.
+const (
+	RoleClaim = "role"
+	RoleAdmin = "admin"
+)
+
+// Common errors for token verification
+var (
+	ErrMissingToken         = errors.New("bearer token required")
+	ErrMalformedToken       = errors.New("malformed token")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrUnknownKey           = errors.New("no key to verify the token")
+	ErrInvalidSignature     = errors.New("invalid token signature")
+	ErrTokenExpired         = errors.New("token expired")
+	ErrTokenNotYetValid     = errors.New("token not valid yet")
+	ErrInvalidIssuer        = errors.New("invalid token issuer")
+	ErrInvalidAudience      = errors.New("invalid token audience")
+)
+
+// JWTConfig configures the verification of bearer tokens
+type JWTConfig struct {
+	// Secret is the shared HS256 key
+	Secret string `yaml:"secret,omitempty" json:"secret,omitempty"`
+	// JWKSFile is a local JSON Web Key Set with the verification keys; it
+	// is read again when it changes, so keys can be rotated without a restart
+	JWKSFile string `yaml:"jwks_file,omitempty" json:"jwks_file,omitempty"`
+	// Issuer, when set, must equal the iss claim
+	Issuer string `yaml:"issuer,omitempty" json:"issuer,omitempty"`
+	// Audience, when set, must be one of the aud claim
+	Audience string `yaml:"audience,omitempty" json:"audience,omitempty"`
+	// Algorithms lists the accepted signing algorithms; empty accepts all
+	Algorithms []string `yaml:"algorithms,omitempty" json:"algorithms,omitempty"`
+	// Leeway tolerates clock skew in the exp and nbf checks
+	Leeway time.Duration `yaml:"leeway" json:"leeway"`
+	// AccessTTL is the lifetime of the access tokens issued at login
+	AccessTTL time.Duration `yaml:"access_ttl" json:"access_ttl"`
+	// RefreshTTL is the lifetime of refresh tokens; refreshing extends it
+	RefreshTTL time.Duration `yaml:"refresh_ttl" json:"refresh_ttl"`
+}
+
+// DefaultJWTConfig returns a configuration without keys, which rejects every
+// token until a secret or JWKS file is set
+func DefaultJWTConfig() JWTConfig {
+	return JWTConfig{
+		Leeway:     30 * time.Second,
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: 30 * 24 * time.Hour,
+	}
+}
+
+// SupportedAlgorithm reports whether alg is a signing algorithm of bearer
+// tokens
+func SupportedAlgorithm(alg string) bool {
+	return alg == HS256 || alg == RS256 || alg == EdDSA
+}
+
+// Audience is the aud claim, a single value or a list
+type Audience []string
+
+// UnmarshalJSON accepts a string or an array of strings
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// MarshalJSON writes a single audience as a string
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// Claims are the claims of a bearer token. Times are Unix seconds.
+type Claims struct {
+	Subject   string   `json:"sub,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+	// Extra holds the claims other than the registered ones above
+	Extra map[string]interface{} `json:"-"`
+}
+
+// registeredClaims are the claims decoded into the fields of Claims
+var registeredClaims = []string{"sub", "iss", "aud", "exp", "nbf", "iat", "jti"}
+
+// UnmarshalJSON decodes the registered claims into their fields and the
+// others into Extra
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type registered Claims
+	if err := json.Unmarshal(data, (*registered)(c)); err != nil {
+		return err
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for _, name := range registeredClaims {
+		delete(all, name)
+	}
+	c.Extra = nil
+	if len(all) > 0 {
+		c.Extra = all
+	}
+	return nil
+}
+
+// MarshalJSON encodes the registered claims together with Extra; a
+// registered claim wins over an Extra entry of the same name
+func (c Claims) MarshalJSON() ([]byte, error) {
+	type registered Claims
+	data, err := json.Marshal(registered(c))
+	if err != nil || len(c.Extra) == 0 {
+		return data, err
+	}
+	all := make(map[string]interface{}, len(c.Extra))
+	for name, value := range c.Extra {
+		all[name] = value
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range fields {
+		all[name] = value
+	}
+	return json.Marshal(all)
+}
+
+// Role returns the role claim, or "" if there is none
+func (c *Claims) Role() string {
+	role, _ := c.Extra[RoleClaim].(string)
+	return role
+}
+
+// Key is a key that verifies or signs tokens. Verification keys are []byte
+// for HS256, *rsa.PublicKey for RS256 and ed25519.PublicKey for EdDSA;
+// signing keys are []byte, *rsa.PrivateKey and ed25519.PrivateKey.
+type Key struct {
+	// ID is matched against the kid header of tokens; empty matches tokens
+	// without a kid
+	ID string
+	// Algorithm is the signing algorithm of the key
+	Algorithm string
+	Key       interface{}
+}
+
+// KeySource provides the current verification keys
+type KeySource interface {
+	Keys() ([]Key, error)
+}
+
+// StaticKeys is a fixed set of verification keys
+type StaticKeys []Key
+
+// Keys returns the keys
+func (k StaticKeys) Keys() ([]Key, error) {
+	return k, nil
+}
+
+// tokenHeader is the JOSE header of a token
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// Verifier checks the signature and claims of bearer tokens.
+// It is safe for concurrent use.
+type Verifier struct {
+	sources    []KeySource
+	issuer     string
+	audience   string
+	algorithms map[string]bool
+	leeway     time.Duration
+	now        func() time.Time
+}
+
+// NewVerifier creates a verifier of tokens signed with the keys of config
+// and of the extra sources
+func NewVerifier(config JWTConfig, sources ...KeySource) (*Verifier, error) {
+	v := &Verifier{
+		issuer:     config.Issuer,
+		audience:   config.Audience,
+		algorithms: make(map[string]bool),
+		leeway:     config.Leeway,
+		now:        time.Now,
+	}
+	algorithms := config.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = []string{HS256, RS256, EdDSA}
+	}
+	for _, alg := range algorithms {
+		if !SupportedAlgorithm(alg) {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, alg)
+		}
+		v.algorithms[alg] = true
+	}
+
+	if config.Secret != "" {
+		v.sources = append(v.sources, StaticKeys{{Algorithm: HS256, Key: []byte(config.Secret)}})
+	}
+	if config.JWKSFile != "" {
+		jwks, err := NewJWKSFile(config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		v.sources = append(v.sources, jwks)
+	}
+	v.sources = append(v.sources, sources...)
+	return v, nil
+}
+
+// Verify checks the signature of token and its exp, nbf, iss and aud claims,
+// and returns its claims. Tokens must carry an exp claim. A token with a kid
+// header is only checked against the keys with that ID; one without is
+// checked against every key of its algorithm.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts, got %d", ErrMalformedToken, len(parts))
+	}
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrMalformedToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrMalformedToken, err)
+	}
+	if !v.algorithms[header.Algorithm] {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, header.Algorithm)
+	}
+
+	if err := v.verifySignature(header, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrMalformedToken, err)
+	}
+	if err := v.validate(&claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// verifySignature checks signature against every candidate key of header
+func (v *Verifier) verifySignature(header tokenHeader, input, signature []byte) error {
+	candidates := 0
+	for _, source := range v.sources {
+		keys, err := source.Keys()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUnknownKey, err)
+		}
+		for _, key := range keys {
+			if key.Algorithm != header.Algorithm || (header.KeyID != "" && key.ID != header.KeyID) {
+				continue
+			}
+			candidates++
+			if verifyWith(key, input, signature) {
+				return nil
+			}
+		}
+	}
+	if candidates == 0 {
+		if header.KeyID != "" {
+			return fmt.Errorf("%w: kid %q", ErrUnknownKey, header.KeyID)
+		}
+		return fmt.Errorf("%w: %s", ErrUnknownKey, header.Algorithm)
+	}
+	return ErrInvalidSignature
+}
+
+// validate checks the time, issuer and audience claims
+func (v *Verifier) validate(claims *Claims) error {
+	now := v.now()
+	if claims.ExpiresAt == 0 {
+		return fmt.Errorf("%w: no exp claim", ErrTokenExpired)
+	}
+	if now.Add(-v.leeway).Unix() >= claims.ExpiresAt {
+		return ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(v.leeway).Unix() < claims.NotBefore {
+		return ErrTokenNotYetValid
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return fmt.Errorf("%w: %q", ErrInvalidIssuer, claims.Issuer)
+	}
+	if v.audience != "" {
+		found := false
+		for _, aud := range claims.Audience {
+			if aud == v.audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: %q", ErrInvalidAudience, []string(claims.Audience))
+		}
+	}
+	return nil
+}
+
+// verifyWith reports whether signature is a valid signature of input by
+// key. Keys of the wrong type for their algorithm never verify.
+func verifyWith(key Key, input, signature []byte) bool {
+	switch key.Algorithm {
+	case HS256:
+		secret, ok := key.Key.([]byte)
+		if !ok || len(secret) == 0 {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case RS256:
+		pub, ok := key.Key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case EdDSA:
+		pub, ok := key.Key.(ed25519.PublicKey)
+		if !ok || len(pub) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(pub, input, signature)
+	}
+	return false
+}
+
+// Sign returns a token with claims signed by key, whose ID becomes the kid
+// header
+func Sign(claims *Claims, key Key) (string, error) {
+	header, err := json.Marshal(tokenHeader{Algorithm: key.Algorithm, KeyID: key.ID, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch k := key.Key.(type) {
+	case []byte:
+		if key.Algorithm != HS256 {
+			return "", fmt.Errorf("%w: %s with an HMAC key", ErrUnsupportedAlgorithm, key.Algorithm)
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		if key.Algorithm != RS256 {
+			return "", fmt.Errorf("%w: %s with an RSA key", ErrUnsupportedAlgorithm, key.Algorithm)
+		}
+		digest := sha256.Sum256([]byte(input))
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	case ed25519.PrivateKey:
+		if key.Algorithm != EdDSA {
+			return "", fmt.Errorf("%w: %s with an Ed25519 key", ErrUnsupportedAlgorithm, key.Algorithm)
+		}
+		signature = ed25519.Sign(k, []byte(input))
+	default:
+		return "", fmt.Errorf("%w: unsupported signing key %T", ErrUnsupportedAlgorithm, key.Key)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a token into v
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// GetClaims returns the claims of the token verified by Auth
+func GetClaims(c *gin.Context) (*Claims, bool) {
+	value, ok := c.Get(ClaimsKey)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := value.(*Claims)
+	return claims, ok
+}
+
+// GetSubject returns the subject of the token verified by Auth, or "" if
+// the request was not authenticated
+func GetSubject(c *gin.Context) string {
+	return c.GetString(SubjectKey)
+}
@@ -0,0 +1,336 @@
+// Package middleware provides tests for bearer token verification.
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testSecret is the HS256 secret of the tests
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// testKeys are the RSA and Ed25519 keys of the tests, generated once
+var testKeys = func() struct {
+	rsa     *rsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+} {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return struct {
+		rsa     *rsa.PrivateKey
+		ed25519 ed25519.PrivateKey
+	}{rsaKey, edKey}
+}()
+
+// validClaims returns claims that pass every check of testConfig
+func validClaims() *Claims {
+	now := time.Now()
+	return &Claims{
+		Subject:   "user_1",
+		Issuer:    "dm-backend",
+		Audience:  Audience{"dm-api"},
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+}
+
+// testConfig returns a configuration requiring the issuer and audience of validClaims
+func testConfig() JWTConfig {
+	return JWTConfig{Secret: testSecret, Issuer: "dm-backend", Audience: "dm-api", Leeway: 30 * time.Second}
+}
+
+// mustSign signs claims with key or fails the test
+func mustSign(t *testing.T, claims *Claims, key Key) string {
+	t.Helper()
+	token, err := Sign(claims, key)
+	if err != nil {
+		t.Fatalf("Sign() returned an error: %v", err)
+	}
+	return token
+}
+
+// b64 encodes data as an unpadded base64url JWK member
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// writeJWKS writes a key set with the public RSA and Ed25519 test keys under the given IDs
+func writeJWKS(t *testing.T, path, rsaID, edID string) {
+	t.Helper()
+	pub := testKeys.rsa.PublicKey
+	set := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": rsaID, "alg": RS256, "use": "sig", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())},
+		{"kty": "OKP", "kid": edID, "crv": "Ed25519", "x": b64(testKeys.ed25519.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("Failed to marshal the key set: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write the key set: %v", err)
+	}
+}
+
+// TestVerify tests the signature and claim checks of tokens
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, "rsa-1", "ed-1")
+	config := testConfig()
+	config.JWKSFile = path
+	v, err := NewVerifier(config)
+	if err != nil {
+		t.Fatalf("NewVerifier() returned an error: %v", err)
+	}
+
+	hmacKey := Key{Algorithm: HS256, Key: []byte(testSecret)}
+	rsaKey := Key{ID: "rsa-1", Algorithm: RS256, Key: testKeys.rsa}
+	edKey := Key{ID: "ed-1", Algorithm: EdDSA, Key: testKeys.ed25519}
+	with := func(change func(c *Claims)) *Claims {
+		c := validClaims()
+		change(c)
+		return c
+	}
+	past := time.Now().Add(-time.Hour).Unix()
+	future := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"HS256", mustSign(t, validClaims(), hmacKey), nil},
+		{"RS256", mustSign(t, validClaims(), rsaKey), nil},
+		{"EdDSA", mustSign(t, validClaims(), edKey), nil},
+		{"EdDSA without kid", mustSign(t, validClaims(), Key{Algorithm: EdDSA, Key: testKeys.ed25519}), nil},
+		{"audience list", mustSign(t, with(func(c *Claims) { c.Audience = Audience{"other", "dm-api"} }), hmacKey), nil},
+		{"expired within leeway", mustSign(t, with(func(c *Claims) { c.ExpiresAt = time.Now().Add(-10 * time.Second).Unix() }), hmacKey), nil},
+		{"unknown kid", mustSign(t, validClaims(), Key{ID: "rsa-2", Algorithm: RS256, Key: testKeys.rsa}), ErrUnknownKey},
+		{"wrong secret", mustSign(t, validClaims(), Key{Algorithm: HS256, Key: []byte("another secret of thirty-two bytes")}), ErrInvalidSignature},
+		{"expired", mustSign(t, with(func(c *Claims) { c.ExpiresAt = past }), hmacKey), ErrTokenExpired},
+		{"no expiry", mustSign(t, with(func(c *Claims) { c.ExpiresAt = 0 }), hmacKey), ErrTokenExpired},
+		{"not yet valid", mustSign(t, with(func(c *Claims) { c.NotBefore = future }), hmacKey), ErrTokenNotYetValid},
+		{"wrong issuer", mustSign(t, with(func(c *Claims) { c.Issuer = "someone" }), hmacKey), ErrInvalidIssuer},
+		{"wrong audience", mustSign(t, with(func(c *Claims) { c.Audience = Audience{"other"} }), hmacKey), ErrInvalidAudience},
+		{"no audience", mustSign(t, with(func(c *Claims) { c.Audience = nil }), hmacKey), ErrInvalidAudience},
+		{"alg none", b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"user_1"}`)) + ".", ErrUnsupportedAlgorithm},
+		{"two parts", "a.b", ErrMalformedToken},
+		{"bad header", "!!!." + b64([]byte(`{}`)) + ".", ErrMalformedToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.Verify(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && claims.Subject != "user_1" {
+				t.Errorf("Verify() subject = %q, want user_1", claims.Subject)
+			}
+		})
+	}
+
+	// A token whose signature was made for other claims
+	token := mustSign(t, validClaims(), hmacKey)
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + b64([]byte(`{"sub":"admin","exp":`+big.NewInt(future).String()+`,"iss":"dm-backend","aud":"dm-api"}`)) + "." + parts[2]
+	if _, err := v.Verify(forged); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() of a forged token error = %v, want %v", err, ErrInvalidSignature)
+	}
+
+	// The RSA public key must not be usable as an HMAC secret
+	pubJSON, _ := json.Marshal(testKeys.rsa.PublicKey)
+	confused := mustSign(t, validClaims(), Key{ID: "rsa-1", Algorithm: HS256, Key: pubJSON})
+	if _, err := v.Verify(confused); err == nil {
+		t.Errorf("Verify() accepted an HS256 token signed with the RSA key ID")
+	}
+}
+
+// TestVerifyAlgorithms tests restricting the accepted algorithms
+func TestVerifyAlgorithms(t *testing.T) {
+	config := testConfig()
+	config.Algorithms = []string{RS256}
+	v, err := NewVerifier(config, StaticKeys{{Algorithm: RS256, Key: &testKeys.rsa.PublicKey}})
+	if err != nil {
+		t.Fatalf("NewVerifier() returned an error: %v", err)
+	}
+	if _, err := v.Verify(mustSign(t, validClaims(), Key{Algorithm: HS256, Key: []byte(testSecret)})); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("Verify() of an HS256 token error = %v, want %v", err, ErrUnsupportedAlgorithm)
+	}
+	if _, err := v.Verify(mustSign(t, validClaims(), Key{Algorithm: RS256, Key: testKeys.rsa})); err != nil {
+		t.Errorf("Verify() of an RS256 token returned an error: %v", err)
+	}
+
+	config.Algorithms = []string{"HS512"}
+	if _, err := NewVerifier(config); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("NewVerifier() with HS512 error = %v, want %v", err, ErrUnsupportedAlgorithm)
+	}
+}
+
+// TestJWKSFileRotation tests that keys are rotated by rewriting the key set file
+func TestJWKSFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, "rsa-1", "ed-1")
+	config := testConfig()
+	config.Secret = ""
+	config.JWKSFile = path
+	v, err := NewVerifier(config)
+	if err != nil {
+		t.Fatalf("NewVerifier() returned an error: %v", err)
+	}
+
+	old := mustSign(t, validClaims(), Key{ID: "rsa-1", Algorithm: RS256, Key: testKeys.rsa})
+	rotated := mustSign(t, validClaims(), Key{ID: "rsa-2", Algorithm: RS256, Key: testKeys.rsa})
+	if _, err := v.Verify(rotated); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Verify() before the rotation error = %v, want %v", err, ErrUnknownKey)
+	}
+
+	writeJWKS(t, path, "rsa-2", "ed-2")
+	// Make the change visible on file systems with a coarse modification time
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if _, err := v.Verify(rotated); err != nil {
+		t.Errorf("Verify() after the rotation returned an error: %v", err)
+	}
+	if _, err := v.Verify(old); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Verify() of a retired key error = %v, want %v", err, ErrUnknownKey)
+	}
+
+	// A broken file keeps the previous keys
+	os.WriteFile(path, []byte("not json"), 0644)
+	os.Chtimes(path, later.Add(time.Minute), later.Add(time.Minute))
+	if _, err := v.Verify(rotated); err != nil {
+		t.Errorf("Verify() after a broken update returned an error: %v", err)
+	}
+}
+
+// TestParseJWKS tests rejecting invalid key sets
+func TestParseJWKS(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		keys    int
+		wantErr error
+	}{
+		{"empty", `{"keys":[]}`, 0, nil},
+		{"oct", `{"keys":[{"kty":"oct","kid":"h1","k":"` + b64([]byte(testSecret)) + `"}]}`, 1, nil},
+		{"not json", `keys`, 0, ErrInvalidJWKS},
+		{"unknown type", `{"keys":[{"kty":"EC","crv":"P-256"}]}`, 0, ErrInvalidJWKS},
+		{"short RSA key", `{"keys":[{"kty":"RSA","n":"` + b64(big.NewInt(1<<40).Bytes()) + `","e":"AQAB"}]}`, 0, ErrInvalidJWKS},
+		{"mismatched alg", `{"keys":[{"kty":"oct","alg":"RS256","k":"c2VjcmV0"}]}`, 0, ErrInvalidJWKS},
+		{"bad Ed25519 key", `{"keys":[{"kty":"OKP","crv":"Ed25519","x":"AQAB"}]}`, 0, ErrInvalidJWKS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := ParseJWKS([]byte(tt.data))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseJWKS() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(keys) != tt.keys {
+				t.Errorf("ParseJWKS() returned %d keys, want %d", len(keys), tt.keys)
+			}
+		})
+	}
+
+	if _, err := NewJWKSFile(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, ErrInvalidJWKS) {
+		t.Errorf("NewJWKSFile() of a missing file error = %v, want %v", err, ErrInvalidJWKS)
+	}
+}
+
+// TestAuthClaims tests that Auth places the verified claims on the context
+func TestAuthClaims(t *testing.T) {
+	v, err := NewVerifier(testConfig())
+	if err != nil {
+		t.Fatalf("NewVerifier() returned an error: %v", err)
+	}
+	router := gin.New()
+	router.GET("/me", Auth(v), func(c *gin.Context) {
+		claims, ok := GetClaims(c)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "no claims"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"subject": GetSubject(c), "role": claims.Extra["role"]})
+	})
+
+	claims := validClaims()
+	claims.Extra = map[string]interface{}{"role": "admin", "sub": "ignored"}
+	req := httptest.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+mustSign(t, claims, Key{Algorithm: HS256, Key: []byte(testSecret)}))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to parse the response: %v", err)
+	}
+	if body["subject"] != "user_1" || body["role"] != "admin" {
+		t.Errorf("Expected subject user_1 and role admin, got %v", body)
+	}
+
+	req = httptest.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", "Bearer expired."+b64([]byte("{}"))+".sig")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("Expected status %d with an invalid_token challenge, got %d %q", http.StatusUnauthorized, w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+// TestRequireRole tests that RequireRole only admits tokens with the role claim
+func TestRequireRole(t *testing.T) {
+	v, err := NewVerifier(testConfig())
+	if err != nil {
+		t.Fatalf("NewVerifier() returned an error: %v", err)
+	}
+	router := gin.New()
+	router.GET("/admin", Auth(v), RequireRole(RoleAdmin), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name  string
+		extra map[string]interface{}
+		want  int
+	}{
+		{"admin", map[string]interface{}{RoleClaim: RoleAdmin}, http.StatusOK},
+		{"other role", map[string]interface{}{RoleClaim: "user"}, http.StatusForbidden},
+		{"role not a string", map[string]interface{}{RoleClaim: []string{RoleAdmin}}, http.StatusForbidden},
+		{"no role", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			claims.Extra = tt.extra
+			req := httptest.NewRequest("GET", "/admin", nil)
+			req.Header.Set("Authorization", "Bearer "+mustSign(t, claims, Key{Algorithm: HS256, Key: []byte(testSecret)}))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
@@ -5,6 +5,8 @@ package middleware
 import (
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,11 +15,11 @@ import (
 
 // CORSConfig holds CORS configuration options
 type CORSConfig struct {
-	AllowOrigins     []string
-	AllowMethods     []string
-	AllowHeaders     []string
-	AllowCredentials bool
-	MaxAge           time.Duration
+	AllowOrigins     []string      `yaml:"allow_origins" json:"allow_origins"`
+	AllowMethods     []string      `yaml:"allow_methods" json:"allow_methods"`
+	AllowHeaders     []string      `yaml:"allow_headers" json:"allow_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials" json:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age" json:"max_age"`
 }
 
 // DefaultCORSConfig returns a permissive CORS configuration for development
@@ -95,8 +97,8 @@ func Logger() gin.HandlerFunc {
 
 // RateLimiter configuration
 type RateLimiterConfig struct {
-	RequestsPerSecond int
-	BurstSize         int
+	RequestsPerSecond int `yaml:"requests_per_second" json:"requests_per_second"`
+	BurstSize         int `yaml:"burst_size" json:"burst_size"`
 }
 
 // RateLimiter implements a simple rate limiter using token bucket algorithm
@@ -185,13 +187,14 @@ func Recovery() gin.HandlerFunc {
 	}
 }
 
-// Auth returns an authentication middleware
-// Currently checks for the presence of an Authorization header
-// TODO: Implement proper JWT validation
-func Auth() gin.HandlerFunc {
+// Auth returns an authentication middleware that requires a bearer token
+// verified by v. The subject and claims of the token are set on the context
+// under SubjectKey and ClaimsKey; see GetSubject and GetClaims.
+func Auth(v *Verifier) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
+			c.Header("WWW-Authenticate", "Bearer")
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"success": false,
 				"error":   "Authorization header required",
@@ -200,9 +203,40 @@ func Auth() gin.HandlerFunc {
 			return
 		}
 
-		// TODO: Validate JWT token here
-		// For now, just check if header exists
+		var claims *Claims
+		err := ErrMissingToken
+		scheme, token, _ := strings.Cut(authHeader, " ")
+		if token = strings.TrimSpace(token); strings.EqualFold(scheme, "Bearer") && token != "" {
+			claims, err = v.Verify(token)
+		}
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"error":   "Invalid token: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
 
+		c.Set(SubjectKey, claims.Subject)
+		c.Set(ClaimsKey, claims)
+		c.Next()
+	}
+}
+
+// RequireRole returns a middleware, used after Auth, that rejects requests
+// whose token does not carry the given role claim with 403 Forbidden
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if claims, ok := GetClaims(c); !ok || claims.Role() != role {
+			c.JSON(http.StatusForbidden, gin.H{
+				"success": false,
+				"error":   "Forbidden: the " + role + " role is required",
+			})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
@@ -234,7 +268,7 @@ func joinStrings(strs []string, sep string) string {
 }
 
 func formatDuration(d time.Duration) string {
-	return string(rune(int(d.Seconds())))
+	return strconv.Itoa(int(d.Seconds()))
 }
 
 func generateRequestID() string {
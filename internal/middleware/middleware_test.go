@@ -58,6 +58,9 @@ func TestCORSMiddleware(t *testing.T) {
 			if w.Header().Get("Access-Control-Allow-Origin") == "" && tt.method != "OPTIONS" {
 				t.Error("Expected Access-Control-Allow-Origin header to be set")
 			}
+			if got := w.Header().Get("Access-Control-Max-Age"); got != "43200" {
+				t.Errorf("Expected Access-Control-Max-Age 43200, got %q", got)
+			}
 		})
 	}
 }
@@ -171,10 +174,20 @@ func TestRecoveryMiddleware(t *testing.T) {
 
 // TestAuthMiddleware tests authentication middleware
 func TestAuthMiddleware(t *testing.T) {
+	key := Key{Algorithm: HS256, Key: []byte(testSecret)}
+	verifier, err := NewVerifier(JWTConfig{Secret: testSecret})
+	if err != nil {
+		t.Fatalf("NewVerifier() returned an error: %v", err)
+	}
+	token, err := Sign(&Claims{Subject: "user_1", ExpiresAt: time.Now().Add(time.Hour).Unix()}, key)
+	if err != nil {
+		t.Fatalf("Sign() returned an error: %v", err)
+	}
+
 	router := gin.New()
-	router.Use(Auth())
+	router.Use(Auth(verifier))
 	router.GET("/protected", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "subject": GetSubject(c)})
 	})
 
 	tests := []struct {
@@ -183,10 +196,20 @@ func TestAuthMiddleware(t *testing.T) {
 		expectedStatus int
 	}{
 		{
-			name:           "With auth header",
-			authHeader:     "Bearer token123",
+			name:           "With a valid token",
+			authHeader:     "Bearer " + token,
 			expectedStatus: http.StatusOK,
 		},
+		{
+			name:           "With an invalid token",
+			authHeader:     "Bearer token123",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "With another scheme",
+			authHeader:     "Basic " + token,
+			expectedStatus: http.StatusUnauthorized,
+		},
 		{
 			name:           "Without auth header",
 			authHeader:     "",
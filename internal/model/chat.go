@@ -3,11 +3,12 @@
 package model
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 
-	"github.com/TeamPentagon/DM-Backend/internal/database"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -19,20 +20,109 @@ var (
 	ErrInvalidConvID       = errors.New("conversation ID cannot be empty")
 )
 
-// SaveMessage persists a message to the LevelDB database.
-// Uses the message ID as the key with a "chat_" prefix.
+// NewMessageID returns a random identifier for a new message.
+func NewMessageID() string {
+	return newID("msg")
+}
+
+// NewConversationID returns a random identifier for a new conversation.
+func NewConversationID() string {
+	return newID("conv")
+}
+
+// newID returns a random hex identifier with the given prefix.
+func newID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("%s_%s", prefix, hex.EncodeToString(b))
+}
+
+// SaveMessage persists a message to the message repository.
+// Uses the message ID as the key in the MessageKeys keyspace.
 // Returns an error if the database operation fails.
 func (msg *Message) SaveMessage() error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Messages.SaveMessage(msg)
+}
+
+// SaveChatHistory persists a chat history to the conversation repository.
+// Uses the conversation ID as the key in the HistoryKeys keyspace.
+// Returns an error if the database operation fails.
+func (msg *ChatHistory) SaveChatHistory() error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Conversations.SaveChatHistory(msg)
+}
+
+// Delete removes a message from the database.
+// Returns an error if the message is not found or if the delete operation fails.
+func (msg *Message) Delete() error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Messages.DeleteMessage(msg)
+}
+
+// Update modifies an existing message in the database.
+// Returns an error if the message is not found or if the update operation fails.
+func (msg *Message) Update() error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Messages.UpdateMessage(msg)
+}
+
+// Get retrieves a message from the database using its message ID.
+// The retrieved data is unmarshaled into the Message struct receiver.
+// Returns an error if the message is not found or if database operations fail.
+func (msg *Message) Get() error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Messages.GetMessage(msg)
+}
+
+// GetChatHistory retrieves a chat history from the database using its conversation ID.
+// Returns an error if the history is not found or if database operations fail.
+func (ch *ChatHistory) GetChatHistory() error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Conversations.GetChatHistory(ch)
+}
+
+// AddMessageToHistory adds a message to an existing chat history.
+// If the history doesn't exist, it creates a new one.
+func (ch *ChatHistory) AddMessageToHistory(msg *Message) error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Conversations.AddMessageToHistory(ch, msg)
+}
+
+// SaveMessage persists a message under its ID in the MessageKeys keyspace
+func (s *Store) SaveMessage(msg *Message) error {
 	if msg.GetMsgId() == "" {
 		return ErrInvalidMessageID
 	}
 
-	db, err := database.CreateLevelDBDatabase("Database/", "Common", "Shard_0.sqlite")
+	defer s.lock(MessageKeys, msg.GetMsgId())()
+
+	db, err := s.place(MessageKeys, msg.GetMsgId())
 	if err != nil {
 		log.Printf("Error opening database: %v", err)
 		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
 	}
-	defer db.Close()
 
 	byteData, err := proto.Marshal(msg)
 	if err != nil {
@@ -40,7 +130,7 @@ func (msg *Message) SaveMessage() error {
 		return fmt.Errorf("%w: %v", ErrSerialize, err)
 	}
 
-	err = db.Put([]byte(fmt.Sprintf("chat_%s", msg.GetMsgId())), byteData, nil)
+	err = db.Put(MessageKeys.Key(msg.GetMsgId()), byteData, nil)
 	if err != nil {
 		log.Printf("Error writing message to database: %v", err)
 		return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
@@ -49,28 +139,33 @@ func (msg *Message) SaveMessage() error {
 	return nil
 }
 
-// SaveChatHistory persists a chat history to the LevelDB database.
-// Uses the conversation ID as the key with a "chat_" prefix.
-// Returns an error if the database operation fails.
-func (msg *ChatHistory) SaveChatHistory() error {
-	if msg.GetConversationId() == "" {
+// SaveChatHistory persists a chat history under its conversation ID in the
+// HistoryKeys keyspace
+func (s *Store) SaveChatHistory(ch *ChatHistory) error {
+	if ch.GetConversationId() == "" {
 		return ErrInvalidConvID
 	}
 
-	db, err := database.CreateLevelDBDatabase("Database/", "Common", "Shard_0.sqlite")
+	defer s.lock(HistoryKeys, ch.GetConversationId())()
+	return s.putChatHistory(ch)
+}
+
+// putChatHistory writes ch to its shard. The caller holds the lock of the
+// history.
+func (s *Store) putChatHistory(ch *ChatHistory) error {
+	db, err := s.place(HistoryKeys, ch.GetConversationId())
 	if err != nil {
 		log.Printf("Error opening database: %v", err)
 		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
 	}
-	defer db.Close()
 
-	byteData, err := proto.Marshal(msg)
+	byteData, err := proto.Marshal(ch)
 	if err != nil {
 		log.Printf("Error marshaling chat history: %v", err)
 		return fmt.Errorf("%w: %v", ErrSerialize, err)
 	}
 
-	err = db.Put([]byte(fmt.Sprintf("history_%s", msg.GetConversationId())), byteData, nil)
+	err = db.Put(HistoryKeys.Key(ch.GetConversationId()), byteData, nil)
 	if err != nil {
 		log.Printf("Error writing chat history to database: %v", err)
 		return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
@@ -79,21 +174,21 @@ func (msg *ChatHistory) SaveChatHistory() error {
 	return nil
 }
 
-// Delete removes a message from the database.
-// Returns an error if the message is not found or if the delete operation fails.
-func (msg *Message) Delete() error {
+// DeleteMessage removes a stored message
+func (s *Store) DeleteMessage(msg *Message) error {
 	if msg.GetMsgId() == "" {
 		return ErrInvalidMessageID
 	}
 
-	db, err := database.CreateLevelDBDatabase("Database/", "NOSQL", "/")
+	defer s.lock(MessageKeys, msg.GetMsgId())()
+
+	db, err := s.route(MessageKeys, msg.GetMsgId())
 	if err != nil {
 		log.Printf("Error opening database: %v", err)
 		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
 	}
-	defer db.Close()
 
-	key := []byte(fmt.Sprintf("chat_%s", msg.GetMsgId()))
+	key := MessageKeys.Key(msg.GetMsgId())
 
 	// Check if message exists
 	_, err = db.Get(key, nil)
@@ -108,24 +203,24 @@ func (msg *Message) Delete() error {
 		return fmt.Errorf("%w: %v", ErrDatabaseDelete, err)
 	}
 
-	return nil
+	return s.unplace(MessageKeys, msg.GetMsgId())
 }
 
-// Update modifies an existing message in the database.
-// Returns an error if the message is not found or if the update operation fails.
-func (msg *Message) Update() error {
+// UpdateMessage replaces an existing stored message
+func (s *Store) UpdateMessage(msg *Message) error {
 	if msg.GetMsgId() == "" {
 		return ErrInvalidMessageID
 	}
 
-	db, err := database.CreateLevelDBDatabase("Database/", "NOSQL", "/")
+	defer s.lock(MessageKeys, msg.GetMsgId())()
+
+	db, err := s.route(MessageKeys, msg.GetMsgId())
 	if err != nil {
 		log.Printf("Error opening database: %v", err)
 		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
 	}
-	defer db.Close()
 
-	key := []byte(fmt.Sprintf("chat_%s", msg.GetMsgId()))
+	key := MessageKeys.Key(msg.GetMsgId())
 
 	// Check if message exists
 	_, err = db.Get(key, nil)
@@ -150,22 +245,19 @@ func (msg *Message) Update() error {
 	return nil
 }
 
-// Get retrieves a message from the database using its message ID.
-// The retrieved data is unmarshaled into the Message struct receiver.
-// Returns an error if the message is not found or if database operations fail.
-func (msg *Message) Get() error {
+// GetMessage reads the message with the ID of msg into msg
+func (s *Store) GetMessage(msg *Message) error {
 	if msg.GetMsgId() == "" {
 		return ErrInvalidMessageID
 	}
 
-	db, err := database.CreateLevelDBDatabase("Database/", "NOSQL", "/")
+	db, err := s.route(MessageKeys, msg.GetMsgId())
 	if err != nil {
 		log.Printf("Error opening database: %v", err)
 		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
 	}
-	defer db.Close()
 
-	data, err := db.Get([]byte(fmt.Sprintf("chat_%s", msg.GetMsgId())), nil)
+	data, err := db.Get(MessageKeys.Key(msg.GetMsgId()), nil)
 	if err != nil {
 		log.Printf("Error reading message %s: %v", msg.GetMsgId(), err)
 		return fmt.Errorf("%w: %v", ErrMessageNotFound, err)
@@ -180,21 +272,19 @@ func (msg *Message) Get() error {
 	return nil
 }
 
-// GetChatHistory retrieves a chat history from the database using its conversation ID.
-// Returns an error if the history is not found or if database operations fail.
-func (ch *ChatHistory) GetChatHistory() error {
+// GetChatHistory reads the history with the conversation ID of ch into ch
+func (s *Store) GetChatHistory(ch *ChatHistory) error {
 	if ch.GetConversationId() == "" {
 		return ErrInvalidConvID
 	}
 
-	db, err := database.CreateLevelDBDatabase("Database/", "Common", "Shard_0.sqlite")
+	db, err := s.route(HistoryKeys, ch.GetConversationId())
 	if err != nil {
 		log.Printf("Error opening database: %v", err)
 		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
 	}
-	defer db.Close()
 
-	data, err := db.Get([]byte(fmt.Sprintf("history_%s", ch.GetConversationId())), nil)
+	data, err := db.Get(HistoryKeys.Key(ch.GetConversationId()), nil)
 	if err != nil {
 		log.Printf("Error reading chat history %s: %v", ch.GetConversationId(), err)
 		return fmt.Errorf("%w: %v", ErrChatHistoryNotFound, err)
@@ -209,9 +299,10 @@ func (ch *ChatHistory) GetChatHistory() error {
 	return nil
 }
 
-// AddMessageToHistory adds a message to an existing chat history.
-// If the history doesn't exist, it creates a new one.
-func (ch *ChatHistory) AddMessageToHistory(msg *Message) error {
+// AddMessageToHistory appends msg to the stored history of ch, creating the
+// history if needed. Concurrent additions to one conversation are serialized
+// so no message is lost.
+func (s *Store) AddMessageToHistory(ch *ChatHistory, msg *Message) error {
 	if ch.GetConversationId() == "" {
 		return ErrInvalidConvID
 	}
@@ -219,8 +310,10 @@ func (ch *ChatHistory) AddMessageToHistory(msg *Message) error {
 		return ErrInvalidMessageID
 	}
 
+	defer s.lock(HistoryKeys, ch.GetConversationId())()
+
 	// Try to get existing history
-	err := ch.GetChatHistory()
+	err := s.GetChatHistory(ch)
 	if err != nil {
 		// Create new history if not found
 		ch.Messages = []*Message{}
@@ -230,5 +323,5 @@ func (ch *ChatHistory) AddMessageToHistory(msg *Message) error {
 	ch.Messages = append(ch.Messages, msg)
 
 	// Save the updated history
-	return ch.SaveChatHistory()
+	return s.putChatHistory(ch)
 }
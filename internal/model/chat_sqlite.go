@@ -0,0 +1,252 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+)
+
+// messageColumns lists the columns of the messages table in the order read
+// by GetMessage and written by SaveMessage
+const messageColumns = `msg_id, conversation_id, user_id, ai_id, content, timestamp`
+
+// SQLiteChats stores messages and chat histories as rows of SQLite tables.
+// Each history keeps its own copy of its messages, in the order they were
+// added, like the histories of Store. It is safe for concurrent use.
+type SQLiteChats struct {
+	db *sql.DB
+}
+
+// OpenSQLiteChats returns the chat store in the SQLite database of db,
+// migrating its schema on first use
+func OpenSQLiteChats(db *database.Store) (*SQLiteChats, error) {
+	sqlDB, err := openSQLite(db)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteChats{db: sqlDB}, nil
+}
+
+// NewSQLiteChats creates a chat store over db and migrates its schema to
+// the latest version
+func NewSQLiteChats(db *sql.DB) (*SQLiteChats, error) {
+	if err := migrateSQLite(db); err != nil {
+		return nil, err
+	}
+	return &SQLiteChats{db: db}, nil
+}
+
+// SaveMessage inserts msg, or replaces the message with the same ID
+func (s *SQLiteChats) SaveMessage(msg *Message) error {
+	if msg.GetMsgId() == "" {
+		return ErrInvalidMessageID
+	}
+
+	_, err := s.db.Exec(`INSERT INTO messages (`+messageColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (msg_id) DO UPDATE SET
+			conversation_id = excluded.conversation_id, user_id = excluded.user_id,
+			ai_id = excluded.ai_id, content = excluded.content, timestamp = excluded.timestamp`,
+		msg.MsgId, msg.ConversationId, msg.UserId, msg.AiId, msg.Content, msg.Timestamp)
+	if err != nil {
+		log.Printf("Error writing message to database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+	}
+	return nil
+}
+
+// GetMessage reads the message with the ID of msg into msg
+func (s *SQLiteChats) GetMessage(msg *Message) error {
+	if msg.GetMsgId() == "" {
+		return ErrInvalidMessageID
+	}
+
+	var m Message
+	err := s.db.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE msg_id = ?`, msg.MsgId).
+		Scan(&m.MsgId, &m.ConversationId, &m.UserId, &m.AiId, &m.Content, &m.Timestamp)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Error reading message %s: not found", msg.MsgId)
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, msg.MsgId)
+	}
+	if err != nil {
+		log.Printf("Error reading message %s: %v", msg.MsgId, err)
+		return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+
+	msg.MsgId, msg.ConversationId, msg.UserId = m.MsgId, m.ConversationId, m.UserId
+	msg.AiId, msg.Content, msg.Timestamp = m.AiId, m.Content, m.Timestamp
+	return nil
+}
+
+// UpdateMessage replaces the existing message with the ID of msg
+func (s *SQLiteChats) UpdateMessage(msg *Message) error {
+	if msg.GetMsgId() == "" {
+		return ErrInvalidMessageID
+	}
+
+	result, err := s.db.Exec(`UPDATE messages SET
+			conversation_id = ?, user_id = ?, ai_id = ?, content = ?, timestamp = ?
+		WHERE msg_id = ?`,
+		msg.ConversationId, msg.UserId, msg.AiId, msg.Content, msg.Timestamp, msg.MsgId)
+	if err != nil {
+		log.Printf("Error updating message: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+	}
+	return affected(result, ErrDatabaseWrite, ErrMessageNotFound, msg.MsgId)
+}
+
+// DeleteMessage removes the message with the ID of msg
+func (s *SQLiteChats) DeleteMessage(msg *Message) error {
+	if msg.GetMsgId() == "" {
+		return ErrInvalidMessageID
+	}
+
+	result, err := s.db.Exec(`DELETE FROM messages WHERE msg_id = ?`, msg.MsgId)
+	if err != nil {
+		log.Printf("Error deleting message: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseDelete, err)
+	}
+	return affected(result, ErrDatabaseDelete, ErrMessageNotFound, msg.MsgId)
+}
+
+// SaveChatHistory replaces the history with the conversation ID of ch
+func (s *SQLiteChats) SaveChatHistory(ch *ChatHistory) error {
+	if ch.GetConversationId() == "" {
+		return ErrInvalidConvID
+	}
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO conversations (conversation_id) VALUES (?)`,
+			ch.ConversationId); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM history_messages WHERE conversation_id = ?`,
+			ch.ConversationId); err != nil {
+			return err
+		}
+		for i, msg := range ch.Messages {
+			if err := insertHistoryMessage(tx, ch.ConversationId, msg, i+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error writing chat history to database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+	}
+	return nil
+}
+
+// GetChatHistory reads the history with the conversation ID of ch into ch
+func (s *SQLiteChats) GetChatHistory(ch *ChatHistory) error {
+	if ch.GetConversationId() == "" {
+		return ErrInvalidConvID
+	}
+
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM conversations WHERE conversation_id = ?)`,
+		ch.ConversationId).Scan(&exists)
+	if err != nil {
+		log.Printf("Error reading chat history %s: %v", ch.ConversationId, err)
+		return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+	if !exists {
+		log.Printf("Error reading chat history %s: not found", ch.ConversationId)
+		return fmt.Errorf("%w: %s", ErrChatHistoryNotFound, ch.ConversationId)
+	}
+
+	rows, err := s.db.Query(`SELECT msg_id, msg_conversation_id, user_id, ai_id, content, timestamp
+		FROM history_messages WHERE conversation_id = ? ORDER BY seq`, ch.ConversationId)
+	if err != nil {
+		log.Printf("Error reading chat history %s: %v", ch.ConversationId, err)
+		return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		m := &Message{}
+		if err := rows.Scan(&m.MsgId, &m.ConversationId, &m.UserId, &m.AiId, &m.Content, &m.Timestamp); err != nil {
+			return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+	ch.Messages = messages
+	return nil
+}
+
+// AddMessageToHistory appends msg to the stored history of ch, creating the
+// history if needed, and reads the result into ch. The message is inserted
+// after the last one in a single transaction, so concurrent additions are
+// all kept.
+func (s *SQLiteChats) AddMessageToHistory(ch *ChatHistory, msg *Message) error {
+	if ch.GetConversationId() == "" {
+		return ErrInvalidConvID
+	}
+	if msg == nil {
+		return ErrInvalidMessageID
+	}
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO conversations (conversation_id) VALUES (?)`,
+			ch.ConversationId); err != nil {
+			return err
+		}
+		var seq int
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) + 1 FROM history_messages
+			WHERE conversation_id = ?`, ch.ConversationId).Scan(&seq); err != nil {
+			return err
+		}
+		return insertHistoryMessage(tx, ch.ConversationId, msg, seq)
+	})
+	if err != nil {
+		log.Printf("Error writing chat history to database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+	}
+	return s.GetChatHistory(ch)
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds
+func (s *SQLiteChats) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertHistoryMessage stores a copy of msg at position seq of the history
+// of conversation
+func insertHistoryMessage(tx *sql.Tx, conversation string, msg *Message, seq int) error {
+	_, err := tx.Exec(`INSERT INTO history_messages
+		(conversation_id, seq, msg_id, msg_conversation_id, user_id, ai_id, content, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		conversation, seq, msg.GetMsgId(), msg.GetConversationId(), msg.GetUserId(),
+		msg.GetAiId(), msg.GetContent(), msg.GetTimestamp())
+	return err
+}
+
+// affected checks that a write changed a row, returning notFound for id when
+// it did not and failed when the count cannot be read
+func affected(result sql.Result, failed, notFound error, id string) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%w: %v", failed, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", notFound, id)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Keyspace names where one kind of record is stored: the database that
+// holds it and the prefix that turns a record ID into its key.
+type Keyspace struct {
+	// Name identifies the keyspace in logs and migration reports
+	Name string
+	// Prefix is prepended to record IDs to form their keys
+	Prefix string
+	// Shard pins the records to the named shard database. Empty spreads
+	// them over the shards through the fragmentation schema.
+	Shard string
+}
+
+// The keyspace registry. Every model method reads and writes its records
+// through one of these entries.
+var (
+	// UserKeys holds users keyed by PersonId
+	UserKeys = Keyspace{Name: "users", Prefix: "user_"}
+	// MessageKeys holds messages keyed by message ID
+	MessageKeys = Keyspace{Name: "messages", Prefix: "chat_"}
+	// HistoryKeys holds chat histories keyed by conversation ID
+	HistoryKeys = Keyspace{Name: "histories", Prefix: "history_"}
+	// SessionKeys holds refresh token sessions keyed by session ID
+	SessionKeys = Keyspace{Name: "sessions", Prefix: "session_"}
+	// UserNameKeys indexes users by user name, in the shard of each user
+	UserNameKeys = Keyspace{Name: "user_names", Prefix: "idx_user_name_"}
+	// UserEmailKeys indexes users by email, in the shard of each user
+	UserEmailKeys = Keyspace{Name: "user_emails", Prefix: "idx_user_email_"}
+	// UserPhoneKeys indexes users by phone number, in the shard of each user
+	UserPhoneKeys = Keyspace{Name: "user_phones", Prefix: "idx_user_phone_"}
+	// UserSessionKeys indexes sessions by user, in the shard of each session
+	UserSessionKeys = Keyspace{Name: "user_sessions", Prefix: "idx_session_user_"}
+)
+
+// Keyspaces returns every registered keyspace
+func Keyspaces() []Keyspace {
+	return []Keyspace{UserKeys, MessageKeys, HistoryKeys, SessionKeys, UserNameKeys, UserEmailKeys, UserPhoneKeys, UserSessionKeys}
+}
+
+// Key returns the key of the record with the given ID
+func (k Keyspace) Key(id string) []byte {
+	return []byte(k.Prefix + id)
+}
+
+// ID returns the record ID of key and whether key belongs to the keyspace
+func (k Keyspace) ID(key []byte) (string, bool) {
+	if !strings.HasPrefix(string(key), k.Prefix) {
+		return "", false
+	}
+	return string(key[len(k.Prefix):]), true
+}
+
+// lock locks the record of k with the given ID against other writers and
+// shard moves. Writers hold it from routing the record to writing it.
+func (s *Store) lock(k Keyspace, id string) (unlock func()) {
+	return s.db.LockKey(k.Prefix + id)
+}
+
+// route returns the database holding the record of k with the given ID.
+// Keys without a schema entry are read from the default shard, which holds
+// records written before they were assigned a shard.
+func (s *Store) route(k Keyspace, id string) (*leveldb.DB, error) {
+	if k.Shard != "" {
+		return s.db.Shard(k.Shard)
+	}
+
+	shard, ok, err := s.schema.Lookup(k.Prefix + id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return s.db.DefaultShard()
+	}
+	return s.db.ShardNumber(shard)
+}
+
+// place returns the database the record of k with the given ID is written
+// to, assigning the key a shard on its first write
+func (s *Store) place(k Keyspace, id string) (*leveldb.DB, error) {
+	if k.Shard != "" {
+		return s.db.Shard(k.Shard)
+	}
+
+	shard, err := s.schema.Assign(k.Prefix+id, s.placement)
+	if err != nil {
+		return nil, err
+	}
+	return s.db.ShardNumber(shard)
+}
+
+// unplace removes the shard assignment of a deleted record
+func (s *Store) unplace(k Keyspace, id string) error {
+	if k.Shard != "" {
+		return nil
+	}
+
+	key := k.Prefix + id
+	if _, ok, err := s.schema.Lookup(key); err != nil || !ok {
+		return err
+	}
+	if err := s.schema.Remove(key); err != nil {
+		return fmt.Errorf("failed to remove the shard of %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+package model
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// MemoryStore keeps users, messages, chat histories and sessions in memory. It
+// implements every repository without touching disk, for tests and local
+// development. Records are copied in and out, so callers never share them.
+// It is safe for concurrent use.
+type MemoryStore struct {
+	mu        sync.Mutex
+	users     map[string]*User
+	messages  map[string]*Message
+	histories map[string]*ChatHistory
+	sessions  map[string]Session
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:     make(map[string]*User),
+		messages:  make(map[string]*Message),
+		histories: make(map[string]*ChatHistory),
+		sessions:  make(map[string]Session),
+	}
+}
+
+// SaveUser stores a copy of u under its PersonId
+func (m *MemoryStore) SaveUser(u *User) error {
+	if u.PersonId == "" {
+		return ErrInvalidUsername
+	}
+	if err := hashUserPassword(u); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkUnique(u, u.PersonId); err != nil {
+		return err
+	}
+	m.users[u.PersonId] = proto.Clone(u).(*User)
+	return nil
+}
+
+// CreateUser stores a copy of u under its PersonId unless a user is already
+// stored under it
+func (m *MemoryStore) CreateUser(u *User) error {
+	if u.PersonId == "" {
+		return ErrInvalidUsername
+	}
+	if err := hashUserPassword(u); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[u.PersonId]; ok {
+		return fmt.Errorf("%w: %s", ErrDuplicateUser, u.PersonId)
+	}
+	if err := m.checkUnique(u, u.PersonId); err != nil {
+		return err
+	}
+	m.users[u.PersonId] = proto.Clone(u).(*User)
+	return nil
+}
+
+// GetUser reads the user stored under id into u
+func (m *MemoryStore) GetUser(u *User, id string) error {
+	if id == "" {
+		return ErrInvalidUsername
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[id]
+	if !ok {
+		return fmt.Errorf("%w: %w", ErrDatabaseRead, ErrUserNotFound)
+	}
+	proto.Reset(u)
+	proto.Merge(u, stored)
+	return nil
+}
+
+// UpdateUser replaces the existing user stored under id with u
+func (m *MemoryStore) UpdateUser(u *User, id string) error {
+	if id == "" {
+		return ErrInvalidUsername
+	}
+	if err := hashUserPassword(u); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[id]; !ok {
+		return fmt.Errorf("%w: %w", ErrDatabaseRead, ErrUserNotFound)
+	}
+	if err := m.checkUnique(u, id); err != nil {
+		return err
+	}
+	m.users[id] = proto.Clone(u).(*User)
+	return nil
+}
+
+// ModifyUser calls modify on a copy of the user stored under id and stores
+// the result
+func (m *MemoryStore) ModifyUser(id string, modify func(*User) error) error {
+	if id == "" {
+		return ErrInvalidUsername
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[id]
+	if !ok {
+		return fmt.Errorf("%w: %w", ErrDatabaseRead, ErrUserNotFound)
+	}
+	u := proto.Clone(stored).(*User)
+	if err := modify(u); err != nil {
+		return err
+	}
+	if err := hashUserPassword(u); err != nil {
+		return err
+	}
+	if err := m.checkUnique(u, id); err != nil {
+		return err
+	}
+	m.users[id] = u
+	return nil
+}
+
+// DeleteUser removes the user stored under id
+func (m *MemoryStore) DeleteUser(id string) error {
+	if id == "" {
+		return ErrInvalidUsername
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id)
+	}
+	delete(m.users, id)
+	return nil
+}
+
+// UserExists reports whether a user is stored under id
+func (m *MemoryStore) UserExists(id string) (bool, error) {
+	if id == "" {
+		return false, ErrInvalidUsername
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.users[id]
+	return ok, nil
+}
+
+// FindUserByName reads the user with the given user name into u
+func (m *MemoryStore) FindUserByName(u *User, name string) error {
+	return m.findIndexed(userNameIndex, u, name)
+}
+
+// FindUserByEmail reads the user with the given email into u
+func (m *MemoryStore) FindUserByEmail(u *User, email string) error {
+	return m.findIndexed(userEmailIndex, u, email)
+}
+
+// FindUserByPhone reads a user with the given phone number into u. Phone
+// numbers are not unique; the user with the lowest PersonId is returned.
+func (m *MemoryStore) FindUserByPhone(u *User, phone string) error {
+	return m.findIndexed(userPhoneIndex, u, phone)
+}
+
+// findIndexed reads the user with the lowest PersonId whose field of x
+// equals value into u
+func (m *MemoryStore) findIndexed(x userIndex, u *User, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value = x.normalized(value)
+	found := ""
+	for id, stored := range m.users {
+		if value != "" && x.value(stored) == value && (found == "" || id < found) {
+			found = id
+		}
+	}
+	if found == "" {
+		return fmt.Errorf("%w: %w", ErrDatabaseRead, ErrUserNotFound)
+	}
+	proto.Reset(u)
+	proto.Merge(u, m.users[found])
+	return nil
+}
+
+// checkUnique returns ErrDuplicateUser if a user other than id has the user
+// name or email of u. The caller holds mu.
+func (m *MemoryStore) checkUnique(u *User, id string) error {
+	for other, stored := range m.users {
+		if other == id {
+			continue
+		}
+		for _, x := range userIndexes {
+			if value := x.value(u); x.unique && value != "" && x.value(stored) == value {
+				return fmt.Errorf("%w: %s %q belongs to %s", ErrDuplicateUser, x.field, value, other)
+			}
+		}
+	}
+	return nil
+}
+
+// SaveMessage stores a copy of msg under its ID
+func (m *MemoryStore) SaveMessage(msg *Message) error {
+	if msg.GetMsgId() == "" {
+		return ErrInvalidMessageID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages[msg.GetMsgId()] = proto.Clone(msg).(*Message)
+	return nil
+}
+
+// GetMessage reads the message with the ID of msg into msg
+func (m *MemoryStore) GetMessage(msg *Message) error {
+	if msg.GetMsgId() == "" {
+		return ErrInvalidMessageID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.messages[msg.GetMsgId()]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, msg.GetMsgId())
+	}
+	proto.Reset(msg)
+	proto.Merge(msg, stored)
+	return nil
+}
+
+// UpdateMessage replaces the existing message with the ID of msg
+func (m *MemoryStore) UpdateMessage(msg *Message) error {
+	if msg.GetMsgId() == "" {
+		return ErrInvalidMessageID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.messages[msg.GetMsgId()]; !ok {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, msg.GetMsgId())
+	}
+	m.messages[msg.GetMsgId()] = proto.Clone(msg).(*Message)
+	return nil
+}
+
+// DeleteMessage removes the message with the ID of msg
+func (m *MemoryStore) DeleteMessage(msg *Message) error {
+	if msg.GetMsgId() == "" {
+		return ErrInvalidMessageID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.messages[msg.GetMsgId()]; !ok {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, msg.GetMsgId())
+	}
+	delete(m.messages, msg.GetMsgId())
+	return nil
+}
+
+// SaveChatHistory stores a copy of ch under its conversation ID
+func (m *MemoryStore) SaveChatHistory(ch *ChatHistory) error {
+	if ch.GetConversationId() == "" {
+		return ErrInvalidConvID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.histories[ch.GetConversationId()] = proto.Clone(ch).(*ChatHistory)
+	return nil
+}
+
+// GetChatHistory reads the history with the conversation ID of ch into ch
+func (m *MemoryStore) GetChatHistory(ch *ChatHistory) error {
+	if ch.GetConversationId() == "" {
+		return ErrInvalidConvID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.histories[ch.GetConversationId()]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrChatHistoryNotFound, ch.GetConversationId())
+	}
+	proto.Reset(ch)
+	proto.Merge(ch, stored)
+	return nil
+}
+
+// AddMessageToHistory appends msg to the stored history of ch, creating the
+// history if needed, and reads the result into ch
+func (m *MemoryStore) AddMessageToHistory(ch *ChatHistory, msg *Message) error {
+	if ch.GetConversationId() == "" {
+		return ErrInvalidConvID
+	}
+	if msg == nil {
+		return ErrInvalidMessageID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.histories[ch.GetConversationId()]
+	if !ok {
+		stored = &ChatHistory{ConversationId: ch.GetConversationId()}
+		m.histories[ch.GetConversationId()] = stored
+	}
+	stored.Messages = append(stored.Messages, proto.Clone(msg).(*Message))
+	proto.Reset(ch)
+	proto.Merge(ch, stored)
+	return nil
+}
+
+// SaveSession stores a copy of s under its ID
+func (m *MemoryStore) SaveSession(s *Session) error {
+	if s.ID == "" {
+		return ErrInvalidSessionID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID] = copySession(s)
+	return nil
+}
+
+// GetSession reads the session stored under id into s
+func (m *MemoryStore) GetSession(s *Session, id string) error {
+	if id == "" {
+		return ErrInvalidSessionID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.sessions[id]
+	if !ok {
+		return fmt.Errorf("%w: %w", ErrDatabaseRead, ErrSessionNotFound)
+	}
+	*s = copySession(&stored)
+	return nil
+}
+
+// ReplaceSession replaces the session stored under the ID of s if the hash
+// of its latest token is still hash, and reports whether it did
+func (m *MemoryStore) ReplaceSession(s *Session, hash string) (bool, error) {
+	if s.ID == "" {
+		return false, ErrInvalidSessionID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.sessions[s.ID]
+	if !ok || stored.TokenHash != hash {
+		return false, nil
+	}
+	m.sessions[s.ID] = copySession(s)
+	return true, nil
+}
+
+// DeleteSession removes the session stored under id
+func (m *MemoryStore) DeleteSession(id string) error {
+	if id == "" {
+		return ErrInvalidSessionID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+// DeleteUserSessions removes every session of the user with the given ID
+// and returns the number removed
+func (m *MemoryStore) DeleteUserSessions(userID string) (int, error) {
+	if userID == "" {
+		return 0, ErrInvalidUsername
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := 0
+	for id, s := range m.sessions {
+		if s.UserID == userID {
+			delete(m.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// copySession returns a copy of s that shares no memory with it
+func copySession(s *Session) Session {
+	c := *s
+	c.PreviousHashes = slices.Clone(s.PreviousHashes)
+	return c
+}
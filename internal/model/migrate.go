@@ -0,0 +1,254 @@
+package model
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"google.golang.org/protobuf/proto"
+)
+
+// MigrationReport counts the records handled by Store.Migrate
+type MigrationReport struct {
+	// Moved counts records moved out of the history database
+	Moved int
+	// Rekeyed counts users moved from their bare PersonId key into UserKeys
+	Rekeyed int
+	// Assigned counts records of the default shard given a schema entry
+	Assigned int
+	// Hashed counts users whose plaintext password was replaced with its hash
+	Hashed int
+	// Conflicts counts records left in place because a different record
+	// already exists at the canonical key
+	Conflicts int
+}
+
+// Migrate moves records written by earlier versions to the location named by
+// their keyspace:
+//   - users stored under their bare PersonId instead of a UserKeys key
+//   - records in the default shard without a fragmentation schema entry,
+//     which are assigned to shard 0
+//   - messages and chat histories stranded in the history database (NOSQL),
+//     which are placed like new records
+//   - users with a plaintext password, which is replaced with its hash
+//
+// The canonical record wins when both locations hold a record under the same
+// key; the stranded copy is then left in place and counted as a conflict.
+// Migrate is safe to run again and does nothing once every record has moved.
+func (s *Store) Migrate() (MigrationReport, error) {
+	var report MigrationReport
+
+	if err := s.rekeyUsers(&report); err != nil {
+		return report, err
+	}
+	// Stranded records are placed through the schema, so existing records
+	// must be registered first for conflicts to be found
+	if err := s.assignUnplaced(&report); err != nil {
+		return report, err
+	}
+
+	if err := s.hashPasswords(&report); err != nil {
+		return report, err
+	}
+
+	legacy, err := s.db.History()
+	if err != nil {
+		return report, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+	for _, k := range []Keyspace{MessageKeys, HistoryKeys} {
+		if err := s.moveStranded(legacy, k, &report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// hashPasswords replaces the plaintext passwords of stored users with their
+// hash. Every user must have a schema entry.
+func (s *Store) hashPasswords(report *MigrationReport) error {
+	keys, err := s.schema.Keys(UserKeys.Prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		id, _ := UserKeys.ID([]byte(key))
+		user := &User{}
+		if err := s.GetUser(user, id); err != nil {
+			return err
+		}
+		if user.Password == "" || IsPasswordHash(user.Password) {
+			continue
+		}
+		if err := s.UpdateUser(user, id); err != nil {
+			return err
+		}
+		report.Hashed++
+	}
+	return nil
+}
+
+// moveStranded moves the records of k found in src to their shard
+func (s *Store) moveStranded(src *leveldb.DB, k Keyspace, report *MigrationReport) error {
+	iter := src.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		id, ok := k.ID(iter.Key())
+		if !ok {
+			continue
+		}
+		key := append([]byte(nil), iter.Key()...)
+
+		dst, err := s.place(k, id)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+		}
+
+		existing, err := dst.Get(key, nil)
+		switch {
+		case errors.Is(err, leveldb.ErrNotFound):
+			if err := dst.Put(key, iter.Value(), nil); err != nil {
+				return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+			}
+		case err != nil:
+			return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+		case !bytes.Equal(existing, iter.Value()):
+			log.Printf("Migration: keeping %s, a different record already exists in %s", key, k.Name)
+			report.Conflicts++
+			continue
+		}
+
+		// The record is now in its canonical location
+		if err := src.Delete(key, nil); err != nil {
+			return fmt.Errorf("%w: %v", ErrDatabaseDelete, err)
+		}
+		report.Moved++
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+	return nil
+}
+
+// rekeyUsers moves users stored under their bare PersonId into UserKeys. A
+// record is only treated as a user when its key matches no keyspace and it
+// decodes to a user whose PersonId is the key.
+func (s *Store) rekeyUsers(report *MigrationReport) error {
+	db, err := s.db.DefaultShard()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if registeredKey(iter.Key()) {
+			continue
+		}
+		var u User
+		if err := proto.Unmarshal(iter.Value(), &u); err != nil || u.PersonId != string(iter.Key()) {
+			continue
+		}
+
+		key := UserKeys.Key(u.PersonId)
+		dst, err := s.route(UserKeys, u.PersonId)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+		}
+		if _, err := dst.Get(key, nil); err == nil {
+			log.Printf("Migration: keeping user %s, a user already exists at %s", u.PersonId, key)
+			report.Conflicts++
+			continue
+		} else if !errors.Is(err, leveldb.ErrNotFound) {
+			return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+		}
+
+		if dst == db {
+			batch := new(leveldb.Batch)
+			batch.Put(key, iter.Value())
+			batch.Delete(iter.Key())
+			err = db.Write(batch, nil)
+		} else if err = dst.Put(key, iter.Value(), nil); err == nil {
+			err = db.Delete(iter.Key(), nil)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+		}
+		report.Rekeyed++
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+	return nil
+}
+
+// assignUnplaced gives the records of the default shard that have no schema
+// entry an entry for shard 0, where they are stored
+func (s *Store) assignUnplaced(report *MigrationReport) error {
+	db, err := s.db.DefaultShard()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !registeredKey(iter.Key()) {
+			continue
+		}
+		key := string(iter.Key())
+		if _, ok, err := s.schema.Lookup(key); err != nil {
+			return err
+		} else if ok {
+			continue
+		}
+		if err := s.schema.Add(0, key); err != nil {
+			return err
+		}
+		report.Assigned++
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+	return nil
+}
+
+// registeredKey reports whether key belongs to a registered keyspace
+func registeredKey(key []byte) bool {
+	for _, k := range Keyspaces() {
+		if _, ok := k.ID(key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CopyUsers copies every user of s to the SQLite user store to, replacing
+// users with the same PersonId, and returns the number copied. Users whose
+// name or email is already taken by another user in to are left out and
+// counted as conflicts. Run Migrate first so every user has a schema entry.
+func (s *Store) CopyUsers(to *SQLiteUsers) (copied, conflicts int, err error) {
+	keys, err := s.schema.Keys(UserKeys.Prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, key := range keys {
+		id, _ := UserKeys.ID([]byte(key))
+		user := &User{}
+		if err := s.GetUser(user, id); err != nil {
+			return copied, conflicts, err
+		}
+		err := to.SaveUser(user)
+		switch {
+		case errors.Is(err, ErrDuplicateUser):
+			log.Printf("Migrate: user %s not copied: %v", id, err)
+			conflicts++
+		case err != nil:
+			return copied, conflicts, err
+		default:
+			copied++
+		}
+	}
+	return copied, conflicts, nil
+}
@@ -0,0 +1,4 @@
+DROP INDEX users_phone_number;
+DROP INDEX users_email;
+DROP INDEX users_user_name;
+DROP TABLE users;
@@ -0,0 +1,18 @@
+CREATE TABLE users (
+    person_id       TEXT PRIMARY KEY,
+    user_name       TEXT NOT NULL DEFAULT '',
+    profile         TEXT NOT NULL DEFAULT '',
+    password        TEXT NOT NULL DEFAULT '',
+    email           TEXT NOT NULL DEFAULT '',
+    profile_pic_url TEXT NOT NULL DEFAULT '',
+    account_time    INTEGER NOT NULL DEFAULT 0,
+    birth_date      INTEGER NOT NULL DEFAULT 0,
+    gender          TEXT NOT NULL DEFAULT '',
+    last_edit       INTEGER NOT NULL DEFAULT 0,
+    phone_number    TEXT NOT NULL DEFAULT ''
+);
+
+-- Users without a name or email do not conflict with each other
+CREATE UNIQUE INDEX users_user_name ON users (user_name) WHERE user_name != '';
+CREATE UNIQUE INDEX users_email ON users (email) WHERE email != '';
+CREATE INDEX users_phone_number ON users (phone_number) WHERE phone_number != '';
@@ -0,0 +1,4 @@
+DROP TABLE conversations;
+DROP TABLE history_messages;
+DROP INDEX messages_conversation_id;
+DROP TABLE messages;
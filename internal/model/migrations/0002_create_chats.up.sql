@@ -0,0 +1,29 @@
+CREATE TABLE messages (
+    msg_id          TEXT PRIMARY KEY,
+    conversation_id TEXT NOT NULL DEFAULT '',
+    user_id         TEXT NOT NULL DEFAULT '',
+    ai_id           TEXT NOT NULL DEFAULT '',
+    content         TEXT NOT NULL DEFAULT '',
+    timestamp       INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX messages_conversation_id ON messages (conversation_id);
+
+-- The history of a conversation keeps its own copy of each message, in the
+-- order the messages were added
+CREATE TABLE history_messages (
+    conversation_id TEXT NOT NULL,
+    seq             INTEGER NOT NULL,
+    msg_id          TEXT NOT NULL DEFAULT '',
+    user_id         TEXT NOT NULL DEFAULT '',
+    ai_id           TEXT NOT NULL DEFAULT '',
+    content         TEXT NOT NULL DEFAULT '',
+    timestamp       INTEGER NOT NULL DEFAULT 0,
+    msg_conversation_id TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (conversation_id, seq)
+);
+
+-- A history may be saved without messages, so conversations are listed apart
+CREATE TABLE conversations (
+    conversation_id TEXT PRIMARY KEY
+);
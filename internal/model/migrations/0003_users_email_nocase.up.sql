@@ -0,0 +1,4 @@
+-- Emails are unique regardless of case. Fails if two users already share an
+-- email in different case; rename one of them and migrate again.
+DROP INDEX users_email;
+CREATE UNIQUE INDEX users_email ON users (email COLLATE NOCASE) WHERE email != '';
@@ -0,0 +1,206 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Common errors for password verification
+var (
+	ErrWrongPassword       = errors.New("password does not match")
+	ErrInvalidPasswordHash = errors.New("invalid password hash")
+)
+
+// passwordPrefix starts every password hash
+const passwordPrefix = "$argon2id$"
+
+// PasswordParams are the argon2id parameters of new password hashes. They
+// are encoded in every hash, so hashes made with earlier parameters can
+// still be verified.
+type PasswordParams struct {
+	// Memory is the memory cost in KiB
+	Memory uint32
+	// Time is the number of passes over the memory
+	Time uint32
+	// Threads is the degree of parallelism
+	Threads uint8
+	// SaltLength and KeyLength are the sizes in bytes of the salt and hash
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// Upper bounds of the parameters accepted in a stored hash. Verifying a hash
+// costs what its parameters say, so a hash beyond them is rejected rather
+// than let it exhaust the memory or CPU of a login.
+const (
+	// maxPasswordMemory is 256 MiB, in KiB
+	maxPasswordMemory    = 256 * 1024
+	maxPasswordTime      = 16
+	maxPasswordThreads   = 16
+	maxPasswordKeyLength = 128
+)
+
+// DefaultPasswordParams follow the OWASP recommendation for argon2id
+var DefaultPasswordParams = PasswordParams{
+	Memory:     19 * 1024,
+	Time:       2,
+	Threads:    1,
+	SaltLength: 16,
+	KeyLength:  32,
+}
+
+// passwordParams holds the parameters of new hashes
+var passwordParams = struct {
+	sync.RWMutex
+	p PasswordParams
+}{p: DefaultPasswordParams}
+
+// SetPasswordParams makes new password hashes use p and returns the
+// previous parameters. Stored hashes with other parameters are rehashed with
+// p the next time their password is verified. p must not exceed the upper
+// bounds checked by CheckPassword, or the new hashes cannot be verified.
+func SetPasswordParams(p PasswordParams) (previous PasswordParams) {
+	passwordParams.Lock()
+	defer passwordParams.Unlock()
+	previous, passwordParams.p = passwordParams.p, p
+	return previous
+}
+
+// currentPasswordParams returns the parameters of new hashes
+func currentPasswordParams() PasswordParams {
+	passwordParams.RLock()
+	defer passwordParams.RUnlock()
+	return passwordParams.p
+}
+
+// HashPassword returns a salted argon2id hash of password in the PHC string
+// format, such as $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	p := currentPasswordParams()
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", passwordPrefix, argon2.Version,
+		p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// IsPasswordHash reports whether s is a password hash made by HashPassword
+func IsPasswordHash(s string) bool {
+	_, _, _, err := parsePasswordHash(s)
+	return err == nil
+}
+
+// CheckPassword compares password with hash. It returns ErrWrongPassword if
+// they do not match, and reports whether the hash was made with parameters
+// other than the current ones and should be replaced.
+func CheckPassword(hash, password string) (rehash bool, err error) {
+	p, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, ErrWrongPassword
+	}
+	return p != currentPasswordParams(), nil
+}
+
+// VerifyPassword checks password against the credential of u. A user without
+// a password never matches. When the stored hash uses outdated parameters,
+// or is a plaintext password left by an earlier version, it is replaced with
+// a new hash and the user is updated; a failed update is logged and does not
+// fail the verification.
+func (u *User) VerifyPassword(password string) error {
+	var rehash bool
+	switch {
+	case u.Password == "":
+		return ErrWrongPassword
+	case strings.HasPrefix(u.Password, passwordPrefix):
+		var err error
+		if rehash, err = CheckPassword(u.Password, password); err != nil {
+			return err
+		}
+	case subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1:
+		rehash = true
+	default:
+		return ErrWrongPassword
+	}
+
+	if rehash {
+		hash, err := HashPassword(password)
+		if err != nil {
+			log.Printf("Error rehashing password of user %s: %v", u.PersonId, err)
+			return nil
+		}
+		u.Password = hash
+		if err := u.UpdateUserData(u.PersonId); err != nil {
+			log.Printf("Error storing rehashed password of user %s: %v", u.PersonId, err)
+		}
+	}
+	return nil
+}
+
+// hashUserPassword replaces a plaintext password of u with its hash before u
+// is stored. Empty passwords and existing hashes are kept, so users read back
+// from storage or migrated from an earlier version keep their hash. A
+// password sent by a client must be hashed with HashPassword instead, or the
+// client could store a hash of its choosing.
+func hashUserPassword(u *User) error {
+	if u.Password == "" || IsPasswordHash(u.Password) {
+		return nil
+	}
+	hash, err := HashPassword(u.Password)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		return fmt.Errorf("%w: %v", ErrSerialize, err)
+	}
+	u.Password = hash
+	return nil
+}
+
+// parsePasswordHash decodes the parameters, salt and key of a hash made by
+// HashPassword
+func parsePasswordHash(hash string) (PasswordParams, []byte, []byte, error) {
+	var p PasswordParams
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[0] != "" || fields[1] != "argon2id" {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("%w: unsupported version %q", ErrInvalidPasswordHash, fields[2])
+	}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, fmt.Errorf("%w: %v", ErrInvalidPasswordHash, err)
+	}
+	if p.Memory == 0 || p.Time == 0 || p.Threads == 0 {
+		return p, nil, nil, fmt.Errorf("%w: parameters must be positive", ErrInvalidPasswordHash)
+	}
+	if p.Memory > maxPasswordMemory || p.Time > maxPasswordTime || p.Threads > maxPasswordThreads {
+		return p, nil, nil, fmt.Errorf("%w: parameters %s exceed m=%d,t=%d,p=%d", ErrInvalidPasswordHash,
+			fields[3], maxPasswordMemory, maxPasswordTime, maxPasswordThreads)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil || len(salt) == 0 {
+		return p, nil, nil, fmt.Errorf("%w: bad salt", ErrInvalidPasswordHash)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(key) == 0 || len(key) > maxPasswordKeyLength {
+		return p, nil, nil, fmt.Errorf("%w: bad key", ErrInvalidPasswordHash)
+	}
+	p.SaltLength, p.KeyLength = uint32(len(salt)), uint32(len(key))
+	return p, salt, key, nil
+}
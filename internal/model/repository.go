@@ -0,0 +1,168 @@
+package model
+
+import (
+	"sync"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+)
+
+// UserRepository stores users keyed by their PersonId.
+// Reads, updates and deletes of a missing user return an error matching
+// ErrUserNotFound; an empty ID returns ErrInvalidUsername. A plaintext
+// password is replaced with its hash, in the user passed in too, before the
+// user is stored. User names and emails are unique among the users that set
+// them: a write giving a user the name or email of another user returns an
+// error matching ErrDuplicateUser.
+type UserRepository interface {
+	// SaveUser inserts u, or replaces the user with the same PersonId
+	SaveUser(u *User) error
+	// CreateUser inserts u, failing with an error matching ErrDuplicateUser
+	// if a user with the same PersonId is stored
+	CreateUser(u *User) error
+	// GetUser reads the user with the given ID into u
+	GetUser(u *User, id string) error
+	// UpdateUser replaces the existing user with the given ID with u
+	UpdateUser(u *User, id string) error
+	// ModifyUser reads the user with the given ID, calls modify on it and
+	// stores the result unless modify fails. No other write of the user
+	// happens in between. modify must not change the PersonId, and may be
+	// called more than once, on a fresh read each time.
+	ModifyUser(id string, modify func(*User) error) error
+	// DeleteUser removes the user with the given ID
+	DeleteUser(id string) error
+	// UserExists reports whether a user with the given ID is stored
+	UserExists(id string) (bool, error)
+	// FindUserByName reads the user with the given user name into u
+	FindUserByName(u *User, name string) error
+	// FindUserByEmail reads the user with the given email into u
+	FindUserByEmail(u *User, email string) error
+	// FindUserByPhone reads a user with the given phone number into u.
+	// Phone numbers are not unique; which of the users sharing one is
+	// returned depends on the backend.
+	FindUserByPhone(u *User, phone string) error
+}
+
+// MessageRepository stores messages keyed by their MsgId.
+// Reads, updates and deletes of a missing message return an error matching
+// ErrMessageNotFound; an empty ID returns ErrInvalidMessageID.
+type MessageRepository interface {
+	// SaveMessage inserts msg, or replaces the message with the same ID
+	SaveMessage(msg *Message) error
+	// GetMessage reads the message with the ID of msg into msg
+	GetMessage(msg *Message) error
+	// UpdateMessage replaces the existing message with the ID of msg
+	UpdateMessage(msg *Message) error
+	// DeleteMessage removes the message with the ID of msg
+	DeleteMessage(msg *Message) error
+}
+
+// ConversationRepository stores the chat history of each conversation.
+// Reads of a missing history return an error matching
+// ErrChatHistoryNotFound; an empty ID returns ErrInvalidConvID.
+type ConversationRepository interface {
+	// SaveChatHistory replaces the history with the conversation ID of ch
+	SaveChatHistory(ch *ChatHistory) error
+	// GetChatHistory reads the history with the conversation ID of ch into ch
+	GetChatHistory(ch *ChatHistory) error
+	// AddMessageToHistory appends msg to the stored history of ch, creating
+	// it if needed, and reads the result into ch. Concurrent additions to
+	// a conversation are all kept.
+	AddMessageToHistory(ch *ChatHistory, msg *Message) error
+}
+
+// SessionRepository stores refresh token sessions keyed by their ID.
+// Reads and deletes of a missing session return an error matching
+// ErrSessionNotFound; an empty ID returns ErrInvalidSessionID.
+type SessionRepository interface {
+	// SaveSession inserts s, or replaces the session with the same ID
+	SaveSession(s *Session) error
+	// GetSession reads the session with the given ID into s
+	GetSession(s *Session, id string) error
+	// ReplaceSession replaces the stored session with the ID of s if the
+	// hash of its latest token is still hash, and reports whether it did.
+	// A missing session is not replaced.
+	ReplaceSession(s *Session, hash string) (bool, error)
+	// DeleteSession removes the session with the given ID
+	DeleteSession(id string) error
+	// DeleteUserSessions removes every session of the user with the given
+	// ID and returns the number removed
+	DeleteUserSessions(userID string) (int, error)
+}
+
+// Repositories holds the storage used by the User, Message and ChatHistory
+// methods and by the session functions
+type Repositories struct {
+	Users         UserRepository
+	Messages      MessageRepository
+	Conversations ConversationRepository
+	Sessions      SessionRepository
+}
+
+// The storage engines implement the repositories
+var (
+	_ UserRepository         = (*Store)(nil)
+	_ MessageRepository      = (*Store)(nil)
+	_ ConversationRepository = (*Store)(nil)
+	_ SessionRepository      = (*Store)(nil)
+	_ UserRepository         = (*SQLiteUsers)(nil)
+	_ MessageRepository      = (*SQLiteChats)(nil)
+	_ ConversationRepository = (*SQLiteChats)(nil)
+	_ UserRepository         = (*MemoryStore)(nil)
+	_ MessageRepository      = (*MemoryStore)(nil)
+	_ ConversationRepository = (*MemoryStore)(nil)
+	_ SessionRepository      = (*MemoryStore)(nil)
+)
+
+// repositories overrides the default storage when set by SetRepositories
+var repositories struct {
+	sync.RWMutex
+	r *Repositories
+}
+
+// SetRepositories makes the User, Message and ChatHistory methods use r
+// instead of the databases of the default layout, for example a MemoryStore
+// in tests. A nil r restores the default. It returns the previous override.
+func SetRepositories(r *Repositories) (previous *Repositories) {
+	repositories.Lock()
+	defer repositories.Unlock()
+	previous, repositories.r = repositories.r, r
+	return previous
+}
+
+// NewMemoryRepositories returns repositories backed by one new MemoryStore
+func NewMemoryRepositories() *Repositories {
+	m := NewMemoryStore()
+	return &Repositories{Users: m, Messages: m, Conversations: m, Sessions: m}
+}
+
+// defaultRepositories returns the override set by SetRepositories, or the
+// repositories over the default database store with users on the engine
+// selected by its UserBackend and messages and histories on the one selected
+// by its ChatBackend. Sessions are always kept in LevelDB.
+func defaultRepositories() (*Repositories, error) {
+	repositories.RLock()
+	r := repositories.r
+	repositories.RUnlock()
+	if r != nil {
+		return r, nil
+	}
+
+	db := database.DefaultStore()
+	store := NewStore(db)
+	r = &Repositories{Users: store, Messages: store, Conversations: store, Sessions: store}
+	if db.Layout().UserBackend == database.BackendSQLite {
+		users, err := OpenSQLiteUsers(db)
+		if err != nil {
+			return nil, err
+		}
+		r.Users = users
+	}
+	if db.Layout().ChatBackend == database.BackendSQLite {
+		chats, err := OpenSQLiteChats(db)
+		if err != nil {
+			return nil, err
+		}
+		r.Messages, r.Conversations = chats, chats
+	}
+	return r, nil
+}
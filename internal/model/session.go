@@ -0,0 +1,477 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Common errors for refresh token sessions
+var (
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrInvalidSessionID    = errors.New("session ID cannot be empty")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// maxPreviousTokens bounds the hashes of exchanged tokens kept per session.
+// An older exchanged token is rejected like an unknown one, without revoking
+// the session.
+const maxPreviousTokens = 64
+
+// Session is a login of a user, identified by the refresh tokens issued to
+// it. Each refresh replaces the token with a new one, so a session is a
+// family of tokens of which only the latest is valid. Only the SHA-256
+// hashes of the token secrets are stored.
+type Session struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	// TokenHash is the hex SHA-256 hash of the secret of the latest token
+	TokenHash string `json:"token_hash"`
+	// PreviousHashes holds the hashes of the tokens already exchanged, oldest
+	// first, so that presenting one of them is recognized as reuse
+	PreviousHashes []string `json:"previous_hashes,omitempty"`
+	// Generation counts the refreshes of the session
+	Generation int64 `json:"generation"`
+	// Times are Unix milliseconds
+	CreatedAt int64 `json:"created_at"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// NewSessionID returns a random identifier for a new session.
+func NewSessionID() string {
+	return newID("sess")
+}
+
+// NewSession starts a session of userID and returns its first refresh
+// token, which expires after ttl
+func NewSession(userID string, ttl time.Duration) (string, *Session, error) {
+	r, err := sessionRepository()
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, hash, err := newTokenSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	s := &Session{
+		ID:        NewSessionID(),
+		UserID:    userID,
+		TokenHash: hash,
+		CreatedAt: now.UnixMilli(),
+		ExpiresAt: now.Add(ttl).UnixMilli(),
+	}
+	if err := r.SaveSession(s); err != nil {
+		return "", nil, err
+	}
+	return s.ID + "." + secret, s, nil
+}
+
+// RefreshSession exchanges the refresh token for a new one of the same
+// session, which expires after ttl. A token that was already exchanged
+// means it was copied: the whole session is revoked and
+// ErrRefreshTokenReused returned, so neither copy can be refreshed again.
+// A secret the session never issued does not revoke it, since session IDs
+// are not secret. Every rejected token returns an error matching
+// ErrInvalidRefreshToken.
+func RefreshSession(token string, ttl time.Duration) (string, *Session, error) {
+	r, err := sessionRepository()
+	if err != nil {
+		return "", nil, err
+	}
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" {
+		return "", nil, ErrInvalidRefreshToken
+	}
+
+	s := &Session{}
+	if err := r.GetSession(s, id); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return "", nil, fmt.Errorf("%w: %w", ErrInvalidRefreshToken, err)
+		}
+		return "", nil, err
+	}
+	now := time.Now()
+	if now.UnixMilli() >= s.ExpiresAt {
+		revokeSession(r, id)
+		return "", nil, fmt.Errorf("%w: %w", ErrInvalidRefreshToken, ErrRefreshTokenExpired)
+	}
+	if !s.matches(secret) {
+		if !s.exchanged(secret) {
+			return "", nil, ErrInvalidRefreshToken
+		}
+		log.Printf("Refresh token of session %s of user %s reused, revoking the session", s.ID, s.UserID)
+		revokeSession(r, id)
+		return "", nil, fmt.Errorf("%w: %w", ErrInvalidRefreshToken, ErrRefreshTokenReused)
+	}
+
+	newSecret, hash, err := newTokenSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	next := *s
+	next.TokenHash = hash
+	next.PreviousHashes = append(append([]string(nil), s.PreviousHashes...), s.TokenHash)
+	if len(next.PreviousHashes) > maxPreviousTokens {
+		next.PreviousHashes = next.PreviousHashes[len(next.PreviousHashes)-maxPreviousTokens:]
+	}
+	next.Generation++
+	next.ExpiresAt = now.Add(ttl).UnixMilli()
+	replaced, err := r.ReplaceSession(&next, s.TokenHash)
+	if err != nil {
+		return "", nil, err
+	}
+	if !replaced {
+		// Another request exchanged the same token first
+		log.Printf("Refresh token of session %s of user %s reused, revoking the session", s.ID, s.UserID)
+		revokeSession(r, id)
+		return "", nil, fmt.Errorf("%w: %w", ErrInvalidRefreshToken, ErrRefreshTokenReused)
+	}
+	return next.ID + "." + newSecret, &next, nil
+}
+
+// CheckSession returns nil if the session with the given ID is open and was
+// started by userID. A session that was revoked, has expired or belongs to
+// another user returns an error matching ErrSessionNotFound.
+func CheckSession(id, userID string) error {
+	r, err := sessionRepository()
+	if err != nil {
+		return err
+	}
+	s := &Session{}
+	if err := r.GetSession(s, id); err != nil {
+		return err
+	}
+	if s.UserID != userID || time.Now().UnixMilli() >= s.ExpiresAt {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	return nil
+}
+
+// RevokeSession ends the session of the refresh token, so none of its
+// tokens can be refreshed anymore. Only the latest token of a session
+// revokes it.
+func RevokeSession(token string) error {
+	r, err := sessionRepository()
+	if err != nil {
+		return err
+	}
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" {
+		return ErrInvalidRefreshToken
+	}
+
+	s := &Session{}
+	if err := r.GetSession(s, id); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return fmt.Errorf("%w: %w", ErrInvalidRefreshToken, err)
+		}
+		return err
+	}
+	if !s.matches(secret) {
+		return ErrInvalidRefreshToken
+	}
+	return r.DeleteSession(id)
+}
+
+// matches reports whether secret is the secret of the latest token of s
+func (s *Session) matches(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashTokenSecret(secret)), []byte(s.TokenHash)) == 1
+}
+
+// exchanged reports whether secret is the secret of a token of s that was
+// already exchanged
+func (s *Session) exchanged(secret string) bool {
+	hash := []byte(hashTokenSecret(secret))
+	for _, previous := range s.PreviousHashes {
+		if subtle.ConstantTimeCompare(hash, []byte(previous)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeSession deletes the session with the given ID, logging failures
+func revokeSession(r SessionRepository, id string) {
+	if err := r.DeleteSession(id); err != nil && !errors.Is(err, ErrSessionNotFound) {
+		log.Printf("Error revoking session %s: %v", id, err)
+	}
+}
+
+// newTokenSecret returns a random refresh token secret and its hash
+func newTokenSecret() (secret, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	secret = base64.RawURLEncoding.EncodeToString(b)
+	return secret, hashTokenSecret(secret), nil
+}
+
+// hashTokenSecret returns the stored hash of a refresh token secret. The
+// secrets are random, so a fast unsalted hash is enough.
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionRepository returns the session repository of the default
+// repositories
+func sessionRepository() (SessionRepository, error) {
+	r, err := defaultRepositories()
+	if err != nil {
+		return nil, err
+	}
+	if r.Sessions == nil {
+		return nil, fmt.Errorf("%w: no session repository", ErrDatabaseOpen)
+	}
+	return r.Sessions, nil
+}
+
+// SaveSession persists s keyed by its ID, together with the entry indexing
+// it under its user. Sessions have no protobuf message and are stored as
+// JSON.
+func (s *Store) SaveSession(session *Session) error {
+	if session.ID == "" {
+		return ErrInvalidSessionID
+	}
+
+	defer s.lock(SessionKeys, session.ID)()
+
+	old, _, err := s.storedSession(session.ID)
+	if err != nil {
+		return err
+	}
+	shard, err := s.schema.Assign(string(SessionKeys.Key(session.ID)), s.placement)
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+	return s.writeSession(shard, old, session)
+}
+
+// GetSession reads the session stored under id into session
+func (s *Store) GetSession(session *Session, id string) error {
+	if id == "" {
+		return ErrInvalidSessionID
+	}
+
+	db, err := s.route(SessionKeys, id)
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+	return getSession(db, session, id)
+}
+
+// ReplaceSession replaces the session stored under the ID of session if the
+// hash of its latest token is still hash, and reports whether it did
+func (s *Store) ReplaceSession(session *Session, hash string) (bool, error) {
+	if session.ID == "" {
+		return false, ErrInvalidSessionID
+	}
+
+	defer s.lock(SessionKeys, session.ID)()
+
+	stored, shard, err := s.storedSession(session.ID)
+	if err != nil {
+		return false, err
+	}
+	if stored == nil || stored.TokenHash != hash {
+		return false, nil
+	}
+	if err := s.writeSession(shard, stored, session); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteSession removes the session stored under id with its index entry
+func (s *Store) DeleteSession(id string) error {
+	if id == "" {
+		return ErrInvalidSessionID
+	}
+
+	defer s.lock(SessionKeys, id)()
+
+	old, shard, err := s.storedSession(id)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	db, err := s.db.ShardNumber(shard)
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	entries := sessionIndexEntries(old)
+	batch := new(leveldb.Batch)
+	batch.Delete(SessionKeys.Key(id))
+	for _, key := range entries {
+		batch.Delete([]byte(key))
+	}
+	if err := db.Write(batch, nil); err != nil {
+		log.Printf("Error deleting session: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseDelete, err)
+	}
+
+	if err := s.unrouteEntries(entries); err != nil {
+		return err
+	}
+	return s.unplace(SessionKeys, id)
+}
+
+// DeleteUserSessions removes every session of the user with the given ID
+// and returns the number removed. The sessions are found through the
+// UserSessionKeys index.
+func (s *Store) DeleteUserSessions(userID string) (int, error) {
+	if userID == "" {
+		return 0, ErrInvalidUsername
+	}
+
+	prefix := UserSessionKeys.Prefix + userID + "\x00"
+	keys, err := s.schema.Keys(prefix)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, prefix)
+		session := &Session{}
+		err := s.GetSession(session, id)
+		if err == nil && session.UserID == userID {
+			err = s.DeleteSession(id)
+			if err == nil {
+				deleted++
+				continue
+			}
+		}
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return deleted, err
+		}
+		// The entry was left by an interrupted write
+		if err := s.unrouteEntries([]string{key}); err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// sessionIndexEntries returns the UserSessionKeys entry of session, if it
+// belongs to a user
+func sessionIndexEntries(session *Session) []string {
+	if session.UserID == "" {
+		return nil
+	}
+	return []string{UserSessionKeys.Prefix + session.UserID + "\x00" + session.ID}
+}
+
+// storedSession reads the session stored under id and returns it with its
+// shard, or a nil session if there is none. Sessions without a schema entry
+// are read from the default shard, shard 0.
+func (s *Store) storedSession(id string) (*Session, int64, error) {
+	shard, ok, err := s.schema.Lookup(string(SessionKeys.Key(id)))
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return nil, 0, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+	if !ok {
+		shard = 0
+	}
+	db, err := s.db.ShardNumber(shard)
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return nil, 0, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	session := &Session{}
+	if err := getSession(db, session, id); errors.Is(err, ErrSessionNotFound) {
+		return nil, shard, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return session, shard, nil
+}
+
+// writeSession stores session in shard together with its index entry in one
+// batch, deleting the entry of old, the session stored before, if it moved
+// to another user
+func (s *Store) writeSession(shard int64, old, session *Session) error {
+	db, err := s.db.ShardNumber(shard)
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		log.Printf("Error marshaling session: %v", err)
+		return fmt.Errorf("%w: %v", ErrSerialize, err)
+	}
+
+	entries := sessionIndexEntries(session)
+	var dropped []string
+	if old != nil {
+		for _, key := range sessionIndexEntries(old) {
+			if !slices.Contains(entries, key) {
+				dropped = append(dropped, key)
+			}
+		}
+	}
+	if len(entries) > 0 {
+		if err := s.schema.Add(shard, entries...); err != nil {
+			log.Printf("Error routing the index entry of session %s: %v", session.ID, err)
+			return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+		}
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put(SessionKeys.Key(session.ID), data)
+	for _, key := range entries {
+		batch.Put([]byte(key), nil)
+	}
+	for _, key := range dropped {
+		batch.Delete([]byte(key))
+	}
+	if err := db.Write(batch, nil); err != nil {
+		log.Printf("Error writing to database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+	}
+
+	return s.unrouteEntries(dropped)
+}
+
+// getSession reads the session stored under id in db into session
+func getSession(db *leveldb.DB, session *Session, id string) error {
+	data, err := db.Get(SessionKeys.Key(id), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return fmt.Errorf("%w: %w", ErrDatabaseRead, ErrSessionNotFound)
+	}
+	if err != nil {
+		log.Printf("Error reading from database for session %s: %v", id, err)
+		return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+	if err := json.Unmarshal(data, session); err != nil {
+		log.Printf("Error unmarshaling session: %v", err)
+		return fmt.Errorf("%w: %v", ErrDeserialize, err)
+	}
+	return nil
+}
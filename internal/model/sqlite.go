@@ -0,0 +1,63 @@
+package model
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sync"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+)
+
+// SQLiteDatabase is the SQLite database of the model tables in the SQL
+// directory
+const SQLiteDatabase = "model.db"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migrations returns the SQL migrations of the model tables
+func Migrations() fs.FS {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// migrated remembers the last database opened by openSQLite, so its schema
+// is migrated once
+var migrated struct {
+	sync.Mutex
+	db *sql.DB
+}
+
+// openSQLite returns the SQLite database of the model tables of db,
+// migrating its schema on first use
+func openSQLite(db *database.Store) (*sql.DB, error) {
+	sqlDB, err := db.SQL(SQLiteDatabase)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	migrated.Lock()
+	defer migrated.Unlock()
+	if migrated.db != sqlDB {
+		if err := migrateSQLite(sqlDB); err != nil {
+			return nil, err
+		}
+		migrated.db = sqlDB
+	}
+	return sqlDB, nil
+}
+
+// migrateSQLite applies the pending migrations of the model tables to db
+func migrateSQLite(db *sql.DB) error {
+	migrator, err := database.NewMigrator(db, Migrations())
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up()
+	return err
+}
@@ -0,0 +1,33 @@
+package model
+
+import (
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+)
+
+// Store persists users and chats in the LevelDB databases of a
+// database.Store. Records are spread over the shards of the layout: the
+// fragmentation schema records the shard of every key, and keys written for
+// the first time are assigned one by the placement policy.
+// It is safe for concurrent use.
+type Store struct {
+	db        *database.Store
+	schema    *database.Schema
+	placement database.Placement
+}
+
+// NewStore creates a Store over the databases of db that places new records
+// with the shard registry of db
+func NewStore(db *database.Store) *Store {
+	return &Store{
+		db:        db,
+		schema:    database.NewSchema(db),
+		placement: db.Registry(),
+	}
+}
+
+// WithPlacement returns a copy of s that assigns shards to new records with p
+func (s *Store) WithPlacement(p database.Placement) *Store {
+	c := *s
+	c.placement = p
+	return &c
+}
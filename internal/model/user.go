@@ -6,75 +6,271 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"time"
 
-	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/syndtr/goleveldb/leveldb"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 // Common errors for user operations
 var (
-	ErrUserNotFound    = errors.New("user not found")
-	ErrDatabaseOpen    = errors.New("failed to open database")
-	ErrSerialize       = errors.New("failed to serialize user data")
-	ErrDeserialize     = errors.New("failed to deserialize user data")
-	ErrDatabaseWrite   = errors.New("failed to write to database")
-	ErrDatabaseRead    = errors.New("failed to read from database")
-	ErrDatabaseDelete  = errors.New("failed to delete from database")
-	ErrInvalidUsername = errors.New("username cannot be empty")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrDatabaseOpen     = errors.New("failed to open database")
+	ErrSerialize        = errors.New("failed to serialize user data")
+	ErrDeserialize      = errors.New("failed to deserialize user data")
+	ErrDatabaseWrite    = errors.New("failed to write to database")
+	ErrDatabaseRead     = errors.New("failed to read from database")
+	ErrDatabaseDelete   = errors.New("failed to delete from database")
+	ErrInvalidUsername  = errors.New("username cannot be empty")
+	ErrDuplicateUser    = errors.New("user name or email already in use")
+	ErrInvalidFieldMask = errors.New("invalid field mask")
 )
 
-// SaveUserData persists the user data to the LevelDB database.
-// It uses the PersonId as the key for storage.
+// SaveUserData persists the user data to the configured user database.
+// It uses the PersonId as the key in the UserKeys keyspace.
 // Returns an error if the database operation fails.
 func (s *User) SaveUserData() error {
-	if s.PersonId == "" {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Users.SaveUser(s)
+}
+
+// CreateUserData persists a new user. Unlike SaveUserData it never replaces
+// an existing user: it returns ErrDuplicateUser if the PersonId is taken.
+func (s *User) CreateUserData() error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Users.CreateUser(s)
+}
+
+// GetUserData retrieves user data from the database using the provided username.
+// The retrieved data is unmarshaled into the User struct receiver.
+// Returns an error if the user is not found or if database operations fail.
+func (g *User) GetUserData(userName string) error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Users.GetUser(g, userName)
+}
+
+// FindUserDataByName retrieves the user with the given user name through the
+// user name index. Returns an error matching ErrUserNotFound if no user has it.
+func (u *User) FindUserDataByName(name string) error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Users.FindUserByName(u, name)
+}
+
+// FindUserDataByEmail retrieves the user with the given email through the
+// email index. Returns an error matching ErrUserNotFound if no user has it.
+func (u *User) FindUserDataByEmail(email string) error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Users.FindUserByEmail(u, email)
+}
+
+// FindUserDataByPhone retrieves a user with the given phone number through
+// the phone index. Phone numbers are not unique, so one of the users sharing
+// it is returned.
+func (u *User) FindUserDataByPhone(phone string) error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Users.FindUserByPhone(u, phone)
+}
+
+// UpdateUserData updates the user data in the database.
+// It retrieves the existing user by username, updates with new data from the receiver,
+// and writes the updated data back to the database.
+// Returns an error if the user is not found or if database operations fail.
+func (u *User) UpdateUserData(userName string) error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	return r.Users.UpdateUser(u, userName)
+}
+
+// PatchUserData applies the fields of patch named by mask to the stored
+// user, leaving the other fields as stored, and reads the result into u.
+// Fields are named as in user.proto, such as "email" or "phone_number"; the
+// PersonId and LastEdit cannot be patched, and LastEdit is set to the
+// current time. A patched password is always hashed. Returns ErrInvalidFieldMask for an unknown or read-only field.
+func (u *User) PatchUserData(userName string, patch *User, mask []string) error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	if err := checkUserMask(mask); err != nil {
+		return err
+	}
+	// A new password is hashed before the user is locked, even if it looks
+	// like a hash already
+	patch = proto.Clone(patch).(*User)
+	if slices.Contains(mask, "password") && patch.Password != "" {
+		hash, err := HashPassword(patch.Password)
+		if err != nil {
+			log.Printf("Error hashing password: %v", err)
+			return fmt.Errorf("%w: %v", ErrSerialize, err)
+		}
+		patch.Password = hash
+	}
+
+	var patched *User
+	err = r.Users.ModifyUser(userName, func(stored *User) error {
+		src, dst := patch.ProtoReflect(), stored.ProtoReflect()
+		for _, name := range mask {
+			field := dst.Descriptor().Fields().ByName(protoreflect.Name(name))
+			dst.Set(field, src.Get(field))
+		}
+		stored.LastEdit = time.Now().Unix()
+		patched = stored
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	proto.Reset(u)
+	proto.Merge(u, patched)
+	return nil
+}
+
+// checkUserMask returns ErrInvalidFieldMask unless every name of mask is a
+// patchable field of User
+func checkUserMask(mask []string) error {
+	fields := (&User{}).ProtoReflect().Descriptor().Fields()
+	for _, name := range mask {
+		if name == "person_id" || name == "last_edit" {
+			return fmt.Errorf("%w: %s cannot be changed", ErrInvalidFieldMask, name)
+		}
+		if fields.ByName(protoreflect.Name(name)) == nil {
+			return fmt.Errorf("%w: unknown field %q", ErrInvalidFieldMask, name)
+		}
+	}
+	return nil
+}
+
+// DeleteUserData removes the user data from the database and revokes the
+// sessions of the user, so that a user registered later under the same name
+// cannot refresh them.
+// Returns an error if the user is not found or if the delete operation fails.
+func (d *User) DeleteUserData(userName string) error {
+	r, err := defaultRepositories()
+	if err != nil {
+		return err
+	}
+	if err := r.Users.DeleteUser(userName); err != nil {
+		return err
+	}
+	if r.Sessions == nil {
+		return nil
+	}
+	if _, err := r.Sessions.DeleteUserSessions(userName); err != nil {
+		log.Printf("Error revoking the sessions of deleted user %s: %v", userName, err)
+		return err
+	}
+	return nil
+}
+
+// UserExists checks if a user exists in the database.
+// Returns true if the user exists, false otherwise.
+func UserExists(userName string) (bool, error) {
+	r, err := defaultRepositories()
+	if err != nil {
+		return false, err
+	}
+	return r.Users.UserExists(userName)
+}
+
+// SaveUser persists the user keyed by its PersonId
+func (s *Store) SaveUser(u *User) error {
+	if u.PersonId == "" {
 		return ErrInvalidUsername
 	}
+	if err := hashUserPassword(u); err != nil {
+		return err
+	}
+
+	defer s.lockUser(u, u.PersonId)()
 
-	db, err := database.CreateLevelDBDatabase("Database/", "Common", "Shard_0.sqlite")
+	old, _, err := s.storedUser(u.PersonId)
+	if err != nil {
+		return err
+	}
+	if err := s.checkUnique(old, u, u.PersonId); err != nil {
+		return err
+	}
+
+	shard, err := s.schema.Assign(string(UserKeys.Key(u.PersonId)), s.placement)
 	if err != nil {
 		log.Printf("Error opening database: %v", err)
 		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
 	}
-	defer db.Close()
+	return s.writeUser(shard, u.PersonId, old, u)
+}
 
-	bytes, err := proto.Marshal(s)
-	if err != nil {
-		log.Printf("Error marshaling user data: %v", err)
-		return fmt.Errorf("%w: %v", ErrSerialize, err)
+// CreateUser persists u keyed by its PersonId unless a user is already
+// stored under it
+func (s *Store) CreateUser(u *User) error {
+	if u.PersonId == "" {
+		return ErrInvalidUsername
 	}
+	if err := hashUserPassword(u); err != nil {
+		return err
+	}
+
+	defer s.lockUser(u, u.PersonId)()
 
-	err = db.Put([]byte(s.PersonId), bytes, nil)
+	old, _, err := s.storedUser(u.PersonId)
 	if err != nil {
-		log.Printf("Error writing to database: %v", err)
-		return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+		return err
+	}
+	if old != nil {
+		return fmt.Errorf("%w: %s", ErrDuplicateUser, u.PersonId)
+	}
+	if err := s.checkUnique(old, u, u.PersonId); err != nil {
+		return err
 	}
 
-	return nil
+	shard, err := s.schema.Assign(string(UserKeys.Key(u.PersonId)), s.placement)
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+	return s.writeUser(shard, u.PersonId, nil, u)
 }
 
-// GetUserData retrieves user data from the database using the provided username.
-// The retrieved data is unmarshaled into the User struct receiver.
-// Returns an error if the user is not found or if database operations fail.
-func (g *User) GetUserData(userName string) error {
+// GetUser reads the user stored under userName into u
+func (s *Store) GetUser(u *User, userName string) error {
 	if userName == "" {
 		return ErrInvalidUsername
 	}
 
-	db, err := database.CreateLevelDBDatabase("Database/", "Common", "Shard_0.sqlite")
+	db, err := s.route(UserKeys, userName)
 	if err != nil {
 		log.Printf("Error opening database: %v", err)
 		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
 	}
-	defer db.Close()
 
-	data, err := db.Get([]byte(userName), nil)
+	data, err := db.Get(UserKeys.Key(userName), nil)
 	if err != nil {
 		log.Printf("Error reading from database for user %s: %v", userName, err)
-		return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+		return readError(err)
 	}
 
-	err = proto.Unmarshal(data, g)
+	err = proto.Unmarshal(data, u)
 	if err != nil {
 		log.Printf("Error unmarshaling user data: %v", err)
 		return fmt.Errorf("%w: %v", ErrDeserialize, err)
@@ -83,94 +279,217 @@ func (g *User) GetUserData(userName string) error {
 	return nil
 }
 
-// UpdateUserData updates the user data in the database.
-// It retrieves the existing user by username, updates with new data from the receiver,
-// and writes the updated data back to the database.
-// Returns an error if the user is not found or if database operations fail.
-func (u *User) UpdateUserData(userName string) error {
+// UpdateUser replaces the existing user stored under userName with u
+func (s *Store) UpdateUser(u *User, userName string) error {
 	if userName == "" {
 		return ErrInvalidUsername
 	}
-
-	db, err := database.CreateLevelDBDatabase("Database/", "Common", "Shard_0.sqlite")
-	if err != nil {
-		log.Printf("Error opening database: %v", err)
-		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	if err := hashUserPassword(u); err != nil {
+		return err
 	}
-	defer db.Close()
+
+	defer s.lockUser(u, userName)()
 
 	// Check if user exists
-	_, err = db.Get([]byte(userName), nil)
+	old, shard, err := s.storedUser(userName)
 	if err != nil {
-		log.Printf("Error reading from database for user %s: %v", userName, err)
-		return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+		return err
+	}
+	if old == nil {
+		log.Printf("Error reading from database for user %s: %v", userName, leveldb.ErrNotFound)
+		return readError(leveldb.ErrNotFound)
+	}
+	if err := s.checkUnique(old, u, userName); err != nil {
+		return err
 	}
 
-	// Marshal updated user data
-	bytes, err := proto.Marshal(u)
-	if err != nil {
-		log.Printf("Error marshaling user data: %v", err)
-		return fmt.Errorf("%w: %v", ErrSerialize, err)
+	return s.writeUser(shard, userName, old, u)
+}
+
+// ModifyUser reads the user stored under userName, calls modify on it and
+// stores the result, with no other write of the user in between. The unique
+// values to lock are only known once modify has run, so if it claims a
+// value whose lock is not held, modify is called again on a fresh read
+// with that lock taken too.
+func (s *Store) ModifyUser(userName string, modify func(*User) error) error {
+	if userName == "" {
+		return ErrInvalidUsername
+	}
+
+	locks := userLocks(nil, userName)
+	for {
+		missing, err := s.modifyUser(userName, locks, modify)
+		if err != nil || len(missing) == 0 {
+			return err
+		}
+		locks = append(locks, missing...)
 	}
+}
+
+// modifyUser runs ModifyUser holding the locks of keys. If the modified
+// user needs locks not among keys, nothing is written and they are returned.
+func (s *Store) modifyUser(userName string, keys []string, modify func(*User) error) (missing []string, err error) {
+	defer s.db.LockKeys(keys...)()
 
-	// Write updated data back to database
-	err = db.Put([]byte(userName), bytes, nil)
+	old, shard, err := s.storedUser(userName)
 	if err != nil {
-		log.Printf("Error writing to database: %v", err)
-		return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+		return nil, err
+	}
+	if old == nil {
+		log.Printf("Error reading from database for user %s: %v", userName, leveldb.ErrNotFound)
+		return nil, readError(leveldb.ErrNotFound)
 	}
 
-	return nil
+	u := proto.Clone(old).(*User)
+	if err := modify(u); err != nil {
+		return nil, err
+	}
+	for _, key := range userLocks(u, userName) {
+		if !slices.Contains(keys, key) {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return missing, nil
+	}
+
+	if err := hashUserPassword(u); err != nil {
+		return nil, err
+	}
+	if err := s.checkUnique(old, u, userName); err != nil {
+		return nil, err
+	}
+	return nil, s.writeUser(shard, userName, old, u)
 }
 
-// DeleteUserData removes the user data from the database.
-// Returns an error if the user is not found or if the delete operation fails.
-func (d *User) DeleteUserData(userName string) error {
+// DeleteUser removes the user stored under userName with its index entries
+func (s *Store) DeleteUser(userName string) error {
 	if userName == "" {
 		return ErrInvalidUsername
 	}
 
-	db, err := database.CreateLevelDBDatabase("Database/", "Common", "Shard_0.sqlite")
+	// Lock the unique values of the stored user too, so that no other user
+	// claims one of them until its index entry is deleted
+	old, _, err := s.storedUser(userName)
 	if err != nil {
-		log.Printf("Error opening database: %v", err)
-		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+		return err
 	}
-	defer db.Close()
+	locks := userLocks(old, userName)
+	for {
+		missing, err := s.deleteUser(userName, locks)
+		if err != nil || len(missing) == 0 {
+			return err
+		}
+		locks = append(locks, missing...)
+	}
+}
+
+// deleteUser runs DeleteUser holding the locks of keys. If the stored user
+// needs locks not among keys, because it changed since it was first read,
+// nothing is deleted and they are returned.
+func (s *Store) deleteUser(userName string, keys []string) (missing []string, err error) {
+	defer s.db.LockKeys(keys...)()
 
 	// Check if user exists before attempting delete
-	_, err = db.Get([]byte(userName), nil)
+	old, shard, err := s.storedUser(userName)
 	if err != nil {
-		log.Printf("Error reading from database for user %s: %v", userName, err)
-		return fmt.Errorf("%w: %v", ErrUserNotFound, err)
+		return nil, err
+	}
+	if old == nil {
+		log.Printf("Error reading from database for user %s: %v", userName, leveldb.ErrNotFound)
+		return nil, fmt.Errorf("%w: %v", ErrUserNotFound, leveldb.ErrNotFound)
+	}
+	for _, key := range userLocks(old, userName) {
+		if !slices.Contains(keys, key) {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return missing, nil
 	}
 
-	// Delete the user data
-	err = db.Delete([]byte(userName), nil)
+	db, err := s.db.ShardNumber(shard)
 	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	// Delete the user data and its index entries
+	entries := userIndexEntries(old, userName)
+	batch := new(leveldb.Batch)
+	batch.Delete(UserKeys.Key(userName))
+	for _, key := range entries {
+		batch.Delete([]byte(key))
+	}
+	if err := db.Write(batch, nil); err != nil {
 		log.Printf("Error deleting from database: %v", err)
-		return fmt.Errorf("%w: %v", ErrDatabaseDelete, err)
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseDelete, err)
 	}
 
-	return nil
+	if err := s.unrouteEntries(entries); err != nil {
+		return nil, err
+	}
+	return nil, s.unplace(UserKeys, userName)
 }
 
-// UserExists checks if a user exists in the database.
-// Returns true if the user exists, false otherwise.
-func UserExists(userName string) (bool, error) {
+// storedUser reads the user stored under id and returns it with its shard,
+// or a nil user if there is none. Users without a schema entry are read
+// from the default shard, shard 0.
+func (s *Store) storedUser(id string) (*User, int64, error) {
+	shard, ok, err := s.schema.Lookup(string(UserKeys.Key(id)))
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return nil, 0, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+	if !ok {
+		shard = 0
+	}
+	db, err := s.db.ShardNumber(shard)
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return nil, 0, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	data, err := db.Get(UserKeys.Key(id), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, shard, nil
+	}
+	if err != nil {
+		log.Printf("Error reading from database for user %s: %v", id, err)
+		return nil, 0, readError(err)
+	}
+	u := &User{}
+	if err := proto.Unmarshal(data, u); err != nil {
+		log.Printf("Error unmarshaling user data: %v", err)
+		return nil, 0, fmt.Errorf("%w: %v", ErrDeserialize, err)
+	}
+	return u, shard, nil
+}
+
+// UserExists reports whether a user is stored under userName
+func (s *Store) UserExists(userName string) (bool, error) {
 	if userName == "" {
 		return false, ErrInvalidUsername
 	}
 
-	db, err := database.CreateLevelDBDatabase("Database/", "Common", "Shard_0.sqlite")
+	db, err := s.route(UserKeys, userName)
 	if err != nil {
 		return false, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
 	}
-	defer db.Close()
 
-	_, err = db.Get([]byte(userName), nil)
+	_, err = db.Get(UserKeys.Key(userName), nil)
 	if err != nil {
 		return false, nil // User doesn't exist
 	}
 
 	return true, nil
 }
+
+// readError wraps a failed user read in ErrDatabaseRead, and also in
+// ErrUserNotFound when the user does not exist
+func readError(err error) error {
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return fmt.Errorf("%w: %w", ErrDatabaseRead, ErrUserNotFound)
+	}
+	return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+}
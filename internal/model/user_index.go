@@ -0,0 +1,440 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"google.golang.org/protobuf/proto"
+)
+
+// userIndex is a secondary index of users over one field. An entry is keyed
+// by the field value and the PersonId of its user and holds no data. Entries
+// are stored in the shard of their user and written in the same batch as
+// the user, so the two never disagree; their fragmentation schema entries
+// route lookups to that shard.
+type userIndex struct {
+	keys Keyspace
+	// field is the name of the indexed field in user.proto
+	field string
+	// unique rejects a value already indexed for another user
+	unique bool
+	// get returns the indexed field of u
+	get func(u *User) string
+	// normalize maps a field value to its indexed form, so that values with
+	// the same form are the same value. A nil normalize indexes values as
+	// they are.
+	normalize func(value string) string
+}
+
+// The indexes kept by the user methods of Store. User names and emails are
+// unique, emails case-insensitively, as in the SQLite user store.
+var (
+	userNameIndex  = userIndex{keys: UserNameKeys, field: "user_name", unique: true, get: (*User).GetUserName}
+	userEmailIndex = userIndex{keys: UserEmailKeys, field: "email", unique: true, get: (*User).GetEmail, normalize: normalizeEmail}
+	userPhoneIndex = userIndex{keys: UserPhoneKeys, field: "phone_number", get: (*User).GetPhoneNumber}
+	userIndexes    = []userIndex{userNameIndex, userEmailIndex, userPhoneIndex}
+)
+
+// normalizeEmail returns the indexed form of an email: trimmed and lower case
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalized returns the indexed form of value. Every value written to,
+// compared with or looked up in x goes through it.
+func (x userIndex) normalized(value string) string {
+	if x.normalize == nil {
+		return value
+	}
+	return x.normalize(value)
+}
+
+// value returns the indexed form of the field of u. Users with an empty
+// value have no entry.
+func (x userIndex) value(u *User) string {
+	return x.normalized(x.get(u))
+}
+
+// prefix returns the key prefix of the entries of value. The value is ended
+// by a NUL byte so that no value is a prefix of another.
+func (x userIndex) prefix(value string) string {
+	return x.keys.Prefix + value + "\x00"
+}
+
+// userIndexEntries returns the index entry keys of u stored under id
+func userIndexEntries(u *User, id string) []string {
+	var keys []string
+	for _, x := range userIndexes {
+		if value := x.value(u); value != "" {
+			keys = append(keys, x.prefix(value)+id)
+		}
+	}
+	return keys
+}
+
+// UserIndexDependents names the index entries of every user and the
+// UserSessionKeys entry of every session, so that database.Rebalancer moves
+// them together with their user or session
+func UserIndexDependents() database.DependentKeys {
+	d := database.DependentKeys{
+		Prefixes: []string{UserSessionKeys.Prefix},
+		Of: func(key string, value []byte) []string {
+			if _, ok := SessionKeys.ID([]byte(key)); ok {
+				session := &Session{}
+				if err := json.Unmarshal(value, session); err != nil {
+					return nil
+				}
+				return sessionIndexEntries(session)
+			}
+			id, ok := UserKeys.ID([]byte(key))
+			if !ok {
+				return nil
+			}
+			u := &User{}
+			if err := proto.Unmarshal(value, u); err != nil {
+				return nil
+			}
+			return userIndexEntries(u, id)
+		},
+	}
+	for _, x := range userIndexes {
+		d.Prefixes = append(d.Prefixes, x.keys.Prefix)
+	}
+	return d
+}
+
+// FindUserByName reads the user with the given user name into u
+func (s *Store) FindUserByName(u *User, name string) error {
+	return s.findIndexed(userNameIndex, u, name)
+}
+
+// FindUserByEmail reads the user with the given email into u
+func (s *Store) FindUserByEmail(u *User, email string) error {
+	return s.findIndexed(userEmailIndex, u, email)
+}
+
+// FindUserByPhone reads a user with the given phone number into u. Phone
+// numbers are not unique; the user with the lowest PersonId is returned.
+func (s *Store) FindUserByPhone(u *User, phone string) error {
+	return s.findIndexed(userPhoneIndex, u, phone)
+}
+
+// findIndexed reads the first user indexed under value by x into u
+func (s *Store) findIndexed(x userIndex, u *User, value string) error {
+	ids, err := s.indexed(x, value)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		log.Printf("Error reading from database for %s %s: user not found", x.field, value)
+		return fmt.Errorf("%w: %w", ErrDatabaseRead, ErrUserNotFound)
+	}
+	return s.GetUser(u, ids[0])
+}
+
+// indexed returns the PersonIds of the users indexed under value by x, in
+// PersonId order. Schema entries whose index entry was never written, left
+// by an interrupted write, are skipped, and so is a user that no longer
+// holds the value.
+func (s *Store) indexed(x userIndex, value string) ([]string, error) {
+	value = x.normalized(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	prefix := x.prefix(value)
+	var entries []database.Entry
+	if err := s.schema.Scan(prefix, func(e database.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+
+	var ids []string
+	for _, e := range entries {
+		db, err := s.db.ShardNumber(e.Shard)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+		}
+		if _, err := db.Get([]byte(e.Key), nil); errors.Is(err, leveldb.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+		}
+
+		id := strings.TrimPrefix(e.Key, prefix)
+		u := &User{}
+		if err := s.GetUser(u, id); errors.Is(err, ErrUserNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if x.value(u) == value {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// lockUser locks the user stored under id and the unique values of u
+// against other writers, so that two users cannot claim a value at once.
+// The striped key locks are not reentrant, so all of them are taken at once
+// by database.Store.LockKeys.
+func (s *Store) lockUser(u *User, id string) (unlock func()) {
+	return s.db.LockKeys(userLocks(u, id)...)
+}
+
+// userLocks returns the lock keys of a write of u under id: the key of the
+// user and the entry prefixes of its unique values. A nil u has no values.
+func userLocks(u *User, id string) []string {
+	keys := []string{string(UserKeys.Key(id))}
+	if u == nil {
+		return keys
+	}
+	for _, x := range userIndexes {
+		if value := x.value(u); x.unique && value != "" {
+			keys = append(keys, x.prefix(value))
+		}
+	}
+	return keys
+}
+
+// checkUnique returns ErrDuplicateUser if a unique value that u claims is
+// indexed for another user than id. Values old, the user stored before,
+// already holds are not claimed again, so users sharing a value from before
+// the indexes can still be written. The caller holds the locks of
+// lockUser.
+func (s *Store) checkUnique(old, u *User, id string) error {
+	for _, x := range userIndexes {
+		value := x.value(u)
+		if !x.unique || value == "" || (old != nil && x.value(old) == value) {
+			continue
+		}
+		ids, err := s.indexed(x, value)
+		if err != nil {
+			return err
+		}
+		for _, other := range ids {
+			if other != id {
+				return fmt.Errorf("%w: %s %q belongs to %s", ErrDuplicateUser, x.field, value, other)
+			}
+		}
+	}
+	return nil
+}
+
+// writeUser stores u under id in shard together with its index entries in
+// one batch, deleting the entries of old, the user stored before, that u no
+// longer has. New entries are added to the schema before the batch and the
+// dropped ones removed after it, so that every entry is routed while it is
+// stored.
+func (s *Store) writeUser(shard int64, id string, old, u *User) error {
+	db, err := s.db.ShardNumber(shard)
+	if err != nil {
+		log.Printf("Error opening database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+
+	bytes, err := proto.Marshal(u)
+	if err != nil {
+		log.Printf("Error marshaling user data: %v", err)
+		return fmt.Errorf("%w: %v", ErrSerialize, err)
+	}
+
+	entries := userIndexEntries(u, id)
+	var dropped []string
+	if old != nil {
+		for _, key := range userIndexEntries(old, id) {
+			if !slices.Contains(entries, key) {
+				dropped = append(dropped, key)
+			}
+		}
+	}
+	if len(entries) > 0 {
+		if err := s.schema.Add(shard, entries...); err != nil {
+			log.Printf("Error routing the index entries of user %s: %v", id, err)
+			return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+		}
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put(UserKeys.Key(id), bytes)
+	for _, key := range entries {
+		batch.Put([]byte(key), nil)
+	}
+	for _, key := range dropped {
+		batch.Delete([]byte(key))
+	}
+	if err := db.Write(batch, nil); err != nil {
+		log.Printf("Error writing to database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+	}
+
+	return s.unrouteEntries(dropped)
+}
+
+// unrouteEntries removes the schema entries of deleted index entries
+func (s *Store) unrouteEntries(keys []string) error {
+	var routed []string
+	for _, key := range keys {
+		if _, ok, err := s.schema.Lookup(key); err != nil {
+			return err
+		} else if ok {
+			routed = append(routed, key)
+		}
+	}
+	if len(routed) == 0 {
+		return nil
+	}
+	if err := s.schema.RemoveMany(routed...); err != nil {
+		return fmt.Errorf("failed to remove deleted index entries: %w", err)
+	}
+	return nil
+}
+
+// RebuildUserIndexes drops every user index entry and indexes the stored
+// users again, for recovery from lost or damaged entries. It returns the
+// number of users indexed and of values left out because a user saved
+// earlier already holds them; users are visited in PersonId order. Run
+// Migrate first so every user has a schema entry, and do not write users
+// while the indexes are rebuilt.
+func (s *Store) RebuildUserIndexes() (indexed, conflicts int, err error) {
+	// The entries may be on any shard holding users or index entries
+	shards := map[int64]bool{0: true}
+	users := make(map[string]int64)
+	var routed []string
+	if err := s.schema.Scan(UserKeys.Prefix, func(e database.Entry) error {
+		shards[e.Shard] = true
+		users[e.Key] = e.Shard
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+	for _, x := range userIndexes {
+		if err := s.schema.Scan(x.keys.Prefix, func(e database.Entry) error {
+			shards[e.Shard] = true
+			routed = append(routed, e.Key)
+			return nil
+		}); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	for shard := range shards {
+		if err := s.dropIndexEntries(shard); err != nil {
+			return 0, 0, err
+		}
+	}
+	if len(routed) > 0 {
+		if err := s.schema.RemoveMany(routed...); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	keys := make([]string, 0, len(users))
+	for key := range users {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// claimed maps the prefix of every unique value to the user holding it
+	claimed := make(map[string]string)
+	for _, key := range keys {
+		id, _ := UserKeys.ID([]byte(key))
+		n, err := s.reindexUser(users[key], id, claimed)
+		if errors.Is(err, ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return indexed, conflicts, err
+		}
+		indexed++
+		conflicts += n
+	}
+	return indexed, conflicts, nil
+}
+
+// dropIndexEntries deletes every user index entry stored on shard
+func (s *Store) dropIndexEntries(shard int64) error {
+	db, err := s.db.ShardNumber(shard)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+	batch := new(leveldb.Batch)
+	for _, x := range userIndexes {
+		iter := db.NewIterator(util.BytesPrefix([]byte(x.keys.Prefix)), nil)
+		for iter.Next() {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+		}
+	}
+	if err := db.Write(batch, nil); err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseDelete, err)
+	}
+	return nil
+}
+
+// reindexUser writes the index entries of the user stored under id on
+// shard, leaving out the unique values claimed by another user, and returns
+// the number left out
+func (s *Store) reindexUser(shard int64, id string, claimed map[string]string) (int, error) {
+	defer s.lock(UserKeys, id)()
+
+	db, err := s.db.ShardNumber(shard)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrDatabaseOpen, err)
+	}
+	data, err := db.Get(UserKeys.Key(id), nil)
+	if err != nil {
+		return 0, readError(err)
+	}
+	u := &User{}
+	if err := proto.Unmarshal(data, u); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrDeserialize, err)
+	}
+
+	var entries []string
+	conflicts := 0
+	for _, x := range userIndexes {
+		value := x.value(u)
+		if value == "" {
+			continue
+		}
+		prefix := x.prefix(value)
+		if x.unique {
+			if owner, ok := claimed[prefix]; ok {
+				log.Printf("Reindex: user %s not indexed by %s, %q belongs to %s", id, x.field, value, owner)
+				conflicts++
+				continue
+			}
+			claimed[prefix] = id
+		}
+		entries = append(entries, prefix+id)
+	}
+	if len(entries) == 0 {
+		return conflicts, nil
+	}
+
+	if err := s.schema.Add(shard, entries...); err != nil {
+		return conflicts, err
+	}
+	batch := new(leveldb.Batch)
+	for _, key := range entries {
+		batch.Put([]byte(key), nil)
+	}
+	if err := db.Write(batch, nil); err != nil {
+		return conflicts, fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+	}
+	return conflicts, nil
+}
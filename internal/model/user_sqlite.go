@@ -0,0 +1,323 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	sqlite "github.com/glebarez/go-sqlite"
+	"google.golang.org/protobuf/proto"
+)
+
+// Extended SQLite result codes of a unique index violation
+// (SQLITE_CONSTRAINT_UNIQUE) and of a duplicate primary key
+// (SQLITE_CONSTRAINT_PRIMARYKEY)
+const (
+	sqliteConstraintUnique     = 2067
+	sqliteConstraintPrimaryKey = 1555
+)
+
+// userColumns lists the columns of the users table in the order read by
+// findUser and written by SaveUser
+const userColumns = `person_id, user_name, profile, password, email, profile_pic_url,
+	account_time, birth_date, gender, last_edit, phone_number`
+
+// emailColumn compares emails regardless of case, as the users_email index does
+const emailColumn = "email COLLATE NOCASE"
+
+// SQLiteUsers stores users as rows of a SQLite table, so they can be
+// queried by email or phone number. User names are unique, and so are
+// emails regardless of case.
+// It has the same contract as the user methods of Store: users are keyed by
+// their PersonId. It is safe for concurrent use.
+type SQLiteUsers struct {
+	db *sql.DB
+}
+
+// OpenSQLiteUsers returns the user store in the SQLite database of db,
+// migrating its schema on first use
+func OpenSQLiteUsers(db *database.Store) (*SQLiteUsers, error) {
+	sqlDB, err := openSQLite(db)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteUsers{db: sqlDB}, nil
+}
+
+// NewSQLiteUsers creates a user store over db and migrates its schema to
+// the latest version
+func NewSQLiteUsers(db *sql.DB) (*SQLiteUsers, error) {
+	if err := migrateSQLite(db); err != nil {
+		return nil, err
+	}
+	return &SQLiteUsers{db: db}, nil
+}
+
+// SaveUser inserts u, or replaces the user with the same PersonId
+func (s *SQLiteUsers) SaveUser(u *User) error {
+	if u.PersonId == "" {
+		return ErrInvalidUsername
+	}
+	if err := hashUserPassword(u); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(`INSERT INTO users (`+userColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (person_id) DO UPDATE SET
+			user_name = excluded.user_name, profile = excluded.profile,
+			password = excluded.password, email = excluded.email,
+			profile_pic_url = excluded.profile_pic_url, account_time = excluded.account_time,
+			birth_date = excluded.birth_date, gender = excluded.gender,
+			last_edit = excluded.last_edit, phone_number = excluded.phone_number`,
+		u.PersonId, u.UserName, u.Profile, u.Password, u.Email, u.ProfilePicUrl,
+		u.AccountTime, u.BirthDate, u.Gender, u.LastEdit, u.PhoneNumber)
+	if err != nil {
+		log.Printf("Error writing to database: %v", err)
+		return writeError(err)
+	}
+	return nil
+}
+
+// CreateUser inserts u, failing with ErrDuplicateUser if its PersonId, name
+// or email is taken
+func (s *SQLiteUsers) CreateUser(u *User) error {
+	if u.PersonId == "" {
+		return ErrInvalidUsername
+	}
+	if err := hashUserPassword(u); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(`INSERT INTO users (`+userColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.PersonId, u.UserName, u.Profile, u.Password, u.Email, u.ProfilePicUrl,
+		u.AccountTime, u.BirthDate, u.Gender, u.LastEdit, u.PhoneNumber)
+	if err != nil {
+		log.Printf("Error writing to database: %v", err)
+		return writeError(err)
+	}
+	return nil
+}
+
+// GetUser reads the user with PersonId id into u
+func (s *SQLiteUsers) GetUser(u *User, id string) error {
+	if id == "" {
+		return ErrInvalidUsername
+	}
+	return findUser(s.db, u, "person_id", id)
+}
+
+// FindUserByName reads the user with the given user name into u
+func (s *SQLiteUsers) FindUserByName(u *User, name string) error {
+	return findUser(s.db, u, "user_name", name)
+}
+
+// FindUserByEmail reads the user with the given email, in any case, into u
+func (s *SQLiteUsers) FindUserByEmail(u *User, email string) error {
+	return findUser(s.db, u, emailColumn, email)
+}
+
+// FindUserByPhone reads the user with the given phone number into u. Phone
+// numbers are not unique; the user saved first is returned.
+func (s *SQLiteUsers) FindUserByPhone(u *User, phone string) error {
+	return findUser(s.db, u, "phone_number", phone)
+}
+
+// UpdateUser replaces the existing user with PersonId id with u
+func (s *SQLiteUsers) UpdateUser(u *User, id string) error {
+	if id == "" {
+		return ErrInvalidUsername
+	}
+	if err := hashUserPassword(u); err != nil {
+		return err
+	}
+
+	result, err := updateUser(s.db, u, id)
+	if err != nil {
+		log.Printf("Error writing to database: %v", err)
+		return writeError(err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+	} else if n == 0 {
+		return fmt.Errorf("%w: %w", ErrDatabaseRead, ErrUserNotFound)
+	}
+	return nil
+}
+
+// ModifyUser reads the user with PersonId id, calls modify on it and stores
+// the result. A new password is hashed before the transaction is begun, so
+// the write lock of the database is never held while hashing; the result is
+// only stored if the user is unchanged by then, and modify runs again on a
+// fresh read otherwise.
+func (s *SQLiteUsers) ModifyUser(id string, modify func(*User) error) error {
+	if id == "" {
+		return ErrInvalidUsername
+	}
+
+	for {
+		old := &User{}
+		if err := findUser(s.db, old, "person_id", id); err != nil {
+			return err
+		}
+		u := proto.Clone(old).(*User)
+		if err := modify(u); err != nil {
+			return err
+		}
+		if err := hashUserPassword(u); err != nil {
+			return err
+		}
+		if written, err := s.replaceUser(id, old, u); err != nil || written {
+			return err
+		}
+	}
+}
+
+// replaceUser stores u as the user with PersonId id in one transaction if
+// the stored user still equals old, and reports whether it did
+func (s *SQLiteUsers) replaceUser(id string, old, u *User) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+	}
+	defer tx.Rollback()
+
+	current := &User{}
+	if err := findUser(tx, current, "person_id", id); err != nil {
+		return false, err
+	}
+	if !proto.Equal(current, old) {
+		return false, nil
+	}
+	if _, err := updateUser(tx, u, id); err != nil {
+		log.Printf("Error writing to database: %v", err)
+		return false, writeError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error writing to database: %v", err)
+		return false, fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+	}
+	return true, nil
+}
+
+// DeleteUser removes the user with PersonId id
+func (s *SQLiteUsers) DeleteUser(id string) error {
+	if id == "" {
+		return ErrInvalidUsername
+	}
+
+	result, err := s.db.Exec(`DELETE FROM users WHERE person_id = ?`, id)
+	if err != nil {
+		log.Printf("Error deleting from database: %v", err)
+		return fmt.Errorf("%w: %v", ErrDatabaseDelete, err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseDelete, err)
+	} else if n == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id)
+	}
+	return nil
+}
+
+// UserExists reports whether a user with PersonId id is stored
+func (s *SQLiteUsers) UserExists(id string) (bool, error) {
+	if id == "" {
+		return false, ErrInvalidUsername
+	}
+
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE person_id = ?)`, id).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+	return exists, nil
+}
+
+// querier runs statements on a database or in a transaction
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// updateUser replaces the columns of the user with PersonId id with u
+func updateUser(q querier, u *User, id string) (sql.Result, error) {
+	return q.Exec(`UPDATE users SET
+			user_name = ?, profile = ?, password = ?, email = ?,
+			profile_pic_url = ?, account_time = ?, birth_date = ?, gender = ?,
+			last_edit = ?, phone_number = ?
+		WHERE person_id = ?`,
+		u.UserName, u.Profile, u.Password, u.Email, u.ProfilePicUrl,
+		u.AccountTime, u.BirthDate, u.Gender, u.LastEdit, u.PhoneNumber, id)
+}
+
+// findUser reads the first user whose column equals value into u. An empty
+// value matches no user, as users without a name or email are not indexed.
+func findUser(q querier, u *User, column, value string) error {
+	if value == "" {
+		return fmt.Errorf("%w: %w", ErrDatabaseRead, ErrUserNotFound)
+	}
+	row := q.QueryRow(`SELECT `+userColumns+` FROM users WHERE `+column+` = ?
+		ORDER BY rowid LIMIT 1`, value)
+	err := row.Scan(&u.PersonId, &u.UserName, &u.Profile, &u.Password, &u.Email, &u.ProfilePicUrl,
+		&u.AccountTime, &u.BirthDate, &u.Gender, &u.LastEdit, &u.PhoneNumber)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Error reading from database for %s %s: user not found", column, value)
+		return fmt.Errorf("%w: %w", ErrDatabaseRead, ErrUserNotFound)
+	}
+	if err != nil {
+		log.Printf("Error reading from database for %s %s: %v", column, value, err)
+		return fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+	return nil
+}
+
+// writeError maps a failed write to ErrDuplicateUser when it violates a
+// unique index or the primary key, and to ErrDatabaseWrite otherwise
+func writeError(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) &&
+		(sqliteErr.Code() == sqliteConstraintUnique || sqliteErr.Code() == sqliteConstraintPrimaryKey) {
+		return fmt.Errorf("%w: %v", ErrDuplicateUser, err)
+	}
+	return fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+}
+
+// HashPasswords replaces every plaintext password with its hash and returns
+// the number of users updated
+func (s *SQLiteUsers) HashPasswords() (int, error) {
+	rows, err := s.db.Query(`SELECT person_id, password FROM users
+		WHERE password != '' AND password NOT LIKE '` + passwordPrefix + `%'`)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+	plaintext := make(map[string]string)
+	for rows.Next() {
+		var id, password string
+		if err := rows.Scan(&id, &password); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+		}
+		plaintext[id] = password
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrDatabaseRead, err)
+	}
+
+	hashed := 0
+	for id, password := range plaintext {
+		hash, err := HashPassword(password)
+		if err != nil {
+			return hashed, fmt.Errorf("%w: %v", ErrSerialize, err)
+		}
+		if _, err := s.db.Exec(`UPDATE users SET password = ? WHERE person_id = ? AND password = ?`,
+			hash, id, password); err != nil {
+			return hashed, fmt.Errorf("%w: %v", ErrDatabaseWrite, err)
+		}
+		hashed++
+	}
+	return hashed, nil
+}
@@ -0,0 +1,171 @@
+// Package prompt assembles conversation-aware prompts for the AI provider.
+// It renders earlier turns of a conversation into a text template and trims the
+// oldest turns so the prompt fits the model's context window.
+package prompt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+)
+
+// Common errors for prompt assembly
+var (
+	ErrPromptTooLong = errors.New("prompt does not fit in the context window")
+	ErrInvalidBudget = errors.New("context budget must be positive")
+	ErrHistoryLoad   = errors.New("failed to load conversation history")
+)
+
+// Template controls how a conversation is rendered into a prompt
+type Template struct {
+	// System is the preamble placed before the conversation
+	System string `yaml:"system" json:"system"`
+	// UserPrefix is placed before each user turn
+	UserPrefix string `yaml:"user_prefix" json:"user_prefix"`
+	// AssistantPrefix is placed before each assistant turn and at the end
+	// of the prompt to cue the model's reply
+	AssistantPrefix string `yaml:"assistant_prefix" json:"assistant_prefix"`
+	// Separator is placed after the preamble and after every turn
+	Separator string `yaml:"separator" json:"separator"`
+}
+
+// DefaultTemplate returns the template used when none is configured
+func DefaultTemplate() Template {
+	return Template{
+		System:          "You are a helpful medical assistant. Answer health questions clearly and recommend consulting a doctor when appropriate.",
+		UserPrefix:      "User: ",
+		AssistantPrefix: "Assistant: ",
+		Separator:       "\n",
+	}
+}
+
+// TokenEstimator returns the estimated number of tokens in text
+type TokenEstimator func(text string) int
+
+// HistoryLoader returns the earlier messages of a conversation, oldest first
+type HistoryLoader func(conversationID string) ([]*model.Message, error)
+
+// EstimateTokens approximates the token count of text at roughly four
+// characters per token, which is close enough for budgeting English text.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// LoadHistory loads the messages of a conversation from the chat history store.
+// A conversation that has not been stored yet has no messages.
+func LoadHistory(conversationID string) ([]*model.Message, error) {
+	history := &model.ChatHistory{ConversationId: conversationID}
+	if err := history.GetChatHistory(); err != nil {
+		if errors.Is(err, model.ErrChatHistoryNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return history.GetMessages(), nil
+}
+
+// Builder renders conversations into prompts
+type Builder struct {
+	Template Template
+	Estimate TokenEstimator
+	Load     HistoryLoader
+}
+
+// NewBuilder creates a Builder that uses the given template, the default
+// token estimator and the chat history store.
+func NewBuilder(template Template) *Builder {
+	return &Builder{
+		Template: template,
+		Estimate: EstimateTokens,
+		Load:     LoadHistory,
+	}
+}
+
+// Budget returns the number of prompt tokens available when maxLength tokens
+// are reserved for the reply in a context window of maxContextLength tokens.
+func Budget(maxContextLength, maxLength int) int {
+	return maxContextLength - maxLength
+}
+
+// Build renders history followed by the new user prompt. The oldest turns are
+// dropped until the estimated token count fits within budget.
+// Returns the rendered prompt and the number of turns that were dropped.
+func (b *Builder) Build(history []*model.Message, userPrompt string, budget int) (string, int, error) {
+	if budget <= 0 {
+		return "", 0, ErrInvalidBudget
+	}
+
+	t := b.Template
+	var header string
+	if t.System != "" {
+		header = t.System + t.Separator
+	}
+	footer := t.UserPrefix + userPrompt + t.Separator + strings.TrimRight(t.AssistantPrefix, " ")
+
+	used := b.Estimate(header) + b.Estimate(footer)
+	if used > budget {
+		return "", 0, fmt.Errorf("%w: needs %d tokens, budget is %d", ErrPromptTooLong, used, budget)
+	}
+
+	turns := make([]string, len(history))
+	for i, msg := range history {
+		turns[i] = b.renderTurn(msg)
+	}
+
+	// Keep the newest turns that fit, walking backwards from the end
+	start := len(turns)
+	for start > 0 {
+		cost := b.Estimate(turns[start-1])
+		if used+cost > budget {
+			break
+		}
+		used += cost
+		start--
+	}
+
+	var sb strings.Builder
+	sb.WriteString(header)
+	for _, turn := range turns[start:] {
+		sb.WriteString(turn)
+	}
+	sb.WriteString(footer)
+
+	return sb.String(), start, nil
+}
+
+// BuildForConversation loads the conversation history and renders it with
+// the new user prompt, reserving maxLength tokens of maxContextLength for the reply.
+func (b *Builder) BuildForConversation(conversationID, userPrompt string, maxContextLength, maxLength int) (string, error) {
+	history, err := b.Load(conversationID)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrHistoryLoad, err)
+	}
+	return b.BuildConversation(conversationID, history, userPrompt, maxContextLength, maxLength)
+}
+
+// BuildConversation renders the already loaded history of a conversation with
+// the new user prompt, like BuildForConversation.
+func (b *Builder) BuildConversation(conversationID string, history []*model.Message, userPrompt string, maxContextLength, maxLength int) (string, error) {
+	rendered, dropped, err := b.Build(history, userPrompt, Budget(maxContextLength, maxLength))
+	if err != nil {
+		return "", err
+	}
+
+	if dropped > 0 {
+		log.Printf("Trimmed %d oldest turns from conversation %s to fit the context window", dropped, conversationID)
+	}
+	return rendered, nil
+}
+
+// renderTurn renders a single message with the prefix for its author
+func (b *Builder) renderTurn(msg *model.Message) string {
+	prefix := b.Template.UserPrefix
+	if msg.GetAiId() != "" {
+		prefix = b.Template.AssistantPrefix
+	}
+	return prefix + msg.GetContent() + b.Template.Separator
+}
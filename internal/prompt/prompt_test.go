@@ -0,0 +1,208 @@
+// Package prompt provides tests for conversation-aware prompt assembly.
+package prompt
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+)
+
+// testTemplate returns a compact template that keeps expectations readable
+func testTemplate() Template {
+	return Template{
+		System:          "SYS",
+		UserPrefix:      "U: ",
+		AssistantPrefix: "A: ",
+		Separator:       "\n",
+	}
+}
+
+// wordCount is a deterministic estimator that counts whitespace-separated words
+func wordCount(text string) int {
+	return len(strings.Fields(text))
+}
+
+// testHistory returns alternating user and assistant messages
+func testHistory() []*model.Message {
+	return []*model.Message{
+		{MsgId: "1", UserId: "u", Content: "one"},
+		{MsgId: "2", AiId: "ai", Content: "two"},
+		{MsgId: "3", UserId: "u", Content: "three"},
+		{MsgId: "4", AiId: "ai", Content: "four"},
+	}
+}
+
+// TestEstimateTokens tests the default token estimator
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"", 0},
+		{"abc", 1},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"héllo wörld", 3},
+	}
+
+	for _, tt := range tests {
+		if got := EstimateTokens(tt.input); got != tt.expected {
+			t.Errorf("EstimateTokens(%q) = %d, want %d", tt.input, got, tt.expected)
+		}
+	}
+}
+
+// TestBudget tests reserving reply tokens from the context window
+func TestBudget(t *testing.T) {
+	if got := Budget(2048, 100); got != 1948 {
+		t.Errorf("Budget(2048, 100) = %d, want 1948", got)
+	}
+}
+
+// TestBuildRendersHistory tests rendering of all turns when they fit
+func TestBuildRendersHistory(t *testing.T) {
+	b := &Builder{Template: testTemplate(), Estimate: wordCount}
+
+	got, dropped, err := b.Build(testHistory(), "five", 100)
+	if err != nil {
+		t.Fatalf("Build() unexpected error: %v", err)
+	}
+
+	expected := "SYS\nU: one\nA: two\nU: three\nA: four\nU: five\nA:"
+	if got != expected {
+		t.Errorf("Build() = %q, want %q", got, expected)
+	}
+	if dropped != 0 {
+		t.Errorf("Expected no dropped turns, got %d", dropped)
+	}
+}
+
+// TestBuildTrimsOldestTurns tests that the oldest turns are dropped to fit the budget
+func TestBuildTrimsOldestTurns(t *testing.T) {
+	b := &Builder{Template: testTemplate(), Estimate: wordCount}
+
+	// Header (1) + footer "U: five A:" (3) leaves room for two 2-word turns
+	got, dropped, err := b.Build(testHistory(), "five", 9)
+	if err != nil {
+		t.Fatalf("Build() unexpected error: %v", err)
+	}
+
+	expected := "SYS\nU: three\nA: four\nU: five\nA:"
+	if got != expected {
+		t.Errorf("Build() = %q, want %q", got, expected)
+	}
+	if dropped != 2 {
+		t.Errorf("Expected 2 dropped turns, got %d", dropped)
+	}
+	if wordCount(got) > 9 {
+		t.Errorf("Rendered prompt exceeds budget: %d tokens", wordCount(got))
+	}
+}
+
+// TestBuildErrors tests budget validation
+func TestBuildErrors(t *testing.T) {
+	b := &Builder{Template: testTemplate(), Estimate: wordCount}
+
+	tests := []struct {
+		name    string
+		prompt  string
+		budget  int
+		wantErr error
+	}{
+		{
+			name:    "Zero budget",
+			prompt:  "hi",
+			budget:  0,
+			wantErr: ErrInvalidBudget,
+		},
+		{
+			name:    "Prompt larger than budget",
+			prompt:  "a b c d e f g h",
+			budget:  5,
+			wantErr: ErrPromptTooLong,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := b.Build(nil, tt.prompt, tt.budget)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Build() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestBuildWithoutSystem tests rendering without a preamble
+func TestBuildWithoutSystem(t *testing.T) {
+	template := testTemplate()
+	template.System = ""
+	b := &Builder{Template: template, Estimate: wordCount}
+
+	got, _, err := b.Build(nil, "hi", 10)
+	if err != nil {
+		t.Fatalf("Build() unexpected error: %v", err)
+	}
+	if got != "U: hi\nA:" {
+		t.Errorf("Build() = %q, want %q", got, "U: hi\nA:")
+	}
+}
+
+// TestBuildForConversation tests loading history through the configured loader
+func TestBuildForConversation(t *testing.T) {
+	b := NewBuilder(testTemplate())
+	b.Load = func(conversationID string) ([]*model.Message, error) {
+		if conversationID != "conv_1" {
+			t.Errorf("Unexpected conversation ID %s", conversationID)
+		}
+		return testHistory()[:2], nil
+	}
+
+	got, err := b.BuildForConversation("conv_1", "three", 2048, 100)
+	if err != nil {
+		t.Fatalf("BuildForConversation() unexpected error: %v", err)
+	}
+	if got != "SYS\nU: one\nA: two\nU: three\nA:" {
+		t.Errorf("BuildForConversation() = %q", got)
+	}
+
+	b.Load = func(string) ([]*model.Message, error) {
+		return nil, errors.New("disk on fire")
+	}
+	if _, err := b.BuildForConversation("conv_1", "three", 2048, 100); !errors.Is(err, ErrHistoryLoad) {
+		t.Errorf("Expected ErrHistoryLoad, got %v", err)
+	}
+}
+
+// TestLoadHistory tests loading stored and missing conversations
+func TestLoadHistory(t *testing.T) {
+	originalDir, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(originalDir)
+	defer database.CloseAll()
+
+	messages, err := LoadHistory("missing_conv")
+	if err != nil {
+		t.Fatalf("LoadHistory() unexpected error for missing conversation: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected no messages, got %d", len(messages))
+	}
+
+	history := &model.ChatHistory{ConversationId: "stored_conv"}
+	if err := history.AddMessageToHistory(&model.Message{MsgId: "m1", Content: "hello"}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	messages, err = LoadHistory("stored_conv")
+	if err != nil {
+		t.Fatalf("LoadHistory() unexpected error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].GetContent() != "hello" {
+		t.Errorf("Unexpected messages: %v", messages)
+	}
+}
@@ -0,0 +1,153 @@
+// Package provider provides load balancing and failover across several AI endpoints.
+package provider
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/TeamPentagon/DM-Backend/internal/upstream"
+)
+
+// BalancedProvider spreads requests over several endpoints of the same kind
+// of backend. When an endpoint cannot be reached or fails with a server
+// error, the request is retried on the next available one; see failover.
+// Streams only fail over before the first token is relayed, so a client
+// never receives a reply stitched together from two generations.
+type BalancedProvider struct {
+	balancer  *upstream.Balancer
+	providers []Provider
+	// probers ping the backends without retries or circuit breakers
+	probers []Provider
+}
+
+// NewBalanced creates a provider of kind cfg.Name for every backend of the balancer.
+// The endpoint, streaming endpoint and HTTP clients of each come from its backend.
+func NewBalanced(cfg Config, balancer *upstream.Balancer) (*BalancedProvider, error) {
+	backends := balancer.Backends()
+	providers := make([]Provider, len(backends))
+	probers := make([]Provider, len(backends))
+	for i, be := range backends {
+		backendCfg := cfg
+		backendCfg.Endpoint = be.URL
+		backendCfg.StreamEndpoint = be.StreamURL
+		backendCfg.Client = be.Client
+
+		p, err := New(backendCfg)
+		if err != nil {
+			return nil, err
+		}
+		providers[i] = p
+
+		backendCfg.Client = be.ProbeClient
+		if probers[i], err = New(backendCfg); err != nil {
+			return nil, err
+		}
+	}
+
+	return &BalancedProvider{balancer: balancer, providers: providers, probers: probers}, nil
+}
+
+// Name returns the name of the underlying provider kind
+func (b *BalancedProvider) Name() string {
+	return b.providers[0].Name()
+}
+
+// Generate sends the request to the next endpoint, failing over on
+// unreachable or failing endpoints
+func (b *BalancedProvider) Generate(ctx context.Context, req Request) (*Result, error) {
+	tried := make(map[*upstream.Backend]bool)
+	var lastErr error
+
+	for {
+		be, err := b.next(tried, lastErr)
+		if err != nil {
+			return nil, err
+		}
+
+		be.Acquire()
+		result, err := b.providers[be.Index].Generate(ctx, req)
+		be.Release()
+
+		if err == nil || ctx.Err() != nil || !failover(err) {
+			return result, err
+		}
+		log.Printf("AI endpoint %s failed: %v", be.URL, err)
+		lastErr = err
+	}
+}
+
+// Stream streams from the next endpoint, failing over while no token has been relayed
+func (b *BalancedProvider) Stream(ctx context.Context, req Request, onToken TokenFunc) (*Result, error) {
+	tried := make(map[*upstream.Backend]bool)
+	var lastErr error
+
+	for {
+		be, err := b.next(tried, lastErr)
+		if err != nil {
+			return nil, err
+		}
+
+		started := false
+		be.Acquire()
+		result, err := b.providers[be.Index].Stream(ctx, req, func(token string) error {
+			started = true
+			return onToken(token)
+		})
+		be.Release()
+
+		if err == nil || started || ctx.Err() != nil || !failover(err) {
+			return result, err
+		}
+		log.Printf("AI endpoint %s failed before streaming: %v", be.URL, err)
+		lastErr = err
+	}
+}
+
+// Ping succeeds when at least one endpoint is reachable
+func (b *BalancedProvider) Ping(ctx context.Context) error {
+	var errs []error
+	for _, be := range b.balancer.Backends() {
+		err := b.Probe(ctx, be)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Probe pings a single backend. It is used as the balancer's health probe.
+// Probes are sent once, through the plain client of the backend, so they
+// neither wait for retries nor open its circuit breaker.
+func (b *BalancedProvider) Probe(ctx context.Context, be *upstream.Backend) error {
+	return b.probers[be.Index].Ping(ctx)
+}
+
+// failover reports whether a request that failed with err is tried on the
+// next endpoint: when the endpoint could not be reached, answered with a
+// server error or has an open circuit breaker. A request rejected with a 4xx
+// status would be rejected by every endpoint, so that error is returned as is,
+// as is an invalid reply.
+func failover(err error) bool {
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.StatusCode >= http.StatusInternalServerError
+	}
+	return !errors.Is(err, ErrInvalidResponse)
+}
+
+// next picks the next untried backend and marks it as tried.
+// Once every endpoint has been tried the last endpoint error is returned.
+func (b *BalancedProvider) next(tried map[*upstream.Backend]bool, lastErr error) (*upstream.Backend, error) {
+	be, err := b.balancer.Next(tried)
+	if err != nil {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, err
+	}
+	tried[be] = true
+	return be, nil
+}
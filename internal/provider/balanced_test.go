@@ -0,0 +1,210 @@
+// Package provider provides tests for load balancing and failover.
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TeamPentagon/DM-Backend/internal/upstream"
+)
+
+// newTestBalanced creates a balanced kobold provider over the given servers
+func newTestBalanced(t *testing.T, urls ...string) *BalancedProvider {
+	t.Helper()
+	endpoints := make([]upstream.Endpoint, len(urls))
+	for i, u := range urls {
+		endpoints[i] = upstream.Endpoint{URL: u + "/api/v1/generate", Weight: 1}
+	}
+
+	cfg := upstream.DefaultConfig()
+	cfg.MaxRetries = 0
+	balancer, err := upstream.NewBalancer(endpoints, upstream.RoundRobin, cfg)
+	if err != nil {
+		t.Fatalf("NewBalancer() unexpected error: %v", err)
+	}
+
+	p, err := NewBalanced(Config{Name: Kobold}, balancer)
+	if err != nil {
+		t.Fatalf("NewBalanced() unexpected error: %v", err)
+	}
+	return p
+}
+
+// countingServer answers with handler and counts the requests it receives
+func countingServer(calls *int32, handler http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		handler(w, r)
+	}))
+}
+
+// TestBalancedGenerateFailover tests that a failed endpoint is retried on the next one
+func TestBalancedGenerateFailover(t *testing.T) {
+	var badCalls, goodCalls int32
+	bad := countingServer(&badCalls, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer bad.Close()
+	good := countingServer(&goodCalls, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"results":[{"text":"ok"}]}`))
+	})
+	defer good.Close()
+
+	p := newTestBalanced(t, bad.URL, good.URL)
+
+	for i := 0; i < 4; i++ {
+		result, err := p.Generate(context.Background(), Request{Prompt: "hi"})
+		if err != nil {
+			t.Fatalf("Generate() unexpected error: %v", err)
+		}
+		if result.Text != "ok" {
+			t.Errorf("Expected reply from the healthy endpoint, got %q", result.Text)
+		}
+	}
+
+	if atomic.LoadInt32(&goodCalls) != 4 {
+		t.Errorf("Expected every request to reach the healthy endpoint, got %d", goodCalls)
+	}
+	if atomic.LoadInt32(&badCalls) == 0 {
+		t.Error("Expected the failing endpoint to be tried")
+	}
+	if p.Name() != Kobold {
+		t.Errorf("Name() = %s, want %s", p.Name(), Kobold)
+	}
+}
+
+// TestBalancedGenerateAllFail tests that the last endpoint error is returned
+func TestBalancedGenerateAllFail(t *testing.T) {
+	var calls int32
+	bad := countingServer(&calls, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer bad.Close()
+
+	p := newTestBalanced(t, bad.URL, bad.URL)
+
+	_, err := p.Generate(context.Background(), Request{Prompt: "hi"})
+	if !errors.Is(err, ErrUpstreamStatus) {
+		t.Errorf("Generate() error = %v, want %v", err, ErrUpstreamStatus)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("Expected each endpoint to be tried once, got %d calls", calls)
+	}
+}
+
+// TestBalancedGenerateClientError tests that a request rejected with a 4xx
+// status is returned as is instead of being sent to every endpoint
+func TestBalancedGenerateClientError(t *testing.T) {
+	var calls int32
+	rejecting := countingServer(&calls, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	})
+	defer rejecting.Close()
+
+	p := newTestBalanced(t, rejecting.URL, rejecting.URL)
+
+	_, err := p.Generate(context.Background(), Request{Prompt: "hi"})
+	var status *StatusError
+	if !errors.As(err, &status) || status.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Generate() error = %v, want status %d", err, http.StatusUnprocessableEntity)
+	}
+	if !errors.Is(err, ErrUpstreamStatus) {
+		t.Errorf("Expected the error to match %v", ErrUpstreamStatus)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Expected a single attempt, got %d calls", got)
+	}
+	for _, s := range p.balancer.Status() {
+		if s.Breaker.State != upstream.StateClosed || s.Breaker.ConsecutiveFailures != 0 {
+			t.Errorf("Expected the rejection not to count against %s, got %+v", s.URL, s.Breaker)
+		}
+	}
+}
+
+// TestBalancedStreamFailover tests failover before the first token only
+func TestBalancedStreamFailover(t *testing.T) {
+	var badCalls, goodCalls int32
+	bad := countingServer(&badCalls, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer bad.Close()
+	good := countingServer(&goodCalls, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"token\":\"ok\"}\n\n")
+	})
+	defer good.Close()
+
+	p := newTestBalanced(t, bad.URL, good.URL)
+
+	var tokens []string
+	result, err := p.Stream(context.Background(), Request{Prompt: "hi"}, func(token string) error {
+		tokens = append(tokens, token)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream() unexpected error: %v", err)
+	}
+	if result.Text != "ok" || len(tokens) != 1 {
+		t.Errorf("Unexpected stream result %q with tokens %v", result.Text, tokens)
+	}
+}
+
+// TestBalancedStreamNoFailoverMidStream tests that a stream that already relayed tokens is not restarted
+func TestBalancedStreamNoFailoverMidStream(t *testing.T) {
+	var calls int32
+	broken := countingServer(&calls, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"token\":\"partial\"}\n\ndata: not json\n\n")
+	})
+	defer broken.Close()
+
+	p := newTestBalanced(t, broken.URL, broken.URL)
+
+	var tokens []string
+	_, err := p.Stream(context.Background(), Request{Prompt: "hi"}, func(token string) error {
+		tokens = append(tokens, token)
+		return nil
+	})
+	if !errors.Is(err, ErrInvalidResponse) {
+		t.Errorf("Stream() error = %v, want %v", err, ErrInvalidResponse)
+	}
+	if atomic.LoadInt32(&calls) != 1 || len(tokens) != 1 {
+		t.Errorf("Expected a single attempt, got %d calls and tokens %v", calls, tokens)
+	}
+}
+
+// TestBalancedProbe tests health probing through each provider's Ping
+func TestBalancedProbe(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/api/v1/model" {
+			t.Errorf("Unexpected probe %s %s", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`{"result":"koboldcpp/model"}`))
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	p := newTestBalanced(t, up.URL, down.URL)
+	for i := 0; i < upstream.DefaultConfig().FailureThreshold; i++ {
+		p.balancer.ProbeAll(context.Background(), time.Second, p.Probe)
+	}
+
+	status := p.balancer.Status()
+	if !status[0].Healthy || status[1].Healthy {
+		t.Errorf("Unexpected probe results: %+v", status)
+	}
+	// Failed probes mark the endpoint unhealthy without opening its breaker
+	if status[1].Breaker.State != upstream.StateClosed || status[1].Breaker.ConsecutiveFailures != 0 {
+		t.Errorf("Expected probes to bypass the circuit breaker, got %+v", status[1].Breaker)
+	}
+	if err := p.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() should succeed while one endpoint is up: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Package provider provides the KoboldAI generation backend.
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// KoboldProvider talks to a KoboldAI-compatible /api/v1/generate API
+type KoboldProvider struct {
+	cfg Config
+}
+
+// koboldResponse is the body returned by /api/v1/generate
+type koboldResponse struct {
+	Results []struct {
+		Text string `json:"text"`
+	} `json:"results"`
+}
+
+// koboldToken is a single event from /api/extra/generate/stream
+type koboldToken struct {
+	Token string `json:"token"`
+}
+
+// NewKobold creates a KoboldAI provider.
+// The streaming endpoint is derived from the generate endpoint unless set explicitly.
+func NewKobold(cfg Config) *KoboldProvider {
+	if cfg.StreamEndpoint == "" {
+		cfg.StreamEndpoint = KoboldStreamEndpoint(cfg.Endpoint)
+	}
+	return &KoboldProvider{cfg: cfg}
+}
+
+// KoboldStreamEndpoint derives the KoboldAI streaming endpoint from the
+// regular generate endpoint.
+func KoboldStreamEndpoint(endpoint string) string {
+	if strings.HasSuffix(endpoint, "/api/v1/generate") {
+		return strings.TrimSuffix(endpoint, "/api/v1/generate") + "/api/extra/generate/stream"
+	}
+	return endpoint
+}
+
+// Name returns the provider name
+func (k *KoboldProvider) Name() string {
+	return Kobold
+}
+
+// Ping checks the /api/v1/model endpoint next to the generate endpoint
+func (k *KoboldProvider) Ping(ctx context.Context) error {
+	return get(ctx, k.cfg, siblingEndpoint(k.cfg.Endpoint, "/api/v1/generate", "/api/v1/model", "/api/v1/model"))
+}
+
+// Generate sends the request to the generate endpoint and returns the reply
+func (k *KoboldProvider) Generate(ctx context.Context, req Request) (*Result, error) {
+	resp, err := post(ctx, k.cfg, k.cfg.Endpoint, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body koboldResponse
+	if err := decode(resp.Body, &body); err != nil {
+		return nil, err
+	}
+	if len(body.Results) == 0 {
+		return nil, fmt.Errorf("%w: no results", ErrInvalidResponse)
+	}
+
+	return &Result{Text: body.Results[0].Text}, nil
+}
+
+// Stream sends the request to the streaming endpoint and relays each token
+func (k *KoboldProvider) Stream(ctx context.Context, req Request, onToken TokenFunc) (*Result, error) {
+	resp, err := post(ctx, k.cfg, k.cfg.StreamEndpoint, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	err = readEventStream(resp.Body, func(data []byte) error {
+		var ev koboldToken
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+		text.WriteString(ev.Token)
+		return onToken(ev.Token)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{Text: text.String()}, nil
+}
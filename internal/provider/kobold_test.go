@@ -0,0 +1,112 @@
+// Package provider provides tests for the KoboldAI backend.
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newKoboldServer returns a stand-in for the KoboldAI generate and stream APIs
+func newKoboldServer(t *testing.T, tokens []string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		if req.Prompt != "Hello" {
+			t.Errorf("Expected prompt 'Hello', got %q", req.Prompt)
+		}
+
+		switch r.URL.Path {
+		case "/api/v1/generate":
+			fmt.Fprint(w, `{"results":[{"text":"Hi there"}]}`)
+		case "/api/extra/generate/stream":
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, token := range tokens {
+				data, _ := json.Marshal(koboldToken{Token: token})
+				fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+				w.(http.Flusher).Flush()
+			}
+		default:
+			t.Errorf("Unexpected path %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// TestKoboldStreamEndpoint tests streaming endpoint derivation
+func TestKoboldStreamEndpoint(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"http://ai.local/api/v1/generate", "http://ai.local/api/extra/generate/stream"},
+		{"http://ai.local/custom", "http://ai.local/custom"},
+	}
+
+	for _, tt := range tests {
+		if got := KoboldStreamEndpoint(tt.input); got != tt.expected {
+			t.Errorf("KoboldStreamEndpoint(%s) = %s, want %s", tt.input, got, tt.expected)
+		}
+	}
+}
+
+// TestKoboldGenerate tests a non-streaming KoboldAI completion
+func TestKoboldGenerate(t *testing.T) {
+	server := newKoboldServer(t, nil)
+	defer server.Close()
+
+	p := NewKobold(Config{Endpoint: server.URL + "/api/v1/generate", Client: http.DefaultClient})
+
+	result, err := p.Generate(context.Background(), Request{Prompt: "Hello", MaxLength: 10})
+	if err != nil {
+		t.Fatalf("Generate() unexpected error: %v", err)
+	}
+	if result.Text != "Hi there" {
+		t.Errorf("Expected 'Hi there', got %q", result.Text)
+	}
+}
+
+// TestKoboldGenerateNoResults tests handling of an empty result list
+func TestKoboldGenerateNoResults(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"results":[]}`)
+	}))
+	defer server.Close()
+
+	p := NewKobold(Config{Endpoint: server.URL, Client: http.DefaultClient})
+
+	if _, err := p.Generate(context.Background(), Request{Prompt: "Hello"}); err == nil {
+		t.Error("Generate() should return error for empty results")
+	}
+}
+
+// TestKoboldStream tests relaying streamed KoboldAI tokens
+func TestKoboldStream(t *testing.T) {
+	tokens := []string{"Hi", " ", "there"}
+	server := newKoboldServer(t, tokens)
+	defer server.Close()
+
+	p := NewKobold(Config{Endpoint: server.URL + "/api/v1/generate", Client: http.DefaultClient})
+
+	var got []string
+	result, err := p.Stream(context.Background(), Request{Prompt: "Hello"}, func(token string) error {
+		got = append(got, token)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream() unexpected error: %v", err)
+	}
+
+	if len(got) != len(tokens) {
+		t.Errorf("Expected %d tokens, got %d", len(tokens), len(got))
+	}
+	if result.Text != "Hi there" {
+		t.Errorf("Expected 'Hi there', got %q", result.Text)
+	}
+}
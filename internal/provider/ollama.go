@@ -0,0 +1,132 @@
+// Package provider provides the Ollama generation backend.
+package provider
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// OllamaProvider talks to an Ollama-style /api/generate API
+type OllamaProvider struct {
+	cfg Config
+}
+
+// ollamaOptions holds the sampler options understood by Ollama
+type ollamaOptions struct {
+	NumCtx        int     `json:"num_ctx,omitempty"`
+	NumPredict    int     `json:"num_predict,omitempty"`
+	RepeatPenalty float64 `json:"repeat_penalty,omitempty"`
+	RepeatLastN   int     `json:"repeat_last_n,omitempty"`
+	Temperature   float64 `json:"temperature"`
+	TfsZ          int     `json:"tfs_z,omitempty"`
+	TopK          int     `json:"top_k,omitempty"`
+	TopP          float64 `json:"top_p,omitempty"`
+	TypicalP      int     `json:"typical_p,omitempty"`
+}
+
+// ollamaRequest is the body sent to /api/generate
+type ollamaRequest struct {
+	Model   string        `json:"model"`
+	Prompt  string        `json:"prompt"`
+	Stream  bool          `json:"stream"`
+	Options ollamaOptions `json:"options"`
+}
+
+// ollamaResponse is the body returned by /api/generate.
+// When streaming, each line of the body is one ollamaResponse.
+type ollamaResponse struct {
+	Response string `json:"response"`
+	Done     bool   `json:"done"`
+}
+
+// NewOllama creates an Ollama provider
+func NewOllama(cfg Config) *OllamaProvider {
+	return &OllamaProvider{cfg: cfg}
+}
+
+// Name returns the provider name
+func (o *OllamaProvider) Name() string {
+	return Ollama
+}
+
+// Ping checks the /api/tags endpoint next to the generate endpoint
+func (o *OllamaProvider) Ping(ctx context.Context) error {
+	return get(ctx, o.cfg, siblingEndpoint(o.cfg.Endpoint, "/api/generate", "/api/tags", "/api/tags"))
+}
+
+// payload maps generation parameters onto the Ollama request format
+func (o *OllamaProvider) payload(req Request, stream bool) ollamaRequest {
+	return ollamaRequest{
+		Model:  o.cfg.Model,
+		Prompt: req.Prompt,
+		Stream: stream,
+		Options: ollamaOptions{
+			NumCtx:        req.MaxContextLength,
+			NumPredict:    req.MaxLength,
+			RepeatPenalty: req.RepPen,
+			RepeatLastN:   req.RepPenRange,
+			Temperature:   req.Temperature,
+			TfsZ:          req.Tfs,
+			TopK:          req.TopK,
+			TopP:          req.TopP,
+			TypicalP:      req.Typical,
+		},
+	}
+}
+
+// Generate sends a non-streaming request and returns the reply
+func (o *OllamaProvider) Generate(ctx context.Context, req Request) (*Result, error) {
+	resp, err := post(ctx, o.cfg, o.cfg.Endpoint, o.payload(req, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body ollamaResponse
+	if err := decode(resp.Body, &body); err != nil {
+		return nil, err
+	}
+
+	return &Result{Text: body.Response}, nil
+}
+
+// Stream sends a streaming request and relays each newline-delimited chunk
+func (o *OllamaProvider) Stream(ctx context.Context, req Request, onToken TokenFunc) (*Result, error) {
+	resp, err := post(ctx, o.cfg, o.cfg.Endpoint, o.payload(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var chunk ollamaResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+		if chunk.Response != "" {
+			text.WriteString(chunk.Response)
+			if err := onToken(chunk.Response); err != nil {
+				return nil, err
+			}
+		}
+		if chunk.Done {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &Result{Text: text.String()}, nil
+}
@@ -0,0 +1,83 @@
+// Package provider provides tests for the Ollama backend.
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestOllamaGenerate tests a non-streaming Ollama completion
+func TestOllamaGenerate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ollamaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		if req.Model != "llama3" || req.Prompt != "Hello" || req.Stream {
+			t.Errorf("Unexpected request: %+v", req)
+		}
+		if req.Options.TopK != 100 || req.Options.NumPredict != 20 || req.Options.RepeatPenalty != 1.1 {
+			t.Errorf("Unexpected options: %+v", req.Options)
+		}
+
+		fmt.Fprint(w, `{"response":"Hi there","done":true}`)
+	}))
+	defer server.Close()
+
+	p := NewOllama(Config{Endpoint: server.URL + "/api/generate", Model: "llama3", Client: http.DefaultClient})
+
+	result, err := p.Generate(context.Background(), Request{Prompt: "Hello", TopK: 100, MaxLength: 20, RepPen: 1.1})
+	if err != nil {
+		t.Fatalf("Generate() unexpected error: %v", err)
+	}
+	if result.Text != "Hi there" {
+		t.Errorf("Expected 'Hi there', got %q", result.Text)
+	}
+}
+
+// TestOllamaStream tests relaying newline-delimited Ollama chunks
+func TestOllamaStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"Hi","done":false}`)
+		fmt.Fprintln(w, `{"response":" there","done":false}`)
+		fmt.Fprintln(w, `{"response":"","done":true}`)
+	}))
+	defer server.Close()
+
+	p := NewOllama(Config{Endpoint: server.URL, Model: "llama3", Client: http.DefaultClient})
+
+	var got []string
+	result, err := p.Stream(context.Background(), Request{Prompt: "Hello"}, func(token string) error {
+		got = append(got, token)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream() unexpected error: %v", err)
+	}
+
+	if len(got) != 2 {
+		t.Errorf("Expected 2 tokens, got %d: %q", len(got), got)
+	}
+	if result.Text != "Hi there" {
+		t.Errorf("Expected 'Hi there', got %q", result.Text)
+	}
+}
+
+// TestOllamaStreamInvalidChunk tests handling of malformed chunks
+func TestOllamaStreamInvalidChunk(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `not json`)
+	}))
+	defer server.Close()
+
+	p := NewOllama(Config{Endpoint: server.URL, Client: http.DefaultClient})
+
+	_, err := p.Stream(context.Background(), Request{Prompt: "Hello"}, func(string) error { return nil })
+	if err == nil {
+		t.Error("Stream() should return error for malformed chunk")
+	}
+}
@@ -0,0 +1,119 @@
+// Package provider provides the OpenAI-compatible chat completions backend.
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// OpenAIProvider talks to an OpenAI-compatible /v1/chat/completions API
+type OpenAIProvider struct {
+	cfg Config
+}
+
+// openAIMessage is a single chat message in the OpenAI format
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// openAIRequest is the body sent to /v1/chat/completions
+type openAIRequest struct {
+	Model       string          `json:"model,omitempty"`
+	Messages    []openAIMessage `json:"messages"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Temperature float64         `json:"temperature"`
+	TopP        float64         `json:"top_p,omitempty"`
+	Stream      bool            `json:"stream,omitempty"`
+}
+
+// openAIResponse is the body returned by /v1/chat/completions.
+// Streamed chunks carry the text in Delta instead of Message.
+type openAIResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+		Delta   openAIMessage `json:"delta"`
+	} `json:"choices"`
+}
+
+// NewOpenAI creates an OpenAI-compatible provider
+func NewOpenAI(cfg Config) *OpenAIProvider {
+	return &OpenAIProvider{cfg: cfg}
+}
+
+// Name returns the provider name
+func (o *OpenAIProvider) Name() string {
+	return OpenAI
+}
+
+// Ping checks the /models endpoint next to the chat completions endpoint
+func (o *OpenAIProvider) Ping(ctx context.Context) error {
+	return get(ctx, o.cfg, siblingEndpoint(o.cfg.Endpoint, "/chat/completions", "/models", "/v1/models"))
+}
+
+// payload maps generation parameters onto the OpenAI request format
+func (o *OpenAIProvider) payload(req Request, stream bool) openAIRequest {
+	return openAIRequest{
+		Model:       o.cfg.Model,
+		Messages:    []openAIMessage{{Role: "user", Content: req.Prompt}},
+		MaxTokens:   req.MaxLength,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stream:      stream,
+	}
+}
+
+// Generate sends the request and returns the first choice
+func (o *OpenAIProvider) Generate(ctx context.Context, req Request) (*Result, error) {
+	resp, err := post(ctx, o.cfg, o.cfg.Endpoint, o.payload(req, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body openAIResponse
+	if err := decode(resp.Body, &body); err != nil {
+		return nil, err
+	}
+	if len(body.Choices) == 0 {
+		return nil, fmt.Errorf("%w: no choices", ErrInvalidResponse)
+	}
+
+	return &Result{Text: body.Choices[0].Message.Content}, nil
+}
+
+// Stream sends a streaming request and relays each content delta
+func (o *OpenAIProvider) Stream(ctx context.Context, req Request, onToken TokenFunc) (*Result, error) {
+	resp, err := post(ctx, o.cfg, o.cfg.Endpoint, o.payload(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	err = readEventStream(resp.Body, func(data []byte) error {
+		if bytes.Equal(bytes.TrimSpace(data), []byte("[DONE]")) {
+			return nil
+		}
+
+		var chunk openAIResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			return nil
+		}
+
+		token := chunk.Choices[0].Delta.Content
+		text.WriteString(token)
+		return onToken(token)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{Text: text.String()}, nil
+}
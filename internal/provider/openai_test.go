@@ -0,0 +1,93 @@
+// Package provider provides tests for the OpenAI-compatible backend.
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestOpenAIGenerate tests a non-streaming chat completion
+func TestOpenAIGenerate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openAIRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		if req.Model != "gpt-test" {
+			t.Errorf("Expected model 'gpt-test', got %q", req.Model)
+		}
+		if len(req.Messages) != 1 || req.Messages[0].Content != "Hello" {
+			t.Errorf("Unexpected messages: %+v", req.Messages)
+		}
+		if req.MaxTokens != 50 || req.Stream {
+			t.Errorf("Unexpected parameters: %+v", req)
+		}
+
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"Hi there"}}]}`)
+	}))
+	defer server.Close()
+
+	p := NewOpenAI(Config{Endpoint: server.URL + "/v1/chat/completions", Model: "gpt-test", Client: http.DefaultClient})
+
+	result, err := p.Generate(context.Background(), Request{Prompt: "Hello", MaxLength: 50, Temperature: 0.5})
+	if err != nil {
+		t.Fatalf("Generate() unexpected error: %v", err)
+	}
+	if result.Text != "Hi there" {
+		t.Errorf("Expected 'Hi there', got %q", result.Text)
+	}
+}
+
+// TestOpenAIGenerateNoChoices tests handling of an empty choice list
+func TestOpenAIGenerateNoChoices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"choices":[]}`)
+	}))
+	defer server.Close()
+
+	p := NewOpenAI(Config{Endpoint: server.URL, Client: http.DefaultClient})
+
+	if _, err := p.Generate(context.Background(), Request{Prompt: "Hello"}); err == nil {
+		t.Error("Generate() should return error for empty choices")
+	}
+}
+
+// TestOpenAIStream tests relaying streamed content deltas
+func TestOpenAIStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openAIRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.Stream {
+			t.Error("Expected stream flag to be set")
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"role\":\"assistant\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\" there\"}}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	p := NewOpenAI(Config{Endpoint: server.URL, Client: http.DefaultClient})
+
+	var got []string
+	result, err := p.Stream(context.Background(), Request{Prompt: "Hello"}, func(token string) error {
+		got = append(got, token)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream() unexpected error: %v", err)
+	}
+
+	if len(got) != 2 {
+		t.Errorf("Expected 2 tokens, got %d: %q", len(got), got)
+	}
+	if result.Text != "Hi there" {
+		t.Errorf("Expected 'Hi there', got %q", result.Text)
+	}
+}
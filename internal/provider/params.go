@@ -0,0 +1,221 @@
+// Package provider provides generation parameter presets, overrides and validation.
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultPreset is the preset used when a request does not name one
+const DefaultPreset = "default"
+
+// Common errors for generation parameters
+var (
+	ErrUnknownPreset = errors.New("unknown preset")
+)
+
+// Params holds optional per-request overrides for generation parameters.
+// Nil fields keep the value from the selected preset.
+type Params struct {
+	MaxContextLength *int     `json:"max_context_length,omitempty"`
+	MaxLength        *int     `json:"max_length,omitempty"`
+	Quiet            *bool    `json:"quiet,omitempty"`
+	RepPen           *float64 `json:"rep_pen,omitempty"`
+	RepPenRange      *int     `json:"rep_pen_range,omitempty"`
+	RepPenSlope      *float64 `json:"rep_pen_slope,omitempty"`
+	Temperature      *float64 `json:"temperature,omitempty"`
+	Tfs              *int     `json:"tfs,omitempty"`
+	TopA             *int     `json:"top_a,omitempty"`
+	TopK             *int     `json:"top_k,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	Typical          *int     `json:"typical,omitempty"`
+}
+
+// Apply returns req with every non-nil override applied
+func (p Params) Apply(req Request) Request {
+	if p.MaxContextLength != nil {
+		req.MaxContextLength = *p.MaxContextLength
+	}
+	if p.MaxLength != nil {
+		req.MaxLength = *p.MaxLength
+	}
+	if p.Quiet != nil {
+		req.Quiet = *p.Quiet
+	}
+	if p.RepPen != nil {
+		req.RepPen = *p.RepPen
+	}
+	if p.RepPenRange != nil {
+		req.RepPenRange = *p.RepPenRange
+	}
+	if p.RepPenSlope != nil {
+		req.RepPenSlope = *p.RepPenSlope
+	}
+	if p.Temperature != nil {
+		req.Temperature = *p.Temperature
+	}
+	if p.Tfs != nil {
+		req.Tfs = *p.Tfs
+	}
+	if p.TopA != nil {
+		req.TopA = *p.TopA
+	}
+	if p.TopK != nil {
+		req.TopK = *p.TopK
+	}
+	if p.TopP != nil {
+		req.TopP = *p.TopP
+	}
+	if p.Typical != nil {
+		req.Typical = *p.Typical
+	}
+	return req
+}
+
+// FieldError describes a single invalid generation parameter
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid parameter of a request
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+// Error implements the error interface
+func (v *ValidationError) Error() string {
+	parts := make([]string, len(v.Errors))
+	for i, fe := range v.Errors {
+		parts[i] = fe.Field + ": " + fe.Message
+	}
+	return "invalid generation parameters: " + strings.Join(parts, "; ")
+}
+
+// Validate checks generation parameters against the ranges accepted by the
+// supported backends. Returns a *ValidationError listing every invalid field, or nil.
+func Validate(req Request) error {
+	v := &ValidationError{}
+
+	checkInt := func(field string, value, min, max int) {
+		if value < min || value > max {
+			v.Errors = append(v.Errors, FieldError{field, fmt.Sprintf("must be between %d and %d", min, max)})
+		}
+	}
+	checkFloat := func(field string, value, min, max float64) {
+		if value < min || value > max {
+			v.Errors = append(v.Errors, FieldError{field, fmt.Sprintf("must be between %g and %g", min, max)})
+		}
+	}
+
+	checkInt("max_context_length", req.MaxContextLength, 256, 32768)
+	checkInt("max_length", req.MaxLength, 1, 4096)
+	if req.MaxLength >= req.MaxContextLength {
+		v.Errors = append(v.Errors, FieldError{"max_length", "must be less than max_context_length"})
+	}
+	checkFloat("rep_pen", req.RepPen, 1, 3)
+	checkInt("rep_pen_range", req.RepPenRange, 0, req.MaxContextLength)
+	checkFloat("rep_pen_slope", req.RepPenSlope, 0, 10)
+	checkFloat("temperature", req.Temperature, 0, 2)
+	checkInt("tfs", req.Tfs, 0, 1)
+	checkInt("top_a", req.TopA, 0, 1)
+	checkInt("top_k", req.TopK, 0, 1000)
+	checkFloat("top_p", req.TopP, 0, 1)
+	checkInt("typical", req.Typical, 0, 1)
+
+	if len(v.Errors) > 0 {
+		return v
+	}
+	return nil
+}
+
+// Presets maps preset names to generation parameters
+type Presets map[string]Request
+
+// DefaultPresets returns the built-in generation presets
+func DefaultPresets() Presets {
+	base := Request{
+		MaxContextLength: 2048,
+		MaxLength:        100,
+		Quiet:            false,
+		RepPen:           1.1,
+		RepPenRange:      256,
+		RepPenSlope:      1,
+		Temperature:      0.5,
+		Tfs:              1,
+		TopA:             0,
+		TopK:             100,
+		TopP:             0.9,
+		Typical:          1,
+	}
+
+	precise := base
+	precise.Temperature = 0.2
+	precise.TopK = 40
+	precise.TopP = 0.8
+
+	creative := base
+	creative.MaxLength = 200
+	creative.RepPen = 1.05
+	creative.Temperature = 1.0
+	creative.TopK = 200
+	creative.TopP = 0.95
+
+	clinical := base
+	clinical.MaxLength = 250
+	clinical.RepPen = 1.15
+	clinical.Temperature = 0.1
+	clinical.TopK = 20
+	clinical.TopP = 0.7
+
+	return Presets{
+		DefaultPreset: base,
+		"precise":     precise,
+		"creative":    creative,
+		"clinical":    clinical,
+	}
+}
+
+// Get returns the parameters of the named preset.
+// An empty name selects DefaultPreset.
+func (p Presets) Get(name string) (Request, error) {
+	if name == "" {
+		name = DefaultPreset
+	}
+
+	req, ok := p[strings.ToLower(name)]
+	if !ok {
+		return Request{}, fmt.Errorf("%w: %s", ErrUnknownPreset, name)
+	}
+	return req, nil
+}
+
+// Resolve returns the parameters of the named preset with overrides applied.
+// An unknown preset or an out-of-range value is reported as a *ValidationError.
+func (p Presets) Resolve(name string, overrides Params) (Request, error) {
+	req, err := p.Get(name)
+	if err != nil {
+		return Request{}, &ValidationError{Errors: []FieldError{{
+			Field:   "preset",
+			Message: fmt.Sprintf("must be one of %s", strings.Join(p.Names(), ", ")),
+		}}}
+	}
+
+	req = overrides.Apply(req)
+	if err := Validate(req); err != nil {
+		return Request{}, err
+	}
+	return req, nil
+}
+
+// Names returns the preset names in sorted order
+func (p Presets) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
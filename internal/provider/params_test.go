@@ -0,0 +1,145 @@
+// Package provider provides tests for generation presets and parameter validation.
+package provider
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestDefaultPresetsAreValid tests that every built-in preset passes validation
+func TestDefaultPresetsAreValid(t *testing.T) {
+	presets := DefaultPresets()
+
+	for _, name := range []string{DefaultPreset, "precise", "creative", "clinical"} {
+		req, err := presets.Get(name)
+		if err != nil {
+			t.Fatalf("Get(%q) unexpected error: %v", name, err)
+		}
+		if err := Validate(req); err != nil {
+			t.Errorf("Preset %q is invalid: %v", name, err)
+		}
+	}
+}
+
+// TestPresetsGet tests preset lookup by name
+func TestPresetsGet(t *testing.T) {
+	presets := DefaultPresets()
+
+	req, err := presets.Get("")
+	if err != nil {
+		t.Fatalf("Get(\"\") unexpected error: %v", err)
+	}
+	if req != presets[DefaultPreset] {
+		t.Errorf("Empty name should select the default preset")
+	}
+
+	if _, err := presets.Get("Clinical"); err != nil {
+		t.Errorf("Get() should be case-insensitive: %v", err)
+	}
+
+	if _, err := presets.Get("missing"); !errors.Is(err, ErrUnknownPreset) {
+		t.Errorf("Get() error = %v, want %v", err, ErrUnknownPreset)
+	}
+}
+
+// TestParamsApply tests that only set overrides replace preset values
+func TestParamsApply(t *testing.T) {
+	base := DefaultPresets()[DefaultPreset]
+	temperature := 0.7
+	topK := 0
+
+	got := Params{Temperature: &temperature, TopK: &topK}.Apply(base)
+
+	if got.Temperature != 0.7 || got.TopK != 0 {
+		t.Errorf("Overrides not applied: %+v", got)
+	}
+	if got.TopP != base.TopP || got.MaxLength != base.MaxLength {
+		t.Errorf("Unset fields changed: %+v", got)
+	}
+}
+
+// TestValidate tests range checks on generation parameters
+func TestValidate(t *testing.T) {
+	base := DefaultPresets()[DefaultPreset]
+
+	tests := []struct {
+		name       string
+		modify     func(r *Request)
+		wantFields []string
+	}{
+		{
+			name:   "Defaults are valid",
+			modify: func(r *Request) {},
+		},
+		{
+			name:       "Temperature too high",
+			modify:     func(r *Request) { r.Temperature = 2.5 },
+			wantFields: []string{"temperature"},
+		},
+		{
+			name:       "Repetition penalty below one",
+			modify:     func(r *Request) { r.RepPen = 0.5 },
+			wantFields: []string{"rep_pen"},
+		},
+		{
+			name:       "Reply longer than context",
+			modify:     func(r *Request) { r.MaxLength = 2048 },
+			wantFields: []string{"max_length"},
+		},
+		{
+			name: "Multiple invalid fields",
+			modify: func(r *Request) {
+				r.TopP = 1.5
+				r.TopK = -1
+			},
+			wantFields: []string{"top_k", "top_p"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := base
+			tt.modify(&req)
+
+			err := Validate(req)
+			if len(tt.wantFields) == 0 {
+				if err != nil {
+					t.Errorf("Validate() unexpected error: %v", err)
+				}
+				return
+			}
+
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("Validate() error = %v, want *ValidationError", err)
+			}
+			if len(invalid.Errors) != len(tt.wantFields) {
+				t.Fatalf("Expected %d field errors, got %+v", len(tt.wantFields), invalid.Errors)
+			}
+			for i, field := range tt.wantFields {
+				if invalid.Errors[i].Field != field {
+					t.Errorf("Field error %d = %s, want %s", i, invalid.Errors[i].Field, field)
+				}
+			}
+		})
+	}
+}
+
+// TestPresetsResolve tests preset selection combined with overrides
+func TestPresetsResolve(t *testing.T) {
+	presets := DefaultPresets()
+	maxLength := 50
+
+	req, err := presets.Resolve("precise", Params{MaxLength: &maxLength})
+	if err != nil {
+		t.Fatalf("Resolve() unexpected error: %v", err)
+	}
+	if req.MaxLength != 50 || req.Temperature != presets["precise"].Temperature {
+		t.Errorf("Unexpected parameters: %+v", req)
+	}
+
+	var invalid *ValidationError
+	if _, err := presets.Resolve("unknown", Params{}); !errors.As(err, &invalid) || invalid.Errors[0].Field != "preset" {
+		t.Errorf("Resolve() error = %v, want preset field error", err)
+	}
+}
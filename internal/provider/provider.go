@@ -0,0 +1,210 @@
+// Package provider abstracts the AI text generation backends used by the chat endpoint.
+// It defines a common Provider interface with implementations for KoboldAI-style,
+// OpenAI-compatible and Ollama-style APIs.
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Provider names accepted by New
+const (
+	Kobold = "kobold"
+	OpenAI = "openai"
+	Ollama = "ollama"
+)
+
+// Common errors for provider operations
+var (
+	ErrUnknownProvider = errors.New("unknown AI provider")
+	ErrMissingEndpoint = errors.New("AI endpoint cannot be empty")
+	ErrUpstreamStatus  = errors.New("unexpected status from AI service")
+	ErrInvalidResponse = errors.New("invalid response from AI service")
+)
+
+// StatusError is returned when the AI service answers with a status other
+// than 200. It matches ErrUpstreamStatus.
+type StatusError struct {
+	StatusCode int
+}
+
+// Error implements the error interface
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v: %d", ErrUpstreamStatus, e.StatusCode)
+}
+
+// Is reports whether target is ErrUpstreamStatus
+func (e *StatusError) Is(target error) bool {
+	return target == ErrUpstreamStatus
+}
+
+// Request holds the generation parameters for a single completion.
+// Field names and JSON tags follow the KoboldAI generate API; other
+// providers map them onto their own request formats.
+type Request struct {
+	MaxContextLength int     `json:"max_context_length"`
+	MaxLength        int     `json:"max_length"`
+	Prompt           string  `json:"prompt"`
+	Quiet            bool    `json:"quiet"`
+	RepPen           float64 `json:"rep_pen"`
+	RepPenRange      int     `json:"rep_pen_range"`
+	RepPenSlope      float64 `json:"rep_pen_slope"`
+	Temperature      float64 `json:"temperature"`
+	Tfs              int     `json:"tfs"`
+	TopA             int     `json:"top_a"`
+	TopK             int     `json:"top_k"`
+	TopP             float64 `json:"top_p"`
+	Typical          int     `json:"typical"`
+}
+
+// Result is the text generated for a request
+type Result struct {
+	Text string
+}
+
+// TokenFunc receives each chunk of text as it is streamed from the provider.
+// Returning an error stops the stream.
+type TokenFunc func(token string) error
+
+// Provider generates text from a prompt using an AI backend
+type Provider interface {
+	// Name returns the provider name, e.g. "kobold"
+	Name() string
+	// Generate returns the full reply once generation completes
+	Generate(ctx context.Context, req Request) (*Result, error)
+	// Stream calls onToken for each chunk of the reply as it arrives and
+	// returns the assembled reply once the stream ends
+	Stream(ctx context.Context, req Request, onToken TokenFunc) (*Result, error)
+	// Ping checks that the backend is reachable and ready to serve requests
+	Ping(ctx context.Context) error
+}
+
+// Config holds the settings used to construct a Provider
+type Config struct {
+	// Name selects the implementation: "kobold", "openai" or "ollama"
+	Name string
+	// Endpoint is the full URL of the generation API
+	Endpoint string
+	// StreamEndpoint overrides the streaming URL for providers that use a
+	// separate endpoint for streaming (KoboldAI)
+	StreamEndpoint string
+	// Model is the model name sent to OpenAI-compatible and Ollama APIs
+	Model string
+	// APIKey is sent as a bearer token when set
+	APIKey string
+	// Client sends the upstream requests. Defaults to http.DefaultClient.
+	Client Doer
+}
+
+// Doer sends HTTP requests. It is satisfied by *http.Client and by clients
+// that add pooling, retries or circuit breaking.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// New creates the Provider selected by cfg.Name.
+// An empty name selects the KoboldAI provider.
+func New(cfg Config) (Provider, error) {
+	if cfg.Endpoint == "" {
+		return nil, ErrMissingEndpoint
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+
+	switch strings.ToLower(cfg.Name) {
+	case "", Kobold:
+		return NewKobold(cfg), nil
+	case OpenAI:
+		return NewOpenAI(cfg), nil
+	case Ollama:
+		return NewOllama(cfg), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, cfg.Name)
+	}
+}
+
+// post sends a JSON payload to url and returns the response once a 200 status is received.
+// The caller must close the response body.
+func post(ctx context.Context, cfg Config, url string, payload interface{}) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+
+	resp, err := cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	return resp, nil
+}
+
+// get sends a GET request with the provider credentials and fails on non-200 responses
+func get(ctx context.Context, cfg Config, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+
+	resp, err := cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// siblingEndpoint swaps the API path suffix of endpoint for replacement.
+// When endpoint does not end in suffix, its whole path is set to fallbackPath.
+func siblingEndpoint(endpoint, suffix, replacement, fallbackPath string) string {
+	if strings.HasSuffix(endpoint, suffix) {
+		return strings.TrimSuffix(endpoint, suffix) + replacement
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	u.Path = fallbackPath
+	u.RawQuery = ""
+	return u.String()
+}
+
+// decode reads a JSON response body into v
+func decode(r io.Reader, v interface{}) error {
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	return nil
+}
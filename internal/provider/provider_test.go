@@ -0,0 +1,145 @@
+// Package provider provides tests for AI provider construction.
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestNew tests provider selection by name
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		wantName string
+		wantErr  error
+	}{
+		{
+			name:     "Empty name selects kobold",
+			cfg:      Config{Endpoint: "http://ai.local/api/v1/generate"},
+			wantName: Kobold,
+		},
+		{
+			name:     "Kobold provider",
+			cfg:      Config{Name: "kobold", Endpoint: "http://ai.local/api/v1/generate"},
+			wantName: Kobold,
+		},
+		{
+			name:     "OpenAI provider is case-insensitive",
+			cfg:      Config{Name: "OpenAI", Endpoint: "http://ai.local/v1/chat/completions"},
+			wantName: OpenAI,
+		},
+		{
+			name:     "Ollama provider",
+			cfg:      Config{Name: "ollama", Endpoint: "http://ai.local/api/generate"},
+			wantName: Ollama,
+		},
+		{
+			name:    "Unknown provider should fail",
+			cfg:     Config{Name: "unknown", Endpoint: "http://ai.local"},
+			wantErr: ErrUnknownProvider,
+		},
+		{
+			name:    "Missing endpoint should fail",
+			cfg:     Config{Name: "kobold"},
+			wantErr: ErrMissingEndpoint,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(tt.cfg)
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("New() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("New() unexpected error: %v", err)
+			}
+			if p.Name() != tt.wantName {
+				t.Errorf("New() provider = %s, want %s", p.Name(), tt.wantName)
+			}
+		})
+	}
+}
+
+// TestPostUpstreamStatus tests that non-200 responses are reported as errors
+func TestPostUpstreamStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	for _, name := range []string{Kobold, OpenAI, Ollama} {
+		t.Run(name, func(t *testing.T) {
+			p, err := New(Config{Name: name, Endpoint: server.URL})
+			if err != nil {
+				t.Fatalf("New() unexpected error: %v", err)
+			}
+
+			_, err = p.Generate(context.Background(), Request{Prompt: "hi"})
+			if !errors.Is(err, ErrUpstreamStatus) {
+				t.Errorf("Generate() error = %v, want %v", err, ErrUpstreamStatus)
+			}
+		})
+	}
+}
+
+// TestPostAPIKey tests that the API key is sent as a bearer token
+func TestPostAPIKey(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"ok"}}]}`))
+	}))
+	defer server.Close()
+
+	p, _ := New(Config{Name: OpenAI, Endpoint: server.URL, APIKey: "secret"})
+	if _, err := p.Generate(context.Background(), Request{Prompt: "hi"}); err != nil {
+		t.Fatalf("Generate() unexpected error: %v", err)
+	}
+
+	if auth != "Bearer secret" {
+		t.Errorf("Expected bearer token, got %q", auth)
+	}
+}
+
+// TestPing tests the health endpoint probed for each provider
+func TestPing(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		wantPath string
+	}{
+		{Kobold, "/api/v1/generate", "/api/v1/model"},
+		{OpenAI, "/v1/chat/completions", "/v1/models"},
+		{Ollama, "/api/generate", "/api/tags"},
+		{Kobold, "/custom", "/api/v1/model"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+tt.path, func(t *testing.T) {
+			var gotPath string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.Path
+				w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			p, _ := New(Config{Name: tt.name, Endpoint: server.URL + tt.path})
+			if err := p.Ping(context.Background()); err != nil {
+				t.Fatalf("Ping() unexpected error: %v", err)
+			}
+			if gotPath != tt.wantPath {
+				t.Errorf("Ping() requested %s, want %s", gotPath, tt.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Package provider provides server-sent event parsing for streaming AI backends.
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// readEventStream parses a server-sent event stream and calls onData with the
+// payload of every event that carries data. It returns nil on a clean EOF.
+func readEventStream(r io.Reader, onData func([]byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var payload []byte
+	flush := func() error {
+		if len(payload) == 0 {
+			return nil
+		}
+		data := payload
+		payload = nil
+		return onData(data)
+	}
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if value, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			if len(payload) > 0 {
+				payload = append(payload, '\n')
+			}
+			payload = append(payload, bytes.TrimPrefix(value, []byte(" "))...)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
@@ -0,0 +1,78 @@
+// Package provider provides tests for server-sent event parsing.
+package provider
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestReadEventStream tests parsing of upstream server-sent events
+func TestReadEventStream(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name:  "Named events with comments",
+			input: "event: message\ndata: {\"token\":\"Hel\"}\n\n: keep-alive\n\ndata: {\"token\":\"lo\"}\n\n",
+			want:  []string{`{"token":"Hel"}`, `{"token":"lo"}`},
+		},
+		{
+			name:  "Multi-line data",
+			input: "data: first\ndata: second\n\n",
+			want:  []string{"first\nsecond"},
+		},
+		{
+			name:  "Missing trailing blank line",
+			input: "data: last",
+			want:  []string{"last"},
+		},
+		{
+			name:  "Empty stream",
+			input: "",
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := readEventStream(strings.NewReader(tt.input), func(data []byte) error {
+				got = append(got, string(data))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("readEventStream() unexpected error: %v", err)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected %d payloads, got %d: %q", len(tt.want), len(got), got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Payload %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestReadEventStreamCallbackError tests that callback errors stop parsing
+func TestReadEventStreamCallbackError(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+
+	err := readEventStream(strings.NewReader("data: a\n\ndata: b\n\n"), func(data []byte) error {
+		calls++
+		return stop
+	})
+
+	if !errors.Is(err, stop) {
+		t.Errorf("Expected callback error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 callback, got %d", calls)
+	}
+}
@@ -0,0 +1,311 @@
+// Package upstream provides load balancing across several AI service endpoints.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Load balancing strategies
+const (
+	// RoundRobin spreads requests in proportion to endpoint weights
+	RoundRobin = "round_robin"
+	// LeastOutstanding picks the endpoint with the fewest in-flight requests
+	// relative to its weight
+	LeastOutstanding = "least_outstanding"
+)
+
+// Common errors for load balancing
+var (
+	ErrNoEndpoints         = errors.New("no upstream endpoints configured")
+	ErrNoHealthyEndpoint   = errors.New("no healthy upstream endpoint")
+	ErrUnknownStrategy     = errors.New("unknown load balancing strategy")
+	ErrInvalidEndpointSpec = errors.New("invalid endpoint")
+)
+
+// Endpoint is a single AI service endpoint
+type Endpoint struct {
+	// URL is the generation API of the endpoint
+	URL string `yaml:"url" json:"url"`
+	// StreamURL overrides the streaming API for providers that use a separate one
+	StreamURL string `yaml:"stream_url,omitempty" json:"stream_url,omitempty"`
+	// Weight is the share of requests sent to the endpoint, relative to the others
+	Weight int `yaml:"weight" json:"weight"`
+}
+
+// ParseEndpoints parses a comma-separated list of endpoint URLs. Each URL may
+// be followed by "|" and a positive weight, e.g. "http://a/api/v1/generate|3".
+func ParseEndpoints(spec string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		endpoint := Endpoint{URL: item, Weight: 1}
+		if i := strings.LastIndex(item, "|"); i >= 0 {
+			weight, err := strconv.Atoi(strings.TrimSpace(item[i+1:]))
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("%w: weight of %s must be a positive integer", ErrInvalidEndpointSpec, item)
+			}
+			endpoint.URL = strings.TrimSpace(item[:i])
+			endpoint.Weight = weight
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// Backend is an endpoint tracked by a Balancer
+type Backend struct {
+	Endpoint
+	// Index is the position of the endpoint in the configured list
+	Index int
+	// Client sends requests to this endpoint through its own circuit breaker
+	Client *Client
+	// ProbeClient sends health probes to this endpoint, without retries and
+	// without feeding the circuit breaker
+	ProbeClient *http.Client
+
+	mu          sync.Mutex
+	healthy     bool
+	lastError   string
+	lastProbe   time.Time
+	outstanding int
+	current     int
+}
+
+// BackendStatus is a snapshot of a backend, as reported on /health
+type BackendStatus struct {
+	URL         string        `json:"url"`
+	Weight      int           `json:"weight"`
+	Healthy     bool          `json:"healthy"`
+	Outstanding int           `json:"outstanding"`
+	LastProbe   *time.Time    `json:"last_probe,omitempty"`
+	LastError   string        `json:"last_error,omitempty"`
+	Breaker     BreakerStatus `json:"breaker"`
+}
+
+// Available reports whether the backend passed its last health probe and its
+// circuit breaker lets calls through
+func (be *Backend) Available() bool {
+	be.mu.Lock()
+	healthy := be.healthy
+	be.mu.Unlock()
+	return healthy && be.Client.Breaker().Ready()
+}
+
+// Acquire marks the start of a request to the backend
+func (be *Backend) Acquire() {
+	be.mu.Lock()
+	be.outstanding++
+	be.mu.Unlock()
+}
+
+// Release marks the end of a request to the backend
+func (be *Backend) Release() {
+	be.mu.Lock()
+	be.outstanding--
+	be.mu.Unlock()
+}
+
+// Outstanding returns the number of in-flight requests
+func (be *Backend) Outstanding() int {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	return be.outstanding
+}
+
+// SetHealth records the result of a health probe
+func (be *Backend) SetHealth(err error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	be.healthy = err == nil
+	be.lastProbe = time.Now()
+	be.lastError = ""
+	if err != nil {
+		be.lastError = err.Error()
+	}
+}
+
+// Status returns a snapshot of the backend
+func (be *Backend) Status() BackendStatus {
+	be.mu.Lock()
+	status := BackendStatus{
+		URL:         be.URL,
+		Weight:      be.Weight,
+		Healthy:     be.healthy,
+		Outstanding: be.outstanding,
+		LastError:   be.lastError,
+	}
+	if !be.lastProbe.IsZero() {
+		lastProbe := be.lastProbe
+		status.LastProbe = &lastProbe
+	}
+	be.mu.Unlock()
+
+	status.Breaker = be.Client.Breaker().Status()
+	return status
+}
+
+// ProbeFunc checks whether a backend can serve requests
+type ProbeFunc func(ctx context.Context, be *Backend) error
+
+// Balancer picks the endpoint for each upstream request
+type Balancer struct {
+	mu       sync.Mutex
+	strategy string
+	backends []*Backend
+}
+
+// NewBalancer creates a Balancer over endpoints. All endpoints share one
+// pooled transport and each gets its own circuit breaker. Endpoints start out
+// healthy until a probe says otherwise.
+func NewBalancer(endpoints []Endpoint, strategy string, cfg Config) (*Balancer, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	switch strategy {
+	case "":
+		strategy = RoundRobin
+	case RoundRobin, LeastOutstanding:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStrategy, strategy)
+	}
+
+	httpClient := &http.Client{Transport: NewTransport(cfg)}
+	backends := make([]*Backend, len(endpoints))
+	for i, endpoint := range endpoints {
+		if endpoint.URL == "" {
+			return nil, fmt.Errorf("%w: endpoint %d has no URL", ErrInvalidEndpointSpec, i)
+		}
+		if endpoint.Weight == 0 {
+			endpoint.Weight = 1
+		}
+		if endpoint.Weight < 0 {
+			return nil, fmt.Errorf("%w: weight of %s must be positive", ErrInvalidEndpointSpec, endpoint.URL)
+		}
+		backends[i] = &Backend{
+			Endpoint:    endpoint,
+			Index:       i,
+			Client:      NewWithClient(cfg, httpClient),
+			ProbeClient: httpClient,
+			healthy:     true,
+		}
+	}
+
+	return &Balancer{strategy: strategy, backends: backends}, nil
+}
+
+// Strategy returns the load balancing strategy
+func (b *Balancer) Strategy() string {
+	return b.strategy
+}
+
+// Backends returns the backends in configuration order
+func (b *Balancer) Backends() []*Backend {
+	return b.backends
+}
+
+// Next picks an available backend that is not in exclude.
+// Returns ErrNoHealthyEndpoint when none is left.
+func (b *Balancer) Next(exclude map[*Backend]bool) (*Backend, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var candidates []*Backend
+	for _, be := range b.backends {
+		if !exclude[be] && be.Available() {
+			candidates = append(candidates, be)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoHealthyEndpoint
+	}
+
+	if b.strategy == LeastOutstanding {
+		return leastOutstanding(candidates), nil
+	}
+	return smoothWeighted(candidates), nil
+}
+
+// smoothWeighted implements smooth weighted round-robin: every candidate gains
+// its weight, the one with the highest total is picked and pays back the sum
+// of all weights. Picks are spread evenly instead of in bursts.
+func smoothWeighted(candidates []*Backend) *Backend {
+	total := 0
+	var best *Backend
+	for _, be := range candidates {
+		be.current += be.Weight
+		total += be.Weight
+		if best == nil || be.current > best.current {
+			best = be
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// leastOutstanding picks the candidate with the lowest outstanding/weight
+// ratio, preferring the earlier endpoint on ties
+func leastOutstanding(candidates []*Backend) *Backend {
+	best := candidates[0]
+	bestLoad := best.Outstanding()
+	for _, be := range candidates[1:] {
+		load := be.Outstanding()
+		// load/be.Weight < bestLoad/best.Weight without division
+		if load*best.Weight < bestLoad*be.Weight {
+			best, bestLoad = be, load
+		}
+	}
+	return best
+}
+
+// ProbeAll probes every backend concurrently and records the results.
+// Each probe is limited to timeout.
+func (b *Balancer) ProbeAll(ctx context.Context, timeout time.Duration, probe ProbeFunc) {
+	var wg sync.WaitGroup
+	for _, be := range b.backends {
+		wg.Add(1)
+		go func(be *Backend) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			be.SetHealth(probe(probeCtx, be))
+		}(be)
+	}
+	wg.Wait()
+}
+
+// RunProbes probes every backend each interval until ctx is done
+func (b *Balancer) RunProbes(ctx context.Context, interval, timeout time.Duration, probe ProbeFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		b.ProbeAll(ctx, timeout, probe)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns a snapshot of every backend
+func (b *Balancer) Status() []BackendStatus {
+	status := make([]BackendStatus, len(b.backends))
+	for i, be := range b.backends {
+		status[i] = be.Status()
+	}
+	return status
+}
@@ -0,0 +1,209 @@
+// Package upstream provides tests for load balancing across endpoints.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestBalancer creates a balancer over weighted test endpoints
+func newTestBalancer(t *testing.T, strategy string, weights ...int) *Balancer {
+	t.Helper()
+	endpoints := make([]Endpoint, len(weights))
+	for i, w := range weights {
+		endpoints[i] = Endpoint{URL: "http://ai" + string(rune('a'+i)) + ".local", Weight: w}
+	}
+	b, err := NewBalancer(endpoints, strategy, testConfig())
+	if err != nil {
+		t.Fatalf("NewBalancer() unexpected error: %v", err)
+	}
+	return b
+}
+
+// TestParseEndpoints tests parsing endpoint lists from the environment
+func TestParseEndpoints(t *testing.T) {
+	got, err := ParseEndpoints("http://a/api/v1/generate|3, http://b/api/v1/generate ,")
+	if err != nil {
+		t.Fatalf("ParseEndpoints() unexpected error: %v", err)
+	}
+
+	expected := []Endpoint{
+		{URL: "http://a/api/v1/generate", Weight: 3},
+		{URL: "http://b/api/v1/generate", Weight: 1},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("ParseEndpoints() = %+v, want %+v", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Endpoint %d = %+v, want %+v", i, got[i], expected[i])
+		}
+	}
+
+	for _, spec := range []string{"http://a|0", "http://a|x", "http://a|-2"} {
+		if _, err := ParseEndpoints(spec); !errors.Is(err, ErrInvalidEndpointSpec) {
+			t.Errorf("ParseEndpoints(%q) error = %v, want %v", spec, err, ErrInvalidEndpointSpec)
+		}
+	}
+
+	if got, err := ParseEndpoints(""); err != nil || len(got) != 0 {
+		t.Errorf("ParseEndpoints(\"\") = %v, %v, want no endpoints", got, err)
+	}
+}
+
+// TestNewBalancerErrors tests configuration validation
+func TestNewBalancerErrors(t *testing.T) {
+	if _, err := NewBalancer(nil, RoundRobin, testConfig()); !errors.Is(err, ErrNoEndpoints) {
+		t.Errorf("Expected ErrNoEndpoints, got %v", err)
+	}
+	if _, err := NewBalancer([]Endpoint{{URL: "http://a"}}, "random", testConfig()); !errors.Is(err, ErrUnknownStrategy) {
+		t.Errorf("Expected ErrUnknownStrategy, got %v", err)
+	}
+	if _, err := NewBalancer([]Endpoint{{Weight: 1}}, RoundRobin, testConfig()); !errors.Is(err, ErrInvalidEndpointSpec) {
+		t.Errorf("Expected ErrInvalidEndpointSpec, got %v", err)
+	}
+}
+
+// TestRoundRobinWeights tests that picks follow endpoint weights and are interleaved
+func TestRoundRobinWeights(t *testing.T) {
+	b := newTestBalancer(t, RoundRobin, 3, 1)
+
+	var picks []int
+	for i := 0; i < 8; i++ {
+		be, err := b.Next(nil)
+		if err != nil {
+			t.Fatalf("Next() unexpected error: %v", err)
+		}
+		picks = append(picks, be.Index)
+	}
+
+	counts := map[int]int{}
+	for _, p := range picks {
+		counts[p]++
+	}
+	if counts[0] != 6 || counts[1] != 2 {
+		t.Errorf("Expected a 3:1 split, got %v (%v)", counts, picks)
+	}
+
+	// Smooth weighting never sends the light endpoint two requests in a row
+	for i := 1; i < len(picks); i++ {
+		if picks[i] == 1 && picks[i-1] == 1 {
+			t.Errorf("Expected picks to be interleaved, got %v", picks)
+		}
+	}
+}
+
+// TestLeastOutstanding tests picking the least loaded endpoint relative to weight
+func TestLeastOutstanding(t *testing.T) {
+	b := newTestBalancer(t, LeastOutstanding, 1, 2)
+	backends := b.Backends()
+
+	backends[0].Acquire()
+	backends[1].Acquire()
+
+	// 1/1 vs 1/2: the heavier endpoint has more spare capacity
+	if be, _ := b.Next(nil); be != backends[1] {
+		t.Errorf("Expected endpoint 1, got %d", be.Index)
+	}
+
+	backends[1].Acquire()
+	backends[1].Acquire()
+
+	// 1/1 vs 3/2
+	if be, _ := b.Next(nil); be != backends[0] {
+		t.Errorf("Expected endpoint 0, got %d", be.Index)
+	}
+
+	backends[1].Release()
+	backends[1].Release()
+	backends[1].Release()
+	if got := backends[1].Outstanding(); got != 0 {
+		t.Errorf("Expected no outstanding requests, got %d", got)
+	}
+}
+
+// TestNextSkipsUnavailable tests that excluded, unhealthy and open-breaker endpoints are skipped
+func TestNextSkipsUnavailable(t *testing.T) {
+	b := newTestBalancer(t, RoundRobin, 1, 1, 1)
+	backends := b.Backends()
+
+	backends[0].SetHealth(errors.New("probe failed"))
+	backends[1].Client.Breaker().Failure()
+	for i := 0; i < testConfig().FailureThreshold; i++ {
+		backends[1].Client.Breaker().Failure()
+	}
+
+	for i := 0; i < 3; i++ {
+		be, err := b.Next(nil)
+		if err != nil || be != backends[2] {
+			t.Fatalf("Expected only endpoint 2 to be picked, got %v, %v", be, err)
+		}
+	}
+
+	if _, err := b.Next(map[*Backend]bool{backends[2]: true}); !errors.Is(err, ErrNoHealthyEndpoint) {
+		t.Errorf("Expected ErrNoHealthyEndpoint, got %v", err)
+	}
+
+	// A successful probe brings the endpoint back
+	backends[0].SetHealth(nil)
+	if be, err := b.Next(map[*Backend]bool{backends[2]: true}); err != nil || be != backends[0] {
+		t.Errorf("Expected endpoint 0 after recovery, got %v, %v", be, err)
+	}
+}
+
+// TestProbeAll tests recording probe results
+func TestProbeAll(t *testing.T) {
+	b := newTestBalancer(t, RoundRobin, 1, 1)
+
+	b.ProbeAll(context.Background(), time.Second, func(ctx context.Context, be *Backend) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("Expected probes to carry a deadline")
+		}
+		if be.Index == 1 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	status := b.Status()
+	if !status[0].Healthy || status[0].LastProbe == nil {
+		t.Errorf("Expected endpoint 0 to be healthy, got %+v", status[0])
+	}
+	if status[1].Healthy || !strings.Contains(status[1].LastError, "refused") {
+		t.Errorf("Expected endpoint 1 to be unhealthy, got %+v", status[1])
+	}
+}
+
+// TestRunProbes tests periodic probing until the context is cancelled
+func TestRunProbes(t *testing.T) {
+	b := newTestBalancer(t, RoundRobin, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	probes := make(chan struct{}, 10)
+	done := make(chan struct{})
+	go func() {
+		b.RunProbes(ctx, time.Millisecond, time.Second, func(context.Context, *Backend) error {
+			probes <- struct{}{}
+			return nil
+		})
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-probes:
+		case <-time.After(time.Second):
+			t.Fatal("Expected repeated probes")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected RunProbes to stop after cancel")
+	}
+}
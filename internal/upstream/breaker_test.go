@@ -0,0 +1,139 @@
+// Package upstream provides tests for the circuit breaker.
+package upstream
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for breaker tests
+type fakeClock struct {
+	now time.Time
+}
+
+// Now returns the current fake time
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+// newTestBreaker creates a breaker driven by a fake clock
+func newTestBreaker(threshold int, cooldown time.Duration) (*Breaker, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	b := NewBreaker(threshold, cooldown)
+	b.now = clock.Now
+	return b, clock
+}
+
+// TestBreakerOpensAfterThreshold tests that consecutive failures open the breaker
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b, _ := newTestBreaker(3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("Allow() unexpected error: %v", err)
+		}
+		b.Failure()
+	}
+	if b.State() != StateClosed {
+		t.Fatalf("Expected breaker to stay closed below the threshold, got %s", b.State())
+	}
+
+	b.Allow()
+	b.Failure()
+	if b.State() != StateOpen {
+		t.Fatalf("Expected breaker to open at the threshold, got %s", b.State())
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Allow() error = %v, want %v", err, ErrCircuitOpen)
+	}
+	if b.RetryAfter() != time.Minute {
+		t.Errorf("RetryAfter() = %s, want 1m", b.RetryAfter())
+	}
+}
+
+// TestBreakerSuccessResetsFailures tests that a success clears the failure count
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	b, _ := newTestBreaker(2, time.Minute)
+
+	b.Failure()
+	b.Success()
+	b.Failure()
+
+	if b.State() != StateClosed {
+		t.Errorf("Expected breaker to stay closed, got %s", b.State())
+	}
+	if got := b.Status().ConsecutiveFailures; got != 1 {
+		t.Errorf("Expected 1 consecutive failure, got %d", got)
+	}
+}
+
+// TestBreakerHalfOpen tests the probe after the cooldown
+func TestBreakerHalfOpen(t *testing.T) {
+	b, clock := newTestBreaker(1, time.Minute)
+
+	b.Failure()
+	clock.now = clock.now.Add(time.Minute)
+
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Expected a probe after the cooldown, got %v", err)
+	}
+	if b.State() != StateHalfOpen {
+		t.Fatalf("Expected half-open state, got %s", b.State())
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected only one probe in flight, got %v", err)
+	}
+
+	// A failed probe opens the breaker again
+	b.Failure()
+	if b.State() != StateOpen {
+		t.Fatalf("Expected breaker to reopen after a failed probe, got %s", b.State())
+	}
+
+	// A successful probe closes it
+	clock.now = clock.now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() unexpected error: %v", err)
+	}
+	b.Success()
+	if b.State() != StateClosed {
+		t.Errorf("Expected breaker to close after a successful probe, got %s", b.State())
+	}
+}
+
+// TestBreakerRelease tests that a cancelled probe frees the probe slot
+func TestBreakerRelease(t *testing.T) {
+	b, clock := newTestBreaker(1, time.Minute)
+
+	b.Failure()
+	clock.now = clock.now.Add(time.Minute)
+	b.Allow()
+	b.Release()
+
+	if err := b.Allow(); err != nil {
+		t.Errorf("Expected a new probe after release, got %v", err)
+	}
+}
+
+// TestBreakerStatus tests the health snapshot
+func TestBreakerStatus(t *testing.T) {
+	b, clock := newTestBreaker(1, time.Minute)
+
+	status := b.Status()
+	if status.State != StateClosed || status.OpenedAt != nil {
+		t.Errorf("Unexpected closed status: %+v", status)
+	}
+
+	b.Failure()
+	status = b.Status()
+	if status.State != StateOpen || status.ConsecutiveFailures != 1 {
+		t.Errorf("Unexpected open status: %+v", status)
+	}
+	if status.OpenedAt == nil || !status.OpenedAt.Equal(clock.now) {
+		t.Errorf("Expected opened_at %s, got %v", clock.now, status.OpenedAt)
+	}
+	if status.RetryAt == nil || !status.RetryAt.Equal(clock.now.Add(time.Minute)) {
+		t.Errorf("Unexpected retry_at %v", status.RetryAt)
+	}
+}
@@ -0,0 +1,204 @@
+// Package upstream provides a shared HTTP client for calls to the AI service.
+// It pools connections, retries transient failures with exponential backoff and
+// stops calling an endpoint that keeps failing through a circuit breaker.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// Common errors for upstream calls
+var (
+	ErrCircuitOpen = errors.New("upstream circuit breaker is open")
+)
+
+// Config holds the upstream client settings
+type Config struct {
+	// MaxRetries is the number of retries after the first attempt
+	MaxRetries int `yaml:"max_retries" json:"max_retries"`
+	// BaseDelay is the backoff before the first retry, doubled for each further retry
+	BaseDelay time.Duration `yaml:"base_delay" json:"base_delay"`
+	// MaxDelay caps the backoff between retries
+	MaxDelay time.Duration `yaml:"max_delay" json:"max_delay"`
+	// FailureThreshold is the number of consecutive failed calls that opens the breaker
+	FailureThreshold int `yaml:"failure_threshold" json:"failure_threshold"`
+	// Cooldown is how long the breaker stays open before a probe is let through
+	Cooldown time.Duration `yaml:"cooldown" json:"cooldown"`
+	// MaxIdleConnsPerHost is the number of pooled keep-alive connections per host
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+	// IdleConnTimeout closes pooled connections that have been idle this long
+	IdleConnTimeout time.Duration `yaml:"idle_conn_timeout" json:"idle_conn_timeout"`
+	// DialTimeout limits how long establishing a connection may take
+	DialTimeout time.Duration `yaml:"dial_timeout" json:"dial_timeout"`
+}
+
+// DefaultConfig returns the default upstream client settings
+func DefaultConfig() Config {
+	return Config{
+		MaxRetries:          2,
+		BaseDelay:           200 * time.Millisecond,
+		MaxDelay:            2 * time.Second,
+		FailureThreshold:    5,
+		Cooldown:            30 * time.Second,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		DialTimeout:         5 * time.Second,
+	}
+}
+
+// Client sends requests to the AI service.
+// It is safe for concurrent use and should be shared by all handlers.
+type Client struct {
+	cfg     Config
+	http    *http.Client
+	breaker *Breaker
+}
+
+// New creates a Client with a pooled transport
+func New(cfg Config) *Client {
+	return NewWithClient(cfg, &http.Client{Transport: NewTransport(cfg)})
+}
+
+// NewWithClient creates a Client that sends requests through httpClient
+func NewWithClient(cfg Config, httpClient *http.Client) *Client {
+	return &Client{
+		cfg:     cfg,
+		http:    httpClient,
+		breaker: NewBreaker(cfg.FailureThreshold, cfg.Cooldown),
+	}
+}
+
+// NewTransport returns a transport that keeps connections to the AI service alive
+func NewTransport(cfg Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = cfg.IdleConnTimeout
+	transport.DialContext = (&net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	return transport
+}
+
+// Breaker returns the client's circuit breaker
+func (c *Client) Breaker() *Breaker {
+	return c.breaker
+}
+
+// Do sends the request, retrying connection failures and 502/503/504 responses.
+// While the circuit breaker is open it fails fast with ErrCircuitOpen.
+// Requests with a body must be replayable through req.GetBody to be retried.
+// Requests cancelled by the caller do not count against the upstream, but
+// requests whose deadline expires do, since a hanging upstream fails that way.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if err := c.breaker.Allow(); err != nil {
+		return nil, fmt.Errorf("%w: retry in %s", err, c.breaker.RetryAfter().Round(time.Second))
+	}
+
+	resp, err := c.doWithRetries(req)
+
+	switch {
+	case errors.Is(req.Context().Err(), context.Canceled):
+		c.breaker.Release()
+	case err != nil || isServerError(resp.StatusCode):
+		c.breaker.Failure()
+	default:
+		c.breaker.Success()
+	}
+	return resp, err
+}
+
+// doWithRetries sends the request until it succeeds, fails permanently or
+// the retries are used up. The last response or error is returned.
+func (c *Client) doWithRetries(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if err := rewind(req); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := c.http.Do(req)
+		if attempt >= c.cfg.MaxRetries || !retryable(resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		if err := sleep(req.Context(), c.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// backoff returns the jittered delay before retry number attempt+1
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.cfg.BaseDelay << attempt
+	if delay > c.cfg.MaxDelay || delay <= 0 {
+		delay = c.cfg.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// Spread retries from concurrent requests over [delay/2, delay)
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// retryable reports whether a failed attempt is worth repeating
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isServerError reports whether status means the upstream is unhealthy
+func isServerError(status int) bool {
+	return status >= http.StatusInternalServerError
+}
+
+// rewind resets the request body before a retry
+func rewind(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if req.GetBody == nil {
+		return errors.New("request body cannot be replayed for retry")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return fmt.Errorf("failed to replay request body: %w", err)
+	}
+	req.Body = body
+	return nil
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
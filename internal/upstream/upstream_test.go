@@ -0,0 +1,321 @@
+// Package upstream provides tests for the retrying upstream client.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testConfig returns settings with short delays for tests
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.BaseDelay = time.Millisecond
+	cfg.MaxDelay = 5 * time.Millisecond
+	return cfg
+}
+
+// flakyServer fails the first failures requests with status, then succeeds.
+// Every request body is recorded.
+type flakyServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	calls  int
+	bodies []string
+}
+
+// newFlakyServer starts a flakyServer
+func newFlakyServer(failures, status int) *flakyServer {
+	f := &flakyServer{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		f.mu.Lock()
+		f.calls++
+		call := f.calls
+		f.bodies = append(f.bodies, string(body))
+		f.mu.Unlock()
+
+		if call <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	return f
+}
+
+// Calls returns the number of requests received
+func (f *flakyServer) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// post sends a POST request with a JSON body through the client
+func post(t *testing.T, c *Client, url string) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(`{"prompt":"hi"}`))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	return c.Do(req)
+}
+
+// TestDoRetriesTransientStatus tests retries on 502/503/504 responses
+func TestDoRetriesTransientStatus(t *testing.T) {
+	for _, status := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			server := newFlakyServer(2, status)
+			defer server.Close()
+
+			resp, err := post(t, New(testConfig()), server.URL)
+			if err != nil {
+				t.Fatalf("Do() unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Expected status 200 after retries, got %d", resp.StatusCode)
+			}
+			if server.Calls() != 3 {
+				t.Errorf("Expected 3 attempts, got %d", server.Calls())
+			}
+			for i, body := range server.bodies {
+				if body != `{"prompt":"hi"}` {
+					t.Errorf("Attempt %d: expected the body to be replayed, got %q", i+1, body)
+				}
+			}
+		})
+	}
+}
+
+// TestDoGivesUpAfterMaxRetries tests that the last failed response is returned
+func TestDoGivesUpAfterMaxRetries(t *testing.T) {
+	server := newFlakyServer(10, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	resp, err := post(t, New(testConfig()), server.URL)
+	if err != nil {
+		t.Fatalf("Do() unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", resp.StatusCode)
+	}
+	if server.Calls() != 3 {
+		t.Errorf("Expected 1 attempt and 2 retries, got %d calls", server.Calls())
+	}
+}
+
+// TestDoDoesNotRetryPermanentFailures tests that other statuses are returned as-is
+func TestDoDoesNotRetryPermanentFailures(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusInternalServerError} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			server := newFlakyServer(1, status)
+			defer server.Close()
+
+			resp, err := post(t, New(testConfig()), server.URL)
+			if err != nil {
+				t.Fatalf("Do() unexpected error: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != status || server.Calls() != 1 {
+				t.Errorf("Expected a single %d response, got %d after %d calls", status, resp.StatusCode, server.Calls())
+			}
+		})
+	}
+}
+
+// TestDoRetriesConnectionRefused tests retries when nothing listens on the port
+func TestDoRetriesConnectionRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	var dials int32
+	transport := NewTransport(testConfig())
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return dial(ctx, network, address)
+	}
+
+	c := NewWithClient(testConfig(), &http.Client{Transport: transport})
+	_, err = post(t, c, "http://"+addr)
+	if err == nil {
+		t.Fatal("Expected an error for a refused connection")
+	}
+	if got := atomic.LoadInt32(&dials); got != 3 {
+		t.Errorf("Expected 3 connection attempts, got %d", got)
+	}
+}
+
+// TestDoStopsRetryingWhenCancelled tests that backoff honours the request context
+func TestDoStopsRetryingWhenCancelled(t *testing.T) {
+	server := newFlakyServer(10, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	cfg := testConfig()
+	cfg.BaseDelay = time.Minute
+	cfg.MaxDelay = time.Minute
+	c := New(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, strings.NewReader("{}"))
+	start := time.Now()
+	_, err := c.Do(req)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Do() error = %v, want %v", err, context.Canceled)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Expected backoff to stop when the context is done")
+	}
+	if c.Breaker().State() != StateClosed || c.Breaker().Status().ConsecutiveFailures != 0 {
+		t.Errorf("Expected cancelled calls not to count as failures, got %+v", c.Breaker().Status())
+	}
+}
+
+// TestDoCountsTimeouts tests that an upstream hanging past the request
+// deadline counts as a failure and opens the breaker
+func TestDoCountsTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cfg := testConfig()
+	cfg.FailureThreshold = 2
+	cfg.Cooldown = time.Hour
+	c := New(cfg)
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, strings.NewReader("{}"))
+		_, err := c.Do(req)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Call %d: Do() error = %v, want %v", i+1, err, context.DeadlineExceeded)
+		}
+	}
+
+	if c.Breaker().State() != StateOpen {
+		t.Errorf("Expected timeouts to open the breaker, got %+v", c.Breaker().Status())
+	}
+}
+
+// TestDoCircuitBreaker tests that a failing upstream is short-circuited
+func TestDoCircuitBreaker(t *testing.T) {
+	server := newFlakyServer(100, http.StatusBadGateway)
+	defer server.Close()
+
+	cfg := testConfig()
+	cfg.MaxRetries = 0
+	cfg.FailureThreshold = 3
+	cfg.Cooldown = time.Hour
+	c := New(cfg)
+
+	for i := 0; i < 3; i++ {
+		resp, err := post(t, c, server.URL)
+		if err != nil {
+			t.Fatalf("Call %d: unexpected error: %v", i+1, err)
+		}
+		resp.Body.Close()
+	}
+
+	if c.Breaker().State() != StateOpen {
+		t.Fatalf("Expected breaker to open, got %s", c.Breaker().State())
+	}
+
+	start := time.Now()
+	_, err := post(t, c, server.URL)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Do() error = %v, want %v", err, ErrCircuitOpen)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("Expected an open breaker to fail fast")
+	}
+	if server.Calls() != 3 {
+		t.Errorf("Expected no upstream call while open, got %d calls", server.Calls())
+	}
+}
+
+// TestDoCircuitRecovers tests that a successful probe closes the breaker
+func TestDoCircuitRecovers(t *testing.T) {
+	server := newFlakyServer(2, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	cfg := testConfig()
+	cfg.MaxRetries = 0
+	cfg.FailureThreshold = 2
+	cfg.Cooldown = 10 * time.Millisecond
+	c := New(cfg)
+
+	for i := 0; i < 2; i++ {
+		resp, _ := post(t, c, server.URL)
+		resp.Body.Close()
+	}
+	if c.Breaker().State() != StateOpen {
+		t.Fatalf("Expected breaker to open, got %s", c.Breaker().State())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	resp, err := post(t, c, server.URL)
+	if err != nil {
+		t.Fatalf("Expected the probe to go through, got %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || c.Breaker().State() != StateClosed {
+		t.Errorf("Expected breaker to close after a successful probe, got %d %s", resp.StatusCode, c.Breaker().State())
+	}
+}
+
+// TestBackoff tests exponential growth and the delay cap
+func TestBackoff(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BaseDelay = 100 * time.Millisecond
+	cfg.MaxDelay = 300 * time.Millisecond
+	c := New(cfg)
+
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond, 200 * time.Millisecond},
+		{2, 150 * time.Millisecond, 300 * time.Millisecond},
+		{10, 150 * time.Millisecond, 300 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if d := c.backoff(tt.attempt); d < tt.min || d > tt.max {
+				t.Errorf("backoff(%d) = %s, want between %s and %s", tt.attempt, d, tt.min, tt.max)
+			}
+		}
+	}
+}
@@ -3,41 +3,34 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/TeamPentagon/DM-Backend/internal/config"
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/TeamPentagon/DM-Backend/internal/middleware"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+	"github.com/TeamPentagon/DM-Backend/internal/prompt"
+	"github.com/TeamPentagon/DM-Backend/internal/provider"
+	"github.com/TeamPentagon/DM-Backend/internal/upstream"
 	"github.com/gin-gonic/gin"
 )
 
 // Config holds application configuration
-type Config struct {
-	Port           string
-	AIEndpoint     string
-	RequestTimeout time.Duration
-}
+type Config = config.Config
 
 // Request represents the AI generation request payload
-type Request struct {
-	MaxContextLength int     `json:"max_context_length"`
-	MaxLength        int     `json:"max_length"`
-	Prompt           string  `json:"prompt"`
-	Quiet            bool    `json:"quiet"`
-	RepPen           float64 `json:"rep_pen"`
-	RepPenRange      int     `json:"rep_pen_range"`
-	RepPenSlope      float64 `json:"rep_pen_slope"`
-	Temperature      float64 `json:"temperature"`
-	Tfs              int     `json:"tfs"`
-	TopA             int     `json:"top_a"`
-	TopK             int     `json:"top_k"`
-	TopP             float64 `json:"top_p"`
-	Typical          int     `json:"typical"`
-}
+type Request = provider.Request
 
 // Response represents the API response structure
 type Response struct {
@@ -46,137 +39,628 @@ type Response struct {
 	Error   string      `json:"error,omitempty"`
 }
 
+// ChatResult is a single generated reply
+type ChatResult struct {
+	Text string `json:"text"`
+}
+
+// ChatData is the payload returned by the chat endpoint
+type ChatData struct {
+	Results        []ChatResult      `json:"results"`
+	ConversationID string            `json:"conversation_id"`
+	MessageID      string            `json:"message_id"`
+	ReplyID        string            `json:"reply_id"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+}
+
 // DefaultConfig returns default configuration values
 func DefaultConfig() Config {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8085"
-	}
-
-	endpoint := os.Getenv("AI_ENDPOINT")
-	if endpoint == "" {
-		endpoint = "https://herbal-pmc-allowance-cognitive.trycloudflare.com/api/v1/generate"
-	}
+	return config.Default()
+}
 
-	return Config{
-		Port:           port,
-		AIEndpoint:     endpoint,
-		RequestTimeout: 30 * time.Second,
-	}
+// newProvider creates the AI provider selected by the configuration, balanced
+// across the configured endpoints
+func newProvider(config Config, balancer *upstream.Balancer) (*provider.BalancedProvider, error) {
+	return provider.NewBalanced(provider.Config{
+		Name:   config.AI.Provider,
+		Model:  config.AI.Model,
+		APIKey: config.AI.APIKey,
+	}, balancer)
 }
 
-// chatResponse handles chat requests and forwards them to the AI service
-func chatResponse(config Config) gin.HandlerFunc {
+// chatResponse handles chat requests and forwards them to the AI provider.
+// bind reads the request, either from the JSON body or the legacy query string.
+// The turn belongs to the authenticated subject, who may only continue the
+// conversations they started.
+// The prompt sent upstream includes as much of the conversation history as
+// fits in the model's context window.
+// Generation parameters come from the requested preset, with any per-request
+// overrides applied and validated.
+// Clients that opt in to streaming receive the reply as server-sent events.
+func chatResponse(config Config, ai provider.Provider, bind chatBinder) gin.HandlerFunc {
+	builder := prompt.NewBuilder(config.AI.Prompt)
+	presets := provider.DefaultPresets()
+
 	return func(c *gin.Context) {
-		prompt, exists := c.GetQuery("response")
-		if !exists || prompt == "" {
-			c.JSON(http.StatusBadRequest, Response{
-				Success: false,
-				Error:   "Missing 'response' query parameter",
-			})
+		req, err := bind(c)
+		if err != nil {
+			respondBindError(c, err)
 			return
 		}
 
-		log.Printf("Received chat request with prompt length: %d", len(prompt))
-
-		data := Request{
-			MaxContextLength: 2048,
-			MaxLength:        100,
-			Prompt:           prompt,
-			Quiet:            false,
-			RepPen:           1.1,
-			RepPenRange:      256,
-			RepPenSlope:      1,
-			Temperature:      0.5,
-			Tfs:              1,
-			TopA:             0,
-			TopK:             100,
-			TopP:             0.9,
-			Typical:          1,
+		userPrompt := req.Prompt
+		userID := middleware.GetSubject(c)
+		conversationID := req.ConversationID
+		if conversationID == "" {
+			conversationID = model.NewConversationID()
 		}
 
-		jsonData, err := json.Marshal(data)
+		log.Printf("Received chat request with prompt length: %d", len(userPrompt))
+
+		data, err := presets.Resolve(req.Preset, req.Params)
 		if err != nil {
-			log.Printf("Error marshaling request: %v", err)
+			var invalid *provider.ValidationError
+			if errors.As(err, &invalid) {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Data:    invalid,
+					Error:   "Invalid generation parameters",
+				})
+				return
+			}
+			log.Printf("Error resolving generation parameters: %v", err)
 			c.JSON(http.StatusInternalServerError, Response{
 				Success: false,
-				Error:   "Failed to process request",
+				Error:   "Failed to resolve generation parameters",
 			})
 			return
 		}
 
-		// Create HTTP client with timeout
-		client := &http.Client{
-			Timeout: config.RequestTimeout,
+		history, err := builder.Load(conversationID)
+		if err != nil {
+			log.Printf("Error loading conversation %s: %v", conversationID, err)
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Error:   "Failed to load conversation history",
+			})
+			return
+		}
+		if len(history) > 0 && conversationOwner(history) != userID {
+			c.JSON(http.StatusForbidden, Response{
+				Success: false,
+				Error:   "Forbidden: the conversation belongs to another user",
+			})
+			return
 		}
 
-		resp, err := client.Post(config.AIEndpoint, "application/json", bytes.NewBuffer(jsonData))
+		rendered, err := builder.BuildConversation(conversationID, history, userPrompt, data.MaxContextLength, data.MaxLength)
 		if err != nil {
-			log.Printf("Error calling AI service: %v", err)
-			c.JSON(http.StatusServiceUnavailable, Response{
+			if errors.Is(err, prompt.ErrPromptTooLong) || errors.Is(err, prompt.ErrInvalidBudget) {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "Prompt is too long for the model context window",
+				})
+				return
+			}
+			log.Printf("Error building prompt: %v", err)
+			c.JSON(http.StatusInternalServerError, Response{
 				Success: false,
-				Error:   "AI service unavailable",
+				Error:   "Failed to build the prompt",
 			})
 			return
 		}
-		defer resp.Body.Close()
+		data.Prompt = rendered
+
+		userMsg := newMessage(conversationID, userID, "", userPrompt)
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), config.Server.RequestTimeout)
+		defer cancel()
+
+		if req.Stream || wantsStream(c) {
+			streamChat(ctx, c, ai, data, userMsg, req.Metadata)
+			return
+		}
+
+		result, err := ai.Generate(ctx, data)
+		if err != nil {
+			log.Printf("Error calling AI service (%s): %v", ai.Name(), err)
+			respondUpstreamError(c, err)
+			return
+		}
 
-		body, err := io.ReadAll(resp.Body)
+		log.Printf("AI response received, length: %d", len(result.Text))
+
+		reply, err := recordTurn(userMsg, ai.Name(), result.Text)
 		if err != nil {
-			log.Printf("Error reading response: %v", err)
+			log.Printf("Error saving AI reply: %v", err)
 			c.JSON(http.StatusInternalServerError, Response{
 				Success: false,
-				Error:   "Failed to read AI response",
+				Error:   "Failed to save message",
 			})
 			return
 		}
 
-		log.Printf("AI response received, length: %d", len(body))
-
 		c.JSON(http.StatusOK, Response{
 			Success: true,
-			Data:    json.RawMessage(body),
+			Data: ChatData{
+				Results:        []ChatResult{{Text: result.Text}},
+				ConversationID: conversationID,
+				MessageID:      userMsg.GetMsgId(),
+				ReplyID:        reply.GetMsgId(),
+				Metadata:       req.Metadata,
+			},
 		})
 	}
 }
 
-// healthCheck handles health check requests
-func healthCheck(c *gin.Context) {
-	c.JSON(http.StatusOK, Response{
-		Success: true,
-		Data:    map[string]string{"status": "healthy"},
+// conversationOwner returns the user who started a conversation, the author
+// of its first user turn
+func conversationOwner(history []*model.Message) string {
+	for _, msg := range history {
+		if msg.GetAiId() == "" {
+			return msg.GetUserId()
+		}
+	}
+	return ""
+}
+
+// newMessage returns a new, not yet stored chat turn of a conversation.
+// User turns carry userID, AI turns carry aiID.
+func newMessage(conversationID, userID, aiID, content string) *model.Message {
+	return &model.Message{
+		MsgId:          model.NewMessageID(),
+		ConversationId: conversationID,
+		UserId:         userID,
+		AiId:           aiID,
+		Content:        content,
+		Timestamp:      time.Now().UnixMilli(),
+	}
+}
+
+// recordTurn stores the user turn userMsg and the AI reply to it, and appends
+// both to the conversation history. It is only called once the reply is
+// complete, so a failed generation leaves no unanswered prompt behind.
+func recordTurn(userMsg *model.Message, aiID, text string) (*model.Message, error) {
+	reply := newMessage(userMsg.GetConversationId(), "", aiID, text)
+	for _, msg := range []*model.Message{userMsg, reply} {
+		if err := recordMessage(msg); err != nil {
+			return nil, err
+		}
+	}
+	return reply, nil
+}
+
+// recordMessage stores a chat turn and appends it to the conversation history
+func recordMessage(msg *model.Message) error {
+	if err := msg.SaveMessage(); err != nil {
+		return err
+	}
+
+	history := &model.ChatHistory{ConversationId: msg.GetConversationId()}
+	return history.AddMessageToHistory(msg)
+}
+
+// respondUpstreamError writes the 503 response for a failed AI service call.
+// Calls rejected by the open circuit breaker get a distinct message, and a
+// request the AI service rejected with a 4xx status gets that status.
+func respondUpstreamError(c *gin.Context, err error) {
+	var status *provider.StatusError
+	if errors.As(err, &status) && status.StatusCode >= http.StatusBadRequest && status.StatusCode < http.StatusInternalServerError {
+		c.JSON(status.StatusCode, Response{
+			Success: false,
+			Error:   "AI service rejected the request",
+		})
+		return
+	}
+
+	message := "AI service unavailable"
+	if errors.Is(err, upstream.ErrCircuitOpen) || errors.Is(err, upstream.ErrNoHealthyEndpoint) {
+		message = "AI service temporarily unavailable, try again later"
+	}
+	c.JSON(http.StatusServiceUnavailable, Response{
+		Success: false,
+		Error:   message,
 	})
 }
 
-// setupRouter configures and returns the Gin router
-func setupRouter(config Config) *gin.Engine {
+// healthCheck handles health check requests.
+// It reports every AI endpoint with its probe result and circuit breaker.
+// The service is "degraded" while any endpoint is unavailable.
+func healthCheck(balancer *upstream.Balancer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		health := "healthy"
+		for _, be := range balancer.Backends() {
+			if !be.Available() {
+				health = "degraded"
+				break
+			}
+		}
+
+		c.JSON(http.StatusOK, Response{
+			Success: true,
+			Data: map[string]interface{}{
+				"status": health,
+				"upstream": map[string]interface{}{
+					"strategy":  balancer.Strategy(),
+					"endpoints": balancer.Status(),
+				},
+			},
+		})
+	}
+}
+
+// server holds the router and the long-lived components behind it
+type server struct {
+	config     Config
+	router     *gin.Engine
+	balancer   *upstream.Balancer
+	ai         *provider.BalancedProvider
+	rebalancer *database.Rebalancer
+	// stopJobs cancels background jobs such as rebalances
+	stopJobs context.CancelFunc
+}
+
+// newServer builds the AI provider and configures the Gin router
+func newServer(config Config) (*server, error) {
+	if err := database.SetLayout(config.Database); err != nil {
+		return nil, err
+	}
+
+	balancer, err := upstream.NewBalancer(config.AI.ResolvedEndpoints(), config.AI.Balance, config.AI.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	ai, err := newProvider(config, balancer)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := middleware.NewVerifier(config.Middleware.Auth)
+	if err != nil {
+		return nil, err
+	}
+	if config.Middleware.Auth.Secret == "" && config.Middleware.Auth.JWKSFile == "" {
+		log.Printf("No token keys configured (AUTH_JWT_SECRET or AUTH_JWKS_FILE); protected endpoints reject every request")
+	}
+	issuer := newTokenIssuer(config.Middleware.Auth)
+	if issuer == nil {
+		log.Printf("No AUTH_JWT_SECRET configured; login and refresh cannot issue tokens")
+	}
+
 	router := gin.Default()
+	if config.Middleware.CORS.Enabled {
+		router.Use(middleware.CORS(config.Middleware.CORS.CORSConfig))
+	}
+	if config.Middleware.RateLimit.Enabled {
+		limiter := middleware.NewRateLimiter(config.Middleware.RateLimit.RateLimiterConfig)
+		router.Use(limiter.RateLimitMiddleware())
+	}
 
 	// Health check endpoint
-	router.GET("/health", healthCheck)
+	router.GET("/health", healthCheck(balancer))
 
 	// API v1 routes
 	v1 := router.Group("/api/v1")
 	{
-		v1.POST("/chat", chatResponse(config))
+		v1.POST("/chat", middleware.Auth(verifier), requireSession, chatResponse(config, ai, bindChatRequest))
+	}
+
+	// Registration and token routes
+	auth := v1.Group("/auth")
+	{
+		auth.POST("/register", register)
+		auth.POST("/login", login(issuer))
+		auth.POST("/refresh", refresh(issuer))
+		auth.POST("/logout", logout)
 	}
 
-	// Legacy route for backward compatibility
-	router.POST("/chat", chatResponse(config))
+	// User profile routes, for the user itself or an admin
+	users := v1.Group("/users", middleware.Auth(verifier), requireSession)
+	{
+		users.GET("/:id", getUser)
+		users.PATCH("/:id", patchUser)
+		users.DELETE("/:id", deleteUser)
+	}
 
-	return router
+	// Administrative routes
+	jobs, stopJobs := context.WithCancel(context.Background())
+	rebalancer := database.NewRebalancer(database.DefaultStore())
+	rebalancer.SetDependents(model.UserIndexDependents())
+	schema := database.NewSchema(database.DefaultStore())
+	admin := v1.Group("/admin", middleware.Auth(verifier), requireSession, middleware.RequireRole(middleware.RoleAdmin))
+	{
+		admin.POST("/rebalance", startRebalance(jobs, rebalancer))
+		admin.GET("/rebalance", rebalanceStatus(rebalancer))
+		admin.GET("/shards", listShards(database.DefaultStore().Registry()))
+		admin.POST("/shards", addShard(database.DefaultStore().Registry()))
+		admin.DELETE("/shards/:shard", removeShard(database.DefaultStore().Registry()))
+		admin.GET("/fragmentation/stats", fragmentationStats(schema))
+		admin.GET("/fragmentation/keys", fragmentationKeys(schema))
+		admin.GET("/fragmentation/export", exportFragmentation(schema))
+		admin.POST("/fragmentation/import", importFragmentation(schema))
+	}
+
+	// Legacy route for backward compatibility, reads the prompt from the query string
+	router.POST("/chat", middleware.Auth(verifier), requireSession, chatResponse(config, ai, bindLegacyChatRequest))
+
+	return &server{
+		config:     config,
+		router:     router,
+		balancer:   balancer,
+		ai:         ai,
+		rebalancer: rebalancer,
+		stopJobs:   stopJobs,
+	}, nil
+}
+
+// run serves requests on ln until ctx is done. It then stops accepting
+// connections and gives in-flight requests, including streams, up to the
+// shutdown timeout to finish before their connections are closed. A running
+// rebalance is stopped between keys and can be resumed later. The shared
+// database handles are closed once nothing can use them anymore.
+func (s *server) run(ctx context.Context, ln net.Listener) error {
+	httpServer := &http.Server{
+		Handler:           s.router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	probeCtx, stopProbes := context.WithCancel(ctx)
+	defer stopProbes()
+	if s.config.AI.HealthInterval > 0 {
+		go s.balancer.RunProbes(probeCtx, s.config.AI.HealthInterval, 5*time.Second, s.ai.Probe)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		s.stopBackground()
+		return errors.Join(err, database.CloseAll())
+	case <-ctx.Done():
+	}
+
+	timeout := s.config.Server.ShutdownTimeout
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("In-flight requests did not finish in time, closing connections: %v", err)
+		httpServer.Close()
+	}
+	<-serveErr
+
+	s.stopBackground()
+	return errors.Join(err, database.CloseAll())
+}
+
+// stopBackground stops background jobs and waits for them to return
+func (s *server) stopBackground() {
+	s.stopJobs()
+	s.rebalancer.Wait()
+}
+
+// setupRouter configures and returns the Gin router
+func setupRouter(config Config) *gin.Engine {
+	srv, err := newServer(config)
+	if err != nil {
+		log.Fatalf("Failed to configure AI provider: %v", err)
+	}
+	return srv.router
 }
 
 func main() {
-	config := DefaultConfig()
+	// The first argument may name a command; the server runs by default
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
 
-	log.Printf("Starting DM-Backend server on port %s", config.Port)
-	log.Printf("AI Endpoint: %s", config.AIEndpoint)
+	var rebalanceOpts database.RebalanceOptions
+	var addShardID, removeShardID int64
+	commandFlags := map[string]func(fs *flag.FlagSet){
+		"rebalance": func(fs *flag.FlagSet) {
+			fs.Int64Var(&rebalanceOpts.From, "from", -1, "rebalance: shard to move keys off")
+			fs.Int64Var(&rebalanceOpts.To, "to", -1, "rebalance: shard to move keys to")
+			fs.Float64Var(&rebalanceOpts.Rate, "rate", 0, "rebalance: keys moved per second, 0 for no limit")
+			fs.IntVar(&rebalanceOpts.Limit, "limit", 0, "rebalance: stop after this many keys, 0 for all")
+			fs.BoolVar(&rebalanceOpts.Retire, "retire", false, "rebalance: stop placing new keys on the shard moved off")
+		},
+		"shards": func(fs *flag.FlagSet) {
+			fs.Int64Var(&addShardID, "add", -1, "shards: shard to place new keys on")
+			fs.Int64Var(&removeShardID, "remove", -1, "shards: shard to stop placing new keys on")
+		},
+	}
+
+	cfg, opts, err := config.Load(args, os.LookupEnv, commandFlags[command])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	if opts.PrintConfig {
+		if err := cfg.Redacted().WriteYAML(os.Stdout); err != nil {
+			log.Fatalf("Failed to print configuration: %v", err)
+		}
+		return
+	}
 
-	router := setupRouter(config)
+	if opts.File != "" {
+		log.Printf("Loaded configuration from %s", opts.File)
+	}
 
-	addr := fmt.Sprintf(":%s", config.Port)
-	if err := router.Run(addr); err != nil {
+	switch command {
+	case "serve":
+		serve(cfg)
+	case "migrate":
+		if err := migrate(cfg); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+	case "rebalance":
+		if err := rebalance(cfg, rebalanceOpts); err != nil {
+			log.Fatalf("Rebalance failed: %v", err)
+		}
+	case "reindex":
+		if err := reindex(cfg); err != nil {
+			log.Fatalf("Reindex failed: %v", err)
+		}
+	case "shards":
+		if err := shards(cfg, addShardID, removeShardID); err != nil {
+			log.Fatalf("Updating the active shards failed: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown command %q, expected serve, migrate, rebalance, reindex or shards", command)
+	}
+}
+
+// serve runs the HTTP server until SIGINT or SIGTERM
+func serve(cfg Config) {
+	log.Printf("Starting DM-Backend server on port %s", cfg.Server.Port)
+	for _, endpoint := range cfg.AI.ResolvedEndpoints() {
+		log.Printf("AI Provider: %s, endpoint: %s (weight %d)", cfg.AI.Provider, endpoint.URL, endpoint.Weight)
+	}
+
+	srv, err := newServer(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure AI provider: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.Server.Port))
+	if err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// Restore the default handlers so a second signal exits immediately
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := srv.run(ctx, ln); err != nil {
+		log.Fatalf("Server stopped with error: %v", err)
+	}
+	log.Printf("Server stopped")
+}
+
+// migrate moves records written by earlier versions to their canonical
+// location and indexes the users, and copies users into SQLite when it is
+// the user backend. The server must not be running, since it holds the
+// database locks.
+func migrate(cfg Config) error {
+	db := database.NewStore(cfg.Database)
+	report, err := model.NewStore(db).Migrate()
+	if err == nil {
+		err = rebuildUserIndexes(db)
+	}
+	if err == nil && cfg.Database.UserBackend == database.BackendSQLite {
+		err = copyUsers(db)
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Migration complete: %d records moved, %d users rekeyed, %d passwords hashed, %d conflicts left in place",
+		report.Moved, report.Rekeyed, report.Hashed, report.Conflicts)
+	return nil
+}
+
+// copyUsers copies the users of the LevelDB shards into the SQLite user
+// database, migrating its schema first, and hashes the plaintext passwords
+// left in it
+func copyUsers(db *database.Store) error {
+	users, err := model.OpenSQLiteUsers(db)
+	if err != nil {
+		return err
+	}
+	copied, conflicts, err := model.NewStore(db).CopyUsers(users)
+	if err != nil {
+		return err
+	}
+	log.Printf("Copied %d users to SQLite, %d left out for a duplicate name or email", copied, conflicts)
+
+	hashed, err := users.HashPasswords()
+	if err != nil {
+		return err
+	}
+	log.Printf("Hashed %d plaintext passwords in SQLite", hashed)
+	return nil
+}
+
+// rebalance moves keys between shards until done or interrupted by SIGINT or
+// SIGTERM; an interrupted rebalance continues where it stopped when run again.
+// The server must not be running; use the admin endpoint to rebalance a
+// running server.
+func rebalance(cfg Config, opts database.RebalanceOptions) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db := database.NewStore(cfg.Database)
+	rebalancer := database.NewRebalancer(db)
+	rebalancer.SetDependents(model.UserIndexDependents())
+	progress, err := rebalancer.Run(ctx, opts)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	log.Printf("Rebalance of shard %d to shard %d: %d keys moved, %d remaining",
+		opts.From, opts.To, progress.Moved, progress.Remaining)
+	return err
+}
+
+// shards activates the shard add and retires the shard remove, each unless
+// negative, and logs the active shards. New keys are only placed on active
+// shards; keys of a retired shard stay there until they are rebalanced. The
+// server must not be running; use the admin endpoints to change the shards
+// of a running server.
+func shards(cfg Config, add, remove int64) error {
+	db := database.NewStore(cfg.Database)
+	registry := db.Registry()
+	var err error
+	if add >= 0 {
+		err = registry.Add(add)
+	}
+	if err == nil && remove >= 0 {
+		err = registry.Remove(remove)
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Active shards: %v", registry.Active())
+	return nil
+}
+
+// reindex rebuilds the user name, email and phone indexes of the LevelDB
+// users from the users themselves, for recovery from lost or damaged index
+// entries. The server must not be running.
+func reindex(cfg Config) error {
+	db := database.NewStore(cfg.Database)
+	err := rebuildUserIndexes(db)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rebuildUserIndexes rebuilds the user indexes of the LevelDB shards of db
+func rebuildUserIndexes(db *database.Store) error {
+	indexed, conflicts, err := model.NewStore(db).RebuildUserIndexes()
+	if err != nil {
+		return err
+	}
+	log.Printf("Indexed %d users, %d names or emails left out as already in use", indexed, conflicts)
+	return nil
 }
@@ -2,31 +2,153 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+	"github.com/TeamPentagon/DM-Backend/internal/provider"
+	"github.com/TeamPentagon/DM-Backend/internal/upstream"
 	"github.com/gin-gonic/gin"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 func init() {
 	gin.SetMode(gin.TestMode)
 }
 
+// setupTestStorage runs the test inside a temporary directory so that
+// persisted conversations do not leak into the working tree
+func setupTestStorage(t *testing.T) func() {
+	originalDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get current directory: %v", err)
+	}
+
+	testDir := t.TempDir()
+	if err := os.Chdir(testDir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+
+	return func() {
+		database.CloseAll()
+		os.Chdir(originalDir)
+	}
+}
+
+// echoUpstream is a stand-in KoboldAI server that echoes the latest user turn
+// and records every request it receives
+type echoUpstream struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []Request
+}
+
+// newEchoUpstream starts an echoUpstream
+func newEchoUpstream() *echoUpstream {
+	e := &echoUpstream{}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		json.NewDecoder(r.Body).Decode(&req)
+
+		e.mu.Lock()
+		e.requests = append(e.requests, req)
+		e.mu.Unlock()
+
+		last := req.Prompt
+		if i := strings.LastIndex(last, "User: "); i >= 0 {
+			last = strings.SplitN(last[i+len("User: "):], "\n", 2)[0]
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"results": []map[string]string{{"text": "echo: " + last}},
+		})
+	}))
+	return e
+}
+
+// Requests returns the generation requests received so far
+func (e *echoUpstream) Requests() []Request {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Request(nil), e.requests...)
+}
+
+// Prompts returns the prompts received so far
+func (e *echoUpstream) Prompts() []string {
+	var prompts []string
+	for _, req := range e.Requests() {
+		prompts = append(prompts, req.Prompt)
+	}
+	return prompts
+}
+
+// chatBody encodes a chat request as a JSON body
+func chatBody(t *testing.T, req ChatRequest) *bytes.Reader {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("Failed to encode chat request: %v", err)
+	}
+	return bytes.NewReader(body)
+}
+
+// chatUser is the subject of the bearer token sent by authorizeChat
+const chatUser = "user_42"
+
+// authorizeChat adds a bearer token of chatUser, signed by adminSecret, to req
+func authorizeChat(req *http.Request) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+userToken(chatUser))
+	return req
+}
+
+// healthData is the data of a /health response
+type healthData struct {
+	Status   string `json:"status"`
+	Upstream struct {
+		Strategy  string                   `json:"strategy"`
+		Endpoints []upstream.BackendStatus `json:"endpoints"`
+	} `json:"upstream"`
+}
+
+// decodeHealth parses a /health response
+func decodeHealth(t *testing.T, w *httptest.ResponseRecorder) healthData {
+	t.Helper()
+	var response struct {
+		Data healthData `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse health response: %v", err)
+	}
+	return response.Data
+}
+
 // TestDefaultConfig tests the default configuration loading
 func TestDefaultConfig(t *testing.T) {
 	config := DefaultConfig()
 
-	if config.Port == "" {
+	if config.Server.Port == "" {
 		t.Error("Expected default port to be set")
 	}
 
-	if config.AIEndpoint == "" {
+	if config.AI.Endpoint == "" {
 		t.Error("Expected default AI endpoint to be set")
 	}
 
-	if config.RequestTimeout <= 0 {
+	if config.Server.RequestTimeout <= 0 {
 		t.Error("Expected request timeout to be positive")
 	}
 }
@@ -92,14 +214,28 @@ func TestHealthCheck(t *testing.T) {
 	if data["status"] != "healthy" {
 		t.Errorf("Expected status 'healthy', got '%v'", data["status"])
 	}
+
+	upstreamStatus, ok := data["upstream"].(map[string]interface{})
+	if !ok || upstreamStatus["strategy"] != "round_robin" {
+		t.Fatalf("Expected upstream status, got %v", data["upstream"])
+	}
+	endpoints, ok := upstreamStatus["endpoints"].([]interface{})
+	if !ok || len(endpoints) != 1 {
+		t.Fatalf("Expected a single endpoint, got %v", upstreamStatus["endpoints"])
+	}
+	breaker := endpoints[0].(map[string]interface{})["breaker"].(map[string]interface{})
+	if breaker["state"] != "closed" {
+		t.Errorf("Expected closed upstream breaker, got %v", breaker)
+	}
 }
 
 // TestChatResponseMissingParameter tests chat endpoint with missing parameter
 func TestChatResponseMissingParameter(t *testing.T) {
-	config := DefaultConfig()
+	config := adminConfig()
 	router := setupRouter(config)
 
 	req := httptest.NewRequest("POST", "/api/v1/chat", nil)
+	authorizeChat(req)
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
@@ -123,12 +259,556 @@ func TestChatResponseMissingParameter(t *testing.T) {
 	}
 }
 
+// TestChatResponseSuccess tests a chat request forwarded to the AI provider
+func TestChatResponseSuccess(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	upstream := newEchoUpstream()
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.AI.Provider = "kobold"
+	config.AI.Endpoint = upstream.URL + "/api/v1/generate"
+	router := setupRouter(config)
+
+	req := httptest.NewRequest("POST", "/api/v1/chat", chatBody(t, ChatRequest{
+		Prompt:   "hello",
+		Metadata: map[string]string{"client": "web"},
+	}))
+	authorizeChat(req)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var response struct {
+		Success bool     `json:"success"`
+		Data    ChatData `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if !response.Success {
+		t.Error("Expected success to be true")
+	}
+	if len(response.Data.Results) != 1 || response.Data.Results[0].Text != "echo: hello" {
+		t.Errorf("Unexpected results: %+v", response.Data.Results)
+	}
+	if response.Data.ConversationID == "" {
+		t.Error("Expected a conversation ID to be generated")
+	}
+	if response.Data.MessageID == "" || response.Data.ReplyID == "" {
+		t.Error("Expected message IDs to be returned")
+	}
+	if response.Data.Metadata["client"] != "web" {
+		t.Errorf("Expected metadata to be echoed, got %v", response.Data.Metadata)
+	}
+}
+
+// TestChatResponsePersistsTurns tests that prompts and replies are stored in the conversation history
+func TestChatResponsePersistsTurns(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	upstream := newEchoUpstream()
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.AI.Endpoint = upstream.URL + "/api/v1/generate"
+	router := setupRouter(config)
+
+	var ids []string
+	for _, prompt := range []string{"first", "second"} {
+		req := httptest.NewRequest("POST", "/api/v1/chat", chatBody(t, ChatRequest{
+			Prompt:         prompt,
+			ConversationID: "conv_test",
+		}))
+		authorizeChat(req)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		var response struct {
+			Data ChatData `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if response.Data.ConversationID != "conv_test" {
+			t.Errorf("Expected conversation 'conv_test', got %q", response.Data.ConversationID)
+		}
+		ids = append(ids, response.Data.MessageID, response.Data.ReplyID)
+	}
+
+	prompts := upstream.Prompts()
+	if len(prompts) != 2 {
+		t.Fatalf("Expected 2 upstream prompts, got %d", len(prompts))
+	}
+	if !strings.Contains(prompts[1], "User: first\nAssistant: echo: first\nUser: second\n") {
+		t.Errorf("Expected second prompt to include the earlier turn, got %q", prompts[1])
+	}
+
+	history := &model.ChatHistory{ConversationId: "conv_test"}
+	if err := history.GetChatHistory(); err != nil {
+		t.Fatalf("GetChatHistory() returned an error: %v", err)
+	}
+
+	if len(history.Messages) != 4 {
+		t.Fatalf("Expected 4 messages, got %d", len(history.Messages))
+	}
+
+	expected := []struct {
+		content string
+		userID  string
+		aiID    string
+	}{
+		{"first", "user_42", ""},
+		{"echo: first", "", "kobold"},
+		{"second", "user_42", ""},
+		{"echo: second", "", "kobold"},
+	}
+
+	for i, msg := range history.Messages {
+		if msg.GetMsgId() != ids[i] {
+			t.Errorf("Message %d: expected ID %s, got %s", i, ids[i], msg.GetMsgId())
+		}
+		if msg.GetContent() != expected[i].content {
+			t.Errorf("Message %d: expected content %q, got %q", i, expected[i].content, msg.GetContent())
+		}
+		if msg.GetUserId() != expected[i].userID || msg.GetAiId() != expected[i].aiID {
+			t.Errorf("Message %d: unexpected author user=%q ai=%q", i, msg.GetUserId(), msg.GetAiId())
+		}
+		if msg.GetTimestamp() == 0 {
+			t.Errorf("Message %d: expected timestamp to be set", i)
+		}
+	}
+}
+
+// TestChatResponseAuth tests that chat requests need a token and may only
+// continue the conversations of their subject
+func TestChatResponseAuth(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	upstream := newEchoUpstream()
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.AI.Endpoint = upstream.URL + "/api/v1/generate"
+	router := setupRouter(config)
+
+	send := func(target, subject string, body ChatRequest) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", target, chatBody(t, body))
+		if subject != "" {
+			req.Header.Set("Authorization", "Bearer "+userToken(subject))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, target := range []string{"/api/v1/chat", "/chat?response=hello"} {
+		if w := send(target, "", ChatRequest{Prompt: "hello"}); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status %d without a token, got %d", target, http.StatusUnauthorized, w.Code)
+		}
+	}
+
+	if w := send("/api/v1/chat", chatUser, ChatRequest{Prompt: "secret", ConversationID: "conv_owned"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	for _, target := range []string{"/api/v1/chat", "/chat?response=hello&conversation_id=conv_owned"} {
+		if w := send(target, "user_7", ChatRequest{Prompt: "hello", ConversationID: "conv_owned"}); w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected status %d for another user's conversation, got %d", target, http.StatusForbidden, w.Code)
+		}
+	}
+	if prompts := upstream.Prompts(); len(prompts) != 1 {
+		t.Errorf("Expected only the owner's prompt upstream, got %q", prompts)
+	}
+	if w := send("/api/v1/chat", chatUser, ChatRequest{Prompt: "again", ConversationID: "conv_owned"}); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d for the owner, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+// TestChatResponsePromptTooLong tests rejection of prompts that exceed the context window
+func TestChatResponsePromptTooLong(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	config := adminConfig()
+	router := setupRouter(config)
+
+	longPrompt := strings.Repeat("a", 4*2048)
+	req := httptest.NewRequest("POST", "/api/v1/chat", chatBody(t, ChatRequest{Prompt: longPrompt}))
+	authorizeChat(req)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+// TestChatResponseUpstreamUnavailable tests the error returned when the AI service is down
+func TestChatResponseUpstreamUnavailable(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.AI.Endpoint = upstream.URL
+	router := setupRouter(config)
+
+	req := httptest.NewRequest("POST", "/api/v1/chat", chatBody(t, ChatRequest{Prompt: "hello", ConversationID: "conv_failed"}))
+	authorizeChat(req)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	// The unanswered prompt is not stored
+	history := &model.ChatHistory{ConversationId: "conv_failed"}
+	if err := history.GetChatHistory(); !errors.Is(err, model.ErrChatHistoryNotFound) {
+		t.Errorf("Expected no history after a failed generation, got %v, %v", err, history.Messages)
+	}
+}
+
+// TestChatResponseUpstreamRejected tests that a request the AI service rejects
+// is neither failed over nor reported as an outage
+func TestChatResponseUpstreamRejected(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	var calls int32
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+	defer upstreamServer.Close()
+
+	config := adminConfig()
+	config.AI.Endpoints = []upstream.Endpoint{{URL: upstreamServer.URL, Weight: 1}, {URL: upstreamServer.URL, Weight: 1}}
+	router := setupRouter(config)
+
+	req := httptest.NewRequest("POST", "/api/v1/chat", chatBody(t, ChatRequest{Prompt: "hello"}))
+	authorizeChat(req)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Expected a single upstream call, got %d", got)
+	}
+}
+
+// TestChatResponseGenerationParams tests presets and per-request overrides
+func TestChatResponseGenerationParams(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	upstream := newEchoUpstream()
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.AI.Endpoint = upstream.URL + "/api/v1/generate"
+	router := setupRouter(config)
+
+	body := `{"prompt":"hello","preset":"clinical","params":{"temperature":0.3,"max_length":64}}`
+	req := httptest.NewRequest("POST", "/api/v1/chat", strings.NewReader(body))
+	authorizeChat(req)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	requests := upstream.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 upstream request, got %d", len(requests))
+	}
+
+	expected := provider.DefaultPresets()["clinical"]
+	got := requests[0]
+	if got.Temperature != 0.3 || got.MaxLength != 64 {
+		t.Errorf("Overrides not applied: temperature=%v max_length=%d", got.Temperature, got.MaxLength)
+	}
+	if got.TopK != expected.TopK || got.TopP != expected.TopP || got.RepPen != expected.RepPen {
+		t.Errorf("Preset not applied: %+v", got)
+	}
+}
+
+// TestChatResponseInvalidParams tests structured errors for invalid parameters
+func TestChatResponseInvalidParams(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	upstream := newEchoUpstream()
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.AI.Endpoint = upstream.URL + "/api/v1/generate"
+	router := setupRouter(config)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantError  string
+		wantFields []string
+	}{
+		{
+			name:       "Out of range values",
+			body:       `{"prompt":"hello","params":{"temperature":9,"top_p":-0.5}}`,
+			wantError:  "Invalid generation parameters",
+			wantFields: []string{"temperature", "top_p"},
+		},
+		{
+			name:       "Unknown preset",
+			body:       `{"prompt":"hello","preset":"reckless"}`,
+			wantError:  "Invalid generation parameters",
+			wantFields: []string{"preset"},
+		},
+		{
+			name:       "Missing prompt",
+			body:       `{"preset":"precise"}`,
+			wantError:  "Invalid chat request",
+			wantFields: []string{"prompt"},
+		},
+		{
+			name:       "Oversized conversation ID",
+			body:       `{"prompt":"hello","conversation_id":"` + strings.Repeat("c", 129) + `"}`,
+			wantError:  "Invalid chat request",
+			wantFields: []string{"conversation_id"},
+		},
+		{
+			name:      "Malformed body",
+			body:      `{"params":`,
+			wantError: "Invalid request body",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/v1/chat", strings.NewReader(tt.body))
+			authorizeChat(req)
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+
+			var response struct {
+				Success bool                     `json:"success"`
+				Data    provider.ValidationError `json:"data"`
+				Error   string                   `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+
+			if response.Success || response.Error != tt.wantError {
+				t.Errorf("Unexpected response: %s", w.Body.String())
+			}
+			if len(response.Data.Errors) != len(tt.wantFields) {
+				t.Fatalf("Expected %d field errors, got %+v", len(tt.wantFields), response.Data.Errors)
+			}
+			for i, field := range tt.wantFields {
+				if response.Data.Errors[i].Field != field || response.Data.Errors[i].Message == "" {
+					t.Errorf("Unexpected field error: %+v", response.Data.Errors[i])
+				}
+			}
+		})
+	}
+
+	if n := len(upstream.Requests()); n != 0 {
+		t.Errorf("Expected no upstream requests, got %d", n)
+	}
+}
+
+// TestChatResponseRetriesFlakyUpstream tests that transient upstream failures are retried
+func TestChatResponseRetriesFlakyUpstream(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	var calls int32
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"results":[{"text":"recovered"}]}`))
+	}))
+	defer upstreamServer.Close()
+
+	config := adminConfig()
+	config.AI.Endpoint = upstreamServer.URL
+	config.AI.Upstream.BaseDelay = time.Millisecond
+	router := setupRouter(config)
+
+	req := httptest.NewRequest("POST", "/api/v1/chat", chatBody(t, ChatRequest{Prompt: "hello"}))
+	authorizeChat(req)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("Expected 2 upstream calls, got %d", got)
+	}
+}
+
+// TestChatResponseCircuitOpen tests the fast 503 and health report once the breaker opens
+func TestChatResponseCircuitOpen(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	var calls int32
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstreamServer.Close()
+
+	config := adminConfig()
+	config.AI.Endpoint = upstreamServer.URL
+	config.AI.Upstream.MaxRetries = 0
+	config.AI.Upstream.FailureThreshold = 2
+	config.AI.Upstream.Cooldown = time.Hour
+	router := setupRouter(config)
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/chat", chatBody(t, ChatRequest{Prompt: "hello"}))
+		authorizeChat(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := send(); w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Call %d: expected status %d, got %d", i+1, http.StatusServiceUnavailable, w.Code)
+		}
+	}
+
+	w := send()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	var response Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if !strings.Contains(response.Error, "temporarily unavailable") {
+		t.Errorf("Expected circuit breaker error, got %q", response.Error)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("Expected the open breaker to skip the upstream, got %d calls", got)
+	}
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	health := decodeHealth(t, w)
+	if health.Status != "degraded" || health.Upstream.Endpoints[0].Breaker.State != upstream.StateOpen {
+		t.Errorf("Expected degraded health with an open breaker, got %+v", health)
+	}
+	if health.Upstream.Endpoints[0].Breaker.RetryAt == nil {
+		t.Error("Expected retry_at to be reported")
+	}
+}
+
+// TestChatResponseLoadBalancing tests spreading requests by weight and failing over
+func TestChatResponseLoadBalancing(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	var downCalls int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downCalls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	first := newEchoUpstream()
+	defer first.Close()
+	second := newEchoUpstream()
+	defer second.Close()
+
+	config := adminConfig()
+	config.AI.Endpoints = []upstream.Endpoint{
+		{URL: first.URL + "/api/v1/generate", Weight: 2},
+		{URL: second.URL + "/api/v1/generate", Weight: 1},
+		{URL: down.URL + "/api/v1/generate", Weight: 1},
+	}
+	config.AI.Upstream.FailureThreshold = 1
+	config.AI.Upstream.Cooldown = time.Hour
+	router := setupRouter(config)
+
+	for i := 0; i < 8; i++ {
+		req := httptest.NewRequest("POST", "/api/v1/chat", chatBody(t, ChatRequest{Prompt: "hello"}))
+		authorizeChat(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected status %d, got %d", i+1, http.StatusOK, w.Code)
+		}
+	}
+
+	// The failing endpoint is tried once, then its breaker takes it out of rotation
+	if got := atomic.LoadInt32(&downCalls); got != 1 {
+		t.Errorf("Expected 1 call to the failing endpoint, got %d", got)
+	}
+	if a, b := len(first.Requests()), len(second.Requests()); a+b != 8 || a <= b {
+		t.Errorf("Expected requests spread 2:1 across healthy endpoints, got %d and %d", a, b)
+	}
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	health := decodeHealth(t, w)
+	if health.Status != "degraded" || len(health.Upstream.Endpoints) != 3 {
+		t.Fatalf("Expected degraded health with 3 endpoints, got %+v", health)
+	}
+	if health.Upstream.Endpoints[2].Breaker.State != upstream.StateOpen {
+		t.Errorf("Expected the failing endpoint's breaker to be open, got %+v", health.Upstream.Endpoints[2])
+	}
+}
+
 // TestChatResponseEmptyParameter tests chat endpoint with empty parameter
 func TestChatResponseEmptyParameter(t *testing.T) {
-	config := DefaultConfig()
+	config := adminConfig()
 	router := setupRouter(config)
 
-	req := httptest.NewRequest("POST", "/api/v1/chat?response=", nil)
+	req := httptest.NewRequest("POST", "/api/v1/chat", strings.NewReader(`{"prompt":""}`))
+	authorizeChat(req)
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
@@ -140,11 +820,12 @@ func TestChatResponseEmptyParameter(t *testing.T) {
 
 // TestLegacyChatEndpoint tests the legacy /chat endpoint
 func TestLegacyChatEndpoint(t *testing.T) {
-	config := DefaultConfig()
+	config := adminConfig()
 	router := setupRouter(config)
 
 	// Should work the same as /api/v1/chat
 	req := httptest.NewRequest("POST", "/chat", nil)
+	authorizeChat(req)
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
@@ -155,6 +836,56 @@ func TestLegacyChatEndpoint(t *testing.T) {
 	}
 }
 
+// TestLegacyChatQueryParameters tests the query-string form on the legacy route
+func TestLegacyChatQueryParameters(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	upstream := newEchoUpstream()
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.AI.Endpoint = upstream.URL + "/api/v1/generate"
+	router := setupRouter(config)
+
+	req := httptest.NewRequest("POST", "/chat?response=hello&conversation_id=conv_legacy", strings.NewReader(`{"params":{"temperature":0.8}}`))
+	authorizeChat(req)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var response struct {
+		Data ChatData `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Data.ConversationID != "conv_legacy" || response.Data.Results[0].Text != "echo: hello" {
+		t.Errorf("Unexpected response data: %+v", response.Data)
+	}
+
+	requests := upstream.Requests()
+	if len(requests) != 1 || requests[0].Temperature != 0.8 {
+		t.Errorf("Expected body params to apply on the legacy route, got %+v", requests)
+	}
+
+	// The versioned route no longer reads the prompt from the query string
+	req = httptest.NewRequest("POST", "/api/v1/chat?response=hello", nil)
+	authorizeChat(req)
+	w = httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for query prompt on /api/v1/chat, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
 // TestResponseStructure tests the Response struct marshaling
 func TestResponseStructure(t *testing.T) {
 	tests := []struct {
@@ -248,3 +979,224 @@ func TestRequestStructure(t *testing.T) {
 		t.Errorf("MaxLength mismatch: got %v, want %v", unmarshaled.MaxLength, req.MaxLength)
 	}
 }
+
+// blockingUpstream is a stand-in KoboldAI server that holds every reply until
+// released. Streams send their first token before blocking.
+type blockingUpstream struct {
+	*httptest.Server
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+// newBlockingUpstream starts a blockingUpstream
+func newBlockingUpstream() *blockingUpstream {
+	u := &blockingUpstream{
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/extra/generate/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: {\"token\":\"Hello\"}\n\n")
+			w.(http.Flusher).Flush()
+			u.started <- struct{}{}
+			<-u.release
+			fmt.Fprint(w, "data: {\"token\":\" again\"}\n\n")
+			return
+		}
+		u.started <- struct{}{}
+		<-u.release
+		w.Write([]byte(`{"results":[{"text":"done"}]}`))
+	}))
+	return u
+}
+
+// Release lets every held reply through
+func (u *blockingUpstream) Release() {
+	u.once.Do(func() { close(u.release) })
+}
+
+// waitStarted waits until the upstream holds a request
+func (u *blockingUpstream) waitStarted(t *testing.T) {
+	t.Helper()
+	select {
+	case <-u.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the request to reach the upstream")
+	}
+}
+
+// runTestServer runs the service on a local port until stop is called.
+// The error returned by run is sent on done.
+func runTestServer(t *testing.T, config Config) (addr string, stop context.CancelFunc, done <-chan error) {
+	t.Helper()
+	srv, err := newServer(config)
+	if err != nil {
+		t.Fatalf("newServer() unexpected error: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.run(ctx, ln)
+	}()
+	return ln.Addr().String(), cancel, errc
+}
+
+// waitRefused waits until addr stops accepting connections
+func waitRefused(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected the server to stop accepting connections")
+}
+
+// assertDatabasesUnlocked checks that no LevelDB lock is held on the service databases
+func assertDatabasesUnlocked(t *testing.T) {
+	t.Helper()
+	l := database.CurrentLayout()
+	for _, dir := range []string{
+		filepath.Join(l.BaseDir, l.ShardGroup, l.DefaultShard),
+		filepath.Join(l.BaseDir, l.HistoryDir),
+	} {
+		db, err := leveldb.OpenFile(dir, nil)
+		if err != nil {
+			t.Errorf("Expected %s to be unlocked after shutdown: %v", dir, err)
+			continue
+		}
+		db.Close()
+	}
+}
+
+// TestGracefulShutdown tests that in-flight requests, including streams, finish after a shutdown signal
+func TestGracefulShutdown(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream bool
+		want   []string
+	}{
+		{name: "generate", want: []string{`"text":"done"`}},
+		{name: "stream", stream: true, want: []string{"Hello", " again", "event:done"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleanup := setupTestStorage(t)
+			defer cleanup()
+
+			up := newBlockingUpstream()
+			defer up.Close()
+			defer up.Release()
+
+			config := adminConfig()
+			config.AI.Endpoint = up.URL + "/api/v1/generate"
+			config.AI.HealthInterval = 0
+			config.Server.ShutdownTimeout = 5 * time.Second
+
+			addr, stop, done := runTestServer(t, config)
+			defer stop()
+
+			type result struct {
+				status int
+				body   string
+				err    error
+			}
+			results := make(chan result, 1)
+			go func() {
+				body := chatBody(t, ChatRequest{Prompt: "hi", Stream: tt.stream})
+				req, _ := http.NewRequest("POST", "http://"+addr+"/api/v1/chat", body)
+				resp, err := http.DefaultClient.Do(authorizeChat(req))
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				data, err := io.ReadAll(resp.Body)
+				results <- result{status: resp.StatusCode, body: string(data), err: err}
+			}()
+
+			up.waitStarted(t)
+			stop()
+			waitRefused(t, addr)
+			up.Release()
+
+			res := <-results
+			if res.err != nil || res.status != http.StatusOK {
+				t.Fatalf("Expected the in-flight request to complete, got %d, %v", res.status, res.err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(res.body, want) {
+					t.Errorf("Expected %q in response %s", want, res.body)
+				}
+			}
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("run() unexpected error: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected run() to return after draining")
+			}
+
+			assertDatabasesUnlocked(t)
+		})
+	}
+}
+
+// TestShutdownDeadline tests that requests still running after the shutdown timeout are cut off
+func TestShutdownDeadline(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	up := newBlockingUpstream()
+	defer up.Close()
+	defer up.Release()
+
+	config := adminConfig()
+	config.AI.Endpoint = up.URL + "/api/v1/generate"
+	config.AI.HealthInterval = 0
+	config.Server.ShutdownTimeout = 100 * time.Millisecond
+
+	addr, stop, done := runTestServer(t, config)
+	defer stop()
+
+	requestErr := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("POST", "http://"+addr+"/api/v1/chat", chatBody(t, ChatRequest{Prompt: "hi"}))
+		resp, err := http.DefaultClient.Do(authorizeChat(req))
+		if err == nil {
+			resp.Body.Close()
+		}
+		requestErr <- err
+	}()
+
+	up.waitStarted(t)
+	stop()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("run() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected run() to give up after the shutdown timeout")
+	}
+
+	if err := <-requestErr; err == nil {
+		t.Error("Expected the held request to be cut off")
+	}
+	assertDatabasesUnlocked(t)
+}
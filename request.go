@@ -0,0 +1,150 @@
+// Package main provides request binding and validation for the chat endpoints.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/TeamPentagon/DM-Backend/internal/provider"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// maxChatBodyBytes limits the size of a chat request body
+const maxChatBodyBytes = 1 << 20
+
+// errMissingQueryPrompt is returned when the legacy route has no 'response' query parameter
+var errMissingQueryPrompt = errors.New("missing 'response' query parameter")
+
+// ChatRequest is the JSON body accepted by POST /api/v1/chat
+type ChatRequest struct {
+	Prompt         string            `json:"prompt" binding:"required,max=65536"`
+	ConversationID string            `json:"conversation_id" binding:"omitempty,max=128"`
+	Preset         string            `json:"preset" binding:"omitempty,max=64"`
+	Params         provider.Params   `json:"params"`
+	Metadata       map[string]string `json:"metadata" binding:"omitempty,max=16,dive,keys,max=64,endkeys,max=1024"`
+	Stream         bool              `json:"stream"`
+}
+
+// chatBinder reads a ChatRequest from an incoming request
+type chatBinder func(c *gin.Context) (ChatRequest, error)
+
+func init() {
+	// Report validation errors with JSON field names rather than Go field names
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(jsonFieldName)
+	}
+}
+
+// jsonFieldName returns the JSON name of a struct field
+func jsonFieldName(field reflect.StructField) string {
+	name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// bindChatRequest reads and validates the JSON body of a chat request
+func bindChatRequest(c *gin.Context) (ChatRequest, error) {
+	var req ChatRequest
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxChatBodyBytes)
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return ChatRequest{}, err
+	}
+	return req, nil
+}
+
+// bindLegacyChatRequest reads a chat request from the query string used by the
+// legacy /chat route. An optional JSON body may still carry the preset and params.
+func bindLegacyChatRequest(c *gin.Context) (ChatRequest, error) {
+	var req ChatRequest
+	if c.Request.ContentLength != 0 {
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, maxChatBodyBytes)
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			return ChatRequest{}, err
+		}
+	}
+
+	prompt, exists := c.GetQuery("response")
+	if !exists || prompt == "" {
+		return ChatRequest{}, errMissingQueryPrompt
+	}
+
+	req.Prompt = prompt
+	req.ConversationID = c.Query("conversation_id")
+
+	if err := binding.Validator.ValidateStruct(&req); err != nil {
+		return ChatRequest{}, err
+	}
+	return req, nil
+}
+
+// respondBindError writes the 400 response for a request that could not be bound
+func respondBindError(c *gin.Context, err error) {
+	if errors.Is(err, errMissingQueryPrompt) {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "Missing 'response' query parameter",
+		})
+		return
+	}
+
+	respondInvalidBody(c, err, "chat request")
+}
+
+// respondInvalidBody writes the 400 response for a request body that could
+// not be bound, listing the failed fields of a validation error
+func respondInvalidBody(c *gin.Context, err error, what string) {
+	var invalid validator.ValidationErrors
+	if errors.As(err, &invalid) {
+		fields := make([]provider.FieldError, len(invalid))
+		for i, fe := range invalid {
+			_, field, _ := strings.Cut(fe.Namespace(), ".")
+			fields[i] = provider.FieldError{
+				Field:   field,
+				Message: describeValidation(fe),
+			}
+		}
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Data:    provider.ValidationError{Errors: fields},
+			Error:   "Invalid " + what,
+		})
+		return
+	}
+
+	c.JSON(http.StatusBadRequest, Response{
+		Success: false,
+		Error:   "Invalid request body",
+	})
+}
+
+// describeValidation turns a failed validation rule into a readable message
+func describeValidation(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "max":
+		if fe.Kind() == reflect.Map {
+			return fmt.Sprintf("must have at most %s entries", fe.Param())
+		}
+		return fmt.Sprintf("must be at most %s characters", fe.Param())
+	case "min":
+		return fmt.Sprintf("must be at least %s characters", fe.Param())
+	case "email":
+		return "must be an email address"
+	case "url":
+		return "must be a URL"
+	default:
+		return fmt.Sprintf("failed the '%s' check", fe.Tag())
+	}
+}
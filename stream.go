@@ -0,0 +1,147 @@
+// Package main provides server-sent event streaming for the chat endpoint.
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+	"github.com/TeamPentagon/DM-Backend/internal/provider"
+	"github.com/gin-gonic/gin"
+)
+
+// streamEvent is a single token relayed to the client
+type streamEvent struct {
+	Token string `json:"token"`
+}
+
+// streamSummary is sent as the final "done" event of a streamed reply
+type streamSummary struct {
+	Text           string            `json:"text"`
+	Tokens         int               `json:"tokens"`
+	DurationMs     int64             `json:"duration_ms"`
+	ConversationID string            `json:"conversation_id"`
+	MessageID      string            `json:"message_id"`
+	ReplyID        string            `json:"reply_id"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+}
+
+// wantsStream reports whether the client asked for a server-sent event stream,
+// either with an "Accept: text/event-stream" header or a "stream" query flag.
+func wantsStream(c *gin.Context) bool {
+	if strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		return true
+	}
+
+	switch strings.ToLower(c.Query("stream")) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// streamChat relays tokens from the AI provider to the client as server-sent
+// events. ctx must be derived from the client request context, so a client
+// disconnect cancels generation upstream. Only a completed reply is stored,
+// together with userMsg, and metadata is echoed in the final summary.
+func streamChat(ctx context.Context, c *gin.Context, ai provider.Provider, data Request, userMsg *model.Message, metadata map[string]string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tokens := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(tokens)
+		_, err := ai.Stream(ctx, data, func(token string) error {
+			select {
+			case tokens <- token:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		errc <- err
+	}()
+
+	var streamErr error
+	finished := false
+	wait := func() error {
+		if !finished {
+			streamErr = <-errc
+			finished = true
+		}
+		return streamErr
+	}
+
+	// Wait for the first token so upstream failures can still be reported
+	// as a regular JSON error before any event is written.
+	first, pending := <-tokens
+	if !pending {
+		if err := wait(); err != nil {
+			log.Printf("Error calling AI stream service (%s): %v", ai.Name(), err)
+			respondUpstreamError(c, err)
+			return
+		}
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	start := time.Now()
+	var text strings.Builder
+	count := 0
+
+	clientGone := c.Stream(func(w io.Writer) bool {
+		token, ok := first, pending
+		if pending {
+			pending = false
+		} else {
+			token, ok = <-tokens
+		}
+
+		if ok {
+			text.WriteString(token)
+			count++
+			c.SSEvent("token", streamEvent{Token: token})
+			return true
+		}
+
+		if err := wait(); err != nil {
+			if c.Request.Context().Err() != nil {
+				return false
+			}
+			log.Printf("Error reading AI stream: %v", err)
+			c.SSEvent("error", Response{Success: false, Error: "AI stream interrupted"})
+			return false
+		}
+
+		reply, err := recordTurn(userMsg, ai.Name(), text.String())
+		if err != nil {
+			log.Printf("Error saving AI reply: %v", err)
+			c.SSEvent("error", Response{Success: false, Error: "Failed to save message"})
+			return false
+		}
+
+		c.SSEvent("done", streamSummary{
+			Text:           text.String(),
+			Tokens:         count,
+			DurationMs:     time.Since(start).Milliseconds(),
+			ConversationID: userMsg.GetConversationId(),
+			MessageID:      userMsg.GetMsgId(),
+			ReplyID:        reply.GetMsgId(),
+			Metadata:       metadata,
+		})
+		return false
+	})
+
+	if clientGone || c.Request.Context().Err() != nil {
+		log.Printf("Client disconnected after %d streamed tokens, cancelling upstream", count)
+		return
+	}
+
+	log.Printf("AI stream completed, tokens: %d, length: %d", count, text.Len())
+}
@@ -0,0 +1,306 @@
+// Package main provides tests for chat response streaming.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+	"github.com/gin-gonic/gin"
+)
+
+// sseEvent is a parsed server-sent event received by the test client
+type sseEvent struct {
+	Name string
+	Data string
+}
+
+// newStreamingUpstream returns a stand-in generator that streams the given
+// tokens as KoboldAI-style server-sent events.
+func newStreamingUpstream(t *testing.T, tokens []string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/extra/generate/stream" {
+			t.Errorf("Unexpected upstream path %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		for _, token := range tokens {
+			data, _ := json.Marshal(streamEvent{Token: token})
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}))
+}
+
+// newTestContext creates a gin context for the given request
+func newTestContext(method, target string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, target, nil)
+	return c, w
+}
+
+// readSSE reads events from a server-sent event stream until EOF
+func readSSE(t *testing.T, scanner *bufio.Scanner, limit int) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if current.Name != "" || current.Data != "" {
+				events = append(events, current)
+				current = sseEvent{}
+				if limit > 0 && len(events) >= limit {
+					return events
+				}
+			}
+		case strings.HasPrefix(line, "event:"):
+			current.Name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			current.Data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	return events
+}
+
+// TestWantsStream tests streaming opt-in detection
+func TestWantsStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		accept string
+		want   bool
+	}{
+		{"No opt-in", "/api/v1/chat", "", false},
+		{"Accept header", "/api/v1/chat", "text/event-stream", true},
+		{"Query flag true", "/api/v1/chat?stream=true", "", true},
+		{"Query flag one", "/api/v1/chat?stream=1", "", true},
+		{"Query flag false", "/api/v1/chat?stream=false", "", false},
+		{"JSON accept", "/api/v1/chat", "application/json", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestContext("POST", tt.target)
+			if tt.accept != "" {
+				c.Request.Header.Set("Accept", tt.accept)
+			}
+
+			if got := wantsStream(c); got != tt.want {
+				t.Errorf("wantsStream() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestChatStreaming tests relaying tokens from the upstream generator
+func TestChatStreaming(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	tokens := []string{"Hello", ", ", "world"}
+	upstream := newStreamingUpstream(t, tokens)
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.AI.Endpoint = upstream.URL + "/api/v1/generate"
+
+	server := httptest.NewServer(setupRouter(config))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/v1/chat", strings.NewReader(`{"prompt":"hi","metadata":{"client":"web"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(authorizeChat(req))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("Expected event-stream content type, got %s", ct)
+	}
+
+	events := readSSE(t, bufio.NewScanner(resp.Body), 0)
+	if len(events) != len(tokens)+1 {
+		t.Fatalf("Expected %d events, got %d: %v", len(tokens)+1, len(events), events)
+	}
+
+	for i, token := range tokens {
+		var ev streamEvent
+		if err := json.Unmarshal([]byte(events[i].Data), &ev); err != nil {
+			t.Fatalf("Failed to parse token event: %v", err)
+		}
+		if events[i].Name != "token" || ev.Token != token {
+			t.Errorf("Event %d: expected token %q, got %s %q", i, token, events[i].Name, ev.Token)
+		}
+	}
+
+	last := events[len(events)-1]
+	if last.Name != "done" {
+		t.Fatalf("Expected final 'done' event, got %s", last.Name)
+	}
+
+	var summary streamSummary
+	if err := json.Unmarshal([]byte(last.Data), &summary); err != nil {
+		t.Fatalf("Failed to parse summary: %v", err)
+	}
+	if summary.Text != "Hello, world" {
+		t.Errorf("Expected summary text 'Hello, world', got %q", summary.Text)
+	}
+	if summary.Tokens != len(tokens) {
+		t.Errorf("Expected %d tokens, got %d", len(tokens), summary.Tokens)
+	}
+	if summary.ConversationID == "" || summary.MessageID == "" || summary.ReplyID == "" {
+		t.Errorf("Expected conversation and message IDs in summary, got %+v", summary)
+	}
+	if summary.Metadata["client"] != "web" {
+		t.Errorf("Expected metadata in summary, got %v", summary.Metadata)
+	}
+
+	history := &model.ChatHistory{ConversationId: summary.ConversationID}
+	if err := history.GetChatHistory(); err != nil {
+		t.Fatalf("GetChatHistory() returned an error: %v", err)
+	}
+	if len(history.Messages) != 2 || history.Messages[1].GetContent() != "Hello, world" {
+		t.Errorf("Expected prompt and streamed reply to be stored, got %v", history.Messages)
+	}
+}
+
+// TestChatStreamingOptIn tests opting in to streaming with a body or query flag
+func TestChatStreamingOptIn(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	upstream := newStreamingUpstream(t, []string{"ok"})
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.AI.StreamEndpoint = upstream.URL + "/api/extra/generate/stream"
+
+	server := httptest.NewServer(setupRouter(config))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+	}{
+		{"Body flag", "/api/v1/chat", `{"prompt":"hi","stream":true}`},
+		{"Legacy query flag", "/chat?response=hi&stream=true", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", server.URL+tt.target, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(authorizeChat(req))
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			events := readSSE(t, bufio.NewScanner(resp.Body), 0)
+			if len(events) != 2 || events[1].Name != "done" {
+				t.Errorf("Expected a token and a done event, got %v", events)
+			}
+		})
+	}
+}
+
+// TestChatStreamingUpstreamUnavailable tests the error before streaming starts
+func TestChatStreamingUpstreamUnavailable(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.AI.StreamEndpoint = upstream.URL + "/api/extra/generate/stream"
+
+	server := httptest.NewServer(setupRouter(config))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/v1/chat", strings.NewReader(`{"prompt":"hi","conversation_id":"conv_failed"}`))
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(authorizeChat(req))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	history := &model.ChatHistory{ConversationId: "conv_failed"}
+	if err := history.GetChatHistory(); !errors.Is(err, model.ErrChatHistoryNotFound) {
+		t.Errorf("Expected no history after a failed stream, got %v, %v", err, history.Messages)
+	}
+}
+
+// TestChatStreamingClientDisconnect tests that a client disconnect cancels the upstream request
+func TestChatStreamingClientDisconnect(t *testing.T) {
+	cleanup := setupTestStorage(t)
+	defer cleanup()
+
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"token\":\"first\"}\n\n")
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.AI.StreamEndpoint = upstream.URL + "/api/extra/generate/stream"
+
+	server := httptest.NewServer(setupRouter(config))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/v1/chat", strings.NewReader(`{"prompt":"hi"}`))
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(authorizeChat(req))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	events := readSSE(t, bufio.NewScanner(resp.Body), 1)
+	if len(events) != 1 || events[0].Name != "token" {
+		t.Fatalf("Expected first token event, got %v", events)
+	}
+
+	// Disconnect mid-stream
+	resp.Body.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected upstream request to be cancelled after client disconnect")
+	}
+}
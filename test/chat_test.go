@@ -2,11 +2,15 @@
 package test
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/TeamPentagon/DM-Backend/internal/database"
 	"github.com/TeamPentagon/DM-Backend/internal/model"
 )
 
@@ -22,6 +26,7 @@ func setupChatTestEnvironment(t *testing.T) func() {
 	os.Chdir(testDir)
 
 	return func() {
+		database.CloseAll()
 		os.Chdir(originalDir)
 		os.RemoveAll(testDir)
 	}
@@ -321,3 +326,120 @@ func TestMultipleConversations(t *testing.T) {
 		}
 	}
 }
+
+// TestNewMessageID tests message and conversation ID generation
+func TestNewMessageID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := model.NewMessageID()
+		if !strings.HasPrefix(id, "msg_") {
+			t.Errorf("Expected message ID with 'msg_' prefix, got %s", id)
+		}
+		if seen[id] {
+			t.Fatalf("Duplicate message ID generated: %s", id)
+		}
+		seen[id] = true
+	}
+
+	if id := model.NewConversationID(); !strings.HasPrefix(id, "conv_") {
+		t.Errorf("Expected conversation ID with 'conv_' prefix, got %s", id)
+	}
+}
+
+// TestConcurrentAddMessageToHistory tests that concurrent additions to one conversation are all kept
+func TestConcurrentAddMessageToHistory(t *testing.T) {
+	cleanup := setupChatTestEnvironment(t)
+	defer cleanup()
+
+	const count = 20
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			history := &model.ChatHistory{ConversationId: "conv_concurrent"}
+			msg := &model.Message{MsgId: fmt.Sprintf("msg_concurrent_%02d", i), ConversationId: "conv_concurrent"}
+			if err := history.AddMessageToHistory(msg); err != nil {
+				t.Errorf("AddMessageToHistory() returned an error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	history := &model.ChatHistory{ConversationId: "conv_concurrent"}
+	if err := history.GetChatHistory(); err != nil {
+		t.Fatalf("GetChatHistory() returned an error: %v", err)
+	}
+	if len(history.Messages) != count {
+		t.Errorf("Expected %d messages, got %d", count, len(history.Messages))
+	}
+}
+
+// TestInjectedStore tests chat persistence through a store over a separate layout
+func TestInjectedStore(t *testing.T) {
+	cleanup := setupChatTestEnvironment(t)
+	defer cleanup()
+
+	layout := database.DefaultLayout()
+	layout.BaseDir = t.TempDir()
+	db := database.NewStore(layout)
+	defer db.Close()
+	store := model.NewStore(db)
+
+	msg := createTestMessage()
+	if err := store.SaveMessage(msg); err != nil {
+		t.Fatalf("SaveMessage() returned an error: %v", err)
+	}
+
+	history := &model.ChatHistory{ConversationId: msg.ConversationId}
+	if err := store.AddMessageToHistory(history, msg); err != nil {
+		t.Fatalf("AddMessageToHistory() returned an error: %v", err)
+	}
+
+	loaded := &model.ChatHistory{ConversationId: msg.ConversationId}
+	if err := store.GetChatHistory(loaded); err != nil {
+		t.Fatalf("GetChatHistory() returned an error: %v", err)
+	}
+	if len(loaded.Messages) != 1 || loaded.Messages[0].Content != msg.Content {
+		t.Errorf("Unexpected history: %v", loaded.Messages)
+	}
+
+	// The default store does not see the injected store's data
+	if err := (&model.ChatHistory{ConversationId: msg.ConversationId}).GetChatHistory(); err == nil {
+		t.Error("Expected the history to exist only in the injected store")
+	}
+}
+
+// TestMessageRoundTrip tests that a saved message can be read, updated and deleted
+func TestMessageRoundTrip(t *testing.T) {
+	cleanup := setupChatTestEnvironment(t)
+	defer cleanup()
+
+	msg := createTestMessage()
+	if err := msg.SaveMessage(); err != nil {
+		t.Fatalf("SaveMessage() returned an error: %v", err)
+	}
+
+	loaded := &model.Message{MsgId: msg.MsgId}
+	if err := loaded.Get(); err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if loaded.Content != msg.Content {
+		t.Errorf("Expected content '%s', got '%s'", msg.Content, loaded.Content)
+	}
+
+	msg.Content = "Edited"
+	if err := msg.Update(); err != nil {
+		t.Fatalf("Update() returned an error: %v", err)
+	}
+	if err := loaded.Get(); err != nil || loaded.Content != "Edited" {
+		t.Errorf("Get() after Update = '%s', %v, want 'Edited'", loaded.Content, err)
+	}
+
+	if err := msg.Delete(); err != nil {
+		t.Fatalf("Delete() returned an error: %v", err)
+	}
+	if err := loaded.Get(); err == nil {
+		t.Error("Get() should return error after Delete")
+	}
+}
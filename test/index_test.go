@@ -0,0 +1,393 @@
+// Package test provides integration tests for the secondary user indexes.
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// indexEntry returns the key of the index entry of value for the user id
+func indexEntry(k model.Keyspace, value, id string) string {
+	return k.Prefix + value + "\x00" + id
+}
+
+// TestUserIndexes tests the lookups and the unique user names and emails of
+// every backend
+func TestUserIndexes(t *testing.T) {
+	for _, backend := range repositoryBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			users := backend.open(t).Users
+			for _, u := range []*model.User{
+				{PersonId: "p1", UserName: "alice", Email: "alice@example.com", PhoneNumber: "555"},
+				{PersonId: "p2", UserName: "bob", Email: "bob@example.com", PhoneNumber: "555"},
+				// Empty names and emails do not conflict
+				{PersonId: "p3"},
+				{PersonId: "p4"},
+			} {
+				if err := users.SaveUser(u); err != nil {
+					t.Fatalf("SaveUser(%s) returned an error: %v", u.PersonId, err)
+				}
+			}
+
+			found := &model.User{}
+			if err := users.FindUserByName(found, "bob"); err != nil || found.PersonId != "p2" {
+				t.Errorf("FindUserByName() = %q, %v, want p2", found.PersonId, err)
+			}
+			if err := users.FindUserByEmail(found, "alice@example.com"); err != nil || found.PersonId != "p1" {
+				t.Errorf("FindUserByEmail() = %q, %v, want p1", found.PersonId, err)
+			}
+			if err := users.FindUserByEmail(found, "Alice@Example.COM"); err != nil || found.PersonId != "p1" {
+				t.Errorf("FindUserByEmail() in another case = %q, %v, want p1", found.PersonId, err)
+			}
+			if err := users.FindUserByPhone(found, "555"); err != nil || found.PersonId != "p1" {
+				t.Errorf("FindUserByPhone() = %q, %v, want p1", found.PersonId, err)
+			}
+			for name, find := range map[string]func() error{
+				"unknown name":  func() error { return users.FindUserByName(found, "carol") },
+				"unknown email": func() error { return users.FindUserByEmail(found, "carol@example.com") },
+				"unknown phone": func() error { return users.FindUserByPhone(found, "666") },
+				"empty email":   func() error { return users.FindUserByEmail(found, "") },
+				"email prefix":  func() error { return users.FindUserByEmail(found, "alice@example") },
+			} {
+				if err := find(); !errors.Is(err, model.ErrUserNotFound) {
+					t.Errorf("Lookup of an %s error = %v, want %v", name, err, model.ErrUserNotFound)
+				}
+			}
+
+			tests := []struct {
+				name  string
+				write func() error
+			}{
+				{"save a taken name", func() error { return users.SaveUser(&model.User{PersonId: "p5", UserName: "alice"}) }},
+				{"create a taken email", func() error {
+					return users.CreateUser(&model.User{PersonId: "p5", Email: "bob@example.com"})
+				}},
+				{"create a taken email in another case", func() error {
+					return users.CreateUser(&model.User{PersonId: "p5", Email: "BOB@example.com"})
+				}},
+				{"update to a taken email", func() error {
+					return users.UpdateUser(&model.User{UserName: "bob", Email: "alice@example.com"}, "p2")
+				}},
+				{"modify to a taken name", func() error {
+					return users.ModifyUser("p3", func(u *model.User) error {
+						u.UserName = "bob"
+						return nil
+					})
+				}},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					if err := tt.write(); !errors.Is(err, model.ErrDuplicateUser) {
+						t.Errorf("error = %v, want %v", err, model.ErrDuplicateUser)
+					}
+				})
+			}
+			if err := users.GetUser(found, "p3"); err != nil || found.UserName != "" {
+				t.Errorf("Expected a rejected write to change nothing, got %+v, %v", found, err)
+			}
+
+			// A changed email frees the old one for other users
+			if err := users.UpdateUser(&model.User{PersonId: "p1", UserName: "alice", Email: "alice@example.org"}, "p1"); err != nil {
+				t.Fatalf("UpdateUser() returned an error: %v", err)
+			}
+			if err := users.FindUserByEmail(found, "alice@example.com"); !errors.Is(err, model.ErrUserNotFound) {
+				t.Errorf("FindUserByEmail() of the old email error = %v, want %v", err, model.ErrUserNotFound)
+			}
+			// The update left out the phone number
+			if err := users.FindUserByPhone(found, "555"); err != nil || found.PersonId != "p2" {
+				t.Errorf("FindUserByPhone() after update = %q, %v, want p2", found.PersonId, err)
+			}
+			if err := users.SaveUser(&model.User{PersonId: "p5", Email: "alice@example.com"}); err != nil {
+				t.Errorf("SaveUser() with a freed email returned an error: %v", err)
+			}
+
+			// So does a deleted user
+			if err := users.DeleteUser("p2"); err != nil {
+				t.Fatalf("DeleteUser() returned an error: %v", err)
+			}
+			if err := users.FindUserByName(found, "bob"); !errors.Is(err, model.ErrUserNotFound) {
+				t.Errorf("FindUserByName() of a deleted user error = %v, want %v", err, model.ErrUserNotFound)
+			}
+			if err := users.CreateUser(&model.User{PersonId: "p6", UserName: "bob", Email: "bob@example.com"}); err != nil {
+				t.Errorf("CreateUser() with the name of a deleted user returned an error: %v", err)
+			}
+		})
+	}
+}
+
+// TestUserEmailNormalized tests that the email index of the LevelDB and
+// in-memory backends ignores the case and surrounding spaces of an email
+func TestUserEmailNormalized(t *testing.T) {
+	for _, backend := range repositoryBackends {
+		if backend.name == "sqlite" {
+			// SQLite compares emails with COLLATE NOCASE and does not trim them
+			continue
+		}
+		t.Run(backend.name, func(t *testing.T) {
+			users := backend.open(t).Users
+			if err := users.SaveUser(&model.User{PersonId: "p1", Email: " Alice@Example.com "}); err != nil {
+				t.Fatalf("SaveUser() returned an error: %v", err)
+			}
+
+			found := &model.User{}
+			for _, email := range []string{"alice@example.com", "ALICE@EXAMPLE.COM", "  alice@example.com"} {
+				if err := users.FindUserByEmail(found, email); err != nil || found.PersonId != "p1" {
+					t.Errorf("FindUserByEmail(%q) = %q, %v, want p1", email, found.PersonId, err)
+				}
+			}
+			if err := users.CreateUser(&model.User{PersonId: "p2", Email: "alice@example.com"}); !errors.Is(err, model.ErrDuplicateUser) {
+				t.Errorf("CreateUser() with the normalized email error = %v, want %v", err, model.ErrDuplicateUser)
+			}
+			// The user keeps the email as it was written
+			if err := users.GetUser(found, "p1"); err != nil || found.Email != " Alice@Example.com " {
+				t.Errorf("GetUser() email = %q, %v, want %q", found.Email, err, " Alice@Example.com ")
+			}
+		})
+	}
+}
+
+// TestUserIndexLocks tests that user writes and deletes do not deadlock when
+// the key of a user and of one of its unique values share a lock stripe, as
+// user_p1 and the name n1 do, or when concurrent writers claim each other's
+// values
+func TestUserIndexLocks(t *testing.T) {
+	_, store := newShardedStore(t, 2)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := store.SaveUser(&model.User{PersonId: "p1", UserName: "n1"}); err != nil {
+			t.Errorf("SaveUser() returned an error: %v", err)
+		}
+		if err := store.ModifyUser("p1", func(u *model.User) error {
+			u.Email = "n1@example.com"
+			return nil
+		}); err != nil {
+			t.Errorf("ModifyUser() returned an error: %v", err)
+		}
+		if err := store.DeleteUser("p1"); err != nil {
+			t.Errorf("DeleteUser() returned an error: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(3)
+			go func(i int) {
+				defer wg.Done()
+				store.SaveUser(&model.User{PersonId: fmt.Sprintf("p%d", i), UserName: fmt.Sprintf("n%d", (i+1)%20)})
+			}(i)
+			go func(i int) {
+				defer wg.Done()
+				store.ModifyUser(fmt.Sprintf("p%d", (i+1)%20), func(u *model.User) error {
+					u.UserName = fmt.Sprintf("n%d", i)
+					return nil
+				})
+			}(i)
+			go func(i int) {
+				defer wg.Done()
+				store.DeleteUser(fmt.Sprintf("p%d", (i+2)%20))
+			}(i)
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("User writes deadlocked")
+	}
+}
+
+// TestUserIndexEntries tests that index entries are stored in the shard of
+// their user and routed by the fragmentation schema
+func TestUserIndexEntries(t *testing.T) {
+	db, store := newShardedStore(t, 4)
+	schema := database.NewSchema(db)
+
+	user := &model.User{PersonId: "p1", UserName: "alice", Email: "alice@example.com", PhoneNumber: "555"}
+	if err := store.SaveUser(user); err != nil {
+		t.Fatalf("SaveUser() returned an error: %v", err)
+	}
+	shard, err := schema.Get(string(model.UserKeys.Key("p1")))
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	ldb, err := db.ShardNumber(shard)
+	if err != nil {
+		t.Fatalf("ShardNumber() returned an error: %v", err)
+	}
+
+	entries := []string{
+		indexEntry(model.UserNameKeys, "alice", "p1"),
+		indexEntry(model.UserEmailKeys, "alice@example.com", "p1"),
+		indexEntry(model.UserPhoneKeys, "555", "p1"),
+	}
+	for _, key := range entries {
+		if got, err := schema.Get(key); err != nil || got != shard {
+			t.Errorf("Expected %q to be routed to shard %d, got %d, %v", key, shard, got, err)
+		}
+		if _, err := ldb.Get([]byte(key), nil); err != nil {
+			t.Errorf("Expected %q on shard %d: %v", key, shard, err)
+		}
+	}
+
+	// The entries of a removed phone number go with it
+	user.PhoneNumber = ""
+	if err := store.UpdateUser(user, "p1"); err != nil {
+		t.Fatalf("UpdateUser() returned an error: %v", err)
+	}
+	if _, err := ldb.Get([]byte(entries[2]), nil); !errors.Is(err, leveldb.ErrNotFound) {
+		t.Errorf("Expected the phone entry to be deleted, got %v", err)
+	}
+	if ok, err := schema.Exists(entries[2]); err != nil || ok {
+		t.Errorf("Expected the phone entry to be unrouted, got %v, %v", ok, err)
+	}
+
+	if err := store.DeleteUser("p1"); err != nil {
+		t.Fatalf("DeleteUser() returned an error: %v", err)
+	}
+	for _, key := range entries {
+		if _, err := ldb.Get([]byte(key), nil); !errors.Is(err, leveldb.ErrNotFound) {
+			t.Errorf("Expected %q to be deleted with its user, got %v", key, err)
+		}
+		if ok, err := schema.Exists(key); err != nil || ok {
+			t.Errorf("Expected %q to be unrouted with its user, got %v, %v", key, ok, err)
+		}
+	}
+}
+
+// TestRebalanceUserIndexes tests that index entries move with their user or
+// session
+func TestRebalanceUserIndexes(t *testing.T) {
+	db, store := newShardedStore(t, 1)
+	schema := database.NewSchema(db)
+	if err := store.SaveUser(&model.User{PersonId: "p1", UserName: "alice", Email: "alice@example.com"}); err != nil {
+		t.Fatalf("SaveUser() returned an error: %v", err)
+	}
+	if err := store.SaveSession(&model.Session{ID: "sess_1", UserID: "p1"}); err != nil {
+		t.Fatalf("SaveSession() returned an error: %v", err)
+	}
+
+	r := database.NewRebalancer(db)
+	r.SetDependents(model.UserIndexDependents())
+	progress, err := r.Run(context.Background(), database.RebalanceOptions{From: 0, To: 2})
+	if err != nil {
+		t.Fatalf("Run() returned an error: %v", err)
+	}
+	if progress.Moved != 2 {
+		t.Errorf("Moved = %d, want only the user and the session", progress.Moved)
+	}
+
+	for _, key := range []string{
+		string(model.UserKeys.Key("p1")),
+		indexEntry(model.UserNameKeys, "alice", "p1"),
+		indexEntry(model.UserEmailKeys, "alice@example.com", "p1"),
+		string(model.SessionKeys.Key("sess_1")),
+		indexEntry(model.UserSessionKeys, "p1", "sess_1"),
+	} {
+		if shard, err := schema.Get(key); err != nil || shard != 2 {
+			t.Errorf("Expected %q on shard 2, got %d, %v", key, shard, err)
+		}
+	}
+
+	found := &model.User{}
+	if err := store.FindUserByEmail(found, "alice@example.com"); err != nil || found.PersonId != "p1" {
+		t.Errorf("FindUserByEmail() after the move = %q, %v, want p1", found.PersonId, err)
+	}
+	// Writes keep updating the moved entries in one batch
+	if err := store.SaveUser(&model.User{PersonId: "p1", UserName: "alicia"}); err != nil {
+		t.Fatalf("SaveUser() returned an error: %v", err)
+	}
+	if err := store.FindUserByName(found, "alicia"); err != nil || found.PersonId != "p1" {
+		t.Errorf("FindUserByName() = %q, %v, want p1", found.PersonId, err)
+	}
+	if err := store.SaveUser(&model.User{PersonId: "p2", UserName: "alice", Email: "alice@example.com"}); err != nil {
+		t.Errorf("SaveUser() with the freed name and email returned an error: %v", err)
+	}
+	if n, err := store.DeleteUserSessions("p1"); err != nil || n != 1 {
+		t.Errorf("DeleteUserSessions() after the move = %d, %v, want 1", n, err)
+	}
+}
+
+// TestRebuildUserIndexes tests recovering the indexes from the stored users
+func TestRebuildUserIndexes(t *testing.T) {
+	db, store := newShardedStore(t, 2)
+	schema := database.NewSchema(db)
+
+	// Users written without index entries, two of them sharing an email
+	shard0, err := db.ShardNumber(0)
+	if err != nil {
+		t.Fatalf("ShardNumber() returned an error: %v", err)
+	}
+	for _, u := range []*model.User{
+		{PersonId: "p1", UserName: "alice", Email: "shared@example.com", PhoneNumber: "555"},
+		{PersonId: "p2", UserName: "bob", Email: "shared@example.com", PhoneNumber: "555"},
+	} {
+		key := string(model.UserKeys.Key(u.PersonId))
+		putRecord(t, shard0, key, u)
+		if err := schema.Add(0, key); err != nil {
+			t.Fatalf("Add() returned an error: %v", err)
+		}
+	}
+	// An entry left behind for a user that no longer holds the value
+	stale := indexEntry(model.UserNameKeys, "mallory", "p1")
+	if err := shard0.Put([]byte(stale), nil, nil); err != nil {
+		t.Fatalf("Put() returned an error: %v", err)
+	}
+	if err := schema.Add(0, stale); err != nil {
+		t.Fatalf("Add() returned an error: %v", err)
+	}
+
+	found := &model.User{}
+	if err := store.FindUserByName(found, "alice"); !errors.Is(err, model.ErrUserNotFound) {
+		t.Errorf("FindUserByName() before the rebuild error = %v, want %v", err, model.ErrUserNotFound)
+	}
+	if err := store.FindUserByName(found, "mallory"); !errors.Is(err, model.ErrUserNotFound) {
+		t.Errorf("FindUserByName() of a stale entry error = %v, want %v", err, model.ErrUserNotFound)
+	}
+
+	indexed, conflicts, err := store.RebuildUserIndexes()
+	if err != nil {
+		t.Fatalf("RebuildUserIndexes() returned an error: %v", err)
+	}
+	if indexed != 2 || conflicts != 1 {
+		t.Errorf("RebuildUserIndexes() = %d, %d, want 2 users and 1 conflict", indexed, conflicts)
+	}
+
+	if err := store.FindUserByName(found, "bob"); err != nil || found.PersonId != "p2" {
+		t.Errorf("FindUserByName() = %q, %v, want p2", found.PersonId, err)
+	}
+	// The user visited first keeps a shared email
+	if err := store.FindUserByEmail(found, "shared@example.com"); err != nil || found.PersonId != "p1" {
+		t.Errorf("FindUserByEmail() = %q, %v, want p1", found.PersonId, err)
+	}
+	if err := store.FindUserByPhone(found, "555"); err != nil || found.PersonId != "p1" {
+		t.Errorf("FindUserByPhone() = %q, %v, want p1", found.PersonId, err)
+	}
+	if ok, err := schema.Exists(stale); err != nil || ok {
+		t.Errorf("Expected the stale entry to be dropped, got %v, %v", ok, err)
+	}
+	if _, err := shard0.Get([]byte(stale), nil); !errors.Is(err, leveldb.ErrNotFound) {
+		t.Errorf("Expected the stale entry to be deleted, got %v", err)
+	}
+
+	// Running it again gives the same indexes
+	if indexed, conflicts, err := store.RebuildUserIndexes(); err != nil || indexed != 2 || conflicts != 1 {
+		t.Errorf("Second RebuildUserIndexes() = %d, %d, %v", indexed, conflicts, err)
+	}
+	if err := store.SaveUser(&model.User{PersonId: "p3", UserName: "bob"}); !errors.Is(err, model.ErrDuplicateUser) {
+		t.Errorf("SaveUser() with an indexed name error = %v, want %v", err, model.ErrDuplicateUser)
+	}
+	// The user left without the shared email can still be written with it,
+	// as when migrate hashes its password
+	if err := store.UpdateUser(&model.User{PersonId: "p2", UserName: "bob", Email: "shared@example.com", Password: "plaintext"}, "p2"); err != nil {
+		t.Errorf("UpdateUser() keeping a shared email returned an error: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+// Package test provides integration tests for migrating stored records.
+package test
+
+import (
+	"testing"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+	"github.com/syndtr/goleveldb/leveldb"
+	"google.golang.org/protobuf/proto"
+)
+
+// putRecord writes the marshaled record m under key, bypassing the model
+func putRecord(t *testing.T, db *leveldb.DB, key string, m proto.Message) {
+	t.Helper()
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatalf("Failed to marshal %s: %v", key, err)
+	}
+	if err := db.Put([]byte(key), data, nil); err != nil {
+		t.Fatalf("Failed to write %s: %v", key, err)
+	}
+}
+
+// TestMigrate tests moving records left behind by earlier versions
+func TestMigrate(t *testing.T) {
+	layout := database.DefaultLayout()
+	layout.BaseDir = t.TempDir()
+	db := database.NewStore(layout)
+	defer db.Close()
+	store := model.NewStore(db)
+
+	legacy, err := db.History()
+	if err != nil {
+		t.Fatalf("History() returned an error: %v", err)
+	}
+	shard, err := db.DefaultShard()
+	if err != nil {
+		t.Fatalf("DefaultShard() returned an error: %v", err)
+	}
+
+	// A message and a history stranded in the history database
+	stranded := &model.Message{MsgId: "msg_stranded", Content: "stranded", ConversationId: "conv_stranded"}
+	putRecord(t, legacy, "chat_msg_stranded", stranded)
+	putRecord(t, legacy, "history_conv_stranded", &model.ChatHistory{
+		ConversationId: "conv_stranded",
+		Messages:       []*model.Message{stranded},
+	})
+
+	// A stranded message that was saved again since; the canonical copy wins
+	current := &model.Message{MsgId: "msg_both", Content: "current"}
+	if err := store.SaveMessage(current); err != nil {
+		t.Fatalf("SaveMessage() returned an error: %v", err)
+	}
+	putRecord(t, legacy, "chat_msg_both", &model.Message{MsgId: "msg_both", Content: "old"})
+
+	// A user under its bare PersonId, and a record that merely looks unprefixed
+	putRecord(t, shard, "alice", &model.User{PersonId: "alice", UserName: "alice", Email: "alice@example.com"})
+	putRecord(t, shard, "not_a_user", &model.User{PersonId: "someone_else"})
+
+	report, err := store.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate() returned an error: %v", err)
+	}
+	want := model.MigrationReport{Moved: 2, Rekeyed: 1, Assigned: 1, Conflicts: 1}
+	if report != want {
+		t.Errorf("Migrate() report = %+v, want %+v", report, want)
+	}
+
+	msg := &model.Message{MsgId: "msg_stranded"}
+	if err := store.GetMessage(msg); err != nil || msg.Content != "stranded" {
+		t.Errorf("GetMessage() = '%s', %v, want the migrated message", msg.Content, err)
+	}
+	history := &model.ChatHistory{ConversationId: "conv_stranded"}
+	if err := store.GetChatHistory(history); err != nil || len(history.Messages) != 1 {
+		t.Errorf("GetChatHistory() = %v, %v, want the migrated history", history.Messages, err)
+	}
+	both := &model.Message{MsgId: "msg_both"}
+	if err := store.GetMessage(both); err != nil || both.Content != "current" {
+		t.Errorf("GetMessage() = '%s', %v, want the canonical copy", both.Content, err)
+	}
+	user := &model.User{}
+	if err := store.GetUser(user, "alice"); err != nil || user.Email != "alice@example.com" {
+		t.Errorf("GetUser() = %v, %v, want the rekeyed user", user, err)
+	}
+
+	for _, key := range []string{"chat_msg_stranded", "history_conv_stranded"} {
+		if _, err := legacy.Get([]byte(key), nil); err != leveldb.ErrNotFound {
+			t.Errorf("Expected %s to be removed from the history database, got %v", key, err)
+		}
+	}
+	if _, err := shard.Get([]byte("alice"), nil); err != leveldb.ErrNotFound {
+		t.Errorf("Expected the bare user key to be removed, got %v", err)
+	}
+	if _, err := shard.Get([]byte("not_a_user"), nil); err != nil {
+		t.Errorf("Expected unrelated records to be left alone, got %v", err)
+	}
+
+	// Running again only finds the conflict
+	report, err = store.Migrate()
+	if err != nil {
+		t.Fatalf("Second Migrate() returned an error: %v", err)
+	}
+	if report != (model.MigrationReport{Conflicts: 1}) {
+		t.Errorf("Second Migrate() report = %+v, want only the conflict", report)
+	}
+}
@@ -0,0 +1,239 @@
+// Package test provides integration tests for password hashing and verification.
+package test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+)
+
+// TestHashPassword tests the format of password hashes and their verification
+func TestHashPassword(t *testing.T) {
+	hash, err := model.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("HashPassword() returned an error: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Errorf("HashPassword() = %s, want an argon2id hash with the default parameters", hash)
+	}
+	if other, _ := model.HashPassword("secret"); other == hash {
+		t.Errorf("Expected a different salt for every hash")
+	}
+	if !model.IsPasswordHash(hash) {
+		t.Errorf("IsPasswordHash(%s) = false, want true", hash)
+	}
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		wantErr  error
+	}{
+		{"match", hash, "secret", nil},
+		{"wrong password", hash, "Secret", model.ErrWrongPassword},
+		{"empty password", hash, "", model.ErrWrongPassword},
+		{"plaintext", "secret", "secret", model.ErrInvalidPasswordHash},
+		{"other algorithm", "$2a$10$abcdefghijklmnopqrstuu", "secret", model.ErrInvalidPasswordHash},
+		{"other version", strings.Replace(hash, "v=19", "v=16", 1), "secret", model.ErrInvalidPasswordHash},
+		{"bad parameters", strings.Replace(hash, "m=19456", "m=0", 1), "secret", model.ErrInvalidPasswordHash},
+		{"excessive memory", strings.Replace(hash, "m=19456", "m=4294967295", 1), "secret", model.ErrInvalidPasswordHash},
+		{"excessive time", strings.Replace(hash, "t=2", "t=1000000", 1), "secret", model.ErrInvalidPasswordHash},
+		{"excessive threads", strings.Replace(hash, "p=1", "p=255", 1), "secret", model.ErrInvalidPasswordHash},
+		{"missing key", hash[:strings.LastIndex(hash, "$")], "secret", model.ErrInvalidPasswordHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rehash, err := model.CheckPassword(tt.hash, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("CheckPassword() error = %v, want %v", err, tt.wantErr)
+			}
+			if rehash {
+				t.Errorf("CheckPassword() asked for a rehash with the current parameters")
+			}
+		})
+	}
+}
+
+// TestVerifyPassword tests verification and rehashing of stored passwords
+func TestVerifyPassword(t *testing.T) {
+	db, store := newShardedStore(t, 1)
+	model.SetRepositories(&model.Repositories{Users: store, Messages: store, Conversations: store})
+	t.Cleanup(func() { model.SetRepositories(nil) })
+
+	user := createTestUser()
+	if err := user.SaveUserData(); err != nil {
+		t.Fatalf("SaveUserData() returned an error: %v", err)
+	}
+	if err := user.VerifyPassword("wrong"); !errors.Is(err, model.ErrWrongPassword) {
+		t.Errorf("VerifyPassword() of a wrong password error = %v, want %v", err, model.ErrWrongPassword)
+	}
+	if err := user.VerifyPassword("testPassword"); err != nil {
+		t.Errorf("VerifyPassword() returned an error: %v", err)
+	}
+	if err := (&model.User{PersonId: "nopass"}).VerifyPassword(""); !errors.Is(err, model.ErrWrongPassword) {
+		t.Errorf("VerifyPassword() of a user without a password error = %v, want %v", err, model.ErrWrongPassword)
+	}
+
+	// Upgraded parameters rehash the password once it is verified
+	upgraded := model.DefaultPasswordParams
+	upgraded.Time++
+	previous := model.SetPasswordParams(upgraded)
+	t.Cleanup(func() { model.SetPasswordParams(previous) })
+
+	old := user.Password
+	if err := user.VerifyPassword("testPassword"); err != nil {
+		t.Fatalf("VerifyPassword() after the upgrade returned an error: %v", err)
+	}
+	stored := &model.User{}
+	if err := stored.GetUserData(user.PersonId); err != nil {
+		t.Fatalf("GetUserData() returned an error: %v", err)
+	}
+	if stored.Password == old || !strings.Contains(stored.Password, ",t=3,") {
+		t.Errorf("Expected a rehash with the upgraded parameters, got %s", stored.Password)
+	}
+	if rehash, err := model.CheckPassword(stored.Password, "testPassword"); err != nil || rehash {
+		t.Errorf("CheckPassword() of the rehashed password = %v, %v, want false, nil", rehash, err)
+	}
+
+	// A plaintext password left by an earlier version is hashed once verified
+	shard, err := db.DefaultShard()
+	if err != nil {
+		t.Fatalf("DefaultShard() returned an error: %v", err)
+	}
+	putRecord(t, shard, string(model.UserKeys.Key("legacy")), &model.User{PersonId: "legacy", Password: "plain"})
+	legacy := &model.User{}
+	if err := legacy.GetUserData("legacy"); err != nil {
+		t.Fatalf("GetUserData() returned an error: %v", err)
+	}
+	if err := legacy.VerifyPassword("plaine"); !errors.Is(err, model.ErrWrongPassword) {
+		t.Errorf("VerifyPassword() of a wrong password error = %v, want %v", err, model.ErrWrongPassword)
+	}
+	if err := legacy.VerifyPassword("plain"); err != nil {
+		t.Fatalf("VerifyPassword() of a plaintext password returned an error: %v", err)
+	}
+	if err := legacy.GetUserData("legacy"); err != nil || !model.IsPasswordHash(legacy.Password) {
+		t.Errorf("Expected the plaintext password to be hashed, got %q, %v", legacy.Password, err)
+	}
+}
+
+// TestPlaintextNeverStored tests that no backend writes a plaintext password to disk
+func TestPlaintextNeverStored(t *testing.T) {
+	const password = "plaintext-canary"
+
+	t.Run("leveldb", func(t *testing.T) {
+		db, store := newShardedStore(t, 2)
+		for _, id := range []string{"p1", "p2", "p3"} {
+			if err := store.SaveUser(&model.User{PersonId: id, Password: password}); err != nil {
+				t.Fatalf("SaveUser() returned an error: %v", err)
+			}
+		}
+		if err := store.UpdateUser(&model.User{PersonId: "p1", Password: password}, "p1"); err != nil {
+			t.Fatalf("UpdateUser() returned an error: %v", err)
+		}
+
+		for shard := int64(0); shard < 2; shard++ {
+			ldb, err := db.ShardNumber(shard)
+			if err != nil {
+				t.Fatalf("ShardNumber(%d) returned an error: %v", shard, err)
+			}
+			iter := ldb.NewIterator(nil, nil)
+			for iter.Next() {
+				if bytes.Contains(iter.Value(), []byte(password)) {
+					t.Errorf("Found the plaintext password under %s in shard %d", iter.Key(), shard)
+				}
+			}
+			iter.Release()
+		}
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		layout := database.DefaultLayout()
+		layout.BaseDir = t.TempDir()
+		db := database.NewStore(layout)
+		t.Cleanup(func() { db.Close() })
+		users, err := model.OpenSQLiteUsers(db)
+		if err != nil {
+			t.Fatalf("OpenSQLiteUsers() returned an error: %v", err)
+		}
+		if err := users.SaveUser(&model.User{PersonId: "p1", Password: password}); err != nil {
+			t.Fatalf("SaveUser() returned an error: %v", err)
+		}
+		if err := users.UpdateUser(&model.User{PersonId: "p1", Password: password}, "p1"); err != nil {
+			t.Fatalf("UpdateUser() returned an error: %v", err)
+		}
+
+		sqlDB, err := db.SQL(model.SQLiteDatabase)
+		if err != nil {
+			t.Fatalf("SQL() returned an error: %v", err)
+		}
+		var count int
+		if err := sqlDB.QueryRow(`SELECT COUNT(*) FROM users WHERE password LIKE ?`, "%"+password+"%").Scan(&count); err != nil {
+			t.Fatalf("Query returned an error: %v", err)
+		}
+		if count != 0 {
+			t.Errorf("Found the plaintext password in %d rows", count)
+		}
+	})
+}
+
+// TestMigratePasswords tests that the migration hashes plaintext passwords left by earlier versions
+func TestMigratePasswords(t *testing.T) {
+	layout := database.DefaultLayout()
+	layout.BaseDir = t.TempDir()
+	db := database.NewStore(layout)
+	defer db.Close()
+	store := model.NewStore(db)
+
+	shard, err := db.DefaultShard()
+	if err != nil {
+		t.Fatalf("DefaultShard() returned an error: %v", err)
+	}
+	putRecord(t, shard, "user_plain", &model.User{PersonId: "plain", Password: "secret"})
+	putRecord(t, shard, "user_empty", &model.User{PersonId: "empty"})
+	if err := store.SaveUser(&model.User{PersonId: "hashed", Password: "secret"}); err != nil {
+		t.Fatalf("SaveUser() returned an error: %v", err)
+	}
+
+	for run, want := range []int{1, 0} {
+		report, err := store.Migrate()
+		if err != nil {
+			t.Fatalf("Migrate() returned an error: %v", err)
+		}
+		if report.Hashed != want {
+			t.Errorf("Migrate() run %d hashed %d passwords, want %d", run+1, report.Hashed, want)
+		}
+	}
+	user := &model.User{}
+	if err := store.GetUser(user, "plain"); err != nil {
+		t.Fatalf("GetUser() returned an error: %v", err)
+	}
+	if _, err := model.CheckPassword(user.Password, "secret"); err != nil {
+		t.Errorf("CheckPassword() of the migrated password returned an error: %v", err)
+	}
+
+	// Plaintext rows left in SQLite by earlier versions
+	users, err := model.OpenSQLiteUsers(db)
+	if err != nil {
+		t.Fatalf("OpenSQLiteUsers() returned an error: %v", err)
+	}
+	sqlDB, err := db.SQL(model.SQLiteDatabase)
+	if err != nil {
+		t.Fatalf("SQL() returned an error: %v", err)
+	}
+	if _, err := sqlDB.Exec(`INSERT INTO users (person_id, password) VALUES ('plain', 'secret'), ('empty', '')`); err != nil {
+		t.Fatalf("Insert returned an error: %v", err)
+	}
+	if hashed, err := users.HashPasswords(); err != nil || hashed != 1 {
+		t.Errorf("HashPasswords() = %d, %v, want 1", hashed, err)
+	}
+	if err := users.GetUser(user, "plain"); err != nil {
+		t.Fatalf("GetUser() returned an error: %v", err)
+	}
+	if _, err := model.CheckPassword(user.Password, "secret"); err != nil {
+		t.Errorf("CheckPassword() of the migrated password returned an error: %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+// Package test provides conformance tests for the model repositories.
+package test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+)
+
+// repositoryBackends lists every repository implementation; each one must
+// pass the conformance tests
+var repositoryBackends = []struct {
+	name string
+	open func(t *testing.T) *model.Repositories
+}{
+	{
+		name: "leveldb",
+		open: func(t *testing.T) *model.Repositories {
+			_, store := newShardedStore(t, 2)
+			return &model.Repositories{Users: store, Messages: store, Conversations: store, Sessions: store}
+		},
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T) *model.Repositories {
+			layout := database.DefaultLayout()
+			layout.BaseDir = t.TempDir()
+			db := database.NewStore(layout)
+			t.Cleanup(func() { db.Close() })
+			users, err := model.OpenSQLiteUsers(db)
+			if err != nil {
+				t.Fatalf("OpenSQLiteUsers() returned an error: %v", err)
+			}
+			chats, err := model.OpenSQLiteChats(db)
+			if err != nil {
+				t.Fatalf("OpenSQLiteChats() returned an error: %v", err)
+			}
+			// Sessions are always kept in LevelDB
+			store := model.NewStore(db)
+			return &model.Repositories{Users: users, Messages: chats, Conversations: chats, Sessions: store}
+		},
+	},
+	{
+		name: "memory",
+		open: func(t *testing.T) *model.Repositories {
+			return model.NewMemoryRepositories()
+		},
+	},
+}
+
+// TestUserRepository tests the UserRepository contract of every backend
+func TestUserRepository(t *testing.T) {
+	for _, backend := range repositoryBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			users := backend.open(t).Users
+			user := createTestUser()
+			loaded := &model.User{}
+
+			if err := users.SaveUser(&model.User{}); !errors.Is(err, model.ErrInvalidUsername) {
+				t.Errorf("SaveUser() without a PersonId error = %v, want %v", err, model.ErrInvalidUsername)
+			}
+			if err := users.GetUser(loaded, ""); !errors.Is(err, model.ErrInvalidUsername) {
+				t.Errorf("GetUser(\"\") error = %v, want %v", err, model.ErrInvalidUsername)
+			}
+			if err := users.GetUser(loaded, user.PersonId); !errors.Is(err, model.ErrUserNotFound) {
+				t.Errorf("GetUser() of a missing user error = %v, want %v", err, model.ErrUserNotFound)
+			}
+			if err := users.UpdateUser(user, user.PersonId); !errors.Is(err, model.ErrUserNotFound) {
+				t.Errorf("UpdateUser() of a missing user error = %v, want %v", err, model.ErrUserNotFound)
+			}
+			if err := users.DeleteUser(user.PersonId); !errors.Is(err, model.ErrUserNotFound) {
+				t.Errorf("DeleteUser() of a missing user error = %v, want %v", err, model.ErrUserNotFound)
+			}
+
+			if err := users.SaveUser(user); err != nil {
+				t.Fatalf("SaveUser() returned an error: %v", err)
+			}
+			saved := user.String()
+			// Changing the saved record must not change the stored one
+			user.Profile = "changed after save"
+			if err := users.GetUser(loaded, user.PersonId); err != nil {
+				t.Fatalf("GetUser() returned an error: %v", err)
+			}
+			if loaded.String() != saved {
+				t.Errorf("GetUser() = %v, want %v", loaded, saved)
+			}
+
+			// Only the hash of the password is stored
+			password := createTestUser().Password
+			if loaded.Password == password {
+				t.Errorf("GetUser() returned the plaintext password")
+			}
+			if _, err := model.CheckPassword(loaded.Password, password); err != nil {
+				t.Errorf("CheckPassword() of the stored hash returned an error: %v", err)
+			}
+
+			user.Profile = "updated"
+			if err := users.UpdateUser(user, user.PersonId); err != nil {
+				t.Fatalf("UpdateUser() returned an error: %v", err)
+			}
+			if err := users.GetUser(loaded, user.PersonId); err != nil || loaded.Profile != "updated" {
+				t.Errorf("Expected the updated profile, got %q, %v", loaded.Profile, err)
+			}
+
+			// A failed modification leaves the user as stored
+			failed := errors.New("modify failed")
+			if err := users.ModifyUser(user.PersonId, func(u *model.User) error {
+				u.Profile = "modified"
+				return failed
+			}); !errors.Is(err, failed) {
+				t.Errorf("ModifyUser() error = %v, want %v", err, failed)
+			}
+			if err := users.GetUser(loaded, user.PersonId); err != nil || loaded.Profile != "updated" {
+				t.Errorf("Expected the profile before the failed modification, got %q, %v", loaded.Profile, err)
+			}
+			if err := users.ModifyUser("missing", func(*model.User) error { return nil }); !errors.Is(err, model.ErrUserNotFound) {
+				t.Errorf("ModifyUser() of a missing user error = %v, want %v", err, model.ErrUserNotFound)
+			}
+
+			// Concurrent modifications are all kept, and a new password is hashed
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := users.ModifyUser(user.PersonId, func(u *model.User) error {
+						u.BirthDate++
+						u.Password = "modified password"
+						return nil
+					}); err != nil {
+						t.Errorf("ModifyUser() returned an error: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+			if err := users.GetUser(loaded, user.PersonId); err != nil || loaded.BirthDate != user.BirthDate+5 {
+				t.Errorf("Expected 5 modifications of the birth date, got %d, %v", loaded.BirthDate-user.BirthDate, err)
+			}
+			if _, err := model.CheckPassword(loaded.Password, "modified password"); err != nil {
+				t.Errorf("CheckPassword() of the modified password returned an error: %v", err)
+			}
+
+			if exists, err := users.UserExists(user.PersonId); err != nil || !exists {
+				t.Errorf("UserExists() = %v, %v, want true", exists, err)
+			}
+			if err := users.DeleteUser(user.PersonId); err != nil {
+				t.Fatalf("DeleteUser() returned an error: %v", err)
+			}
+			if exists, err := users.UserExists(user.PersonId); err != nil || exists {
+				t.Errorf("UserExists() after delete = %v, %v, want false", exists, err)
+			}
+
+			// CreateUser never replaces a stored user
+			if err := users.CreateUser(createTestUser()); err != nil {
+				t.Fatalf("CreateUser() returned an error: %v", err)
+			}
+			if err := users.CreateUser(&model.User{PersonId: user.PersonId, Profile: "other"}); !errors.Is(err, model.ErrDuplicateUser) {
+				t.Errorf("CreateUser() of a stored user error = %v, want %v", err, model.ErrDuplicateUser)
+			}
+			if err := users.GetUser(loaded, user.PersonId); err != nil || loaded.Profile != createTestUser().Profile {
+				t.Errorf("Expected the first created user, got %q, %v", loaded.Profile, err)
+			}
+		})
+	}
+}
+
+// TestMessageRepository tests the MessageRepository contract of every backend
+func TestMessageRepository(t *testing.T) {
+	for _, backend := range repositoryBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			messages := backend.open(t).Messages
+			msg := createTestMessage()
+
+			if err := messages.SaveMessage(&model.Message{}); !errors.Is(err, model.ErrInvalidMessageID) {
+				t.Errorf("SaveMessage() without an ID error = %v, want %v", err, model.ErrInvalidMessageID)
+			}
+			for name, op := range map[string]func(*model.Message) error{
+				"GetMessage":    messages.GetMessage,
+				"UpdateMessage": messages.UpdateMessage,
+				"DeleteMessage": messages.DeleteMessage,
+			} {
+				if err := op(createTestMessage()); !errors.Is(err, model.ErrMessageNotFound) {
+					t.Errorf("%s() of a missing message error = %v, want %v", name, err, model.ErrMessageNotFound)
+				}
+			}
+
+			if err := messages.SaveMessage(msg); err != nil {
+				t.Fatalf("SaveMessage() returned an error: %v", err)
+			}
+			loaded := &model.Message{MsgId: msg.MsgId}
+			if err := messages.GetMessage(loaded); err != nil {
+				t.Fatalf("GetMessage() returned an error: %v", err)
+			}
+			if loaded.String() != msg.String() {
+				t.Errorf("GetMessage() = %v, want %v", loaded, msg)
+			}
+
+			msg.Content = "updated"
+			if err := messages.UpdateMessage(msg); err != nil {
+				t.Fatalf("UpdateMessage() returned an error: %v", err)
+			}
+			if err := messages.GetMessage(loaded); err != nil || loaded.Content != "updated" {
+				t.Errorf("Expected the updated content, got %q, %v", loaded.Content, err)
+			}
+
+			if err := messages.DeleteMessage(msg); err != nil {
+				t.Fatalf("DeleteMessage() returned an error: %v", err)
+			}
+			if err := messages.GetMessage(loaded); !errors.Is(err, model.ErrMessageNotFound) {
+				t.Errorf("GetMessage() after delete error = %v, want %v", err, model.ErrMessageNotFound)
+			}
+		})
+	}
+}
+
+// TestConversationRepository tests the ConversationRepository contract of every backend
+func TestConversationRepository(t *testing.T) {
+	for _, backend := range repositoryBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			conversations := backend.open(t).Conversations
+
+			if err := conversations.SaveChatHistory(&model.ChatHistory{}); !errors.Is(err, model.ErrInvalidConvID) {
+				t.Errorf("SaveChatHistory() without an ID error = %v, want %v", err, model.ErrInvalidConvID)
+			}
+			if err := conversations.GetChatHistory(&model.ChatHistory{ConversationId: "conv_missing"}); !errors.Is(err, model.ErrChatHistoryNotFound) {
+				t.Errorf("GetChatHistory() of a missing history error = %v, want %v", err, model.ErrChatHistoryNotFound)
+			}
+
+			// A history saved without messages exists
+			if err := conversations.SaveChatHistory(&model.ChatHistory{ConversationId: "conv_empty"}); err != nil {
+				t.Fatalf("SaveChatHistory() returned an error: %v", err)
+			}
+			empty := &model.ChatHistory{ConversationId: "conv_empty"}
+			if err := conversations.GetChatHistory(empty); err != nil || len(empty.Messages) != 0 {
+				t.Errorf("GetChatHistory() of an empty history = %d messages, %v, want 0", len(empty.Messages), err)
+			}
+
+			history := &model.ChatHistory{ConversationId: "conv_order"}
+			for i := 0; i < 3; i++ {
+				msg := &model.Message{MsgId: fmt.Sprintf("msg_%d", i), ConversationId: "conv_order", Content: fmt.Sprintf("message %d", i)}
+				if err := conversations.AddMessageToHistory(history, msg); err != nil {
+					t.Fatalf("AddMessageToHistory() returned an error: %v", err)
+				}
+				if len(history.Messages) != i+1 {
+					t.Errorf("Expected %d messages after AddMessageToHistory(), got %d", i+1, len(history.Messages))
+				}
+			}
+
+			loaded := &model.ChatHistory{ConversationId: "conv_order"}
+			if err := conversations.GetChatHistory(loaded); err != nil {
+				t.Fatalf("GetChatHistory() returned an error: %v", err)
+			}
+			if loaded.String() != history.String() {
+				t.Errorf("GetChatHistory() = %v, want %v", loaded, history)
+			}
+			for i, msg := range loaded.Messages {
+				if want := fmt.Sprintf("msg_%d", i); msg.MsgId != want {
+					t.Errorf("Message %d = %s, want %s", i, msg.MsgId, want)
+				}
+			}
+
+			// Saving replaces the stored messages
+			loaded.Messages = loaded.Messages[:1]
+			if err := conversations.SaveChatHistory(loaded); err != nil {
+				t.Fatalf("SaveChatHistory() returned an error: %v", err)
+			}
+			if err := conversations.GetChatHistory(history); err != nil || len(history.Messages) != 1 {
+				t.Errorf("GetChatHistory() after save = %d messages, %v, want 1", len(history.Messages), err)
+			}
+		})
+	}
+}
+
+// TestConversationRepositoryConcurrent tests that concurrent additions to one conversation are all kept by every backend
+func TestConversationRepositoryConcurrent(t *testing.T) {
+	for _, backend := range repositoryBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			conversations := backend.open(t).Conversations
+
+			const count = 20
+			var wg sync.WaitGroup
+			for i := 0; i < count; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					history := &model.ChatHistory{ConversationId: "conv_concurrent"}
+					msg := &model.Message{MsgId: fmt.Sprintf("msg_%02d", i), ConversationId: "conv_concurrent"}
+					if err := conversations.AddMessageToHistory(history, msg); err != nil {
+						t.Errorf("AddMessageToHistory() returned an error: %v", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			history := &model.ChatHistory{ConversationId: "conv_concurrent"}
+			if err := conversations.GetChatHistory(history); err != nil {
+				t.Fatalf("GetChatHistory() returned an error: %v", err)
+			}
+			if len(history.Messages) != count {
+				t.Errorf("Expected %d messages, got %d", count, len(history.Messages))
+			}
+		})
+	}
+}
+
+// TestSetRepositories tests that the model methods use the repositories set by SetRepositories
+func TestSetRepositories(t *testing.T) {
+	repos := model.NewMemoryRepositories()
+	model.SetRepositories(repos)
+	t.Cleanup(func() { model.SetRepositories(nil) })
+
+	user := createTestUser()
+	if err := user.SaveUserData(); err != nil {
+		t.Fatalf("SaveUserData() returned an error: %v", err)
+	}
+	if exists, err := repos.Users.UserExists(user.PersonId); err != nil || !exists {
+		t.Errorf("Expected the user in the memory repository, got %v, %v", exists, err)
+	}
+
+	history := &model.ChatHistory{ConversationId: "conv_memory"}
+	if err := history.AddMessageToHistory(createTestMessage()); err != nil {
+		t.Fatalf("AddMessageToHistory() returned an error: %v", err)
+	}
+	if err := repos.Conversations.GetChatHistory(&model.ChatHistory{ConversationId: "conv_memory"}); err != nil {
+		t.Errorf("Expected the history in the memory repository, got %v", err)
+	}
+
+	if previous := model.SetRepositories(nil); previous != repos {
+		t.Errorf("SetRepositories() returned %p, want %p", previous, repos)
+	}
+}
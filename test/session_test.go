@@ -0,0 +1,205 @@
+// Package test provides integration tests for refresh token sessions.
+package test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+)
+
+// TestSessionRepository tests the SessionRepository contract of every backend
+func TestSessionRepository(t *testing.T) {
+	for _, backend := range repositoryBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			sessions := backend.open(t).Sessions
+			session := &model.Session{ID: "sess_test", UserID: "testPersonId", TokenHash: "h1", PreviousHashes: []string{"h0"}, ExpiresAt: 1}
+			loaded := &model.Session{}
+
+			if err := sessions.SaveSession(&model.Session{}); !errors.Is(err, model.ErrInvalidSessionID) {
+				t.Errorf("SaveSession() without an ID error = %v, want %v", err, model.ErrInvalidSessionID)
+			}
+			if err := sessions.GetSession(loaded, session.ID); !errors.Is(err, model.ErrSessionNotFound) {
+				t.Errorf("GetSession() of a missing session error = %v, want %v", err, model.ErrSessionNotFound)
+			}
+			if replaced, err := sessions.ReplaceSession(session, "h1"); err != nil || replaced {
+				t.Errorf("ReplaceSession() of a missing session = %v, %v, want false", replaced, err)
+			}
+			if err := sessions.DeleteSession(session.ID); !errors.Is(err, model.ErrSessionNotFound) {
+				t.Errorf("DeleteSession() of a missing session error = %v, want %v", err, model.ErrSessionNotFound)
+			}
+
+			if err := sessions.SaveSession(session); err != nil {
+				t.Fatalf("SaveSession() returned an error: %v", err)
+			}
+			if err := sessions.GetSession(loaded, session.ID); err != nil || !reflect.DeepEqual(loaded, session) {
+				t.Errorf("GetSession() = %+v, %v, want %+v", loaded, err, session)
+			}
+
+			next := *session
+			next.TokenHash, next.PreviousHashes, next.Generation = "h2", []string{"h0", "h1"}, 1
+			if replaced, err := sessions.ReplaceSession(&next, "other"); err != nil || replaced {
+				t.Errorf("ReplaceSession() with a stale hash = %v, %v, want false", replaced, err)
+			}
+			if replaced, err := sessions.ReplaceSession(&next, "h1"); err != nil || !replaced {
+				t.Errorf("ReplaceSession() = %v, %v, want true", replaced, err)
+			}
+			if err := sessions.GetSession(loaded, session.ID); err != nil || !reflect.DeepEqual(*loaded, next) {
+				t.Errorf("GetSession() after replace = %+v, %v, want %+v", loaded, err, next)
+			}
+
+			if err := sessions.DeleteSession(session.ID); err != nil {
+				t.Fatalf("DeleteSession() returned an error: %v", err)
+			}
+			if err := sessions.GetSession(loaded, session.ID); !errors.Is(err, model.ErrSessionNotFound) {
+				t.Errorf("GetSession() after delete error = %v, want %v", err, model.ErrSessionNotFound)
+			}
+
+			// Only the sessions of the given user are deleted
+			for _, s := range []*model.Session{
+				{ID: "sess_a1", UserID: "alice"},
+				{ID: "sess_a2", UserID: "alice"},
+				{ID: "sess_b1", UserID: "alice.b"},
+			} {
+				if err := sessions.SaveSession(s); err != nil {
+					t.Fatalf("SaveSession() returned an error: %v", err)
+				}
+			}
+			if n, err := sessions.DeleteUserSessions("alice"); err != nil || n != 2 {
+				t.Errorf("DeleteUserSessions() = %d, %v, want 2", n, err)
+			}
+			for id, want := range map[string]error{"sess_a1": model.ErrSessionNotFound, "sess_a2": model.ErrSessionNotFound, "sess_b1": nil} {
+				if err := sessions.GetSession(loaded, id); !errors.Is(err, want) {
+					t.Errorf("GetSession(%s) after DeleteUserSessions() error = %v, want %v", id, err, want)
+				}
+			}
+			if n, err := sessions.DeleteUserSessions("alice"); err != nil || n != 0 {
+				t.Errorf("DeleteUserSessions() of a user without sessions = %d, %v, want 0", n, err)
+			}
+			if _, err := sessions.DeleteUserSessions(""); !errors.Is(err, model.ErrInvalidUsername) {
+				t.Errorf("DeleteUserSessions(\"\") error = %v, want %v", err, model.ErrInvalidUsername)
+			}
+		})
+	}
+}
+
+// TestRefreshSession tests refresh token rotation, reuse detection, expiry
+// and revocation
+func TestRefreshSession(t *testing.T) {
+	_, store := newShardedStore(t, 2)
+	model.SetRepositories(&model.Repositories{Users: store, Messages: store, Conversations: store, Sessions: store})
+	t.Cleanup(func() { model.SetRepositories(nil) })
+
+	first, session, err := model.NewSession("testPersonId", time.Hour)
+	if err != nil {
+		t.Fatalf("NewSession() returned an error: %v", err)
+	}
+	if !strings.HasPrefix(first, session.ID+".") || session.UserID != "testPersonId" {
+		t.Errorf("NewSession() = %q, %+v", first, session)
+	}
+	stored := &model.Session{}
+	if err := store.GetSession(stored, session.ID); err != nil || strings.Contains(first, stored.TokenHash) {
+		t.Errorf("Expected only the hash of the token to be stored, got %+v, %v", stored, err)
+	}
+
+	second, refreshed, err := model.RefreshSession(first, time.Hour)
+	if err != nil {
+		t.Fatalf("RefreshSession() returned an error: %v", err)
+	}
+	if second == first || refreshed.ID != session.ID || refreshed.Generation != 1 {
+		t.Errorf("RefreshSession() = %q, %+v, want a new token of session %s", second, refreshed, session.ID)
+	}
+
+	// A secret the session never issued is rejected without revoking it, as
+	// session IDs are visible in access tokens
+	if _, _, err := model.RefreshSession(session.ID+".forged", time.Hour); !errors.Is(err, model.ErrInvalidRefreshToken) || errors.Is(err, model.ErrRefreshTokenReused) {
+		t.Errorf("RefreshSession() of a forged token error = %v, want %v", err, model.ErrInvalidRefreshToken)
+	}
+	third, _, err := model.RefreshSession(second, time.Hour)
+	if err != nil {
+		t.Fatalf("RefreshSession() after a forged token returned an error: %v", err)
+	}
+
+	// Reusing an exchanged token revokes the session, so the latest token
+	// fails too
+	if _, _, err := model.RefreshSession(first, time.Hour); !errors.Is(err, model.ErrRefreshTokenReused) {
+		t.Errorf("RefreshSession() of a reused token error = %v, want %v", err, model.ErrRefreshTokenReused)
+	}
+	if _, _, err := model.RefreshSession(third, time.Hour); !errors.Is(err, model.ErrInvalidRefreshToken) {
+		t.Errorf("RefreshSession() after reuse error = %v, want %v", err, model.ErrInvalidRefreshToken)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"no secret", session.ID},
+		{"unknown session", "sess_unknown.secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := model.RefreshSession(tt.token, time.Hour); !errors.Is(err, model.ErrInvalidRefreshToken) {
+				t.Errorf("RefreshSession() error = %v, want %v", err, model.ErrInvalidRefreshToken)
+			}
+			if err := model.RevokeSession(tt.token); !errors.Is(err, model.ErrInvalidRefreshToken) {
+				t.Errorf("RevokeSession() error = %v, want %v", err, model.ErrInvalidRefreshToken)
+			}
+		})
+	}
+
+	expiring, _, err := model.NewSession("testPersonId", time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewSession() returned an error: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, _, err := model.RefreshSession(expiring, time.Hour); !errors.Is(err, model.ErrRefreshTokenExpired) {
+		t.Errorf("RefreshSession() of an expired token error = %v, want %v", err, model.ErrRefreshTokenExpired)
+	}
+
+	revoked, _, err := model.NewSession("testPersonId", time.Hour)
+	if err != nil {
+		t.Fatalf("NewSession() returned an error: %v", err)
+	}
+	if err := model.RevokeSession(revoked); err != nil {
+		t.Fatalf("RevokeSession() returned an error: %v", err)
+	}
+	if _, _, err := model.RefreshSession(revoked, time.Hour); !errors.Is(err, model.ErrInvalidRefreshToken) {
+		t.Errorf("RefreshSession() of a revoked token error = %v, want %v", err, model.ErrInvalidRefreshToken)
+	}
+}
+
+// TestRefreshSessionConcurrent tests that a token refreshed by concurrent
+// requests is exchanged at most once
+func TestRefreshSessionConcurrent(t *testing.T) {
+	model.SetRepositories(model.NewMemoryRepositories())
+	t.Cleanup(func() { model.SetRepositories(nil) })
+
+	token, _, err := model.NewSession("testPersonId", time.Hour)
+	if err != nil {
+		t.Fatalf("NewSession() returned an error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	exchanged := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := model.RefreshSession(token, time.Hour); err == nil {
+				mu.Lock()
+				exchanged++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if exchanged > 1 {
+		t.Errorf("Token exchanged %d times, want at most 1", exchanged)
+	}
+}
@@ -0,0 +1,143 @@
+// Package test provides integration tests for shard-aware persistence.
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// newShardedStore creates a model store over a temporary layout with the given number of shards
+func newShardedStore(t *testing.T, shards int64) (*database.Store, *model.Store) {
+	t.Helper()
+	layout := database.DefaultLayout()
+	layout.BaseDir = t.TempDir()
+	layout.Shards = shards
+	db := database.NewStore(layout)
+	t.Cleanup(func() { db.Close() })
+	return db, model.NewStore(db)
+}
+
+// TestShardedUsers tests that users are spread over the shards and read back from theirs
+func TestShardedUsers(t *testing.T) {
+	db, store := newShardedStore(t, 4)
+	schema := database.NewSchema(db)
+
+	perShard := make(map[int64]int)
+	for i := 0; i < 40; i++ {
+		user := &model.User{PersonId: fmt.Sprintf("person_%d", i), Email: fmt.Sprintf("p%d@example.com", i)}
+		if err := store.SaveUser(user); err != nil {
+			t.Fatalf("SaveUser() returned an error: %v", err)
+		}
+
+		key := string(model.UserKeys.Key(user.PersonId))
+		shard, err := schema.Get(key)
+		if err != nil {
+			t.Fatalf("Expected a shard assignment for %s: %v", key, err)
+		}
+		perShard[shard]++
+
+		shardDB, err := db.ShardNumber(shard)
+		if err != nil {
+			t.Fatalf("ShardNumber() returned an error: %v", err)
+		}
+		if _, err := shardDB.Get([]byte(key), nil); err != nil {
+			t.Errorf("Expected %s on shard %d: %v", key, shard, err)
+		}
+
+		loaded := &model.User{}
+		if err := store.GetUser(loaded, user.PersonId); err != nil || loaded.Email != user.Email {
+			t.Errorf("GetUser() = %v, %v, want %v", loaded, err, user)
+		}
+	}
+	if len(perShard) != 4 {
+		t.Errorf("Expected users on all 4 shards, got %v", perShard)
+	}
+
+	// Deleting a user releases its assignment
+	if err := store.DeleteUser("person_0"); err != nil {
+		t.Fatalf("DeleteUser() returned an error: %v", err)
+	}
+	if exists, _ := schema.Exists(string(model.UserKeys.Key("person_0"))); exists {
+		t.Error("Expected the shard assignment to be removed with the user")
+	}
+}
+
+// TestShardedChat tests that messages and histories are routed through the placement policy
+func TestShardedChat(t *testing.T) {
+	db, store := newShardedStore(t, 4)
+	pinned := store.WithPlacement(database.PlacementFunc(func(key string) (int64, error) {
+		return 2, nil
+	}))
+
+	msg := createTestMessage()
+	if err := pinned.SaveMessage(msg); err != nil {
+		t.Fatalf("SaveMessage() returned an error: %v", err)
+	}
+	history := &model.ChatHistory{ConversationId: msg.ConversationId}
+	if err := pinned.AddMessageToHistory(history, msg); err != nil {
+		t.Fatalf("AddMessageToHistory() returned an error: %v", err)
+	}
+
+	shard2, err := db.ShardNumber(2)
+	if err != nil {
+		t.Fatalf("ShardNumber() returned an error: %v", err)
+	}
+	for _, key := range [][]byte{model.MessageKeys.Key(msg.MsgId), model.HistoryKeys.Key(msg.ConversationId)} {
+		if _, err := shard2.Get(key, nil); err != nil {
+			t.Errorf("Expected %s on shard 2: %v", key, err)
+		}
+	}
+
+	// Placed records are found whatever the current policy
+	msg.Content = "Edited"
+	if err := store.UpdateMessage(msg); err != nil {
+		t.Fatalf("UpdateMessage() returned an error: %v", err)
+	}
+	loaded := &model.Message{MsgId: msg.MsgId}
+	if err := store.GetMessage(loaded); err != nil || loaded.Content != "Edited" {
+		t.Errorf("GetMessage() = '%s', %v, want 'Edited'", loaded.Content, err)
+	}
+	if err := store.GetChatHistory(&model.ChatHistory{ConversationId: msg.ConversationId}); err != nil {
+		t.Errorf("GetChatHistory() returned an error: %v", err)
+	}
+}
+
+// TestUnplacedRecords tests that records without a shard assignment are read from the default shard
+func TestUnplacedRecords(t *testing.T) {
+	db, store := newShardedStore(t, 4)
+
+	shard0, err := db.DefaultShard()
+	if err != nil {
+		t.Fatalf("DefaultShard() returned an error: %v", err)
+	}
+	putRecord(t, shard0, string(model.UserKeys.Key("legacy")), &model.User{PersonId: "legacy", Email: "legacy@example.com"})
+
+	loaded := &model.User{}
+	if err := store.GetUser(loaded, "legacy"); err != nil || loaded.Email != "legacy@example.com" {
+		t.Errorf("GetUser() = %v, %v, want the unplaced user", loaded, err)
+	}
+
+	report, err := store.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate() returned an error: %v", err)
+	}
+	if report.Assigned != 1 {
+		t.Errorf("Migrate() assigned %d records, want 1", report.Assigned)
+	}
+	if shard, err := database.NewSchema(db).Get(string(model.UserKeys.Key("legacy"))); err != nil || shard != 0 {
+		t.Errorf("Expected the unplaced user to be assigned shard 0, got %d, %v", shard, err)
+	}
+
+	// Updates keep the record where it is
+	loaded.Email = "moved@example.com"
+	if err := store.UpdateUser(loaded, "legacy"); err != nil {
+		t.Fatalf("UpdateUser() returned an error: %v", err)
+	}
+	if _, err := shard0.Get(model.UserKeys.Key("legacy"), nil); err == leveldb.ErrNotFound {
+		t.Error("Expected the user to stay on the default shard")
+	}
+}
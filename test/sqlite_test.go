@@ -0,0 +1,222 @@
+// Package test provides integration tests for the SQLite user backend.
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/TeamPentagon/DM-Backend/internal/database"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+)
+
+// newSQLiteUsers creates a SQLite user store over a temporary layout
+func newSQLiteUsers(t *testing.T) (*database.Store, *model.SQLiteUsers) {
+	t.Helper()
+	layout := database.DefaultLayout()
+	layout.BaseDir = t.TempDir()
+	db := database.NewStore(layout)
+	t.Cleanup(func() { db.Close() })
+	users, err := model.OpenSQLiteUsers(db)
+	if err != nil {
+		t.Fatalf("OpenSQLiteUsers() returned an error: %v", err)
+	}
+	return db, users
+}
+
+// TestSQLiteUsers tests the CRUD contract of the SQLite user store
+func TestSQLiteUsers(t *testing.T) {
+	_, users := newSQLiteUsers(t)
+	user := createTestUser()
+
+	if err := users.SaveUser(&model.User{}); !errors.Is(err, model.ErrInvalidUsername) {
+		t.Errorf("SaveUser() without a PersonId error = %v, want %v", err, model.ErrInvalidUsername)
+	}
+	if err := users.SaveUser(user); err != nil {
+		t.Fatalf("SaveUser() returned an error: %v", err)
+	}
+
+	loaded := &model.User{}
+	if err := users.GetUser(loaded, user.PersonId); err != nil {
+		t.Fatalf("GetUser() returned an error: %v", err)
+	}
+	if loaded.String() != user.String() {
+		t.Errorf("GetUser() = %v, want %v", loaded, user)
+	}
+
+	user.Profile = "updated"
+	if err := users.UpdateUser(user, user.PersonId); err != nil {
+		t.Fatalf("UpdateUser() returned an error: %v", err)
+	}
+	if err := users.GetUser(loaded, user.PersonId); err != nil || loaded.Profile != "updated" {
+		t.Errorf("Expected the updated profile, got %q, %v", loaded.Profile, err)
+	}
+	if err := users.UpdateUser(user, "missing"); !errors.Is(err, model.ErrDatabaseRead) {
+		t.Errorf("UpdateUser() of a missing user error = %v, want %v", err, model.ErrDatabaseRead)
+	}
+
+	if exists, err := users.UserExists(user.PersonId); err != nil || !exists {
+		t.Errorf("UserExists() = %v, %v, want true", exists, err)
+	}
+	if err := users.DeleteUser(user.PersonId); err != nil {
+		t.Fatalf("DeleteUser() returned an error: %v", err)
+	}
+	if exists, err := users.UserExists(user.PersonId); err != nil || exists {
+		t.Errorf("UserExists() after delete = %v, %v, want false", exists, err)
+	}
+	if err := users.GetUser(loaded, user.PersonId); !errors.Is(err, model.ErrUserNotFound) {
+		t.Errorf("GetUser() after delete error = %v, want %v", err, model.ErrUserNotFound)
+	}
+	if err := users.DeleteUser(user.PersonId); !errors.Is(err, model.ErrUserNotFound) {
+		t.Errorf("DeleteUser() of a missing user error = %v, want %v", err, model.ErrUserNotFound)
+	}
+}
+
+// TestSQLiteUsersUnique tests the unique user name and email indexes and the lookups
+func TestSQLiteUsersUnique(t *testing.T) {
+	_, users := newSQLiteUsers(t)
+	for _, u := range []*model.User{
+		{PersonId: "p1", UserName: "alice", Email: "alice@example.com", PhoneNumber: "555"},
+		{PersonId: "p2", UserName: "bob", Email: "bob@example.com", PhoneNumber: "555"},
+		// Empty names and emails do not conflict
+		{PersonId: "p3"},
+		{PersonId: "p4"},
+	} {
+		if err := users.SaveUser(u); err != nil {
+			t.Fatalf("SaveUser(%s) returned an error: %v", u.PersonId, err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		save func() error
+	}{
+		{"duplicate user name", func() error { return users.SaveUser(&model.User{PersonId: "p5", UserName: "alice"}) }},
+		{"duplicate email", func() error { return users.SaveUser(&model.User{PersonId: "p5", Email: "bob@example.com"}) }},
+		{"duplicate email in another case", func() error {
+			return users.CreateUser(&model.User{PersonId: "p5", Email: "Bob@Example.COM"})
+		}},
+		{"update to a taken email", func() error {
+			return users.UpdateUser(&model.User{UserName: "bob", Email: "alice@example.com"}, "p2")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.save(); !errors.Is(err, model.ErrDuplicateUser) {
+				t.Errorf("error = %v, want %v", err, model.ErrDuplicateUser)
+			}
+		})
+	}
+
+	found := &model.User{}
+	if err := users.FindUserByEmail(found, "bob@example.com"); err != nil || found.PersonId != "p2" {
+		t.Errorf("FindUserByEmail() = %q, %v, want p2", found.PersonId, err)
+	}
+	if err := users.FindUserByEmail(found, "BOB@example.com"); err != nil || found.PersonId != "p2" {
+		t.Errorf("FindUserByEmail() in another case = %q, %v, want p2", found.PersonId, err)
+	}
+	if err := users.FindUserByPhone(found, "555"); err != nil || found.PersonId != "p1" {
+		t.Errorf("FindUserByPhone() = %q, %v, want the first user p1", found.PersonId, err)
+	}
+	if err := users.FindUserByEmail(found, "nobody@example.com"); !errors.Is(err, model.ErrUserNotFound) {
+		t.Errorf("FindUserByEmail() of an unknown email error = %v, want %v", err, model.ErrUserNotFound)
+	}
+}
+
+// TestUserBackendSelection tests that the User methods use the configured backend
+func TestUserBackendSelection(t *testing.T) {
+	layout := database.DefaultLayout()
+	layout.BaseDir = t.TempDir()
+	layout.UserBackend = database.BackendSQLite
+	if err := database.SetLayout(layout); err != nil {
+		t.Fatalf("SetLayout() returned an error: %v", err)
+	}
+	t.Cleanup(func() { database.SetLayout(database.DefaultLayout()) })
+
+	user := createTestUser()
+	if err := user.SaveUserData(); err != nil {
+		t.Fatalf("SaveUserData() returned an error: %v", err)
+	}
+
+	users, err := model.OpenSQLiteUsers(database.DefaultStore())
+	if err != nil {
+		t.Fatalf("OpenSQLiteUsers() returned an error: %v", err)
+	}
+	if exists, err := users.UserExists(user.PersonId); err != nil || !exists {
+		t.Errorf("Expected the user in SQLite, got %v, %v", exists, err)
+	}
+	if exists, err := model.NewStore(database.DefaultStore()).UserExists(user.PersonId); err != nil || exists {
+		t.Errorf("Expected no user in LevelDB, got %v, %v", exists, err)
+	}
+
+	loaded := &model.User{}
+	if err := loaded.GetUserData(user.PersonId); err != nil || loaded.Email != user.Email {
+		t.Errorf("GetUserData() = %q, %v, want %q", loaded.Email, err, user.Email)
+	}
+}
+
+// TestChatBackendSelection tests that the Message and ChatHistory methods use
+// the configured backend
+func TestChatBackendSelection(t *testing.T) {
+	layout := database.DefaultLayout()
+	layout.BaseDir = t.TempDir()
+	layout.ChatBackend = database.BackendSQLite
+	if err := database.SetLayout(layout); err != nil {
+		t.Fatalf("SetLayout() returned an error: %v", err)
+	}
+	t.Cleanup(func() { database.SetLayout(database.DefaultLayout()) })
+
+	msg := createTestMessage()
+	if err := msg.SaveMessage(); err != nil {
+		t.Fatalf("SaveMessage() returned an error: %v", err)
+	}
+	history := &model.ChatHistory{ConversationId: msg.ConversationId}
+	if err := history.AddMessageToHistory(msg); err != nil {
+		t.Fatalf("AddMessageToHistory() returned an error: %v", err)
+	}
+
+	chats, err := model.OpenSQLiteChats(database.DefaultStore())
+	if err != nil {
+		t.Fatalf("OpenSQLiteChats() returned an error: %v", err)
+	}
+	stored := &model.Message{MsgId: msg.MsgId}
+	if err := chats.GetMessage(stored); err != nil || stored.Content != msg.Content {
+		t.Errorf("Expected the message in SQLite, got %q, %v", stored.Content, err)
+	}
+	if err := model.NewStore(database.DefaultStore()).GetMessage(&model.Message{MsgId: msg.MsgId}); !errors.Is(err, model.ErrMessageNotFound) {
+		t.Errorf("Expected no message in LevelDB, got %v", err)
+	}
+
+	loaded := &model.ChatHistory{ConversationId: msg.ConversationId}
+	if err := loaded.GetChatHistory(); err != nil || len(loaded.Messages) != 1 {
+		t.Errorf("GetChatHistory() = %d messages, %v, want 1", len(loaded.Messages), err)
+	}
+}
+
+// TestCopyUsers tests copying LevelDB users into SQLite
+func TestCopyUsers(t *testing.T) {
+	db, users := newSQLiteUsers(t)
+	store := model.NewStore(db)
+	for _, u := range []*model.User{
+		{PersonId: "p1", UserName: "alice", Email: "alice@example.com"},
+		{PersonId: "p2", UserName: "bob", Email: "bob@example.com"},
+		{PersonId: "p3", UserName: "carol", Email: "taken@example.com"},
+	} {
+		if err := store.SaveUser(u); err != nil {
+			t.Fatalf("SaveUser() returned an error: %v", err)
+		}
+	}
+	if err := users.SaveUser(&model.User{PersonId: "other", Email: "taken@example.com"}); err != nil {
+		t.Fatalf("SaveUser() returned an error: %v", err)
+	}
+
+	for run := 0; run < 2; run++ {
+		copied, conflicts, err := store.CopyUsers(users)
+		if err != nil || copied != 2 || conflicts != 1 {
+			t.Errorf("CopyUsers() run %d = %d, %d, %v, want 2 copied and 1 conflict", run, copied, conflicts, err)
+		}
+	}
+	loaded := &model.User{}
+	if err := users.GetUser(loaded, "p2"); err != nil || loaded.UserName != "bob" {
+		t.Errorf("GetUser() = %q, %v, want bob", loaded.UserName, err)
+	}
+}
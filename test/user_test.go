@@ -3,10 +3,12 @@
 package test
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/TeamPentagon/DM-Backend/internal/database"
 	"github.com/TeamPentagon/DM-Backend/internal/model"
 )
 
@@ -24,6 +26,7 @@ func setupTestEnvironment(t *testing.T) func() {
 	os.Chdir(testDir)
 
 	return func() {
+		database.CloseAll()
 		os.Chdir(originalDir)
 		os.RemoveAll(testDir)
 	}
@@ -318,3 +321,89 @@ func TestUserCRUDLifecycle(t *testing.T) {
 		t.Error("DELETE verification failed: user still exists")
 	}
 }
+
+// TestPatchUserData tests partial updates of stored users on every backend
+func TestPatchUserData(t *testing.T) {
+	for _, backend := range repositoryBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			model.SetRepositories(backend.open(t))
+			t.Cleanup(func() { model.SetRepositories(nil) })
+
+			user := createTestUser()
+			if err := user.SaveUserData(); err != nil {
+				t.Fatalf("SaveUserData() returned an error: %v", err)
+			}
+
+			patched := &model.User{}
+			patch := &model.User{Email: "new@example.com", Profile: "ignored", Gender: ""}
+			if err := patched.PatchUserData(user.PersonId, patch, []string{"email", "gender"}); err != nil {
+				t.Fatalf("PatchUserData() returned an error: %v", err)
+			}
+			stored := &model.User{}
+			if err := stored.GetUserData(user.PersonId); err != nil {
+				t.Fatalf("GetUserData() returned an error: %v", err)
+			}
+			if stored.String() != patched.String() {
+				t.Errorf("PatchUserData() = %v, stored %v", patched, stored)
+			}
+			if stored.Email != "new@example.com" || stored.Gender != "" {
+				t.Errorf("Expected the masked fields to change, got %v", stored)
+			}
+			if stored.Profile != user.Profile || stored.PhoneNumber != user.PhoneNumber || stored.Password != user.Password {
+				t.Errorf("Expected the other fields to be kept, got %v", stored)
+			}
+			if stored.LastEdit <= user.LastEdit {
+				t.Errorf("Expected LastEdit to be stamped, got %d", stored.LastEdit)
+			}
+
+			if err := patched.PatchUserData(user.PersonId, &model.User{Password: "new password"}, []string{"password"}); err != nil {
+				t.Fatalf("PatchUserData() of the password returned an error: %v", err)
+			}
+			if err := stored.GetUserData(user.PersonId); err != nil {
+				t.Fatalf("GetUserData() returned an error: %v", err)
+			}
+			if err := stored.VerifyPassword("new password"); err != nil {
+				t.Errorf("VerifyPassword() of the patched password returned an error: %v", err)
+			}
+
+			// A patched password is hashed even when it looks like a hash
+			hash, err := model.HashPassword("short")
+			if err != nil {
+				t.Fatalf("HashPassword() returned an error: %v", err)
+			}
+			if err := patched.PatchUserData(user.PersonId, &model.User{Password: hash}, []string{"password"}); err != nil {
+				t.Fatalf("PatchUserData() of the password returned an error: %v", err)
+			}
+			if err := stored.GetUserData(user.PersonId); err != nil {
+				t.Fatalf("GetUserData() returned an error: %v", err)
+			}
+			if stored.Password == hash || stored.VerifyPassword("short") == nil {
+				t.Errorf("Expected the hash to be hashed as a password, got %s", stored.Password)
+			}
+
+			tests := []struct {
+				name    string
+				id      string
+				mask    []string
+				wantErr error
+			}{
+				{"person_id", user.PersonId, []string{"person_id"}, model.ErrInvalidFieldMask},
+				{"last_edit", user.PersonId, []string{"last_edit"}, model.ErrInvalidFieldMask},
+				{"unknown field", user.PersonId, []string{"email", "nickname"}, model.ErrInvalidFieldMask},
+				{"missing user", "nobody", []string{"email"}, model.ErrUserNotFound},
+				{"empty ID", "", []string{"email"}, model.ErrInvalidUsername},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					err := (&model.User{}).PatchUserData(tt.id, &model.User{Email: "other@example.com"}, tt.mask)
+					if !errors.Is(err, tt.wantErr) {
+						t.Errorf("PatchUserData() error = %v, want %v", err, tt.wantErr)
+					}
+				})
+			}
+			if err := stored.GetUserData(user.PersonId); err != nil || stored.Email != "new@example.com" {
+				t.Errorf("Expected rejected patches to change nothing, got %q, %v", stored.Email, err)
+			}
+		})
+	}
+}
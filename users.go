@@ -0,0 +1,168 @@
+// Package main provides the user profile endpoints of the server.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/TeamPentagon/DM-Backend/internal/middleware"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// readOnlyUserFields cannot be changed through PATCH /api/v1/users/{id}.
+// The user name is the PersonId of registered users.
+var readOnlyUserFields = map[string]bool{
+	"person_id":    true,
+	"user_name":    true,
+	"account_time": true,
+	"last_edit":    true,
+}
+
+// UserPatch holds the fields accepted by PATCH /api/v1/users/{id}. Only the
+// fields present in the JSON body are changed; the others keep their stored
+// values.
+type UserPatch struct {
+	Password      string `json:"password" binding:"omitempty,min=8,max=256"`
+	Email         string `json:"email" binding:"omitempty,email,max=254"`
+	PhoneNumber   string `json:"phone_number" binding:"omitempty,max=32"`
+	Profile       string `json:"profile" binding:"omitempty,max=4096"`
+	ProfilePicURL string `json:"profile_pic_url" binding:"omitempty,url,max=2048"`
+	Gender        string `json:"gender" binding:"omitempty,max=32"`
+	BirthDate     int64  `json:"birth_date"`
+}
+
+// authorizeUser reports whether the authenticated subject may access the
+// user with the given ID: users access their own profile and admins every
+// profile. Otherwise it writes the 403 response.
+func authorizeUser(c *gin.Context, id string) bool {
+	if middleware.GetSubject(c) == id {
+		return true
+	}
+	if claims, ok := middleware.GetClaims(c); ok && claims.Role() == middleware.RoleAdmin {
+		return true
+	}
+	c.JSON(http.StatusForbidden, Response{
+		Success: false,
+		Error:   "Forbidden: only the user or an admin may access this profile",
+	})
+	return false
+}
+
+// getUser returns the profile of the user with the ID of the path
+func getUser(c *gin.Context) {
+	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+
+	user := &model.User{}
+	if err := user.GetUserData(id); err != nil {
+		respondUserError(c, id, err)
+		return
+	}
+	c.JSON(http.StatusOK, Response{Success: true, Data: newUserProfile(user)})
+}
+
+// patchUser changes the fields present in the JSON body of the request and
+// keeps the others, stamping the last edit time
+func patchUser(c *gin.Context) {
+	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxAuthBodyBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		c.JSON(http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	if len(fields) == 0 {
+		c.JSON(http.StatusBadRequest, Response{Success: false, Error: "No fields to update"})
+		return
+	}
+	mask := make([]string, 0, len(fields))
+	for name := range fields {
+		if readOnlyUserFields[name] {
+			c.JSON(http.StatusBadRequest, Response{Success: false, Error: name + " cannot be changed"})
+			return
+		}
+		mask = append(mask, name)
+	}
+	sort.Strings(mask)
+
+	var req UserPatch
+	if err := json.Unmarshal(body, &req); err != nil {
+		respondInvalidBody(c, err, "request")
+		return
+	}
+	if err := binding.Validator.ValidateStruct(&req); err != nil {
+		respondInvalidBody(c, err, "request")
+		return
+	}
+	if _, ok := fields["password"]; ok && req.Password == "" {
+		c.JSON(http.StatusBadRequest, Response{Success: false, Error: "password cannot be empty"})
+		return
+	}
+
+	patch := &model.User{
+		Password:      req.Password,
+		Email:         req.Email,
+		PhoneNumber:   req.PhoneNumber,
+		Profile:       req.Profile,
+		ProfilePicUrl: req.ProfilePicURL,
+		Gender:        req.Gender,
+		BirthDate:     req.BirthDate,
+	}
+	user := &model.User{}
+	if err := user.PatchUserData(id, patch, mask); err != nil {
+		respondUserError(c, id, err)
+		return
+	}
+	log.Printf("Updated %v of user %s", mask, id)
+	c.JSON(http.StatusOK, Response{Success: true, Data: newUserProfile(user)})
+}
+
+// deleteUser removes the user with the ID of the path and revokes its
+// sessions, so they can no longer be refreshed
+func deleteUser(c *gin.Context) {
+	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+
+	if err := (&model.User{}).DeleteUserData(id); err != nil {
+		respondUserError(c, id, err)
+		return
+	}
+	log.Printf("Deleted user %s", id)
+	c.JSON(http.StatusOK, Response{Success: true})
+}
+
+// respondUserError writes the response for a failed read or write of a user
+func respondUserError(c *gin.Context, id string, err error) {
+	switch {
+	case errors.Is(err, model.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, Response{Success: false, Error: "User not found"})
+	case errors.Is(err, model.ErrInvalidFieldMask):
+		c.JSON(http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+	case errors.Is(err, model.ErrDuplicateUser):
+		c.JSON(http.StatusConflict, Response{Success: false, Error: "User name or email already in use"})
+	default:
+		log.Printf("Error accessing user %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to access the user",
+		})
+	}
+}
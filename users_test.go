@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TeamPentagon/DM-Backend/internal/middleware"
+	"github.com/TeamPentagon/DM-Backend/internal/model"
+)
+
+// userToken returns a bearer token of subject signed by adminSecret, without
+// a role
+func userToken(subject string) string {
+	token, err := middleware.Sign(&middleware.Claims{Subject: subject, ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		middleware.Key{Algorithm: middleware.HS256, Key: []byte(adminSecret)})
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+// userRequest sends a request with a bearer token of subject signed by
+// adminSecret, without a role
+func userRequest(srv *server, subject, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+userToken(subject))
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, req)
+	return w
+}
+
+// decodeProfile decodes the user profile of a response
+func decodeProfile(t *testing.T, w *httptest.ResponseRecorder) UserProfile {
+	t.Helper()
+	var profile UserProfile
+	if err := json.Unmarshal(w.Body.Bytes(), &Response{Data: &profile}); err != nil {
+		t.Fatalf("Failed to decode the response %s: %v", w.Body.String(), err)
+	}
+	return profile
+}
+
+// TestUserProfile tests reading, patching and deleting a profile
+func TestUserProfile(t *testing.T) {
+	srv := newAuthServer(t, adminConfig())
+	for _, name := range []string{"alice", "bob"} {
+		if w := postJSON(t, srv, "/api/v1/auth/register", `{"user_name": "`+name+`", "password": "long password", "email": "`+name+`@example.com", "gender": "f"}`, nil); w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+	}
+	stored := &model.User{}
+	if err := stored.GetUserData("alice"); err != nil {
+		t.Fatalf("GetUserData() returned an error: %v", err)
+	}
+
+	w := userRequest(srv, "alice", "GET", "/api/v1/users/alice", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if profile := decodeProfile(t, w); profile.PersonID != "alice" || profile.Email != "alice@example.com" {
+		t.Errorf("Unexpected profile: %+v", profile)
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("password")) {
+		t.Errorf("Expected no password in the response: %s", w.Body.String())
+	}
+
+	// Only the fields in the body change
+	w = userRequest(srv, "alice", "PATCH", "/api/v1/users/alice", `{"profile": "Cardiologist", "gender": ""}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	profile := decodeProfile(t, w)
+	if profile.Profile != "Cardiologist" || profile.Gender != "" || profile.Email != "alice@example.com" {
+		t.Errorf("Unexpected patched profile: %+v", profile)
+	}
+	if profile.LastEdit < stored.LastEdit || profile.AccountTime != stored.AccountTime {
+		t.Errorf("Expected last_edit to be stamped and account_time kept, got %+v", profile)
+	}
+
+	// Changing the password keeps the user able to log in
+	if w := userRequest(srv, "alice", "PATCH", "/api/v1/users/alice", `{"password": "new long password"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := postJSON(t, srv, "/api/v1/auth/login", `{"user_name": "alice", "password": "new long password"}`, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d for a login with the new password, got %d", http.StatusOK, w.Code)
+	}
+
+	tests := []struct {
+		name    string
+		subject string
+		method  string
+		path    string
+		body    string
+		want    int
+	}{
+		{"read other user", "bob", "GET", "/api/v1/users/alice", "", http.StatusForbidden},
+		{"patch other user", "bob", "PATCH", "/api/v1/users/alice", `{"profile": "x"}`, http.StatusForbidden},
+		{"delete other user", "bob", "DELETE", "/api/v1/users/alice", "", http.StatusForbidden},
+		{"read-only field", "alice", "PATCH", "/api/v1/users/alice", `{"user_name": "mallory"}`, http.StatusBadRequest},
+		{"unknown field", "alice", "PATCH", "/api/v1/users/alice", `{"nickname": "al"}`, http.StatusBadRequest},
+		{"invalid email", "alice", "PATCH", "/api/v1/users/alice", `{"email": "alice"}`, http.StatusBadRequest},
+		{"wrong type", "alice", "PATCH", "/api/v1/users/alice", `{"birth_date": "yesterday"}`, http.StatusBadRequest},
+		{"empty password", "alice", "PATCH", "/api/v1/users/alice", `{"password": ""}`, http.StatusBadRequest},
+		{"empty patch", "alice", "PATCH", "/api/v1/users/alice", `{}`, http.StatusBadRequest},
+		{"not an object", "alice", "PATCH", "/api/v1/users/alice", `["profile"]`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := userRequest(srv, tt.subject, tt.method, tt.path, tt.body); w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// Requests without a token are rejected before any check
+	req := httptest.NewRequest("GET", "/api/v1/users/alice", nil)
+	w = httptest.NewRecorder()
+	srv.router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without a token, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// Admins access every profile
+	if w := adminRequest(srv, "PATCH", "/api/v1/users/bob", `{"profile": "Set by an admin"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d for an admin, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := adminRequest(srv, "GET", "/api/v1/users/nobody", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a missing user, got %d", http.StatusNotFound, w.Code)
+	}
+
+	if w := userRequest(srv, "alice", "DELETE", "/api/v1/users/alice", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := userRequest(srv, "alice", "GET", "/api/v1/users/alice", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d after delete, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := adminRequest(srv, "DELETE", "/api/v1/users/bob", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d for an admin delete, got %d", http.StatusOK, w.Code)
+	}
+}